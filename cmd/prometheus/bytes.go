@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// 带单位的字节数, 例如 512MB, 单位按 1024 进位
+type bytesValue int64
+
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"EB", 1 << 60},
+	{"PB", 1 << 50},
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+func (b *bytesValue) String() string {
+	for _, u := range byteUnits {
+		if int64(*b) != 0 && int64(*b)%u.size == 0 {
+			return fmt.Sprintf("%d%s", int64(*b)/u.size, u.suffix)
+		}
+	}
+	return "0B"
+}
+
+func (b *bytesValue) Set(s string) error {
+	num, unit := strings.TrimSpace(s), int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(num, u.suffix) {
+			num, unit = strings.TrimSuffix(num, u.suffix), u.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %q", s)
+	}
+	if n > (1<<63-1)/unit {
+		return fmt.Errorf("size %q overflows", s)
+	}
+	*b = bytesValue(n * unit)
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import "testing"
+
+func TestBytesValue_Set(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    bytesValue
+		wantErr bool
+	}{
+		{input: "0", want: 0},
+		{input: "100", want: 100},
+		{input: "100B", want: 100},
+		{input: "1KB", want: 1 << 10},
+		{input: "512MB", want: 512 << 20},
+		{input: "2GB", want: 2 << 30},
+		{input: "3TB", want: 3 << 40},
+		{input: "4PB", want: 4 << 50},
+		{input: "7EB", want: 7 << 60},
+		{input: " 1GB ", want: 1 << 30},
+		{input: "9223372036854775807", want: 1<<63 - 1},
+		{input: "8EB", wantErr: true},
+		{input: "8796093022208TB", wantErr: true},
+		{input: "9223372036854775808", wantErr: true},
+		{input: "", wantErr: true},
+		{input: "MB", wantErr: true},
+		{input: "-1MB", wantErr: true},
+		{input: "1.5GB", wantErr: true},
+		{input: "1gb", wantErr: true},
+		{input: "1 GB", wantErr: true},
+		{input: "10XB", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var b bytesValue
+			err := b.Set(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("期望出错，实际得到 %d", b)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("解析失败: %v", err)
+			}
+			if b != tt.want {
+				t.Errorf("期望 %d，实际 %d", tt.want, b)
+			}
+		})
+	}
+}
+
+func TestBytesValue_String(t *testing.T) {
+	tests := []struct {
+		value bytesValue
+		want  string
+	}{
+		{0, "0B"},
+		{100, "100B"},
+		{1 << 10, "1KB"},
+		{1536, "1536B"},
+		{512 << 20, "512MB"},
+		{3 << 40, "3TB"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := tt.value.String(); got != tt.want {
+				t.Errorf("期望 %s，实际 %s", tt.want, got)
+			}
+		})
+	}
+}
@@ -1,5 +1,175 @@
 package main
 
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"mini-promethues/pkg/config"
+	"mini-promethues/pkg/scrape"
+	"mini-promethues/pkg/storage"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+type flagConfig struct {
+	configFile      string
+	listenAddress   string
+	storagePath     string
+	retentionTime   time.Duration
+	retentionSize   bytesValue
+	lookbackDelta   time.Duration
+	shutdownTimeout time.Duration
+
+	// --storage.tsdb.retention.time, 与上游 Prometheus 同名的别名, 解析后合并到 retentionTime
+	retentionTimeAlias time.Duration
+}
+
+func parseFlags(args []string) (*flagConfig, error) {
+	cfg := &flagConfig{}
+	fs := flag.NewFlagSet("prometheus", flag.ContinueOnError)
+	fs.StringVar(&cfg.configFile, "config.file", config.DefaultConfigPath,
+		"Prometheus configuration file path.")
+	fs.StringVar(&cfg.listenAddress, "web.listen-address", ":9090",
+		"Address to listen on for the web interface.")
+	fs.StringVar(&cfg.storagePath, "storage.tsdb.path", "data/",
+		"Base path for metrics storage.")
+	fs.DurationVar(&cfg.retentionTime, "storage.retention", 15*24*time.Hour,
+		"How long to retain samples in storage. 0 disables time based retention.")
+	fs.DurationVar(&cfg.retentionTimeAlias, "storage.tsdb.retention.time", 0,
+		"Alias of --storage.retention.")
+	fs.Var(&cfg.retentionSize, "storage.tsdb.retention.size",
+		"Maximum number of bytes of storage blocks to retain, e.g. 512MB. 0 disables size based retention.")
+	fs.DurationVar(&cfg.lookbackDelta, "query.lookback-delta", storage.DefaultLookbackDelta,
+		"The maximum lookback duration for retrieving metrics during expression evaluations.")
+	fs.DurationVar(&cfg.shutdownTimeout, "shutdown.timeout", 30*time.Second,
+		"Maximum time to wait for components to stop on shutdown.")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	// 两个参数都设置时以 --storage.retention 为准, 与它们在命令行中的顺序无关
+	switch {
+	case set["storage.retention"] && set["storage.tsdb.retention.time"]:
+		log.Printf("--storage.tsdb.retention.time is ignored because --storage.retention is set")
+	case set["storage.tsdb.retention.time"]:
+		cfg.retentionTime = cfg.retentionTimeAlias
+	}
+	if cfg.retentionTime < 0 {
+		return nil, fmt.Errorf("storage.retention must not be negative, got %v", cfg.retentionTime)
+	}
+	if cfg.lookbackDelta <= 0 {
+		return nil, fmt.Errorf("query.lookback-delta must be positive, got %v", cfg.lookbackDelta)
+	}
+	if cfg.shutdownTimeout <= 0 {
+		return nil, fmt.Errorf("shutdown.timeout must be positive, got %v", cfg.shutdownTimeout)
+	}
+	return cfg, nil
+}
+
 func main() {
+	cfg, err := parseFlags(os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		log.Fatalf("parse flags: %v", err)
+	}
+	if err := run(cfg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(cfg *flagConfig) error {
+	promCfg, err := config.NewLoader(cfg.configFile).Load()
+	if err != nil {
+		return fmt.Errorf("load config: %w", err)
+	}
+	log.Printf("loaded config file %s, storage retention time %v, size %s",
+		cfg.configFile, cfg.retentionTime, &cfg.retentionSize)
+
+	opts := storage.DefaultOptions()
+	opts.RetentionDuration = cfg.retentionTime
+	opts.MaxBytes = int64(cfg.retentionSize)
+	opts.OutOfOrderTimeWindow = promCfg.Storage.TSDB.OutOfOrderTimeWindow
+	opts.LookbackDelta = cfg.lookbackDelta
+	store, err := storage.Open(cfg.storagePath, opts)
+	if err != nil {
+		return fmt.Errorf("open storage: %w", err)
+	}
+	scraper := scrape.NewScraper(promCfg, store)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Prometheus is Healthy.")
+	})
+	mux.HandleFunc("/-/ready", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Prometheus is Ready.")
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		writeStorageMetrics(w, store)
+	})
+	srv := &http.Server{Addr: cfg.listenAddress, Handler: mux}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if err := scraper.Start(); err != nil {
+		return fmt.Errorf("start scraper: %w", err)
+	}
+	srvErr := make(chan error, 1)
+	go func() {
+		log.Printf("listening on %s", cfg.listenAddress)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			srvErr <- err
+		}
+		close(srvErr)
+	}()
+
+	select {
+	case <-ctx.Done():
+		log.Printf("received shutdown signal, stopping")
+	case err := <-srvErr:
+		if err != nil {
+			log.Printf("web server failed: %v", err)
+		}
+	}
+	stop()
+	return shutdown(cfg.shutdownTimeout, srv, scraper, store)
+}
+
+// 按 web -> scraper -> storage 的顺序停止, 整个过程不超过 timeout
+func shutdown(timeout time.Duration, srv *http.Server, scraper *scrape.Scraper, store storage.Storage) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		var errs []error
+		if err := srv.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("shutdown web server: %w", err))
+		}
+		if err := scraper.Stop(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("stop scraper: %w", err))
+		}
+		if err := store.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("close storage: %w", err))
+		}
+		done <- errors.Join(errs...)
+	}()
 
+	select {
+	case err := <-done:
+		if err == nil {
+			log.Printf("shutdown complete")
+		}
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("shutdown timed out after %v", timeout)
+	}
 }
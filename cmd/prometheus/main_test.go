@@ -0,0 +1,113 @@
+package main
+
+import (
+	"mini-promethues/pkg/config"
+	"mini-promethues/pkg/storage"
+	"testing"
+	"time"
+)
+
+func TestParseFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		check   func(t *testing.T, cfg *flagConfig)
+		wantErr bool
+	}{
+		{
+			name: "使用默认值",
+			args: nil,
+			check: func(t *testing.T, cfg *flagConfig) {
+				if cfg.configFile != config.DefaultConfigPath || cfg.listenAddress != ":9090" || cfg.storagePath != "data/" {
+					t.Errorf("默认参数不正确: %+v", cfg)
+				}
+				if cfg.retentionTime != 15*24*time.Hour || cfg.retentionSize != 0 {
+					t.Errorf("期望保留 15 天且不限制大小，实际 %v, %d", cfg.retentionTime, cfg.retentionSize)
+				}
+				if cfg.lookbackDelta != storage.DefaultLookbackDelta || cfg.shutdownTimeout != 30*time.Second {
+					t.Errorf("期望回溯窗口 %v、关闭超时 30s，实际 %v, %v", storage.DefaultLookbackDelta, cfg.lookbackDelta, cfg.shutdownTimeout)
+				}
+			},
+		},
+		{
+			name: "设置全部参数",
+			args: []string{
+				"--config.file=prom.yml", "--web.listen-address=:8080", "--storage.tsdb.path=/tmp/prom",
+				"--storage.retention=24h", "--storage.tsdb.retention.size=512MB",
+				"--query.lookback-delta=1m", "--shutdown.timeout=5s",
+			},
+			check: func(t *testing.T, cfg *flagConfig) {
+				want := flagConfig{
+					configFile:      "prom.yml",
+					listenAddress:   ":8080",
+					storagePath:     "/tmp/prom",
+					retentionTime:   24 * time.Hour,
+					retentionSize:   512 << 20,
+					lookbackDelta:   time.Minute,
+					shutdownTimeout: 5 * time.Second,
+				}
+				if *cfg != want {
+					t.Errorf("期望 %+v，实际 %+v", want, *cfg)
+				}
+			},
+		},
+		{
+			name: "使用别名设置保留时间",
+			args: []string{"--storage.tsdb.retention.time=2h"},
+			check: func(t *testing.T, cfg *flagConfig) {
+				if cfg.retentionTime != 2*time.Hour {
+					t.Errorf("期望保留 2h，实际 %v", cfg.retentionTime)
+				}
+			},
+		},
+		{
+			name: "两个保留时间参数都设置时以 storage.retention 为准",
+			args: []string{"--storage.retention=3h", "--storage.tsdb.retention.time=2h"},
+			check: func(t *testing.T, cfg *flagConfig) {
+				if cfg.retentionTime != 3*time.Hour {
+					t.Errorf("期望保留 3h，实际 %v", cfg.retentionTime)
+				}
+			},
+		},
+		{
+			name: "与参数顺序无关",
+			args: []string{"--storage.tsdb.retention.time=2h", "--storage.retention=3h"},
+			check: func(t *testing.T, cfg *flagConfig) {
+				if cfg.retentionTime != 3*time.Hour {
+					t.Errorf("期望保留 3h，实际 %v", cfg.retentionTime)
+				}
+			},
+		},
+		{
+			name: "保留时间为 0 时不按时间删除",
+			args: []string{"--storage.retention=0s"},
+			check: func(t *testing.T, cfg *flagConfig) {
+				if cfg.retentionTime != 0 {
+					t.Errorf("期望保留时间为 0，实际 %v", cfg.retentionTime)
+				}
+			},
+		},
+		{name: "保留时间为负数", args: []string{"--storage.retention=-1h"}, wantErr: true},
+		{name: "别名设置的保留时间为负数", args: []string{"--storage.tsdb.retention.time=-1h"}, wantErr: true},
+		{name: "回溯窗口为 0", args: []string{"--query.lookback-delta=0s"}, wantErr: true},
+		{name: "关闭超时为负数", args: []string{"--shutdown.timeout=-1s"}, wantErr: true},
+		{name: "非法的大小", args: []string{"--storage.tsdb.retention.size=1XB"}, wantErr: true},
+		{name: "未知参数", args: []string{"--unknown"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseFlags(tt.args)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("期望出错，实际得到 %+v", cfg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("解析参数失败: %v", err)
+			}
+			tt.check(t, cfg)
+		})
+	}
+}
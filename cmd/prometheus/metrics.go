@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mini-promethues/pkg/storage"
+)
+
+// 以文本格式暴露存储的指标
+func writeStorageMetrics(w io.Writer, db *storage.DB) {
+	stats := db.RetentionStats()
+	writeMetric(w, "prometheus_tsdb_time_retentions_total", "counter",
+		"Number of blocks removed because the retention time was exceeded.", float64(stats.TimeRetentionBlocks))
+	writeMetric(w, "prometheus_tsdb_size_retentions_total", "counter",
+		"Number of blocks removed because the retention size was exceeded.", float64(stats.SizeRetentionBlocks))
+	writeMetric(w, "prometheus_tsdb_retention_reclaimed_bytes_total", "counter",
+		"Disk space reclaimed by removing blocks.", float64(stats.BytesReclaimed))
+	writeMetric(w, "prometheus_tsdb_head_retention_samples_total", "counter",
+		"Number of head samples removed because the retention time was exceeded.", float64(stats.HeadSamplesReclaimed))
+	if size, err := db.Size(); err == nil {
+		writeMetric(w, "prometheus_tsdb_storage_size_bytes", "gauge",
+			"Disk space used by blocks and the write-ahead log.", float64(size))
+	}
+}
+
+func writeMetric(w io.Writer, name, typ, help string, value float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, typ, name, value)
+}
@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"mini-promethues/pkg/model"
 	"net/url"
 	"path"
 	"strings"
@@ -11,6 +12,7 @@ import (
 type Config struct {
 	Global        GlobalConfig   `yaml:"global"`
 	ScrapeConfigs []ScrapeConfig `yaml:"scrape_configs"`
+	Storage       StorageConfig  `yaml:"storage"`
 }
 
 type GlobalConfig struct {
@@ -30,6 +32,13 @@ type StaticConfig struct {
 	Targets []string          `yaml:"targets"`
 	Labels  map[string]string `yaml:"labels"`
 }
+type StorageConfig struct {
+	TSDB TSDBConfig `yaml:"tsdb"`
+}
+type TSDBConfig struct {
+	// 允许写入的乱序样本最多比已写入的最大时间戳早多少, 为 0 时拒绝乱序样本
+	OutOfOrderTimeWindow time.Duration `yaml:"out_of_order_time_window"`
+}
 
 func NewConfig() *Config {
 	return &Config{}
@@ -40,6 +49,13 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("global scrape timeout (%v) must be <= scrape interval (%v)",
 			c.Global.ScrapeTimeout, c.Global.ScrapeInterval)
 	}
+	if err := validateLabels(c.Global.ExternalLabels); err != nil {
+		return fmt.Errorf("external_labels: %w", err)
+	}
+	if c.Storage.TSDB.OutOfOrderTimeWindow < 0 {
+		return fmt.Errorf("storage.tsdb.out_of_order_time_window (%v) must not be negative",
+			c.Storage.TSDB.OutOfOrderTimeWindow)
+	}
 	for i, sc := range c.ScrapeConfigs {
 		if sc.JobName == "" {
 			return fmt.Errorf("scrape_config[%d]: job_name is required", i)
@@ -58,11 +74,26 @@ func (c *Config) Validate() error {
 			if len(stc.Targets) == 0 {
 				return fmt.Errorf("job %q: static_config[%d] has no targets", sc.JobName, j)
 			}
+			if err := validateLabels(stc.Labels); err != nil {
+				return fmt.Errorf("job %q: static_config[%d] labels: %w", sc.JobName, j, err)
+			}
 		}
 	}
 	return nil
 }
 
+// 配置中的标签会加到每个抓取到的序列上, 不能使用 __ 开头的保留标签名
+func validateLabels(labels map[string]string) error {
+	ls := make(model.Labels, 0, len(labels))
+	for name, value := range labels {
+		if strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return fmt.Errorf("label name %q is reserved for internal use", name)
+		}
+		ls = append(ls, model.Label{Name: name, Value: value})
+	}
+	return ls.Validate()
+}
+
 const (
 	DefaultMetricPath     = "/metrics"
 	DefaultScrapeInterval = 15 * time.Second
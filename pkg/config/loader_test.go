@@ -152,6 +152,15 @@ func TestLoader_Load_Valid(t *testing.T) {
 				}
 			},
 		},
+		{
+			name: "存储配置",
+			file: "testdata/storage.yaml",
+			validate: func(t *testing.T, c *Config) {
+				if c.Storage.TSDB.OutOfOrderTimeWindow != 10*time.Minute {
+					t.Errorf("期望 out_of_order_time_window=10m, 实际=%v", c.Storage.TSDB.OutOfOrderTimeWindow)
+				}
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -213,6 +222,16 @@ func TestLoader_Load_Errors(t *testing.T) {
 			file:        "testdata/empty_targets.yaml",
 			expectError: "has no targets",
 		},
+		{
+			name:        "非法的标签名",
+			file:        "testdata/invalid_label_name.yaml",
+			expectError: "invalid label name \"data-center\"",
+		},
+		{
+			name:        "保留的标签名",
+			file:        "testdata/reserved_label_name.yaml",
+			expectError: "label name \"__tenant__\" is reserved",
+		},
 	}
 
 	for _, tt := range tests {
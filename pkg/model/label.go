@@ -1,16 +1,32 @@
 package model
 
 import (
+	"fmt"
 	"sort"
 	"strings"
+	"unicode/utf8"
 )
 
+// 指标名称对应的保留标签名, 匹配器可以通过它选择指标名称
+const MetricNameLabel = "__name__"
+
+// 以该前缀开头的标签名保留给内部使用, 只有 __name__ 可以出现在标签集合中
+const ReservedLabelPrefix = "__"
+
+// 计算 fingerprint 时分隔名称和值, 0xff 不会出现在合法的 UTF-8 字符串中
+const labelSep = '\xff'
+
 type Label struct {
 	Name  string
 	Value string
 }
 type Labels []Label
 
+// 返回排序后的标签副本, 作为标签集合的规范形式; 之后不应再修改
+func NewLabels(ls ...Label) Labels {
+	return Labels(ls).Sorted()
+}
+
 func (l Labels) Sorted() Labels {
 	sorted := make(Labels, len(l))
 	copy(sorted, l)
@@ -18,6 +34,154 @@ func (l Labels) Sorted() Labels {
 	return sorted
 }
 
+func (l Labels) IsSorted() bool {
+	return sort.IsSorted(l)
+}
+
+// 两个标签集合是否相同, 与顺序无关
+func (l Labels) Equal(o Labels) bool {
+	if len(l) != len(o) {
+		return false
+	}
+	if !l.IsSorted() {
+		l = l.Sorted()
+	}
+	if !o.IsSorted() {
+		o = o.Sorted()
+	}
+	for i := range l {
+		if l[i] != o[i] {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+按排序后的顺序计算 FNV-1a 哈希, 每个名称和值后面都写入 0xff 分隔
+不使用 String() 的 "a=b,c=d" 形式, 标签值中包含 "," 或 "=" 时不同的集合会得到相同的字符串
+*/
+func (l Labels) Hash() uint64 {
+	if !l.IsSorted() {
+		l = l.Sorted()
+	}
+	h := uint64(offset64)
+	for _, label := range l {
+		h = hashLabel(h, label.Name, label.Value)
+	}
+	return h
+}
+
+func hashLabel(h uint64, name, value string) uint64 {
+	h = hashString(h, name)
+	h = hashByte(h, labelSep)
+	h = hashString(h, value)
+	return hashByte(h, labelSep)
+}
+
+// 内联的 FNV-1a, 避免 hash.Hash64 的内存分配
+const (
+	offset64 = 14695981039346656037
+	prime64  = 1099511628211
+)
+
+func hashString(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= prime64
+	}
+	return h
+}
+
+func hashByte(h uint64, b byte) uint64 {
+	h ^= uint64(b)
+	h *= prime64
+	return h
+}
+
+// 标签名需要匹配 [a-zA-Z_][a-zA-Z0-9_]*
+func ValidLabelName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' || (i > 0 && c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+检查标签集合是否合法:
+  - 标签名合法且不重复
+  - 除 __name__ 外不使用 __ 开头的保留标签名, __name__ 的值必须是合法的指标名称
+  - 标签值是合法的 UTF-8
+*/
+func (l Labels) Validate() error {
+	for _, label := range l {
+		if !ValidLabelName(label.Name) {
+			return fmt.Errorf("invalid label name %q", label.Name)
+		}
+		if label.Name == MetricNameLabel {
+			if !ValidMetricName(label.Value) {
+				return fmt.Errorf("invalid metric name %q", label.Value)
+			}
+		} else if strings.HasPrefix(label.Name, ReservedLabelPrefix) {
+			return fmt.Errorf("label name %q is reserved for internal use", label.Name)
+		}
+		if !utf8.ValidString(label.Value) {
+			return fmt.Errorf("invalid UTF-8 in value of label %q", label.Name)
+		}
+	}
+	sorted := l
+	if !l.IsSorted() {
+		sorted = l.Sorted()
+	}
+	for i := 1; i < len(sorted); i++ {
+		if sorted[i].Name == sorted[i-1].Name {
+			return fmt.Errorf("duplicate label name %q", sorted[i].Name)
+		}
+	}
+	return nil
+}
+
+/*
+按规范形式比较两个已排序的标签集合, 逐个比较标签名和标签值, 前缀相同时较短的集合在前
+返回负数、0、正数分别表示 l 小于、等于、大于 o
+*/
+func (l Labels) Compare(o Labels) int {
+	for i := 0; i < len(l) && i < len(o); i++ {
+		if l[i].Name != o[i].Name {
+			return strings.Compare(l[i].Name, o[i].Name)
+		}
+		if l[i].Value != o[i].Value {
+			return strings.Compare(l[i].Value, o[i].Value)
+		}
+	}
+	return len(l) - len(o)
+}
+
+func (l Labels) Has(name string) bool {
+	for _, label := range l {
+		if label.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 返回标签值, 不存在时返回空字符串
+func (l Labels) Get(name string) string {
+	for _, label := range l {
+		if label.Name == name {
+			return label.Value
+		}
+	}
+	return ""
+}
+
 // 返回类似 "host=A,region=us" 的字符串
 func (l Labels) String() string {
 	sorted := l.Sorted()
@@ -1,6 +1,9 @@
 package model
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestLabels_String(t *testing.T) {
 	tests := []struct {
@@ -46,3 +49,66 @@ func TestLabels_String(t *testing.T) {
 		})
 	}
 }
+
+func TestLabels_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		l       Labels
+		wantErr string
+	}{
+		{"合法的标签", Labels{{Name: "host", Value: "A"}, {Name: "_region1", Value: "us"}}, ""},
+		{"空标签集合", Labels{}, ""},
+		{"空的标签值", Labels{{Name: "host", Value: ""}}, ""},
+		{"__name__ 标签", Labels{{Name: MetricNameLabel, Value: "http_requests:rate5m"}}, ""},
+		{"重复的标签名", Labels{{Name: "host", Value: "X"}, {Name: "region", Value: "us"}, {Name: "host", Value: "A"}}, `duplicate label name "host"`},
+		{"空的标签名", Labels{{Name: "", Value: "A"}}, `invalid label name ""`},
+		{"数字开头的标签名", Labels{{Name: "1host", Value: "A"}}, `invalid label name "1host"`},
+		{"包含非法字符", Labels{{Name: "data-center", Value: "A"}}, `invalid label name "data-center"`},
+		{"保留的标签名", Labels{{Name: "__meta_host", Value: "A"}}, `label name "__meta_host" is reserved`},
+		{"非法的指标名称", Labels{{Name: MetricNameLabel, Value: "1up"}}, `invalid metric name "1up"`},
+		{"非法的 UTF-8 标签值", Labels{{Name: "host", Value: "\xff"}}, `invalid UTF-8`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.l.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("期望合法，实际 %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("期望错误包含 %q，实际 %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLabels_Compare(t *testing.T) {
+	a := NewLabels(Label{Name: "job", Value: "api"})
+	ab := NewLabels(Label{Name: "job", Value: "api"}, Label{Name: "path", Value: "/"})
+	b := NewLabels(Label{Name: "job", Value: "db"})
+	c := NewLabels(Label{Name: "instance", Value: "z"})
+	tests := []struct {
+		name string
+		l, o Labels
+		want int
+	}{
+		{"相同", a, a, 0},
+		{"值不同", a, b, -1},
+		{"名称不同", a, c, 1},
+		{"前缀相同时短的在前", a, ab, -1},
+		{"空集合", Labels{}, a, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.l.Compare(tt.o)
+			if got < 0 && tt.want >= 0 || got == 0 && tt.want != 0 || got > 0 && tt.want <= 0 {
+				t.Errorf("期望符号与 %d 相同，实际 %d", tt.want, got)
+			}
+			if back := tt.o.Compare(tt.l); back != 0 && got != 0 && back > 0 == (got > 0) {
+				t.Errorf("期望交换后符号相反，实际 %d 和 %d", got, back)
+			}
+		})
+	}
+}
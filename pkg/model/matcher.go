@@ -0,0 +1,79 @@
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+type MatchType int
+
+const (
+	MatchEqual MatchType = iota
+	MatchNotEqual
+	MatchRegexp
+	MatchNotRegexp
+)
+
+func (t MatchType) String() string {
+	switch t {
+	case MatchEqual:
+		return "="
+	case MatchNotEqual:
+		return "!="
+	case MatchRegexp:
+		return "=~"
+	case MatchNotRegexp:
+		return "!~"
+	}
+	return fmt.Sprintf("MatchType(%d)", int(t))
+}
+
+// 标签匹配器, 对应 PromQL 中的 {name="value"} / != / =~ / !~
+type LabelMatcher struct {
+	Type  MatchType
+	Name  string
+	Value string
+	re    *regexp.Regexp
+}
+
+// 正则匹配是全锚定的, 与 Prometheus 一致: =~"GET|POST" 等价于 ^(?:GET|POST)$
+func NewLabelMatcher(t MatchType, name, value string) (*LabelMatcher, error) {
+	m := &LabelMatcher{Type: t, Name: name, Value: value}
+	switch t {
+	case MatchEqual, MatchNotEqual:
+	case MatchRegexp, MatchNotRegexp:
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q: %w", value, err)
+		}
+		m.re = re
+	default:
+		return nil, fmt.Errorf("invalid match type %v", t)
+	}
+	return m, nil
+}
+
+func (m *LabelMatcher) Matches(v string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return v == m.Value
+	case MatchNotEqual:
+		return v != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(v)
+	case MatchNotRegexp:
+		return !m.re.MatchString(v)
+	}
+	return false
+}
+
+// 返回类似 method=~"GET|POST" 的字符串
+func (m *LabelMatcher) String() string {
+	return m.Name + m.Type.String() + strconv.Quote(m.Value)
+}
+
+// 不存在的标签按空字符串处理
+func (m *LabelMatcher) MatchesMetric(metric *Metric) bool {
+	return m.Matches(metric.Get(m.Name))
+}
@@ -0,0 +1,52 @@
+package model
+
+import "testing"
+
+func TestLabelMatcher_Matches(t *testing.T) {
+	tests := []struct {
+		name  string
+		t     MatchType
+		value string
+		input string
+		want  bool
+	}{
+		{"等于-匹配", MatchEqual, "GET", "GET", true},
+		{"等于-不匹配", MatchEqual, "GET", "POST", false},
+		{"不等于-匹配", MatchNotEqual, "GET", "POST", true},
+		{"不等于-不匹配", MatchNotEqual, "GET", "GET", false},
+		{"正则-匹配", MatchRegexp, "GET|POST", "POST", true},
+		{"正则-全锚定", MatchRegexp, "GET|POST", "XPOST", false},
+		{"正则-匹配空值", MatchRegexp, ".*", "", true},
+		{"正则不匹配-匹配", MatchNotRegexp, "2..", "500", true},
+		{"正则不匹配-不匹配", MatchNotRegexp, "2..", "200", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewLabelMatcher(tt.t, "label", tt.value)
+			if err != nil {
+				t.Fatalf("创建匹配器失败: %v", err)
+			}
+			if got := m.Matches(tt.input); got != tt.want {
+				t.Errorf("%s Matches(%q) = %v, want %v", m, tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewLabelMatcher_InvalidRegexp(t *testing.T) {
+	if _, err := NewLabelMatcher(MatchRegexp, "label", "(abc"); err == nil {
+		t.Error("期望非法正则返回错误")
+	}
+}
+
+func TestLabelMatcher_MatchesMetric(t *testing.T) {
+	metric := &Metric{Name: "http_requests_total", Labels: Labels{{Name: "method", Value: "GET"}}}
+	nameMatcher, _ := NewLabelMatcher(MatchRegexp, MetricNameLabel, "http_.*")
+	if !nameMatcher.MatchesMetric(metric) {
+		t.Errorf("期望 %s 匹配指标名称", nameMatcher)
+	}
+	missing, _ := NewLabelMatcher(MatchEqual, "status", "")
+	if !missing.MatchesMetric(metric) {
+		t.Errorf("期望 %s 匹配不存在的标签", missing)
+	}
+}
@@ -2,22 +2,157 @@ package model
 
 import (
 	"fmt"
-	"hash/fnv"
+	"sort"
 )
 
+/*
+时间序列的标识: 指标名称和标签集合
+规范形式是把名称作为 __name__ 标签的标签集合 (见 LabelSet), fingerprint 和 Equal 都基于规范形式,
+因此 {Name: "up", Labels: {job="a"}} 和 {Labels: {__name__="up", job="a"}} 表示同一个序列
+*/
 type Metric struct {
 	Name   string
 	Labels Labels
+	// NewMetric 预先计算的 fingerprint, 为 0 时每次调用 Fingerprint 重新计算
+	fp uint64
+}
+
+/*
+返回标签已排序、fingerprint 已缓存的 Metric, 写入和查询的热路径上不再重复排序和计算哈希
+name 为空时使用标签中的 __name__; 与名称一致的 __name__ 标签会被移除, 冲突的保留下来交给 Validate 报错
+返回的 Metric 不能再修改 Name 和 Labels, 否则缓存的 fingerprint 会失效
+*/
+func NewMetric(name string, labels Labels) *Metric {
+	if name == "" {
+		name = labels.Get(MetricNameLabel)
+	}
+	ls := make(Labels, 0, len(labels))
+	for _, l := range labels {
+		if l.Name == MetricNameLabel && l.Value == name {
+			continue
+		}
+		ls = append(ls, l)
+	}
+	sort.Sort(ls)
+	m := &Metric{Name: name, Labels: ls}
+	m.fp = m.computeFingerprint()
+	return m
+}
+
+// 从包含 __name__ 的规范标签集合构造 Metric, LabelSet 的逆操作
+func MetricFromLabels(labels Labels) *Metric {
+	return NewMetric("", labels)
+}
+
+// 指标名称需要匹配 [a-zA-Z_:][a-zA-Z0-9_:]*
+func ValidMetricName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' || c == ':' || (i > 0 && c >= '0' && c <= '9')) {
+			return false
+		}
+	}
+	return true
+}
+
+// 检查指标名称和标签; 名称可以只出现在 __name__ 标签中, 两处都有时必须一致
+func (m *Metric) Validate() error {
+	name := m.MetricName()
+	if !ValidMetricName(name) {
+		return fmt.Errorf("invalid metric name %q", name)
+	}
+	if m.Labels.Has(MetricNameLabel) && m.Labels.Get(MetricNameLabel) != name {
+		return fmt.Errorf("label %s=%q conflicts with metric name %q",
+			MetricNameLabel, m.Labels.Get(MetricNameLabel), name)
+	}
+	return m.Labels.Validate()
+}
+
+// 指标名称, Name 为空时取 __name__ 标签
+func (m *Metric) MetricName() string {
+	if m.Name != "" {
+		return m.Name
+	}
+	return m.Labels.Get(MetricNameLabel)
+}
+
+/*
+规范形式: 名称作为 __name__ 标签加入标签集合, 按标签名排序
+Name 和 __name__ 标签同时存在时以 Name 为准
+*/
+func (m *Metric) LabelSet() Labels {
+	ls := make(Labels, 0, len(m.Labels)+1)
+	if m.Name != "" {
+		ls = append(ls, Label{Name: MetricNameLabel, Value: m.Name})
+	}
+	for _, l := range m.Labels {
+		if l.Name == MetricNameLabel && m.Name != "" {
+			continue
+		}
+		ls = append(ls, l)
+	}
+	sort.Sort(ls)
+	return ls
 }
 
 // 返回类似 "cpu{host=A,region=us}" 的字符串
 func (m *Metric) String() string {
-	return fmt.Sprintf("%s{%s}", m.Name, m.Labels.String())
+	if !m.Labels.Has(MetricNameLabel) {
+		return fmt.Sprintf("%s{%s}", m.Name, m.Labels.String())
+	}
+	c := NewMetric(m.Name, m.Labels)
+	return fmt.Sprintf("%s{%s}", c.Name, c.Labels.String())
+}
+
+// 返回标签值, __name__ 返回指标名称
+func (m *Metric) Get(name string) string {
+	if name == MetricNameLabel {
+		return m.MetricName()
+	}
+	return m.Labels.Get(name)
 }
 
-// FIXME 重复调用的话, 会重复计算和排序
+/*
+规范形式的哈希, 与标签顺序以及名称放在 Name 还是 __name__ 中无关
+不同的标签集合可能得到相同的 fingerprint, 按 fingerprint 建索引时需要再用 Equal 比较
+*/
 func (m *Metric) Fingerprint() uint64 {
-	h := fnv.New64a()
-	h.Write([]byte(m.String()))
-	return h.Sum64()
+	if m.fp != 0 {
+		return m.fp
+	}
+	return m.computeFingerprint()
+}
+
+func (m *Metric) computeFingerprint() uint64 {
+	if m.Name == "" || !m.Labels.IsSorted() || m.Labels.Has(MetricNameLabel) {
+		return m.LabelSet().Hash()
+	}
+	// 常见情况: 标签已排序且不含 __name__, 边遍历边插入 __name__, 不需要构造 LabelSet
+	h := uint64(offset64)
+	named := false
+	for _, l := range m.Labels {
+		if !named && l.Name > MetricNameLabel {
+			h = hashLabel(h, MetricNameLabel, m.Name)
+			named = true
+		}
+		h = hashLabel(h, l.Name, l.Value)
+	}
+	if !named {
+		h = hashLabel(h, MetricNameLabel, m.Name)
+	}
+	return h
+}
+
+// 规范形式相同
+func (m *Metric) Equal(o *Metric) bool {
+	if m.fp != 0 && o.fp != 0 && m.fp != o.fp {
+		return false
+	}
+	if !m.Labels.Has(MetricNameLabel) && !o.Labels.Has(MetricNameLabel) {
+		return m.Name == o.Name && m.Labels.Equal(o.Labels)
+	}
+	return m.LabelSet().Equal(o.LabelSet())
 }
@@ -1,6 +1,9 @@
 package model
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestMetric_String(t *testing.T) {
 	type fields struct {
@@ -72,3 +75,142 @@ func TestMetric_Fingerprint(t *testing.T) {
 	}
 
 }
+
+func TestMetric_FingerprintSeparators(t *testing.T) {
+	// String() 相同的两个不同标签集合
+	m1 := &Metric{Name: "up", Labels: Labels{{Name: "a", Value: "b,c=d"}}}
+	m2 := &Metric{Name: "up", Labels: Labels{{Name: "a", Value: "b"}, {Name: "c", Value: "d"}}}
+	if m1.String() != m2.String() {
+		t.Fatalf("期望 String() 相同，实际 %s 和 %s", m1, m2)
+	}
+	if m1.Fingerprint() == m2.Fingerprint() {
+		t.Error("期望不同的标签集合 fingerprint 不同")
+	}
+	if m1.Equal(m2) {
+		t.Error("期望不同的标签集合不相等")
+	}
+	// 名称和标签之间也有分隔
+	m3 := &Metric{Name: "upa", Labels: Labels{{Name: "b", Value: "c"}}}
+	m4 := &Metric{Name: "up", Labels: Labels{{Name: "ab", Value: "c"}}}
+	if m3.Fingerprint() == m4.Fingerprint() {
+		t.Error("期望名称和标签名的边界影响 fingerprint")
+	}
+}
+
+func TestNewMetric(t *testing.T) {
+	labels := Labels{{Name: "region", Value: "us"}, {Name: "host", Value: "A"}}
+	m := NewMetric("cpu_total", labels)
+	if !m.Labels.IsSorted() {
+		t.Errorf("期望标签已排序，实际 %v", m.Labels)
+	}
+	if labels[0].Name != "region" {
+		t.Error("期望不修改传入的标签")
+	}
+	plain := &Metric{Name: "cpu_total", Labels: labels}
+	if m.Fingerprint() != plain.Fingerprint() {
+		t.Errorf("期望缓存的 fingerprint 与重新计算的一致，实际 %d != %d", m.Fingerprint(), plain.Fingerprint())
+	}
+	if !m.Equal(plain) {
+		t.Error("期望与标签顺序无关")
+	}
+}
+
+func BenchmarkMetric_Fingerprint(b *testing.B) {
+	labels := Labels{
+		{Name: "method", Value: "GET"},
+		{Name: "code", Value: "200"},
+		{Name: "instance", Value: "localhost:8080"},
+		{Name: "job", Value: "api"},
+	}
+	b.Run("cached", func(b *testing.B) {
+		m := NewMetric("http_requests_total", labels)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			m.Fingerprint()
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		m := &Metric{Name: "http_requests_total", Labels: labels}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			m.Fingerprint()
+		}
+	})
+}
+
+func TestValidMetricName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"up":                          true,
+		"http_requests_total":         true,
+		"job:http_requests:rate5m":    true,
+		"_private":                    true,
+		"":                            false,
+		"1up":                         false,
+		"http-requests":               false,
+		"http.requests":               false,
+		"cpu{host=A}":                 false,
+		"node_cpu_seconds_total_2024": true,
+	} {
+		if got := ValidMetricName(name); got != want {
+			t.Errorf("ValidMetricName(%q) = %v, 期望 %v", name, got, want)
+		}
+	}
+}
+
+func TestMetric_Validate(t *testing.T) {
+	m := &Metric{Name: "up", Labels: Labels{{Name: MetricNameLabel, Value: "down"}}}
+	if err := m.Validate(); err == nil || !strings.Contains(err.Error(), "conflicts with metric name") {
+		t.Errorf("期望 __name__ 和指标名称冲突，实际 %v", err)
+	}
+	m.Labels[0].Value = "up"
+	if err := m.Validate(); err != nil {
+		t.Errorf("期望一致的 __name__ 合法，实际 %v", err)
+	}
+	if err := (&Metric{Name: "up:1"}).Validate(); err != nil {
+		t.Errorf("期望合法，实际 %v", err)
+	}
+}
+
+// TestMetric_LabelSet 测试名称和 __name__ 标签两种表示之间的转换
+func TestMetric_LabelSet(t *testing.T) {
+	named := &Metric{Name: "up", Labels: Labels{{Name: "job", Value: "api"}, {Name: "Zone", Value: "a"}}}
+	labeled := &Metric{Labels: Labels{
+		{Name: "job", Value: "api"},
+		{Name: MetricNameLabel, Value: "up"},
+		{Name: "Zone", Value: "a"},
+	}}
+
+	want := "Zone=a,__name__=up,job=api"
+	if got := named.LabelSet().String(); got != want {
+		t.Errorf("期望 %s，实际 %s", want, got)
+	}
+	if got := labeled.LabelSet().String(); got != want {
+		t.Errorf("期望 %s，实际 %s", want, got)
+	}
+	if named.Fingerprint() != labeled.Fingerprint() || named.Fingerprint() != named.LabelSet().Hash() {
+		t.Error("期望两种表示的 fingerprint 相同")
+	}
+	if !named.Equal(labeled) || !labeled.Equal(named) {
+		t.Error("期望两种表示相等")
+	}
+	if labeled.Get(MetricNameLabel) != "up" || labeled.MetricName() != "up" {
+		t.Errorf("期望名称为 up，实际 %s", labeled.Get(MetricNameLabel))
+	}
+	if labeled.String() != named.String() {
+		t.Errorf("期望 String() 相同，实际 %s 和 %s", labeled, named)
+	}
+	if err := labeled.Validate(); err != nil {
+		t.Errorf("期望合法，实际 %v", err)
+	}
+
+	m := MetricFromLabels(named.LabelSet())
+	if m.Name != "up" || m.Labels.Has(MetricNameLabel) || len(m.Labels) != 2 {
+		t.Errorf("期望拆分出名称 up 和 2 个标签，实际 %v", m)
+	}
+	if m.Fingerprint() != named.Fingerprint() {
+		t.Error("期望转换后 fingerprint 不变")
+	}
+	if other := (&Metric{Name: "down", Labels: named.Labels}); other.Equal(labeled) {
+		t.Error("期望名称不同的序列不相等")
+	}
+}
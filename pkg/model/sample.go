@@ -1,8 +1,27 @@
 package model
 
+import "math"
+
+/*
+staleness marker 的位模式
+目标不再暴露某个序列时, 在抓取时间写入一个值为 StaleNaN 的样本, 表示序列从此刻起没有值
+它和 math.NaN() 的位模式不同, 目标自己暴露的 NaN 不会被当成 marker
+*/
+const StaleNaN uint64 = 0x7ff0000000000002
+
 type Sample struct {
 	Timestamp int64
 	Value     float64
 }
 
 type Samples []Sample
+
+// 返回 staleness marker 的样本值
+func StaleValue() float64 {
+	return math.Float64frombits(StaleNaN)
+}
+
+// 按位比较, 判断 v 是否为 staleness marker
+func IsStaleNaN(v float64) bool {
+	return math.Float64bits(v) == StaleNaN
+}
@@ -0,0 +1,21 @@
+package model
+
+import (
+	"math"
+	"testing"
+)
+
+func TestIsStaleNaN(t *testing.T) {
+	if !IsStaleNaN(StaleValue()) {
+		t.Error("期望 StaleValue() 是 staleness marker")
+	}
+	if !math.IsNaN(StaleValue()) {
+		t.Error("期望 staleness marker 是 NaN")
+	}
+	if IsStaleNaN(math.NaN()) {
+		t.Error("期望普通 NaN 不是 staleness marker")
+	}
+	if IsStaleNaN(0) {
+		t.Error("期望 0 不是 staleness marker")
+	}
+}
@@ -0,0 +1,219 @@
+package promql
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"mini-promethues/pkg/model"
+	"slices"
+	"strconv"
+)
+
+// 聚合中的一组样本
+type aggregateGroup struct {
+	labels  model.Labels
+	samples Vector
+}
+
+/*
+聚合运算, 结果中的分组按第一次出现的顺序排列
+除 topk / bottomk 外, 结果的标签是分组标签: by 只保留列出的标签, without 去掉列出的标签和 __name__
+*/
+func (ev *evaluator) evalAggregate(e *AggregateExpr, ts int64) (Value, error) {
+	v, err := ev.eval(e.Expr, ts)
+	if err != nil {
+		return nil, err
+	}
+	vec := v.(Vector)
+	var param Value
+	if e.Param != nil {
+		if param, err = ev.eval(e.Param, ts); err != nil {
+			return nil, err
+		}
+	}
+
+	groupOf := func(s Sample) model.Labels {
+		return groupingLabels(s.Metric, e.Grouping, e.Without)
+	}
+	switch e.Op {
+	case "topk", "bottomk":
+		return ev.aggregateTopK(e, vec, param.(Scalar).V, groupOf, ts)
+	case "count_values":
+		// 每个不同的值单独成为一组, 值写在参数指定的标签中
+		name := param.(String).V
+		if !model.ValidLabelName(name) {
+			return nil, fmt.Errorf("invalid label name %q", name)
+		}
+		groupOf = func(s Sample) model.Labels {
+			ls := groupingLabels(s.Metric, e.Grouping, e.Without)
+			ls = slices.DeleteFunc(ls, func(l model.Label) bool { return l.Name == name })
+			ls = append(ls, model.Label{Name: name, Value: strconv.FormatFloat(s.V, 'f', -1, 64)})
+			return ls.Sorted()
+		}
+	}
+
+	var arg float64
+	if e.Op == "quantile" {
+		arg = param.(Scalar).V
+	}
+	groups, err := ev.groupSamples(vec, groupOf)
+	if err != nil {
+		return nil, err
+	}
+	result := make(Vector, 0, len(groups))
+	for _, g := range groups {
+		if err := ev.checkContext(); err != nil {
+			return nil, err
+		}
+		values := make([]float64, len(g.samples))
+		for i, s := range g.samples {
+			values[i] = s.V
+		}
+		result = append(result, Sample{Metric: g.labels, T: ts, V: aggregateValues(e.Op, values, arg)})
+	}
+	return result, nil
+}
+
+// 样本所在分组的标签, 输入已排序所以结果也是排序的
+func groupingLabels(metric model.Labels, grouping []string, without bool) model.Labels {
+	result := make(model.Labels, 0, len(metric))
+	for _, l := range metric {
+		listed := slices.Contains(grouping, l.Name)
+		if without && (listed || l.Name == model.MetricNameLabel) || !without && !listed {
+			continue
+		}
+		result = append(result, l)
+	}
+	return result
+}
+
+func (ev *evaluator) groupSamples(vec Vector, groupOf func(Sample) model.Labels) ([]*aggregateGroup, error) {
+	var groups []*aggregateGroup
+	index := make(map[string]*aggregateGroup)
+	for _, s := range vec {
+		if err := ev.checkContext(); err != nil {
+			return nil, err
+		}
+		ls := groupOf(s)
+		key := labelsKey(ls)
+		g, ok := index[key]
+		if !ok {
+			g = &aggregateGroup{labels: ls}
+			index[key] = g
+			groups = append(groups, g)
+		}
+		g.samples = append(g.samples, s)
+	}
+	return groups, nil
+}
+
+// 每组中值最大 (topk) 或最小 (bottomk) 的 k 个样本, 保留原来的标签; 组内按值排序, NaN 排在最后
+func (ev *evaluator) aggregateTopK(e *AggregateExpr, vec Vector, param float64, groupOf func(Sample) model.Labels, ts int64) (Value, error) {
+	if math.IsNaN(param) {
+		return nil, errors.New("parameter value is NaN")
+	}
+	result := Vector{}
+	if param < 1 {
+		return result, nil
+	}
+	k := len(vec)
+	if param < float64(k) {
+		k = int(param)
+	}
+	less := func(a, b float64) bool { return a > b }
+	if e.Op == "bottomk" {
+		less = func(a, b float64) bool { return a < b }
+	}
+	groups, err := ev.groupSamples(vec, groupOf)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		if err := ev.checkContext(); err != nil {
+			return nil, err
+		}
+		for _, s := range sortVector(g.samples, less)[:min(k, len(g.samples))] {
+			result = append(result, Sample{Metric: s.Metric, T: ts, V: s.V})
+		}
+	}
+	return result, nil
+}
+
+// 一组的聚合值, values 至少有一个元素; arg 是 quantile 的分位数
+func aggregateValues(op string, values []float64, arg float64) float64 {
+	switch op {
+	case "sum":
+		return sumValues(values)
+	case "avg":
+		return sumValues(values) / float64(len(values))
+	case "min":
+		// NaN 只在全部是 NaN 时出现在结果中
+		result := values[0]
+		for _, v := range values[1:] {
+			if v < result || math.IsNaN(result) {
+				result = v
+			}
+		}
+		return result
+	case "max":
+		result := values[0]
+		for _, v := range values[1:] {
+			if v > result || math.IsNaN(result) {
+				result = v
+			}
+		}
+		return result
+	case "count", "count_values":
+		return float64(len(values))
+	case "group":
+		return 1
+	case "stddev":
+		return math.Sqrt(stdvar(values))
+	case "stdvar":
+		return stdvar(values)
+	case "quantile":
+		return quantile(arg, values)
+	}
+	panic(fmt.Sprintf("unknown aggregation %q", op))
+}
+
+func sumValues(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum
+}
+
+// 总体方差
+func stdvar(values []float64) float64 {
+	mean := sumValues(values) / float64(len(values))
+	var sum float64
+	for _, v := range values {
+		sum += (v - mean) * (v - mean)
+	}
+	return sum / float64(len(values))
+}
+
+/*
+φ 分位数, 在相邻的两个值之间线性插值, 与 Prometheus 一致
+φ < 0 返回 -Inf, φ > 1 返回 +Inf, φ 是 NaN 时返回 NaN
+*/
+func quantile(q float64, values []float64) float64 {
+	switch {
+	case math.IsNaN(q):
+		return math.NaN()
+	case q < 0:
+		return math.Inf(-1)
+	case q > 1:
+		return math.Inf(1)
+	}
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	n := float64(len(sorted))
+	rank := q * (n - 1)
+	lower := math.Max(0, math.Floor(rank))
+	upper := math.Min(n-1, lower+1)
+	weight := rank - math.Floor(rank)
+	return sorted[int(lower)]*(1-weight) + sorted[int(upper)]*weight
+}
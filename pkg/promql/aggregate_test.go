@@ -0,0 +1,112 @@
+package promql
+
+import (
+	"context"
+	"math"
+	"mini-promethues/pkg/storage"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newAggregateTestStorage(t testing.TB) storage.Storage {
+	st := storage.NewMemoryStorage()
+	loadSeries(t, st, `http_requests_total{job="api", instance="a", code="200"}`, time.Minute, 10)
+	loadSeries(t, st, `http_requests_total{job="api", instance="b", code="200"}`, time.Minute, 20)
+	loadSeries(t, st, `http_requests_total{job="db", instance="c", code="200"}`, time.Minute, 8)
+	loadSeries(t, st, `http_requests_total{job="api", instance="a", code="500"}`, time.Minute, 2)
+	loadSeries(t, st, `up{instance="a"}`, time.Minute, 1)
+	loadSeries(t, st, `up{instance="b"}`, time.Minute, 1)
+	loadSeries(t, st, `up{instance="c"}`, time.Minute, 0)
+	return st
+}
+
+// TestEngine_Aggregations 测试聚合运算
+func TestEngine_Aggregations(t *testing.T) {
+	st := newAggregateTestStorage(t)
+	engine := NewEngine()
+	tests := []struct {
+		query string
+		want  Vector
+	}{
+		{"sum(http_requests_total)", Vector{{Metric: labels(), V: 40}}},
+		{"sum by (job) (http_requests_total)", Vector{{Metric: labels("job", "api"), V: 32}, {Metric: labels("job", "db"), V: 8}}},
+		{"sum(http_requests_total) by (job)", Vector{{Metric: labels("job", "api"), V: 32}, {Metric: labels("job", "db"), V: 8}}},
+		{"sum without (instance) (http_requests_total)", Vector{
+			{Metric: labels("code", "200", "job", "api"), V: 30},
+			{Metric: labels("code", "200", "job", "db"), V: 8},
+			{Metric: labels("code", "500", "job", "api"), V: 2},
+		}},
+		{"sum by (__name__) (up)", Vector{{Metric: labels("__name__", "up"), V: 2}}},
+		{"sum by (nonexistent) (up)", Vector{{Metric: labels(), V: 2}}},
+		{"sum(nonexistent)", Vector{}},
+		{"avg by (code) (http_requests_total)", Vector{{Metric: labels("code", "200"), V: 38.0 / 3}, {Metric: labels("code", "500"), V: 2}}},
+		{"min by (job) (http_requests_total)", Vector{{Metric: labels("job", "api"), V: 2}, {Metric: labels("job", "db"), V: 8}}},
+		{"max by (job) (http_requests_total)", Vector{{Metric: labels("job", "api"), V: 20}, {Metric: labels("job", "db"), V: 8}}},
+		{"count by (code) (http_requests_total)", Vector{{Metric: labels("code", "200"), V: 3}, {Metric: labels("code", "500"), V: 1}}},
+		{"group by (job) (http_requests_total)", Vector{{Metric: labels("job", "api"), V: 1}, {Metric: labels("job", "db"), V: 1}}},
+		// 10, 20, 8, 2 的平均值是 10, 方差 (0 + 100 + 4 + 64) / 4
+		{"stdvar(http_requests_total)", Vector{{Metric: labels(), V: 42}}},
+		{"stddev(http_requests_total)", Vector{{Metric: labels(), V: math.Sqrt(42)}}},
+		// 排序后 2, 8, 10, 20, 中位数在 8 和 10 中间
+		{"quantile(0.5, http_requests_total)", Vector{{Metric: labels(), V: 9}}},
+		{"quantile(0.75, http_requests_total)", Vector{{Metric: labels(), V: 12.5}}},
+		{"quantile(-1, http_requests_total)", Vector{{Metric: labels(), V: math.Inf(-1)}}},
+		{"quantile(2, http_requests_total)", Vector{{Metric: labels(), V: math.Inf(1)}}},
+		{"topk(2, http_requests_total)", Vector{
+			{Metric: labels("__name__", "http_requests_total", "code", "200", "instance", "b", "job", "api"), V: 20},
+			{Metric: labels("__name__", "http_requests_total", "code", "200", "instance", "a", "job", "api"), V: 10},
+		}},
+		{"topk by (job) (1, http_requests_total)", Vector{
+			{Metric: labels("__name__", "http_requests_total", "code", "200", "instance", "b", "job", "api"), V: 20},
+			{Metric: labels("__name__", "http_requests_total", "code", "200", "instance", "c", "job", "db"), V: 8},
+		}},
+		{"bottomk(1, http_requests_total)", Vector{
+			{Metric: labels("__name__", "http_requests_total", "code", "500", "instance", "a", "job", "api"), V: 2},
+		}},
+		{"topk(0, http_requests_total)", Vector{}},
+		{"topk(10, up)", Vector{
+			{Metric: labels("__name__", "up", "instance", "a"), V: 1},
+			{Metric: labels("__name__", "up", "instance", "b"), V: 1},
+			{Metric: labels("__name__", "up", "instance", "c"), V: 0},
+		}},
+		{`count_values("status", up)`, Vector{{Metric: labels("status", "1"), V: 2}, {Metric: labels("status", "0"), V: 1}}},
+		{`count_values by (job) ("value", up)`, Vector{{Metric: labels("value", "1"), V: 2}, {Metric: labels("value", "0"), V: 1}}},
+		{`count_values("instance", up)`, Vector{{Metric: labels("instance", "1"), V: 2}, {Metric: labels("instance", "0"), V: 1}}},
+		{`count_values without (instance) ("v", up)`, Vector{{Metric: labels("v", "1"), V: 2}, {Metric: labels("v", "0"), V: 1}}},
+		{"sum(sum by (job) (http_requests_total))", Vector{{Metric: labels(), V: 40}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := engine.InstantQuery(context.Background(), st, tt.query, time.UnixMilli(0))
+			if err != nil {
+				t.Fatalf("查询失败: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("期望\n%v\n实际\n%v", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestEngine_AggregationErrors 测试聚合参数错误
+func TestEngine_AggregationErrors(t *testing.T) {
+	st := newAggregateTestStorage(t)
+	engine := NewEngine()
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{`count_values("1bad", up)`, `invalid label name "1bad"`},
+		{"topk(scalar(nonexistent), up)", "parameter value is NaN"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := engine.InstantQuery(context.Background(), st, tt.query, time.UnixMilli(0))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("期望错误 %q，实际 %v", tt.want, err)
+			}
+		})
+	}
+}
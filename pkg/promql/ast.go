@@ -0,0 +1,305 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+	"mini-promethues/pkg/model"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ValueType string
+
+const (
+	ValueTypeNone   ValueType = "none"
+	ValueTypeScalar ValueType = "scalar"
+	ValueTypeVector ValueType = "vector"
+	ValueTypeMatrix ValueType = "matrix"
+	ValueTypeString ValueType = "string"
+)
+
+// 错误信息中使用的类型名称, 与 Prometheus 一致
+func documentedType(t ValueType) string {
+	switch t {
+	case ValueTypeVector:
+		return "instant vector"
+	case ValueTypeMatrix:
+		return "range vector"
+	}
+	return string(t)
+}
+
+// 表达式在查询字符串中的字节范围 [Start, End)
+type PositionRange struct {
+	Start int
+	End   int
+}
+
+type Expr interface {
+	Type() ValueType
+	// 返回等价的 PromQL, 格式是规范化的, 不保留原始的空白和括号以外的写法
+	String() string
+	PositionRange() PositionRange
+}
+
+type NumberLiteral struct {
+	Val      float64
+	PosRange PositionRange
+}
+
+type StringLiteral struct {
+	Val      string
+	PosRange PositionRange
+}
+
+type ParenExpr struct {
+	Expr     Expr
+	PosRange PositionRange
+}
+
+// 一元 + 和 -, 作用于数字字面量时在解析阶段直接折叠
+type UnaryExpr struct {
+	Op       ItemType
+	Expr     Expr
+	StartPos int
+}
+
+type VectorMatchCardinality int
+
+const (
+	CardOneToOne VectorMatchCardinality = iota
+	CardManyToOne
+	CardOneToMany
+	CardManyToMany
+)
+
+func (c VectorMatchCardinality) String() string {
+	switch c {
+	case CardOneToOne:
+		return "one-to-one"
+	case CardManyToOne:
+		return "many-to-one"
+	case CardOneToMany:
+		return "one-to-many"
+	case CardManyToMany:
+		return "many-to-many"
+	}
+	return fmt.Sprintf("VectorMatchCardinality(%d)", int(c))
+}
+
+// 两个向量之间的匹配方式, 只在两边都是向量时存在
+type VectorMatching struct {
+	Card VectorMatchCardinality
+	// On 为 true 时只按 MatchingLabels 匹配, 否则按除 MatchingLabels 以外的标签匹配 (ignoring)
+	MatchingLabels []string
+	On             bool
+	// group_left / group_right 中列出的、从 "一" 侧复制到结果的标签
+	Include []string
+}
+
+type BinaryExpr struct {
+	Op             ItemType
+	LHS, RHS       Expr
+	VectorMatching *VectorMatching
+	// 比较运算符带 bool 修饰时返回 0/1 而不是过滤
+	ReturnBool bool
+}
+
+/*
+即时向量选择器, 指标名称也作为 __name__ 的等值匹配器出现在 LabelMatchers 中
+Timestamp 和 StartOrEnd 对应 @ 修饰符: @ 后面是数字时 Timestamp 是毫秒时间戳, @ start() / @ end() 时 StartOrEnd 为 START / END
+*/
+type VectorSelector struct {
+	Name          string
+	LabelMatchers []*model.LabelMatcher
+	Offset        time.Duration
+	Timestamp     *int64
+	StartOrEnd    ItemType
+	PosRange      PositionRange
+}
+
+type MatrixSelector struct {
+	// 总是 *VectorSelector
+	VectorSelector Expr
+	Range          time.Duration
+	EndPos         int
+}
+
+type AggregateExpr struct {
+	// sum、avg、topk 等
+	Op string
+	// topk 的 k、quantile 的分位数、count_values 的标签名, 其它聚合为 nil
+	Param    Expr
+	Expr     Expr
+	Grouping []string
+	Without  bool
+	PosRange PositionRange
+}
+
+type Call struct {
+	Func     *Function
+	Args     []Expr
+	PosRange PositionRange
+}
+
+func (e *NumberLiteral) Type() ValueType  { return ValueTypeScalar }
+func (e *StringLiteral) Type() ValueType  { return ValueTypeString }
+func (e *ParenExpr) Type() ValueType      { return e.Expr.Type() }
+func (e *UnaryExpr) Type() ValueType      { return e.Expr.Type() }
+func (e *VectorSelector) Type() ValueType { return ValueTypeVector }
+func (e *MatrixSelector) Type() ValueType { return ValueTypeMatrix }
+func (e *AggregateExpr) Type() ValueType  { return ValueTypeVector }
+func (e *Call) Type() ValueType           { return e.Func.ReturnType }
+
+func (e *BinaryExpr) Type() ValueType {
+	if e.LHS.Type() == ValueTypeScalar && e.RHS.Type() == ValueTypeScalar {
+		return ValueTypeScalar
+	}
+	return ValueTypeVector
+}
+
+func (e *NumberLiteral) PositionRange() PositionRange  { return e.PosRange }
+func (e *StringLiteral) PositionRange() PositionRange  { return e.PosRange }
+func (e *ParenExpr) PositionRange() PositionRange      { return e.PosRange }
+func (e *VectorSelector) PositionRange() PositionRange { return e.PosRange }
+func (e *AggregateExpr) PositionRange() PositionRange  { return e.PosRange }
+func (e *Call) PositionRange() PositionRange           { return e.PosRange }
+
+func (e *UnaryExpr) PositionRange() PositionRange {
+	return PositionRange{Start: e.StartPos, End: e.Expr.PositionRange().End}
+}
+
+func (e *BinaryExpr) PositionRange() PositionRange {
+	return PositionRange{Start: e.LHS.PositionRange().Start, End: e.RHS.PositionRange().End}
+}
+
+func (e *MatrixSelector) PositionRange() PositionRange {
+	return PositionRange{Start: e.VectorSelector.PositionRange().Start, End: e.EndPos}
+}
+
+func (e *NumberLiteral) String() string {
+	switch {
+	case math.IsInf(e.Val, 1):
+		return "+Inf"
+	case math.IsInf(e.Val, -1):
+		return "-Inf"
+	case math.IsNaN(e.Val):
+		return "NaN"
+	}
+	return strconv.FormatFloat(e.Val, 'g', -1, 64)
+}
+
+func (e *StringLiteral) String() string { return strconv.Quote(e.Val) }
+func (e *ParenExpr) String() string     { return "(" + e.Expr.String() + ")" }
+func (e *UnaryExpr) String() string     { return e.Op.String() + e.Expr.String() }
+
+func (e *BinaryExpr) String() string {
+	var b strings.Builder
+	b.WriteString(e.LHS.String())
+	b.WriteString(" " + e.Op.String())
+	if e.ReturnBool {
+		b.WriteString(" bool")
+	}
+	if vm := e.VectorMatching; vm != nil {
+		if vm.On || len(vm.MatchingLabels) > 0 {
+			keyword := "ignoring"
+			if vm.On {
+				keyword = "on"
+			}
+			fmt.Fprintf(&b, " %s (%s)", keyword, strings.Join(vm.MatchingLabels, ", "))
+		}
+		switch vm.Card {
+		case CardManyToOne:
+			fmt.Fprintf(&b, " group_left (%s)", strings.Join(vm.Include, ", "))
+		case CardOneToMany:
+			fmt.Fprintf(&b, " group_right (%s)", strings.Join(vm.Include, ", "))
+		}
+	}
+	b.WriteString(" " + e.RHS.String())
+	return b.String()
+}
+
+func (e *VectorSelector) String() string {
+	return e.selectorString() + e.modifiersString()
+}
+
+// 不带 offset 和 @ 的部分, 例如 http_requests_total{method="GET"}
+func (e *VectorSelector) selectorString() string {
+	var matchers []string
+	for _, m := range e.LabelMatchers {
+		// 指标名称已经写在前面
+		if e.Name != "" && m.Name == model.MetricNameLabel && m.Type == model.MatchEqual {
+			continue
+		}
+		matchers = append(matchers, m.String())
+	}
+	if len(matchers) == 0 {
+		return e.Name
+	}
+	return e.Name + "{" + strings.Join(matchers, ", ") + "}"
+}
+
+func (e *VectorSelector) modifiersString() string {
+	var s string
+	switch {
+	case e.Timestamp != nil:
+		s += fmt.Sprintf(" @ %.3f", float64(*e.Timestamp)/1000)
+	case e.StartOrEnd != 0:
+		s += fmt.Sprintf(" @ %s()", e.StartOrEnd)
+	}
+	if e.Offset > 0 {
+		s += " offset " + formatDuration(e.Offset)
+	} else if e.Offset < 0 {
+		s += " offset -" + formatDuration(-e.Offset)
+	}
+	return s
+}
+
+func (e *MatrixSelector) String() string {
+	vs := e.VectorSelector.(*VectorSelector)
+	return vs.selectorString() + "[" + formatDuration(e.Range) + "]" + vs.modifiersString()
+}
+
+func (e *AggregateExpr) String() string {
+	s := e.Op
+	if e.Without {
+		s += " without (" + strings.Join(e.Grouping, ", ") + ") "
+	} else if len(e.Grouping) > 0 {
+		s += " by (" + strings.Join(e.Grouping, ", ") + ") "
+	}
+	if e.Param != nil {
+		return s + "(" + e.Param.String() + ", " + e.Expr.String() + ")"
+	}
+	return s + "(" + e.Expr.String() + ")"
+}
+
+func (e *Call) String() string {
+	args := make([]string, len(e.Args))
+	for i, arg := range e.Args {
+		args[i] = arg.String()
+	}
+	return e.Func.Name + "(" + strings.Join(args, ", ") + ")"
+}
+
+// 直接子表达式, 用于遍历 AST
+func children(e Expr) []Expr {
+	switch e := e.(type) {
+	case *ParenExpr:
+		return []Expr{e.Expr}
+	case *UnaryExpr:
+		return []Expr{e.Expr}
+	case *BinaryExpr:
+		return []Expr{e.LHS, e.RHS}
+	case *MatrixSelector:
+		return []Expr{e.VectorSelector}
+	case *AggregateExpr:
+		if e.Param != nil {
+			return []Expr{e.Param, e.Expr}
+		}
+		return []Expr{e.Expr}
+	case *Call:
+		return e.Args
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package promql
+
+import (
+	"fmt"
+	"math"
+	"mini-promethues/pkg/model"
+	"slices"
+)
+
+func (ev *evaluator) evalBinary(e *BinaryExpr, ts int64) (Value, error) {
+	lhs, err := ev.eval(e.LHS, ts)
+	if err != nil {
+		return nil, err
+	}
+	rhs, err := ev.eval(e.RHS, ts)
+	if err != nil {
+		return nil, err
+	}
+
+	switch l := lhs.(type) {
+	case Scalar:
+		switch r := rhs.(type) {
+		case Scalar:
+			v, keep := binaryOp(e.Op, l.V, r.V)
+			if e.ReturnBool {
+				v = boolValue(keep)
+			}
+			return Scalar{T: ts, V: v}, nil
+		case Vector:
+			return vectorScalarBinary(e, r, l.V, true, ts)
+		}
+	case Vector:
+		switch r := rhs.(type) {
+		case Scalar:
+			return vectorScalarBinary(e, l, r.V, false, ts)
+		case Vector:
+			return vectorBinary(e, l, r, ts)
+		}
+	}
+	return nil, fmt.Errorf("unexpected operand types %s and %s for binary %s", lhs.Type(), rhs.Type(), e.Op)
+}
+
+/*
+两个值的运算, keep 表示比较运算的结果
+比较运算返回左边的值, 由调用方根据 keep 和 bool 修饰决定过滤还是返回 0/1
+*/
+func binaryOp(op ItemType, lhs, rhs float64) (float64, bool) {
+	switch op {
+	case ADD:
+		return lhs + rhs, true
+	case SUB:
+		return lhs - rhs, true
+	case MUL:
+		return lhs * rhs, true
+	case DIV:
+		return lhs / rhs, true
+	case MOD:
+		return math.Mod(lhs, rhs), true
+	case POW:
+		return math.Pow(lhs, rhs), true
+	case EQLC:
+		return lhs, lhs == rhs
+	case NEQ:
+		return lhs, lhs != rhs
+	case GTR:
+		return lhs, lhs > rhs
+	case LSS:
+		return lhs, lhs < rhs
+	case GTE:
+		return lhs, lhs >= rhs
+	case LTE:
+		return lhs, lhs <= rhs
+	}
+	panic(fmt.Sprintf("operator %q not allowed for operations between values", op))
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// 算术运算和带 bool 的比较运算的结果不再是原来的指标, 去掉 __name__
+func dropsMetricName(e *BinaryExpr) bool {
+	return !e.Op.IsComparisonOperator() || e.ReturnBool
+}
+
+// 向量的每个元素和标量运算, scalarLeft 表示标量在运算符左边
+func vectorScalarBinary(e *BinaryExpr, vec Vector, scalar float64, scalarLeft bool, ts int64) (Vector, error) {
+	result := make(Vector, 0, len(vec))
+	for _, s := range vec {
+		lv, rv := s.V, scalar
+		if scalarLeft {
+			lv, rv = rv, lv
+		}
+		v, keep := binaryOp(e.Op, lv, rv)
+		// 比较运算总是保留向量一侧的值, 即使向量在右边
+		if e.Op.IsComparisonOperator() && scalarLeft {
+			v = rv
+		}
+		if e.ReturnBool {
+			v, keep = boolValue(keep), true
+		}
+		if !keep {
+			continue
+		}
+		metric := s.Metric
+		if dropsMetricName(e) {
+			metric = dropMetricName(metric)
+		}
+		result = append(result, Sample{Metric: metric, T: ts, V: v})
+	}
+	return result, checkDuplicates(result)
+}
+
+// 用于匹配两边元素的标签: on 只看列出的标签, ignoring 看除列出的标签和 __name__ 以外的标签
+func matchingKey(metric model.Labels, vm *VectorMatching) string {
+	return labelsKey(groupingLabels(metric, vm.MatchingLabels, !vm.On))
+}
+
+func vectorBinary(e *BinaryExpr, lhs, rhs Vector, ts int64) (Vector, error) {
+	vm := e.VectorMatching
+	switch e.Op {
+	case LAND:
+		return vectorAnd(lhs, rhs, vm, ts), nil
+	case LOR:
+		return vectorOr(lhs, rhs, vm, ts), nil
+	case LUNLESS:
+		return vectorUnless(lhs, rhs, vm, ts), nil
+	}
+	if vm.Card == CardManyToMany {
+		return nil, fmt.Errorf("many-to-many only allowed for set operators")
+	}
+
+	// 右边总是 "一" 的一侧, group_right 时交换两边, 计算时再换回来
+	// "一" 的一侧同一个匹配标签只能有一个元素, 否则就是不允许的多对多匹配
+	oneSide := "right"
+	if vm.Card == CardOneToMany {
+		lhs, rhs = rhs, lhs
+		oneSide = "left"
+	}
+	rightByKey := make(map[string]Sample, len(rhs))
+	for _, rs := range rhs {
+		key := matchingKey(rs.Metric, vm)
+		if dup, ok := rightByKey[key]; ok {
+			return nil, fmt.Errorf("found duplicate series for the match group %s on the %s hand-side of the operation: [%s, %s]; %w",
+				labelsString(groupingLabels(rs.Metric, vm.MatchingLabels, !vm.On)), oneSide,
+				labelsString(dup.Metric), labelsString(rs.Metric), ErrManyToManyMatching)
+		}
+		rightByKey[key] = rs
+	}
+
+	// 一对一时每个匹配标签只能有一个结果; 多对一时 "多" 的一侧可以有多个元素, 但结果的标签不能相同
+	matched := make(map[string]map[string]struct{})
+	result := Vector{}
+	for _, ls := range lhs {
+		key := matchingKey(ls.Metric, vm)
+		rs, ok := rightByKey[key]
+		if !ok {
+			continue
+		}
+		lv, rv := ls.V, rs.V
+		if vm.Card == CardOneToMany {
+			lv, rv = rv, lv
+		}
+		v, keep := binaryOp(e.Op, lv, rv)
+		if e.ReturnBool {
+			v, keep = boolValue(keep), true
+		}
+		if !keep {
+			continue
+		}
+		metric := resultMetric(e, ls.Metric, rs.Metric)
+
+		results, exists := matched[key]
+		if vm.Card == CardOneToOne {
+			if exists {
+				return nil, fmt.Errorf("multiple matches for labels: many-to-one matching must be explicit (group_left/group_right)")
+			}
+			matched[key] = nil
+		} else {
+			if !exists {
+				results = make(map[string]struct{})
+				matched[key] = results
+			}
+			metricKey := labelsKey(metric)
+			if _, dup := results[metricKey]; dup {
+				return nil, fmt.Errorf("multiple matches for labels: grouping labels must ensure unique matches")
+			}
+			results[metricKey] = struct{}{}
+		}
+		result = append(result, Sample{Metric: metric, T: ts, V: v})
+	}
+	return result, nil
+}
+
+/*
+结果的标签取自 "多" 的一侧 (一对一时是左边)
+一对一时 on 只保留匹配标签, ignoring 去掉忽略的标签; group_x 列出的标签从 "一" 的一侧复制过来
+*/
+func resultMetric(e *BinaryExpr, many, one model.Labels) model.Labels {
+	vm := e.VectorMatching
+	metric := slices.Clone(many)
+	if dropsMetricName(e) {
+		metric = dropMetricName(metric)
+	}
+	if vm.Card == CardOneToOne {
+		metric = slices.DeleteFunc(metric, func(l model.Label) bool {
+			return slices.Contains(vm.MatchingLabels, l.Name) != vm.On
+		})
+	}
+	if len(vm.Include) == 0 {
+		return metric
+	}
+	metric = slices.DeleteFunc(metric, func(l model.Label) bool {
+		return slices.Contains(vm.Include, l.Name)
+	})
+	for _, name := range vm.Include {
+		if v := one.Get(name); v != "" {
+			metric = append(metric, model.Label{Name: name, Value: v})
+		}
+	}
+	return metric.Sorted()
+}
+
+// 左边中在右边有匹配的元素
+func vectorAnd(lhs, rhs Vector, vm *VectorMatching, ts int64) Vector {
+	keys := make(map[string]struct{}, len(rhs))
+	for _, rs := range rhs {
+		keys[matchingKey(rs.Metric, vm)] = struct{}{}
+	}
+	result := Vector{}
+	for _, ls := range lhs {
+		if _, ok := keys[matchingKey(ls.Metric, vm)]; ok {
+			result = append(result, Sample{Metric: ls.Metric, T: ts, V: ls.V})
+		}
+	}
+	return result
+}
+
+// 左边的全部元素, 加上右边中在左边没有匹配的元素
+func vectorOr(lhs, rhs Vector, vm *VectorMatching, ts int64) Vector {
+	keys := make(map[string]struct{}, len(lhs))
+	result := make(Vector, 0, len(lhs)+len(rhs))
+	for _, ls := range lhs {
+		keys[matchingKey(ls.Metric, vm)] = struct{}{}
+		result = append(result, Sample{Metric: ls.Metric, T: ts, V: ls.V})
+	}
+	for _, rs := range rhs {
+		if _, ok := keys[matchingKey(rs.Metric, vm)]; !ok {
+			result = append(result, Sample{Metric: rs.Metric, T: ts, V: rs.V})
+		}
+	}
+	return result
+}
+
+// 左边中在右边没有匹配的元素
+func vectorUnless(lhs, rhs Vector, vm *VectorMatching, ts int64) Vector {
+	keys := make(map[string]struct{}, len(rhs))
+	for _, rs := range rhs {
+		keys[matchingKey(rs.Metric, vm)] = struct{}{}
+	}
+	result := Vector{}
+	for _, ls := range lhs {
+		if _, ok := keys[matchingKey(ls.Metric, vm)]; !ok {
+			result = append(result, Sample{Metric: ls.Metric, T: ts, V: ls.V})
+		}
+	}
+	return result
+}
@@ -0,0 +1,154 @@
+package promql
+
+import (
+	"context"
+	"errors"
+	"mini-promethues/pkg/storage"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newBinaryTestStorage(t testing.TB) storage.Storage {
+	st := storage.NewMemoryStorage()
+	loadSeries(t, st, `http_requests_total{job="api", instance="a", code="200"}`, time.Minute, 10)
+	loadSeries(t, st, `http_requests_total{job="api", instance="b", code="200"}`, time.Minute, 20)
+	loadSeries(t, st, `http_requests_total{job="api", instance="a", code="500"}`, time.Minute, 2)
+	loadSeries(t, st, `capacity{job="api", instance="a"}`, time.Minute, 100)
+	loadSeries(t, st, `capacity{job="api", instance="b"}`, time.Minute, 50)
+	loadSeries(t, st, `up{job="api", instance="a"}`, time.Minute, 1)
+	loadSeries(t, st, `up{job="api", instance="b"}`, time.Minute, 0)
+	loadSeries(t, st, `up{job="db", instance="c"}`, time.Minute, 1)
+	loadSeries(t, st, `owner{job="api", team="infra"}`, time.Minute, 1)
+	return st
+}
+
+// TestEngine_BinaryOperators 测试二元运算
+func TestEngine_BinaryOperators(t *testing.T) {
+	st := newBinaryTestStorage(t)
+	engine := NewEngine()
+	reqA200 := labels("__name__", "http_requests_total", "code", "200", "instance", "a", "job", "api")
+	reqB200 := labels("__name__", "http_requests_total", "code", "200", "instance", "b", "job", "api")
+	reqA500 := labels("__name__", "http_requests_total", "code", "500", "instance", "a", "job", "api")
+	upA := labels("__name__", "up", "instance", "a", "job", "api")
+	upB := labels("__name__", "up", "instance", "b", "job", "api")
+	upC := labels("__name__", "up", "instance", "c", "job", "db")
+	capA := labels("__name__", "capacity", "instance", "a", "job", "api")
+	capB := labels("__name__", "capacity", "instance", "b", "job", "api")
+	a := labels("instance", "a", "job", "api")
+	b := labels("instance", "b", "job", "api")
+	tests := []struct {
+		query string
+		want  Value
+	}{
+		// 标量之间
+		{"1 + 2 * 3", Scalar{V: 7}},
+		{"2 ^ 3 ^ 2", Scalar{V: 512}},
+		{"7 % 4 - 1", Scalar{V: 2}},
+		{"1 < bool 2", Scalar{V: 1}},
+		{"2 == bool 1", Scalar{V: 0}},
+
+		// 向量和标量
+		{"capacity * 2", Vector{{Metric: a, V: 200}, {Metric: b, V: 100}}},
+		{"100 / capacity", Vector{{Metric: a, V: 1}, {Metric: b, V: 2}}},
+		{"capacity > 60", Vector{{Metric: capA, V: 100}}},
+		{"60 < capacity", Vector{{Metric: capA, V: 100}}},
+		{"capacity > bool 60", Vector{{Metric: a, V: 1}, {Metric: b, V: 0}}},
+		{"capacity == 1", Vector{}},
+
+		// 一对一匹配
+		{"up + capacity", Vector{{Metric: a, V: 101}, {Metric: b, V: 50}}},
+		{"up == capacity", Vector{}},
+		{"up > bool on (instance) capacity", Vector{{Metric: labels("instance", "a"), V: 0}, {Metric: labels("instance", "b"), V: 0}}},
+		{"up - ignoring (job) capacity", Vector{{Metric: labels("instance", "a"), V: -99}, {Metric: labels("instance", "b"), V: -50}}},
+
+		// 多对一和一对多匹配
+		{"http_requests_total / ignoring (code) group_left capacity", Vector{
+			{Metric: labels("code", "200", "instance", "a", "job", "api"), V: 0.1},
+			{Metric: labels("code", "200", "instance", "b", "job", "api"), V: 0.4},
+			{Metric: labels("code", "500", "instance", "a", "job", "api"), V: 0.02},
+		}},
+		{"capacity / ignoring (code) group_right http_requests_total", Vector{
+			{Metric: labels("code", "200", "instance", "a", "job", "api"), V: 10},
+			{Metric: labels("code", "200", "instance", "b", "job", "api"), V: 2.5},
+			{Metric: labels("code", "500", "instance", "a", "job", "api"), V: 50},
+		}},
+		{"http_requests_total * on (job) group_left (team) owner", Vector{
+			{Metric: labels("code", "200", "instance", "a", "job", "api", "team", "infra"), V: 10},
+			{Metric: labels("code", "200", "instance", "b", "job", "api", "team", "infra"), V: 20},
+			{Metric: labels("code", "500", "instance", "a", "job", "api", "team", "infra"), V: 2},
+		}},
+		{"http_requests_total > on (instance, job) group_left capacity / 10", Vector{{Metric: reqB200, V: 20}}},
+
+		// 集合运算
+		{"up and capacity", Vector{{Metric: upA, V: 1}, {Metric: upB, V: 0}}},
+		{"up unless capacity", Vector{{Metric: upC, V: 1}}},
+		{"capacity or up", Vector{{Metric: capA, V: 100}, {Metric: capB, V: 50}, {Metric: upC, V: 1}}},
+		{"up and on (job) owner", Vector{{Metric: upA, V: 1}, {Metric: upB, V: 0}}},
+		{"http_requests_total and ignoring (code) up == 1", Vector{{Metric: reqA200, V: 10}, {Metric: reqA500, V: 2}}},
+		{"sum by (job) (up) or on (job) owner", Vector{{Metric: labels("job", "api"), V: 1}, {Metric: labels("job", "db"), V: 1}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := engine.InstantQuery(context.Background(), st, tt.query, time.UnixMilli(0))
+			if err != nil {
+				t.Fatalf("查询失败: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("期望\n%v\n实际\n%v", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestEngine_BinaryMatchingErrors 测试向量匹配错误
+func TestEngine_BinaryMatchingErrors(t *testing.T) {
+	st := newBinaryTestStorage(t)
+	engine := NewEngine()
+	tests := []struct {
+		query   string
+		want    string
+		wantErr error
+	}{
+		{
+			query:   "capacity + on (job) http_requests_total",
+			want:    `found duplicate series for the match group {job="api"} on the right hand-side of the operation`,
+			wantErr: ErrManyToManyMatching,
+		},
+		{
+			query:   "http_requests_total + on (job) group_left capacity",
+			want:    "many-to-many matching not allowed",
+			wantErr: ErrManyToManyMatching,
+		},
+		{
+			query:   "capacity + on (job) group_right up",
+			want:    `on the left hand-side of the operation`,
+			wantErr: ErrManyToManyMatching,
+		},
+		{
+			query: "http_requests_total / ignoring (code) capacity",
+			want:  "multiple matches for labels: many-to-one matching must be explicit (group_left/group_right)",
+		},
+		{
+			query: `{job="api", instance="a", code=""} * on (instance) group_left capacity`,
+			want:  "multiple matches for labels: grouping labels must ensure unique matches",
+		},
+		{
+			query:   `{job="api", instance="a"} * 1`,
+			want:    "vector cannot contain metrics with the same labelset",
+			wantErr: ErrDuplicateLabelSet,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, err := engine.InstantQuery(context.Background(), st, tt.query, time.UnixMilli(0))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("期望错误 %q，实际 %v", tt.want, err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("期望 %v，实际 %v", tt.wantErr, err)
+			}
+		})
+	}
+}
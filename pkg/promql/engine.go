@@ -0,0 +1,372 @@
+package promql
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mini-promethues/pkg/model"
+	"mini-promethues/pkg/storage"
+	"sort"
+	"time"
+)
+
+const DefaultQueryTimeout = 2 * time.Minute
+
+// 在 storage.Storage 上执行 PromQL 查询, 可以被多个 goroutine 同时使用
+type Engine struct {
+	timeout time.Duration
+}
+
+type EngineOption func(*Engine)
+
+// 单个查询的最长执行时间, 超时返回 ErrQueryTimeout
+func WithTimeout(timeout time.Duration) EngineOption {
+	return func(e *Engine) {
+		if timeout > 0 {
+			e.timeout = timeout
+		}
+	}
+}
+
+func NewEngine(opts ...EngineOption) *Engine {
+	e := &Engine{
+		timeout: DefaultQueryTimeout,
+	}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+// 在 ts 时刻对表达式求值, 结果可能是 Scalar、String、Vector 或 Matrix
+func (e *Engine) InstantQuery(ctx context.Context, st storage.Storage, qs string, ts time.Time) (Value, error) {
+	expr, err := ParseExpr(qs)
+	if err != nil {
+		return nil, err
+	}
+	t := ts.UnixMilli()
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	ev, err := e.newEvaluator(ctx, st, expr, t, t, 0)
+	if err != nil {
+		return nil, err
+	}
+	v, err := ev.eval(expr, t)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, contextErr(err)
+	}
+	return v, nil
+}
+
+/*
+在 [start, end] 内每隔 step 求值一次, 每个时刻的结果合并成 Matrix
+表达式必须是 Scalar 或即时向量, Scalar 的结果是一条没有标签的序列
+*/
+func (e *Engine) RangeQuery(ctx context.Context, st storage.Storage, qs string, start, end time.Time, step time.Duration) (Matrix, error) {
+	if step <= 0 {
+		return nil, ErrInvalidStep
+	}
+	if end.Before(start) {
+		return nil, ErrTimeRange
+	}
+	expr, err := ParseExpr(qs)
+	if err != nil {
+		return nil, err
+	}
+	if t := expr.Type(); t != ValueTypeScalar && t != ValueTypeVector {
+		return nil, fmt.Errorf("invalid expression type %q for range query, must be scalar or instant vector", documentedType(t))
+	}
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	mint, maxt, interval := start.UnixMilli(), end.UnixMilli(), max(step.Milliseconds(), 1)
+	ev, err := e.newEvaluator(ctx, st, expr, mint, maxt, interval)
+	if err != nil {
+		return nil, err
+	}
+
+	series := make(map[string]*Series)
+	add := func(metric model.Labels, t int64, v float64) {
+		key := labelsKey(metric)
+		s, ok := series[key]
+		if !ok {
+			s = &Series{Metric: metric}
+			series[key] = s
+		}
+		s.Samples = append(s.Samples, model.Sample{Timestamp: t, Value: v})
+	}
+	for t := mint; t <= maxt; t += interval {
+		if err := ctx.Err(); err != nil {
+			return nil, contextErr(err)
+		}
+		v, err := ev.eval(expr, t)
+		if err != nil {
+			return nil, err
+		}
+		switch v := v.(type) {
+		case Scalar:
+			add(model.Labels{}, t, v.V)
+		case Vector:
+			for _, s := range v {
+				add(s.Metric, t, s.V)
+			}
+		}
+	}
+	result := make(Matrix, 0, len(series))
+	for _, s := range series {
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Metric.Compare(result[j].Metric) < 0 })
+	return result, nil
+}
+
+// 把 context 的错误转换成查询错误, 同时保留原始错误
+func contextErr(err error) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("%w: %w", ErrQueryTimeout, err)
+	case errors.Is(err, context.Canceled):
+		return fmt.Errorf("%w: %w", ErrQueryCanceled, err)
+	}
+	return err
+}
+
+/*
+一次查询的求值状态
+开始求值前按每个选择器需要的时间范围从存储中取出全部序列, 之后每个时刻只在内存中截取, 范围查询不会对每一步重复访问存储
+*/
+type evaluator struct {
+	ctx context.Context
+	// 查询的时间范围和步长 (毫秒), 即时查询时 start == end, interval 为 0
+	start, end, interval int64
+	// 即时向量选择器的回溯窗口 (毫秒), 取自存储, 查询和 Storage.Query 看到的最新值相同
+	lookbackDelta int64
+	series        map[*VectorSelector][]Series
+}
+
+func (e *Engine) newEvaluator(ctx context.Context, st storage.Storage, expr Expr, start, end, interval int64) (*evaluator, error) {
+	ev := &evaluator{
+		ctx:           ctx,
+		start:         start,
+		end:           end,
+		interval:      interval,
+		lookbackDelta: st.LookbackDelta().Milliseconds(),
+		series:        make(map[*VectorSelector][]Series),
+	}
+	resolveAtModifiers(expr, start, end)
+	if err := ev.populate(st, expr); err != nil {
+		return nil, err
+	}
+	return ev, nil
+}
+
+// @ start() / @ end() 在查询开始前换成具体的时间戳, 之后只需要看 Timestamp
+func resolveAtModifiers(expr Expr, start, end int64) {
+	if vs, ok := expr.(*VectorSelector); ok {
+		switch vs.StartOrEnd {
+		case START:
+			vs.Timestamp = &start
+		case END:
+			vs.Timestamp = &end
+		}
+	}
+	for _, child := range children(expr) {
+		resolveAtModifiers(child, start, end)
+	}
+}
+
+func (ev *evaluator) populate(st storage.Storage, expr Expr) error {
+	switch e := expr.(type) {
+	case *VectorSelector:
+		return ev.load(st, e, ev.lookbackDelta)
+	case *MatrixSelector:
+		return ev.load(st, e.VectorSelector.(*VectorSelector), e.Range.Milliseconds())
+	}
+	for _, child := range children(expr) {
+		if err := ev.populate(st, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 取出选择器在整个查询范围内可能用到的样本, window 是回溯窗口或者范围向量的长度
+func (ev *evaluator) load(st storage.Storage, vs *VectorSelector, window int64) error {
+	if err := ev.ctx.Err(); err != nil {
+		return contextErr(err)
+	}
+	mint, maxt := refTime(vs, ev.start)-window, refTime(vs, ev.end)
+	ss, err := st.Select(vs.LabelMatchers, mint, maxt)
+	if err != nil {
+		return fmt.Errorf("select %s: %w", vs, err)
+	}
+	var result []Series
+	for ss.Next() {
+		if err := ev.checkContext(); err != nil {
+			return err
+		}
+		s := ss.At()
+		result = append(result, Series{Metric: s.Metric.LabelSet(), Samples: s.Samples})
+	}
+	if err := ss.Err(); err != nil {
+		return fmt.Errorf("select %s: %w", vs, err)
+	}
+	ev.series[vs] = result
+	return nil
+}
+
+// 求值过程中处理每条序列或每个分组前调用, 数据量很大的一次求值也能及时响应超时和取消
+func (ev *evaluator) checkContext() error {
+	if err := ev.ctx.Err(); err != nil {
+		return contextErr(err)
+	}
+	return nil
+}
+
+// 选择器在求值时刻 ts 实际读取的时间: @ 指定的时间或 ts, 再往前移 offset
+func refTime(vs *VectorSelector, ts int64) int64 {
+	if vs.Timestamp != nil {
+		ts = *vs.Timestamp
+	}
+	return ts - vs.Offset.Milliseconds()
+}
+
+func (ev *evaluator) eval(expr Expr, ts int64) (Value, error) {
+	switch e := expr.(type) {
+	case *NumberLiteral:
+		return Scalar{T: ts, V: e.Val}, nil
+	case *StringLiteral:
+		return String{T: ts, V: e.Val}, nil
+	case *ParenExpr:
+		return ev.eval(e.Expr, ts)
+	case *UnaryExpr:
+		return ev.evalUnary(e, ts)
+	case *VectorSelector:
+		return ev.vectorSelector(e, ts)
+	case *MatrixSelector:
+		return ev.matrixSelector(e, ts)
+	case *AggregateExpr:
+		return ev.evalAggregate(e, ts)
+	case *BinaryExpr:
+		return ev.evalBinary(e, ts)
+	case *Call:
+		args := make([]Value, len(e.Args))
+		for i, arg := range e.Args {
+			// timestamp(x) 需要选择器读到的样本实际的时间戳, 而不是求值时刻
+			var v Value
+			var err error
+			if vs, ok := unwrapParens(arg).(*VectorSelector); ok && e.Func.Name == "timestamp" {
+				v, err = ev.latestSamples(vs, ts)
+			} else {
+				v, err = ev.eval(arg, ts)
+			}
+			if err != nil {
+				return nil, err
+			}
+			args[i] = v
+		}
+		v := e.Func.call(args, e, ts)
+		if vec, ok := v.(Vector); ok {
+			return vec, checkDuplicates(vec)
+		}
+		return v, nil
+	}
+	return nil, fmt.Errorf("unsupported expression %s", expr)
+}
+
+func (ev *evaluator) evalUnary(e *UnaryExpr, ts int64) (Value, error) {
+	v, err := ev.eval(e.Expr, ts)
+	if err != nil || e.Op == ADD {
+		return v, err
+	}
+	switch v := v.(type) {
+	case Scalar:
+		return Scalar{T: ts, V: -v.V}, nil
+	case Vector:
+		result := make(Vector, len(v))
+		for i, s := range v {
+			result[i] = Sample{Metric: dropMetricName(s.Metric), T: ts, V: -s.V}
+		}
+		return result, checkDuplicates(result)
+	}
+	return nil, fmt.Errorf("unexpected operand type %s for unary %s", v.Type(), e.Op)
+}
+
+// 与 Storage.Query 的回溯语义一致: [ref - lookback, ref] 内的最新样本, 是 staleness marker 时没有值
+func (ev *evaluator) vectorSelector(vs *VectorSelector, ts int64) (Vector, error) {
+	result, err := ev.latestSamples(vs, ts)
+	for i := range result {
+		result[i].T = ts
+	}
+	return result, err
+}
+
+// 和 vectorSelector 相同, 但样本保留实际的时间戳
+func (ev *evaluator) latestSamples(vs *VectorSelector, ts int64) (Vector, error) {
+	ref := refTime(vs, ts)
+	var result Vector
+	for _, s := range ev.series[vs] {
+		if err := ev.checkContext(); err != nil {
+			return nil, err
+		}
+		i := sort.Search(len(s.Samples), func(i int) bool { return s.Samples[i].Timestamp > ref }) - 1
+		if i < 0 || s.Samples[i].Timestamp < ref-ev.lookbackDelta || model.IsStaleNaN(s.Samples[i].Value) {
+			continue
+		}
+		result = append(result, Sample{Metric: s.Metric, T: s.Samples[i].Timestamp, V: s.Samples[i].Value})
+	}
+	return result, nil
+}
+
+func unwrapParens(expr Expr) Expr {
+	for {
+		p, ok := expr.(*ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = p.Expr
+	}
+}
+
+// (ref - range, ref] 内的样本, 去掉 staleness marker; 没有样本的序列不出现在结果中
+func (ev *evaluator) matrixSelector(ms *MatrixSelector, ts int64) (Matrix, error) {
+	vs := ms.VectorSelector.(*VectorSelector)
+	ref := refTime(vs, ts)
+	mint := ref - ms.Range.Milliseconds()
+	var result Matrix
+	for _, s := range ev.series[vs] {
+		if err := ev.checkContext(); err != nil {
+			return nil, err
+		}
+		lo := sort.Search(len(s.Samples), func(i int) bool { return s.Samples[i].Timestamp > mint })
+		hi := sort.Search(len(s.Samples), func(i int) bool { return s.Samples[i].Timestamp > ref })
+		var samples model.Samples
+		for _, p := range s.Samples[lo:hi] {
+			if !model.IsStaleNaN(p.Value) {
+				samples = append(samples, p)
+			}
+		}
+		if len(samples) > 0 {
+			result = append(result, Series{Metric: s.Metric, Samples: samples})
+		}
+	}
+	return result, nil
+}
+
+// 去掉 __name__ 等标签后不同的序列可能得到相同的标签集合, 这样的结果没有意义
+func checkDuplicates(v Vector) error {
+	if len(v) < 2 {
+		return nil
+	}
+	seen := make(map[string]struct{}, len(v))
+	for _, s := range v {
+		key := labelsKey(s.Metric)
+		if _, ok := seen[key]; ok {
+			return fmt.Errorf("%w: %s", ErrDuplicateLabelSet, labelsString(s.Metric))
+		}
+		seen[key] = struct{}{}
+	}
+	return nil
+}
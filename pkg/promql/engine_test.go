@@ -0,0 +1,442 @@
+package promql
+
+import (
+	"context"
+	"errors"
+	"math"
+	"mini-promethues/pkg/model"
+	"mini-promethues/pkg/storage"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 表示该时刻没有样本
+var none = math.NaN()
+
+/*
+写入测试数据: 从时间 0 开始每隔 interval 一个样本, 值为 none 的位置跳过
+metric 使用选择器语法, 例如 http_requests_total{job="api"}
+*/
+func loadSeries(t testing.TB, st storage.Storage, metric string, interval time.Duration, values ...float64) {
+	t.Helper()
+	expr, err := ParseExpr(metric)
+	if err != nil {
+		t.Fatalf("解析 %s 失败: %v", metric, err)
+	}
+	var ls model.Labels
+	for _, m := range expr.(*VectorSelector).LabelMatchers {
+		ls = append(ls, model.Label{Name: m.Name, Value: m.Value})
+	}
+	m := model.MetricFromLabels(ls)
+	for i, v := range values {
+		if math.IsNaN(v) && !model.IsStaleNaN(v) {
+			continue
+		}
+		ts := int64(i) * interval.Milliseconds()
+		if err := st.Append(m, &model.Sample{Timestamp: ts, Value: v}); err != nil {
+			t.Fatalf("写入 %s 失败: %v", metric, err)
+		}
+	}
+}
+
+// 按 name, value, name, value 的顺序构造排序后的标签集合
+func labels(kv ...string) model.Labels {
+	ls := model.Labels{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		ls = append(ls, model.Label{Name: kv[i], Value: kv[i+1]})
+	}
+	return ls.Sorted()
+}
+
+func ms(d time.Duration) int64 {
+	return d.Milliseconds()
+}
+
+func newTestStorage(t testing.TB) storage.Storage {
+	st := storage.NewMemoryStorage()
+	loadSeries(t, st, `http_requests_total{job="api", instance="a"}`, time.Minute, 0, 10, 20, 30, 40, 50)
+	loadSeries(t, st, `http_requests_total{job="api", instance="b"}`, time.Minute, 0, 5, 10, 15, 20, 25)
+	loadSeries(t, st, `up{instance="a"}`, time.Minute, 1, 1, 1, model.StaleValue())
+	loadSeries(t, st, `temperature{room="x"}`, time.Minute, -1.5, 2.4, 3.5)
+	loadSeries(t, st, `requests_copy{job="api", instance="a"}`, time.Minute, none, none, 1)
+	return st
+}
+
+// TestEngine_InstantQuery 测试即时查询
+func TestEngine_InstantQuery(t *testing.T) {
+	st := newTestStorage(t)
+	engine := NewEngine()
+	reqA := labels("__name__", "http_requests_total", "instance", "a", "job", "api")
+	reqB := labels("__name__", "http_requests_total", "instance", "b", "job", "api")
+	tests := []struct {
+		name  string
+		query string
+		ts    time.Duration
+		want  Value
+	}{
+		{
+			name:  "选择器",
+			query: "http_requests_total",
+			ts:    5 * time.Minute,
+			want:  Vector{{Metric: reqA, T: ms(5 * time.Minute), V: 50}, {Metric: reqB, T: ms(5 * time.Minute), V: 25}},
+		},
+		{
+			name:  "回溯窗口内的最新样本",
+			query: `http_requests_total{instance="a"}`,
+			ts:    10 * time.Minute,
+			want:  Vector{{Metric: reqA, T: ms(10 * time.Minute), V: 50}},
+		},
+		{
+			name:  "超出回溯窗口",
+			query: `http_requests_total{instance="a"}`,
+			ts:    10*time.Minute + time.Millisecond,
+			want:  Vector(nil),
+		},
+		{
+			name:  "staleness marker 之后没有值",
+			query: "up",
+			ts:    3 * time.Minute,
+			want:  Vector(nil),
+		},
+		{
+			name:  "staleness marker 之前",
+			query: "up",
+			ts:    2*time.Minute + 30*time.Second,
+			want:  Vector{{Metric: labels("__name__", "up", "instance", "a"), T: ms(150 * time.Second), V: 1}},
+		},
+		{
+			name:  "offset",
+			query: `http_requests_total{instance="b"} offset 2m`,
+			ts:    5 * time.Minute,
+			want:  Vector{{Metric: reqB, T: ms(5 * time.Minute), V: 15}},
+		},
+		{
+			name:  "@ 固定读取时间",
+			query: `http_requests_total{instance="a"} @ 120`,
+			ts:    10 * time.Minute,
+			want:  Vector{{Metric: reqA, T: ms(10 * time.Minute), V: 20}},
+		},
+		{
+			name:  "范围向量左开右闭",
+			query: `http_requests_total{instance="a"}[2m]`,
+			ts:    5 * time.Minute,
+			want: Matrix{{Metric: reqA, Samples: model.Samples{
+				{Timestamp: ms(4 * time.Minute), Value: 40},
+				{Timestamp: ms(5 * time.Minute), Value: 50},
+			}}},
+		},
+		{
+			name:  "范围向量去掉 staleness marker",
+			query: "up[5m]",
+			ts:    4 * time.Minute,
+			want: Matrix{{Metric: labels("__name__", "up", "instance", "a"), Samples: model.Samples{
+				{Timestamp: 0, Value: 1}, {Timestamp: ms(time.Minute), Value: 1}, {Timestamp: ms(2 * time.Minute), Value: 1},
+			}}},
+		},
+		{
+			name:  "一元负号去掉指标名称",
+			query: "-temperature",
+			ts:    2 * time.Minute,
+			want:  Vector{{Metric: labels("room", "x"), T: ms(2 * time.Minute), V: -3.5}},
+		},
+		{name: "数字", query: "1.5", ts: time.Second, want: Scalar{T: 1000, V: 1.5}},
+		{name: "字符串", query: `"hello"`, ts: time.Second, want: String{T: 1000, V: "hello"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := engine.InstantQuery(context.Background(), st, tt.query, time.UnixMilli(ms(tt.ts)))
+			if err != nil {
+				t.Fatalf("查询失败: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("期望\n%v\n实际\n%v", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestEngine_Functions 测试内置函数
+func TestEngine_Functions(t *testing.T) {
+	st := newTestStorage(t)
+	engine := NewEngine()
+	reqA := labels("__name__", "http_requests_total", "instance", "a", "job", "api")
+	reqB := labels("__name__", "http_requests_total", "instance", "b", "job", "api")
+	room := labels("room", "x")
+	tests := []struct {
+		query string
+		ts    time.Duration
+		want  Value
+	}{
+		{"abs(temperature)", 0, Vector{{Metric: room, V: 1.5}}},
+		{"ceil(temperature)", time.Minute, Vector{{Metric: room, T: ms(time.Minute), V: 3}}},
+		{"floor(temperature)", 0, Vector{{Metric: room, V: -2}}},
+		{"sgn(temperature)", 0, Vector{{Metric: room, V: -1}}},
+		{"sqrt(http_requests_total{instance=\"b\"})", 4 * time.Minute, Vector{{Metric: labels("instance", "b", "job", "api"), T: ms(4 * time.Minute), V: math.Sqrt(20)}}},
+		{"round(temperature)", time.Minute, Vector{{Metric: room, T: ms(time.Minute), V: 2}}},
+		{"round(temperature, 0.5)", time.Minute, Vector{{Metric: room, T: ms(time.Minute), V: 2.5}}},
+		{"clamp(temperature, 0, 3)", 2 * time.Minute, Vector{{Metric: room, T: ms(2 * time.Minute), V: 3}}},
+		{"clamp(temperature, 3, 0)", 2 * time.Minute, Vector{}},
+		{"clamp_min(temperature, 0)", 0, Vector{{Metric: room, V: 0}}},
+		{"clamp_max(temperature, 3)", 2 * time.Minute, Vector{{Metric: room, T: ms(2 * time.Minute), V: 3}}},
+		{"time()", 90 * time.Second, Scalar{T: ms(90 * time.Second), V: 90}},
+		{"timestamp(temperature)", 150 * time.Second, Vector{{Metric: room, T: ms(150 * time.Second), V: 120}}},
+		{"timestamp((temperature offset 1m))", 150 * time.Second, Vector{{Metric: room, T: ms(150 * time.Second), V: 60}}},
+		{"timestamp(abs(temperature))", 150 * time.Second, Vector{{Metric: room, T: ms(150 * time.Second), V: 150}}},
+		{"vector(3)", 0, Vector{{Metric: model.Labels{}, V: 3}}},
+		{`scalar(http_requests_total{instance="a"})`, 5 * time.Minute, Scalar{T: ms(5 * time.Minute), V: 50}},
+		{"sort(http_requests_total)", 5 * time.Minute, Vector{{Metric: reqB, T: ms(5 * time.Minute), V: 25}, {Metric: reqA, T: ms(5 * time.Minute), V: 50}}},
+		{"sort_desc(http_requests_total)", 5 * time.Minute, Vector{{Metric: reqA, T: ms(5 * time.Minute), V: 50}, {Metric: reqB, T: ms(5 * time.Minute), V: 25}}},
+		{`absent(nonexistent{job="x", env=~"p.*"})`, 0, Vector{{Metric: labels("job", "x"), V: 1}}},
+		{"absent(up)", time.Minute, Vector{}},
+		{`avg_over_time(http_requests_total{instance="b"}[3m])`, 5 * time.Minute, Vector{{Metric: labels("instance", "b", "job", "api"), T: ms(5 * time.Minute), V: 20}}},
+		{`sum_over_time(http_requests_total{instance="b"}[3m])`, 5 * time.Minute, Vector{{Metric: labels("instance", "b", "job", "api"), T: ms(5 * time.Minute), V: 60}}},
+		{`count_over_time(http_requests_total{instance="b"}[3m])`, 5 * time.Minute, Vector{{Metric: labels("instance", "b", "job", "api"), T: ms(5 * time.Minute), V: 3}}},
+		{`min_over_time(temperature[5m])`, 2 * time.Minute, Vector{{Metric: room, T: ms(2 * time.Minute), V: -1.5}}},
+		{`max_over_time(temperature[5m])`, 2 * time.Minute, Vector{{Metric: room, T: ms(2 * time.Minute), V: 3.5}}},
+		{`last_over_time(temperature[5m])`, 2 * time.Minute, Vector{{Metric: labels("__name__", "temperature", "room", "x"), T: ms(2 * time.Minute), V: 3.5}}},
+		{`present_over_time(temperature[5m])`, 10 * time.Minute, Vector{}},
+		{`rate(http_requests_total{instance="a"}[5m])`, 5 * time.Minute, Vector{{Metric: labels("instance", "a", "job", "api"), T: ms(5 * time.Minute), V: 50.0 / 300}}},
+		{`increase(http_requests_total{instance="a"}[5m])`, 5 * time.Minute, Vector{{Metric: labels("instance", "a", "job", "api"), T: ms(5 * time.Minute), V: 50}}},
+		{`increase(http_requests_total{instance="a"}[2m] offset 1m)`, 5 * time.Minute, Vector{{Metric: labels("instance", "a", "job", "api"), T: ms(5 * time.Minute), V: 20}}},
+		{`increase(http_requests_total{instance="a"}[2m] @ 240)`, 10 * time.Minute, Vector{{Metric: labels("instance", "a", "job", "api"), T: ms(10 * time.Minute), V: 20}}},
+		{`irate(http_requests_total[5m])`, 5 * time.Minute, Vector{
+			{Metric: labels("instance", "a", "job", "api"), T: ms(5 * time.Minute), V: 10.0 / 60},
+			{Metric: labels("instance", "b", "job", "api"), T: ms(5 * time.Minute), V: 5.0 / 60},
+		}},
+		{`idelta(temperature[5m])`, 2 * time.Minute, Vector{{Metric: room, T: ms(2 * time.Minute), V: 3.5 - 2.4}}},
+		{`rate(requests_copy[5m])`, 5 * time.Minute, Vector{}},
+		{`resets(temperature[5m])`, 2 * time.Minute, Vector{{Metric: room, T: ms(2 * time.Minute), V: 0}}},
+		{`changes(up[5m])`, 2 * time.Minute, Vector{{Metric: labels("instance", "a"), T: ms(2 * time.Minute), V: 0}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := engine.InstantQuery(context.Background(), st, tt.query, time.UnixMilli(ms(tt.ts)))
+			if err != nil {
+				t.Fatalf("查询失败: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("期望\n%v\n实际\n%v", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestEngine_RangeQuery 测试范围查询
+func TestEngine_RangeQuery(t *testing.T) {
+	st := newTestStorage(t)
+	engine := NewEngine()
+	tests := []struct {
+		name       string
+		query      string
+		start, end time.Duration
+		step       time.Duration
+		want       Matrix
+	}{
+		{
+			name:  "回溯窗口填补抓取间隔",
+			query: `http_requests_total{instance="a"}`,
+			start: 0, end: 10 * time.Minute, step: 2 * time.Minute,
+			want: Matrix{{Metric: labels("__name__", "http_requests_total", "instance", "a", "job", "api"), Samples: model.Samples{
+				{Timestamp: 0, Value: 0}, {Timestamp: ms(2 * time.Minute), Value: 20}, {Timestamp: ms(4 * time.Minute), Value: 40},
+				{Timestamp: ms(6 * time.Minute), Value: 50}, {Timestamp: ms(8 * time.Minute), Value: 50}, {Timestamp: ms(10 * time.Minute), Value: 50},
+			}}},
+		},
+		{
+			name:  "staleness marker 之后没有点",
+			query: "up",
+			start: 0, end: 4 * time.Minute, step: time.Minute,
+			want: Matrix{{Metric: labels("__name__", "up", "instance", "a"), Samples: model.Samples{
+				{Timestamp: 0, Value: 1}, {Timestamp: ms(time.Minute), Value: 1}, {Timestamp: ms(2 * time.Minute), Value: 1},
+			}}},
+		},
+		{
+			name:  "标量结果是没有标签的序列",
+			query: "time()",
+			start: 0, end: 2 * time.Minute, step: time.Minute,
+			want: Matrix{{Metric: model.Labels{}, Samples: model.Samples{
+				{Timestamp: 0, Value: 0}, {Timestamp: ms(time.Minute), Value: 60}, {Timestamp: ms(2 * time.Minute), Value: 120},
+			}}},
+		},
+		{
+			name:  "聚合",
+			query: "sum by (job) (http_requests_total)",
+			start: 0, end: 2 * time.Minute, step: time.Minute,
+			want: Matrix{{Metric: labels("job", "api"), Samples: model.Samples{
+				{Timestamp: 0, Value: 0}, {Timestamp: ms(time.Minute), Value: 15}, {Timestamp: ms(2 * time.Minute), Value: 30},
+			}}},
+		},
+		{
+			name:  "@ end() 每一步取同一个时刻",
+			query: `http_requests_total{instance="b"} @ end()`,
+			start: time.Minute, end: 3 * time.Minute, step: time.Minute,
+			want: Matrix{{Metric: labels("__name__", "http_requests_total", "instance", "b", "job", "api"), Samples: model.Samples{
+				{Timestamp: ms(time.Minute), Value: 15}, {Timestamp: ms(2 * time.Minute), Value: 15}, {Timestamp: ms(3 * time.Minute), Value: 15},
+			}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := engine.RangeQuery(context.Background(), st, tt.query,
+				time.UnixMilli(ms(tt.start)), time.UnixMilli(ms(tt.end)), tt.step)
+			if err != nil {
+				t.Fatalf("查询失败: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("期望\n%v\n实际\n%v", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestEngine_LookbackDelta 测试使用存储配置的回溯窗口
+func TestEngine_LookbackDelta(t *testing.T) {
+	engine := NewEngine()
+	for _, tt := range []struct {
+		name string
+		opts []storage.Option
+		ts   time.Duration
+		want int
+	}{
+		{name: "默认回溯窗口", ts: 6*time.Minute + time.Millisecond, want: 1},
+		{name: "回溯窗口 1m 内", opts: []storage.Option{storage.WithLookbackDelta(time.Minute)}, ts: 6 * time.Minute, want: 1},
+		{name: "回溯窗口 1m 外", opts: []storage.Option{storage.WithLookbackDelta(time.Minute)}, ts: 6*time.Minute + time.Millisecond, want: 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			st := storage.NewMemoryStorage(tt.opts...)
+			// 最后一个样本在 5m
+			loadSeries(t, st, `http_requests_total{instance="a"}`, time.Minute, 0, 10, 20, 30, 40, 50)
+			m := &model.Metric{Name: "http_requests_total", Labels: model.Labels{{Name: "instance", Value: "a"}}}
+			series, err := st.Query(m, ms(tt.ts))
+			if err != nil {
+				t.Fatalf("存储查询失败: %v", err)
+			}
+			v, err := engine.InstantQuery(context.Background(), st, `http_requests_total{instance="a"}`, time.UnixMilli(ms(tt.ts)))
+			if err != nil {
+				t.Fatalf("查询失败: %v", err)
+			}
+			if n := len(v.(Vector)); n != tt.want || len(series.Samples) != tt.want {
+				t.Errorf("期望引擎和存储都返回 %d 个样本，实际 %d 个和 %d 个", tt.want, n, len(series.Samples))
+			}
+		})
+	}
+}
+
+// 每次 Select 都很慢的存储, 用于测试查询超时
+type slowStorage struct {
+	storage.Storage
+	delay time.Duration
+}
+
+func (s *slowStorage) Select(matchers []*model.LabelMatcher, mint, maxt int64) (storage.SeriesSet, error) {
+	time.Sleep(s.delay)
+	return s.Storage.Select(matchers, mint, maxt)
+}
+
+// 调用 expire 之后 Err 返回 DeadlineExceeded 的 context, 用于在求值中途让查询超时
+type expiringContext struct {
+	context.Context
+	expired atomic.Bool
+}
+
+func (c *expiringContext) Err() error {
+	if c.expired.Load() {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// TestEngine_DeadlineDuringEval 测试从存储取完数据后, 求值过程中超时也能中断查询
+func TestEngine_DeadlineDuringEval(t *testing.T) {
+	st := newTestStorage(t)
+	ts := ms(5 * time.Minute)
+	for _, query := range []string{
+		"http_requests_total",
+		"rate(http_requests_total[5m])",
+		"timestamp(http_requests_total)",
+		"sum by (job) (http_requests_total)",
+		"topk(1, http_requests_total)",
+		`count_values("value", http_requests_total)`,
+	} {
+		t.Run(query, func(t *testing.T) {
+			expr, err := ParseExpr(query)
+			if err != nil {
+				t.Fatalf("解析失败: %v", err)
+			}
+			ctx := &expiringContext{Context: context.Background()}
+			ev, err := NewEngine().newEvaluator(ctx, st, expr, ts, ts, 0)
+			if err != nil {
+				t.Fatalf("加载数据失败: %v", err)
+			}
+			ctx.expired.Store(true)
+			if _, err := ev.eval(expr, ts); !errors.Is(err, ErrQueryTimeout) {
+				t.Errorf("期望 ErrQueryTimeout，实际 %v", err)
+			}
+		})
+	}
+}
+
+// TestEngine_Errors 测试查询错误
+func TestEngine_Errors(t *testing.T) {
+	st := newTestStorage(t)
+	engine := NewEngine()
+	ctx := context.Background()
+	start, end := time.UnixMilli(0), time.UnixMilli(ms(5*time.Minute))
+
+	t.Run("非法的步长", func(t *testing.T) {
+		if _, err := engine.RangeQuery(ctx, st, "up", start, end, 0); !errors.Is(err, ErrInvalidStep) {
+			t.Errorf("期望 ErrInvalidStep，实际 %v", err)
+		}
+	})
+
+	t.Run("结束时间早于开始时间", func(t *testing.T) {
+		if _, err := engine.RangeQuery(ctx, st, "up", end, start, time.Minute); !errors.Is(err, ErrTimeRange) {
+			t.Errorf("期望 ErrTimeRange，实际 %v", err)
+		}
+	})
+
+	t.Run("范围查询不能返回范围向量", func(t *testing.T) {
+		_, err := engine.RangeQuery(ctx, st, "up[5m]", start, end, time.Minute)
+		if err == nil || !strings.Contains(err.Error(), `invalid expression type "range vector"`) {
+			t.Errorf("期望类型错误，实际 %v", err)
+		}
+	})
+
+	t.Run("语法错误", func(t *testing.T) {
+		var perr *ParseError
+		if _, err := engine.InstantQuery(ctx, st, "up{", end); !errors.As(err, &perr) {
+			t.Errorf("期望 *ParseError，实际 %v", err)
+		}
+	})
+
+	t.Run("相同的标签集合", func(t *testing.T) {
+		_, err := engine.RangeQuery(ctx, st, `-{instance="a", job="api"}`, start, end, time.Minute)
+		if !errors.Is(err, ErrDuplicateLabelSet) {
+			t.Errorf("期望 ErrDuplicateLabelSet，实际 %v", err)
+		}
+	})
+
+	t.Run("取消查询", func(t *testing.T) {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		if _, err := engine.InstantQuery(canceled, st, "up", end); !errors.Is(err, ErrQueryCanceled) || !errors.Is(err, context.Canceled) {
+			t.Errorf("期望 ErrQueryCanceled，实际 %v", err)
+		}
+		if _, err := engine.RangeQuery(canceled, st, "up", start, end, time.Minute); !errors.Is(err, ErrQueryCanceled) {
+			t.Errorf("期望 ErrQueryCanceled，实际 %v", err)
+		}
+	})
+
+	t.Run("查询超时", func(t *testing.T) {
+		slow := &slowStorage{Storage: st, delay: 20 * time.Millisecond}
+		engine := NewEngine(WithTimeout(5 * time.Millisecond))
+		if _, err := engine.InstantQuery(ctx, slow, "up", end); !errors.Is(err, ErrQueryTimeout) {
+			t.Errorf("期望 ErrQueryTimeout，实际 %v", err)
+		}
+		if _, err := engine.RangeQuery(ctx, slow, "up + up", start, end, time.Minute); !errors.Is(err, ErrQueryTimeout) {
+			t.Errorf("期望 ErrQueryTimeout，实际 %v", err)
+		}
+	})
+}
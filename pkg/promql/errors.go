@@ -0,0 +1,13 @@
+package promql
+
+import "errors"
+
+var (
+	ErrQueryTimeout  = errors.New("query timed out")
+	ErrQueryCanceled = errors.New("query was canceled")
+	ErrInvalidStep   = errors.New("zero or negative query resolution step widths are not accepted")
+	ErrTimeRange     = errors.New("invalid time range: end timestamp must not be before start time")
+
+	ErrDuplicateLabelSet  = errors.New("vector cannot contain metrics with the same labelset")
+	ErrManyToManyMatching = errors.New("many-to-many matching not allowed: matching labels must be unique on one side")
+)
@@ -0,0 +1,561 @@
+package promql
+
+import (
+	"math"
+	"mini-promethues/pkg/model"
+	"slices"
+	"sort"
+)
+
+// 函数签名, 解析时用来检查参数个数和类型
+type Function struct {
+	Name     string
+	ArgTypes []ValueType
+	// 末尾可以省略的参数个数, 例如 round(v, to_nearest) 的 to_nearest
+	Variadic   int
+	ReturnType ValueType
+	call       funcCall
+}
+
+// 函数的实现, args 是已经求值的参数, 省略的可选参数不出现在 args 中; ts 是求值时刻
+type funcCall func(args []Value, e *Call, ts int64) Value
+
+var Functions = map[string]*Function{
+	"abs": {
+		Name:       "abs",
+		ArgTypes:   []ValueType{ValueTypeVector},
+		ReturnType: ValueTypeVector,
+		call:       mathFunc(math.Abs),
+	},
+	"ceil": {
+		Name:       "ceil",
+		ArgTypes:   []ValueType{ValueTypeVector},
+		ReturnType: ValueTypeVector,
+		call:       mathFunc(math.Ceil),
+	},
+	"floor": {
+		Name:       "floor",
+		ArgTypes:   []ValueType{ValueTypeVector},
+		ReturnType: ValueTypeVector,
+		call:       mathFunc(math.Floor),
+	},
+	"exp": {
+		Name:       "exp",
+		ArgTypes:   []ValueType{ValueTypeVector},
+		ReturnType: ValueTypeVector,
+		call:       mathFunc(math.Exp),
+	},
+	"ln": {
+		Name:       "ln",
+		ArgTypes:   []ValueType{ValueTypeVector},
+		ReturnType: ValueTypeVector,
+		call:       mathFunc(math.Log),
+	},
+	"log2": {
+		Name:       "log2",
+		ArgTypes:   []ValueType{ValueTypeVector},
+		ReturnType: ValueTypeVector,
+		call:       mathFunc(math.Log2),
+	},
+	"log10": {
+		Name:       "log10",
+		ArgTypes:   []ValueType{ValueTypeVector},
+		ReturnType: ValueTypeVector,
+		call:       mathFunc(math.Log10),
+	},
+	"sqrt": {
+		Name:       "sqrt",
+		ArgTypes:   []ValueType{ValueTypeVector},
+		ReturnType: ValueTypeVector,
+		call:       mathFunc(math.Sqrt),
+	},
+	"sgn": {
+		Name:       "sgn",
+		ArgTypes:   []ValueType{ValueTypeVector},
+		ReturnType: ValueTypeVector,
+		call:       mathFunc(sgn),
+	},
+	"round": {
+		Name:       "round",
+		ArgTypes:   []ValueType{ValueTypeVector, ValueTypeScalar},
+		Variadic:   1,
+		ReturnType: ValueTypeVector,
+		call:       funcRound,
+	},
+	"clamp": {
+		Name:       "clamp",
+		ArgTypes:   []ValueType{ValueTypeVector, ValueTypeScalar, ValueTypeScalar},
+		ReturnType: ValueTypeVector,
+		call:       funcClamp,
+	},
+	"clamp_min": {
+		Name:       "clamp_min",
+		ArgTypes:   []ValueType{ValueTypeVector, ValueTypeScalar},
+		ReturnType: ValueTypeVector,
+		call:       funcClampMin,
+	},
+	"clamp_max": {
+		Name:       "clamp_max",
+		ArgTypes:   []ValueType{ValueTypeVector, ValueTypeScalar},
+		ReturnType: ValueTypeVector,
+		call:       funcClampMax,
+	},
+	"time": {
+		Name:       "time",
+		ReturnType: ValueTypeScalar,
+		call:       funcTime,
+	},
+	"timestamp": {
+		Name:       "timestamp",
+		ArgTypes:   []ValueType{ValueTypeVector},
+		ReturnType: ValueTypeVector,
+		call:       funcTimestamp,
+	},
+	"vector": {
+		Name:       "vector",
+		ArgTypes:   []ValueType{ValueTypeScalar},
+		ReturnType: ValueTypeVector,
+		call:       funcVector,
+	},
+	"scalar": {
+		Name:       "scalar",
+		ArgTypes:   []ValueType{ValueTypeVector},
+		ReturnType: ValueTypeScalar,
+		call:       funcScalar,
+	},
+	"sort": {
+		Name:       "sort",
+		ArgTypes:   []ValueType{ValueTypeVector},
+		ReturnType: ValueTypeVector,
+		call:       funcSort,
+	},
+	"sort_desc": {
+		Name:       "sort_desc",
+		ArgTypes:   []ValueType{ValueTypeVector},
+		ReturnType: ValueTypeVector,
+		call:       funcSortDesc,
+	},
+	"absent": {
+		Name:       "absent",
+		ArgTypes:   []ValueType{ValueTypeVector},
+		ReturnType: ValueTypeVector,
+		call:       funcAbsent,
+	},
+	"rate": {
+		Name:       "rate",
+		ArgTypes:   []ValueType{ValueTypeMatrix},
+		ReturnType: ValueTypeVector,
+		call:       extrapolatedRate(true, true),
+	},
+	"increase": {
+		Name:       "increase",
+		ArgTypes:   []ValueType{ValueTypeMatrix},
+		ReturnType: ValueTypeVector,
+		call:       extrapolatedRate(true, false),
+	},
+	"delta": {
+		Name:       "delta",
+		ArgTypes:   []ValueType{ValueTypeMatrix},
+		ReturnType: ValueTypeVector,
+		call:       extrapolatedRate(false, false),
+	},
+	"irate": {
+		Name:       "irate",
+		ArgTypes:   []ValueType{ValueTypeMatrix},
+		ReturnType: ValueTypeVector,
+		call:       instantValue(true),
+	},
+	"idelta": {
+		Name:       "idelta",
+		ArgTypes:   []ValueType{ValueTypeMatrix},
+		ReturnType: ValueTypeVector,
+		call:       instantValue(false),
+	},
+	"resets": {
+		Name:       "resets",
+		ArgTypes:   []ValueType{ValueTypeMatrix},
+		ReturnType: ValueTypeVector,
+		call:       overTimeFunc(countResets),
+	},
+	"changes": {
+		Name:       "changes",
+		ArgTypes:   []ValueType{ValueTypeMatrix},
+		ReturnType: ValueTypeVector,
+		call:       overTimeFunc(countChanges),
+	},
+	"avg_over_time": {
+		Name:       "avg_over_time",
+		ArgTypes:   []ValueType{ValueTypeMatrix},
+		ReturnType: ValueTypeVector,
+		call:       overTimeFunc(avgOverTime),
+	},
+	"min_over_time": {
+		Name:       "min_over_time",
+		ArgTypes:   []ValueType{ValueTypeMatrix},
+		ReturnType: ValueTypeVector,
+		call:       overTimeFunc(minOverTime),
+	},
+	"max_over_time": {
+		Name:       "max_over_time",
+		ArgTypes:   []ValueType{ValueTypeMatrix},
+		ReturnType: ValueTypeVector,
+		call:       overTimeFunc(maxOverTime),
+	},
+	"sum_over_time": {
+		Name:       "sum_over_time",
+		ArgTypes:   []ValueType{ValueTypeMatrix},
+		ReturnType: ValueTypeVector,
+		call:       overTimeFunc(sumOverTime),
+	},
+	"count_over_time": {
+		Name:       "count_over_time",
+		ArgTypes:   []ValueType{ValueTypeMatrix},
+		ReturnType: ValueTypeVector,
+		call:       overTimeFunc(countOverTime),
+	},
+	"last_over_time": {
+		Name:       "last_over_time",
+		ArgTypes:   []ValueType{ValueTypeMatrix},
+		ReturnType: ValueTypeVector,
+		call:       funcLastOverTime,
+	},
+	"present_over_time": {
+		Name:       "present_over_time",
+		ArgTypes:   []ValueType{ValueTypeMatrix},
+		ReturnType: ValueTypeVector,
+		call:       overTimeFunc(presentOverTime),
+	},
+}
+
+// 对每个样本的值做数学运算, 结果不再是原来的指标, 去掉 __name__
+func mathFunc(f func(float64) float64) funcCall {
+	return func(args []Value, e *Call, ts int64) Value {
+		vec := args[0].(Vector)
+		result := make(Vector, 0, len(vec))
+		for _, s := range vec {
+			result = append(result, Sample{Metric: dropMetricName(s.Metric), T: ts, V: f(s.V)})
+		}
+		return result
+	}
+}
+
+func sgn(v float64) float64 {
+	switch {
+	case v < 0:
+		return -1
+	case v > 0:
+		return 1
+	}
+	return v
+}
+
+// round(v, to_nearest=1): 四舍五入到 to_nearest 的整数倍, 正好一半时向上
+func funcRound(args []Value, e *Call, ts int64) Value {
+	toNearest := 1.0
+	if len(args) > 1 {
+		toNearest = args[1].(Scalar).V
+	}
+	// 除以 to_nearest 会有精度问题, 例如 0.3 / 0.1, 先取倒数再乘
+	inverse := 1 / toNearest
+	return mathFunc(func(v float64) float64 {
+		return math.Floor(v*inverse+0.5) / inverse
+	})(args[:1], e, ts)
+}
+
+// 下限大于上限时返回空向量
+func funcClamp(args []Value, e *Call, ts int64) Value {
+	lo, hi := args[1].(Scalar).V, args[2].(Scalar).V
+	if lo > hi {
+		return Vector{}
+	}
+	return mathFunc(func(v float64) float64 {
+		return math.Max(lo, math.Min(hi, v))
+	})(args[:1], e, ts)
+}
+
+func funcClampMin(args []Value, e *Call, ts int64) Value {
+	lo := args[1].(Scalar).V
+	return mathFunc(func(v float64) float64 { return math.Max(lo, v) })(args[:1], e, ts)
+}
+
+func funcClampMax(args []Value, e *Call, ts int64) Value {
+	hi := args[1].(Scalar).V
+	return mathFunc(func(v float64) float64 { return math.Min(hi, v) })(args[:1], e, ts)
+}
+
+// 求值时刻的 Unix 时间戳 (秒)
+func funcTime(args []Value, e *Call, ts int64) Value {
+	return Scalar{T: ts, V: float64(ts) / 1000}
+}
+
+/*
+每个样本的时间戳 (秒), 去掉 __name__
+参数是选择器时求值器保留样本实际的时间戳, 其余表达式的样本时间戳就是求值时刻
+*/
+func funcTimestamp(args []Value, e *Call, ts int64) Value {
+	vec := args[0].(Vector)
+	result := make(Vector, 0, len(vec))
+	for _, s := range vec {
+		result = append(result, Sample{Metric: dropMetricName(s.Metric), T: ts, V: float64(s.T) / 1000})
+	}
+	return result
+}
+
+func funcVector(args []Value, e *Call, ts int64) Value {
+	return Vector{{Metric: model.Labels{}, T: ts, V: args[0].(Scalar).V}}
+}
+
+// 向量只有一个元素时返回它的值, 否则返回 NaN
+func funcScalar(args []Value, e *Call, ts int64) Value {
+	vec := args[0].(Vector)
+	if len(vec) != 1 {
+		return Scalar{T: ts, V: math.NaN()}
+	}
+	return Scalar{T: ts, V: vec[0].V}
+}
+
+// 按值升序排列, NaN 排在最后
+func funcSort(args []Value, e *Call, ts int64) Value {
+	return sortVector(args[0].(Vector), func(a, b float64) bool { return a < b })
+}
+
+func funcSortDesc(args []Value, e *Call, ts int64) Value {
+	return sortVector(args[0].(Vector), func(a, b float64) bool { return a > b })
+}
+
+func sortVector(vec Vector, less func(a, b float64) bool) Vector {
+	result := make(Vector, len(vec))
+	copy(result, vec)
+	sort.SliceStable(result, func(i, j int) bool {
+		a, b := result[i].V, result[j].V
+		if math.IsNaN(a) || math.IsNaN(b) {
+			return !math.IsNaN(a)
+		}
+		return less(a, b)
+	})
+	return result
+}
+
+/*
+向量为空时返回值为 1 的一个元素, 否则返回空向量, 用于对序列不存在告警
+参数是选择器时, 结果带上选择器中的等值匹配条件, 例如 absent(up{job="api"}) 返回 {job="api"} 1
+*/
+func funcAbsent(args []Value, e *Call, ts int64) Value {
+	if len(args[0].(Vector)) > 0 {
+		return Vector{}
+	}
+	metric := model.Labels{}
+	if vs, ok := e.Args[0].(*VectorSelector); ok {
+		seen := make(map[string]bool)
+		for _, m := range vs.LabelMatchers {
+			if m.Type != model.MatchEqual || m.Name == model.MetricNameLabel {
+				continue
+			}
+			// 同一个标签有多个等值条件时无法确定取哪个值
+			if seen[m.Name] {
+				metric = slices.DeleteFunc(metric, func(l model.Label) bool { return l.Name == m.Name })
+				continue
+			}
+			seen[m.Name] = true
+			metric = append(metric, model.Label{Name: m.Name, Value: m.Value})
+		}
+		sort.Sort(metric)
+	}
+	return Vector{{Metric: metric, T: ts, V: 1}}
+}
+
+// 对范围向量中的每条序列计算一个值, 去掉 __name__
+func overTimeFunc(f func(model.Samples) float64) funcCall {
+	return func(args []Value, e *Call, ts int64) Value {
+		matrix := args[0].(Matrix)
+		result := make(Vector, 0, len(matrix))
+		for _, s := range matrix {
+			result = append(result, Sample{Metric: dropMetricName(s.Metric), T: ts, V: f(s.Samples)})
+		}
+		return result
+	}
+}
+
+func avgOverTime(samples model.Samples) float64 {
+	return sumOverTime(samples) / float64(len(samples))
+}
+
+func minOverTime(samples model.Samples) float64 {
+	result := samples[0].Value
+	for _, s := range samples[1:] {
+		if s.Value < result || math.IsNaN(result) {
+			result = s.Value
+		}
+	}
+	return result
+}
+
+func maxOverTime(samples model.Samples) float64 {
+	result := samples[0].Value
+	for _, s := range samples[1:] {
+		if s.Value > result || math.IsNaN(result) {
+			result = s.Value
+		}
+	}
+	return result
+}
+
+func sumOverTime(samples model.Samples) float64 {
+	var sum float64
+	for _, s := range samples {
+		sum += s.Value
+	}
+	return sum
+}
+
+func countOverTime(samples model.Samples) float64 {
+	return float64(len(samples))
+}
+
+func presentOverTime(samples model.Samples) float64 {
+	return 1
+}
+
+// 最后一个样本的值, 仍然是原来的指标, 保留 __name__
+func funcLastOverTime(args []Value, e *Call, ts int64) Value {
+	matrix := args[0].(Matrix)
+	result := make(Vector, 0, len(matrix))
+	for _, s := range matrix {
+		result = append(result, Sample{Metric: s.Metric, T: ts, V: s.Samples[len(s.Samples)-1].Value})
+	}
+	return result
+}
+
+// 函数的范围向量参数, 允许外面套括号
+func matrixSelectorArg(e Expr) *MatrixSelector {
+	for {
+		p, ok := e.(*ParenExpr)
+		if !ok {
+			return e.(*MatrixSelector)
+		}
+		e = p.Expr
+	}
+}
+
+/*
+rate、increase 和 delta, 与 Prometheus 的计算方式一致:
+范围内第一个和最后一个样本的差值, 计数器 (isCounter) 要加上每次重置前的值
+样本很少正好落在范围的边界上, 差值还要按比例外推到整个范围, 否则结果总是偏小, 见 extrapolatedDelta
+rate 再除以范围的秒数; 少于两个样本的序列不出现在结果中
+*/
+func extrapolatedRate(isCounter, isRate bool) funcCall {
+	return func(args []Value, e *Call, ts int64) Value {
+		ms := matrixSelectorArg(e.Args[0])
+		rangeEnd := refTime(ms.VectorSelector.(*VectorSelector), ts)
+		rangeStart := rangeEnd - ms.Range.Milliseconds()
+		matrix := args[0].(Matrix)
+		result := make(Vector, 0, len(matrix))
+		for _, s := range matrix {
+			v, ok := extrapolatedDelta(s.Samples, rangeStart, rangeEnd, isCounter)
+			if !ok {
+				continue
+			}
+			if isRate {
+				v /= ms.Range.Seconds()
+			}
+			result = append(result, Sample{Metric: dropMetricName(s.Metric), T: ts, V: v})
+		}
+		return result
+	}
+}
+
+/*
+范围 (rangeStart, rangeEnd] 内外推后的差值
+第一个/最后一个样本到边界的距离小于平均采样间隔的 1.1 倍时, 认为序列覆盖了这段边界, 外推到边界;
+否则认为序列在范围内开始或结束, 只外推半个平均间隔
+计数器不会小于 0, 向前外推不能超过按斜率推算出的计数器为 0 的时刻
+*/
+func extrapolatedDelta(samples model.Samples, rangeStart, rangeEnd int64, isCounter bool) (float64, bool) {
+	if len(samples) < 2 {
+		return 0, false
+	}
+	first, last := samples[0], samples[len(samples)-1]
+	delta := last.Value - first.Value
+	if isCounter {
+		prev := first.Value
+		for _, s := range samples[1:] {
+			if s.Value < prev {
+				delta += prev
+			}
+			prev = s.Value
+		}
+	}
+
+	sampledInterval := float64(last.Timestamp-first.Timestamp) / 1000
+	averageInterval := sampledInterval / float64(len(samples)-1)
+	threshold := averageInterval * 1.1
+	durationToStart := float64(first.Timestamp-rangeStart) / 1000
+	durationToEnd := float64(rangeEnd-last.Timestamp) / 1000
+
+	if durationToStart >= threshold {
+		durationToStart = averageInterval / 2
+	}
+	if isCounter && delta > 0 && first.Value >= 0 {
+		if durationToZero := sampledInterval * (first.Value / delta); durationToZero < durationToStart {
+			durationToStart = durationToZero
+		}
+	}
+	if durationToEnd >= threshold {
+		durationToEnd = averageInterval / 2
+	}
+	return delta * (sampledInterval + durationToStart + durationToEnd) / sampledInterval, true
+}
+
+// irate 和 idelta: 只看最后两个样本, 少于两个样本的序列不出现在结果中
+func instantValue(isRate bool) funcCall {
+	return func(args []Value, e *Call, ts int64) Value {
+		matrix := args[0].(Matrix)
+		result := make(Vector, 0, len(matrix))
+		for _, s := range matrix {
+			if v, ok := instantDelta(s.Samples, isRate); ok {
+				result = append(result, Sample{Metric: dropMetricName(s.Metric), T: ts, V: v})
+			}
+		}
+		return result
+	}
+}
+
+// 最后两个样本的差值, isRate 时按计数器处理重置并换算成每秒的变化
+func instantDelta(samples model.Samples, isRate bool) (float64, bool) {
+	if len(samples) < 2 {
+		return 0, false
+	}
+	prev, last := samples[len(samples)-2], samples[len(samples)-1]
+	if !isRate {
+		return last.Value - prev.Value, true
+	}
+	delta := last.Value - prev.Value
+	if last.Value < prev.Value {
+		// 计数器重置, 重置后从 0 开始
+		delta = last.Value
+	}
+	return delta / (float64(last.Timestamp-prev.Timestamp) / 1000), true
+}
+
+// 计数器重置的次数, 即值比前一个样本小的次数
+func countResets(samples model.Samples) float64 {
+	var resets int
+	for i := 1; i < len(samples); i++ {
+		if samples[i].Value < samples[i-1].Value {
+			resets++
+		}
+	}
+	return float64(resets)
+}
+
+// 值发生变化的次数, 连续的 NaN 不算变化
+func countChanges(samples model.Samples) float64 {
+	var changes int
+	for i := 1; i < len(samples); i++ {
+		prev, cur := samples[i-1].Value, samples[i].Value
+		if cur != prev && !(math.IsNaN(cur) && math.IsNaN(prev)) {
+			changes++
+		}
+	}
+	return float64(changes)
+}
@@ -0,0 +1,157 @@
+package promql
+
+import (
+	"math"
+	"mini-promethues/pkg/model"
+	"testing"
+)
+
+// 按 时间戳(秒), 值, 时间戳(秒), 值 ... 构造样本
+func samples(pairs ...float64) model.Samples {
+	var result model.Samples
+	for i := 0; i+1 < len(pairs); i += 2 {
+		result = append(result, model.Sample{Timestamp: int64(pairs[i] * 1000), Value: pairs[i+1]})
+	}
+	return result
+}
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+// TestExtrapolatedDelta 测试 rate / increase / delta 的外推
+func TestExtrapolatedDelta(t *testing.T) {
+	tests := []struct {
+		name      string
+		samples   model.Samples
+		isCounter bool
+		want      float64
+		wantOK    bool
+	}{
+		{
+			// 差值 30, 第一个样本距离起点 15s 小于阈值 16.5s, 外推到整个 60s: 30 * 60 / 45
+			name:      "覆盖整个范围",
+			samples:   samples(15, 10, 30, 20, 45, 30, 60, 40),
+			isCounter: true,
+			want:      40,
+			wantOK:    true,
+		},
+		{
+			// 差值 5 加上重置前的 20, 再外推: 25 * 60 / 45
+			name:      "计数器重置",
+			samples:   samples(15, 10, 30, 20, 45, 5, 60, 15),
+			isCounter: true,
+			want:      25 * 60.0 / 45,
+			wantOK:    true,
+		},
+		{
+			// 非计数器不处理重置: 5 * 60 / 45
+			name:      "delta 不处理重置",
+			samples:   samples(15, 10, 30, 20, 45, 5, 60, 15),
+			isCounter: false,
+			want:      5 * 60.0 / 45,
+			wantOK:    true,
+		},
+		{
+			// 第一个样本距离起点 30s 超过阈值, 只向前外推半个间隔 7.5s: 20 * 37.5 / 30
+			name:      "序列在范围内开始",
+			samples:   samples(30, 100, 45, 110, 60, 120),
+			isCounter: true,
+			want:      25,
+			wantOK:    true,
+		},
+		{
+			// 按斜率 1 / 1.5s 推算, 计数器在第一个样本前 1.5s 为 0, 只外推 1.5s: 20 * 31.5 / 30
+			name:      "计数器不外推到负数",
+			samples:   samples(30, 1, 45, 11, 60, 21),
+			isCounter: true,
+			want:      21,
+			wantOK:    true,
+		},
+		{
+			// 同样的样本作为 gauge 外推 7.5s: 20 * 37.5 / 30
+			name:      "gauge 可以外推到负数",
+			samples:   samples(30, 1, 45, 11, 60, 21),
+			isCounter: false,
+			want:      25,
+			wantOK:    true,
+		},
+		{
+			// 最后一个样本距离终点 30s, 只向后外推 7.5s: 20 * 37.5 / 30
+			name:      "序列在范围内结束",
+			samples:   samples(0, 100, 15, 110, 30, 120),
+			isCounter: false,
+			want:      25,
+			wantOK:    true,
+		},
+		{
+			name:      "只有一个样本",
+			samples:   samples(30, 1),
+			isCounter: true,
+			wantOK:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := extrapolatedDelta(tt.samples, 0, 60000, tt.isCounter)
+			if ok != tt.wantOK {
+				t.Fatalf("期望 ok=%v，实际 %v", tt.wantOK, ok)
+			}
+			if ok && !almostEqual(got, tt.want) {
+				t.Errorf("期望 %v，实际 %v", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestInstantDelta 测试 irate / idelta
+func TestInstantDelta(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples model.Samples
+		isRate  bool
+		want    float64
+		wantOK  bool
+	}{
+		{name: "irate", samples: samples(0, 5, 10, 10, 20, 30), isRate: true, want: 2, wantOK: true},
+		{name: "irate 计数器重置", samples: samples(0, 10, 15, 20, 30, 5), isRate: true, want: 5.0 / 15, wantOK: true},
+		{name: "idelta", samples: samples(0, 10, 15, 20, 30, 5), isRate: false, want: -15, wantOK: true},
+		{name: "只有一个样本", samples: samples(0, 10), isRate: true, wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := instantDelta(tt.samples, tt.isRate)
+			if ok != tt.wantOK {
+				t.Fatalf("期望 ok=%v，实际 %v", tt.wantOK, ok)
+			}
+			if ok && !almostEqual(got, tt.want) {
+				t.Errorf("期望 %v，实际 %v", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestCountResetsAndChanges 测试 resets / changes
+func TestCountResetsAndChanges(t *testing.T) {
+	tests := []struct {
+		name        string
+		samples     model.Samples
+		wantResets  float64
+		wantChanges float64
+	}{
+		{name: "单个样本", samples: samples(0, 1), wantResets: 0, wantChanges: 0},
+		{name: "单调递增", samples: samples(0, 1, 15, 2, 30, 2, 45, 3), wantResets: 0, wantChanges: 2},
+		{name: "两次重置", samples: samples(0, 10, 15, 2, 30, 8, 45, 1, 60, 1), wantResets: 2, wantChanges: 3},
+		{name: "连续 NaN 不算变化", samples: samples(0, 1, 15, math.NaN(), 30, math.NaN(), 45, 1), wantResets: 0, wantChanges: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := countResets(tt.samples); got != tt.wantResets {
+				t.Errorf("resets 期望 %v，实际 %v", tt.wantResets, got)
+			}
+			if got := countChanges(tt.samples); got != tt.wantChanges {
+				t.Errorf("changes 期望 %v，实际 %v", tt.wantChanges, got)
+			}
+		})
+	}
+}
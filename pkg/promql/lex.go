@@ -0,0 +1,477 @@
+package promql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type ItemType int
+
+const (
+	EOF ItemType = iota
+	ERROR
+	IDENTIFIER
+	// 包含 ':' 的标识符, 只能作为指标名称 (recording rule 的命名习惯)
+	METRIC_IDENTIFIER
+	NUMBER
+	STRING
+	DURATION
+
+	LEFT_PAREN
+	RIGHT_PAREN
+	LEFT_BRACE
+	RIGHT_BRACE
+	LEFT_BRACKET
+	RIGHT_BRACKET
+	COMMA
+	AT
+	// 标签匹配器中的 =, 与比较运算符 == 区分
+	EQL
+
+	operatorsStart
+	ADD
+	SUB
+	MUL
+	DIV
+	MOD
+	POW
+	EQLC
+	NEQ
+	LTE
+	LSS
+	GTE
+	GTR
+	EQL_REGEX
+	NEQ_REGEX
+	LAND
+	LOR
+	LUNLESS
+	operatorsEnd
+
+	keywordsStart
+	BY
+	WITHOUT
+	ON
+	IGNORING
+	GROUP_LEFT
+	GROUP_RIGHT
+	BOOL
+	OFFSET
+	keywordsEnd
+
+	// @ start() 和 @ end(), 只出现在 AST 中, 词法上是普通标识符
+	START
+	END
+)
+
+var itemTypeStr = map[ItemType]string{
+	EOF:               "end of input",
+	ERROR:             "error",
+	IDENTIFIER:        "identifier",
+	METRIC_IDENTIFIER: "metric identifier",
+	NUMBER:            "number",
+	STRING:            "string",
+	DURATION:          "duration",
+
+	LEFT_PAREN:    "(",
+	RIGHT_PAREN:   ")",
+	LEFT_BRACE:    "{",
+	RIGHT_BRACE:   "}",
+	LEFT_BRACKET:  "[",
+	RIGHT_BRACKET: "]",
+	COMMA:         ",",
+	AT:            "@",
+	EQL:           "=",
+
+	ADD:       "+",
+	SUB:       "-",
+	MUL:       "*",
+	DIV:       "/",
+	MOD:       "%",
+	POW:       "^",
+	EQLC:      "==",
+	NEQ:       "!=",
+	LTE:       "<=",
+	LSS:       "<",
+	GTE:       ">=",
+	GTR:       ">",
+	EQL_REGEX: "=~",
+	NEQ_REGEX: "!~",
+	LAND:      "and",
+	LOR:       "or",
+	LUNLESS:   "unless",
+
+	BY:          "by",
+	WITHOUT:     "without",
+	ON:          "on",
+	IGNORING:    "ignoring",
+	GROUP_LEFT:  "group_left",
+	GROUP_RIGHT: "group_right",
+	BOOL:        "bool",
+	OFFSET:      "offset",
+	START:       "start",
+	END:         "end",
+}
+
+// 关键字不区分大小写, and/or/unless 也按关键字识别
+var keywords = map[string]ItemType{
+	"and":         LAND,
+	"or":          LOR,
+	"unless":      LUNLESS,
+	"by":          BY,
+	"without":     WITHOUT,
+	"on":          ON,
+	"ignoring":    IGNORING,
+	"group_left":  GROUP_LEFT,
+	"group_right": GROUP_RIGHT,
+	"bool":        BOOL,
+	"offset":      OFFSET,
+}
+
+func (t ItemType) String() string {
+	if s, ok := itemTypeStr[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("ItemType(%d)", int(t))
+}
+
+// 用于错误信息, 符号和关键字带引号, 例如 expected ")" / expected duration
+func (t ItemType) desc() string {
+	if t < LEFT_PAREN {
+		return t.String()
+	}
+	return strconv.Quote(t.String())
+}
+
+func (t ItemType) IsOperator() bool { return t > operatorsStart && t < operatorsEnd }
+func (t ItemType) IsKeyword() bool  { return t > keywordsStart && t < keywordsEnd }
+
+func (t ItemType) IsComparisonOperator() bool {
+	switch t {
+	case EQLC, NEQ, LTE, LSS, GTE, GTR:
+		return true
+	}
+	return false
+}
+
+func (t ItemType) IsSetOperator() bool {
+	switch t {
+	case LAND, LOR, LUNLESS:
+		return true
+	}
+	return false
+}
+
+// 二元运算符的优先级, 数值越大结合越紧
+func (t ItemType) precedence() int {
+	switch t {
+	case LOR:
+		return 1
+	case LAND, LUNLESS:
+		return 2
+	case EQLC, NEQ, LTE, LSS, GTE, GTR:
+		return 3
+	case ADD, SUB:
+		return 4
+	case MUL, DIV, MOD:
+		return 5
+	case POW:
+		return 6
+	}
+	return 0
+}
+
+func (t ItemType) isRightAssociative() bool {
+	return t == POW
+}
+
+type Item struct {
+	Typ ItemType
+	// 在查询字符串中的字节偏移
+	Pos int
+	Val string
+}
+
+// 用于错误信息, 例如 unexpected identifier "foo"
+func (i Item) desc() string {
+	switch i.Typ {
+	case EOF:
+		return "end of input"
+	case ERROR:
+		return i.Val
+	case IDENTIFIER, METRIC_IDENTIFIER:
+		return fmt.Sprintf("identifier %q", i.Val)
+	case NUMBER:
+		return fmt.Sprintf("number %q", i.Val)
+	case STRING:
+		return fmt.Sprintf("string %s", i.Val)
+	case DURATION:
+		return fmt.Sprintf("duration %q", i.Val)
+	}
+	if i.Typ.IsKeyword() {
+		return fmt.Sprintf("keyword %q", i.Val)
+	}
+	return fmt.Sprintf("%q", i.Val)
+}
+
+/*
+把查询切分成 Item, 最后一个是 EOF 或 ERROR
+关键字在任何位置都按关键字返回, 标签名位置上由解析器当作普通标识符处理, 所以 {on="x"} 和 by (on) 都是合法的
+*/
+func lex(input string) []Item {
+	l := &lexer{input: input}
+	for {
+		it := l.next()
+		l.items = append(l.items, it)
+		if it.Typ == EOF || it.Typ == ERROR {
+			return l.items
+		}
+	}
+}
+
+type lexer struct {
+	input string
+	pos   int
+	items []Item
+}
+
+func (l *lexer) item(t ItemType, start int) Item {
+	return Item{Typ: t, Pos: start, Val: l.input[start:l.pos]}
+}
+
+func (l *lexer) errorf(start int, format string, args ...any) Item {
+	return Item{Typ: ERROR, Pos: start, Val: fmt.Sprintf(format, args...)}
+}
+
+func (l *lexer) peek() byte {
+	if l.pos >= len(l.input) {
+		return 0
+	}
+	return l.input[l.pos]
+}
+
+func (l *lexer) next() Item {
+	for l.pos < len(l.input) {
+		c := l.input[l.pos]
+		if c == '#' {
+			// 注释到行尾
+			for l.pos < len(l.input) && l.input[l.pos] != '\n' {
+				l.pos++
+			}
+			continue
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+			break
+		}
+		l.pos++
+	}
+	start := l.pos
+	if l.pos >= len(l.input) {
+		return Item{Typ: EOF, Pos: start}
+	}
+	c := l.input[l.pos]
+	l.pos++
+	switch c {
+	case '(':
+		return l.item(LEFT_PAREN, start)
+	case ')':
+		return l.item(RIGHT_PAREN, start)
+	case '{':
+		return l.item(LEFT_BRACE, start)
+	case '}':
+		return l.item(RIGHT_BRACE, start)
+	case '[':
+		return l.item(LEFT_BRACKET, start)
+	case ']':
+		return l.item(RIGHT_BRACKET, start)
+	case ',':
+		return l.item(COMMA, start)
+	case '@':
+		return l.item(AT, start)
+	case '+':
+		return l.item(ADD, start)
+	case '-':
+		return l.item(SUB, start)
+	case '*':
+		return l.item(MUL, start)
+	case '/':
+		return l.item(DIV, start)
+	case '%':
+		return l.item(MOD, start)
+	case '^':
+		return l.item(POW, start)
+	case '=':
+		switch l.peek() {
+		case '=':
+			l.pos++
+			return l.item(EQLC, start)
+		case '~':
+			l.pos++
+			return l.item(EQL_REGEX, start)
+		}
+		return l.item(EQL, start)
+	case '!':
+		switch l.peek() {
+		case '=':
+			l.pos++
+			return l.item(NEQ, start)
+		case '~':
+			l.pos++
+			return l.item(NEQ_REGEX, start)
+		}
+		return l.errorf(start, "unexpected character after '!': %q", l.peek())
+	case '<':
+		if l.peek() == '=' {
+			l.pos++
+			return l.item(LTE, start)
+		}
+		return l.item(LSS, start)
+	case '>':
+		if l.peek() == '=' {
+			l.pos++
+			return l.item(GTE, start)
+		}
+		return l.item(GTR, start)
+	case '"', '\'', '`':
+		return l.lexString(c, start)
+	}
+	if isDigit(c) || (c == '.' && isDigit(l.peek())) {
+		l.pos--
+		return l.lexNumberOrDuration(start)
+	}
+	if isAlpha(c) || c == ':' {
+		return l.lexIdentifier(start)
+	}
+	r, _ := utf8.DecodeRuneInString(l.input[start:])
+	return l.errorf(start, "unexpected character: %q", r)
+}
+
+func (l *lexer) lexString(quote byte, start int) Item {
+	for l.pos < len(l.input) {
+		c := l.input[l.pos]
+		l.pos++
+		switch {
+		case c == quote:
+			return l.item(STRING, start)
+		case c == '\\' && quote != '`':
+			if l.pos < len(l.input) {
+				l.pos++
+			}
+		case c == '\n' && quote != '`':
+			return l.errorf(start, "unterminated quoted string")
+		}
+	}
+	return l.errorf(start, "unterminated quoted string")
+}
+
+func (l *lexer) lexIdentifier(start int) Item {
+	for l.pos < len(l.input) && (isAlphaNumeric(l.input[l.pos]) || l.input[l.pos] == ':') {
+		l.pos++
+	}
+	word := l.input[start:l.pos]
+	if kw, ok := keywords[strings.ToLower(word)]; ok {
+		return l.item(kw, start)
+	}
+	switch strings.ToLower(word) {
+	case "inf", "nan":
+		return l.item(NUMBER, start)
+	}
+	if strings.Contains(word, ":") {
+		return l.item(METRIC_IDENTIFIER, start)
+	}
+	return l.item(IDENTIFIER, start)
+}
+
+/*
+数字: 整数、小数、科学计数法和 0x 开头的十六进制
+时长: 一个或多个 "整数+单位", 例如 5m、1h30m、500ms
+*/
+func (l *lexer) lexNumberOrDuration(start int) Item {
+	if l.acceptPrefix("0x") || l.acceptPrefix("0X") {
+		if !l.acceptRun(isHexDigit) {
+			return l.errorf(start, "bad number syntax: %q", l.input[start:l.pos])
+		}
+		return l.finishNumber(start)
+	}
+	integer := l.acceptRun(isDigit)
+	if l.peek() == '.' {
+		integer = false
+		l.pos++
+		l.acceptRun(isDigit)
+	}
+	if c := l.peek(); c == 'e' || c == 'E' {
+		save := l.pos
+		l.pos++
+		if c := l.peek(); c == '+' || c == '-' {
+			l.pos++
+		}
+		if l.acceptRun(isDigit) {
+			return l.finishNumber(start)
+		}
+		// 不是指数, 例如 1e 后面不是数字
+		l.pos = save
+	}
+	if integer && l.acceptUnit() {
+		for l.acceptRun(isDigit) {
+			if !l.acceptUnit() {
+				return l.errorf(start, "bad duration syntax: %q", l.input[start:l.pos])
+			}
+		}
+		return l.finishItem(DURATION, start, "bad duration syntax")
+	}
+	return l.finishNumber(start)
+}
+
+func (l *lexer) finishNumber(start int) Item {
+	return l.finishItem(NUMBER, start, "bad number or duration syntax")
+}
+
+// 数字和时长后面不能紧跟字母或数字, 例如 5x、1.2.3
+func (l *lexer) finishItem(t ItemType, start int, msg string) Item {
+	if c := l.peek(); isAlphaNumeric(c) || c == '.' {
+		l.acceptRun(func(c byte) bool { return isAlphaNumeric(c) || c == '.' })
+		return l.errorf(start, "%s: %q", msg, l.input[start:l.pos])
+	}
+	return l.item(t, start)
+}
+
+func (l *lexer) acceptUnit() bool {
+	// ms 要先于 m 匹配
+	for _, unit := range []string{"ms", "s", "m", "h", "d", "w", "y"} {
+		if l.acceptPrefix(unit) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *lexer) acceptPrefix(prefix string) bool {
+	if strings.HasPrefix(l.input[l.pos:], prefix) {
+		l.pos += len(prefix)
+		return true
+	}
+	return false
+}
+
+func (l *lexer) acceptRun(valid func(byte) bool) bool {
+	start := l.pos
+	for l.pos < len(l.input) && valid(l.input[l.pos]) {
+		l.pos++
+	}
+	return l.pos > start
+}
+
+func isDigit(c byte) bool    { return c >= '0' && c <= '9' }
+func isHexDigit(c byte) bool { return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F') }
+func isAlpha(c byte) bool    { return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') }
+
+func isAlphaNumeric(c byte) bool {
+	return isAlpha(c) || isDigit(c)
+}
+
+// 标签名位置上可以使用关键字
+func isLabelName(it Item) bool {
+	return it.Typ == IDENTIFIER || it.Typ.IsKeyword() || it.Typ.IsSetOperator()
+}
@@ -0,0 +1,75 @@
+package promql
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestLex 测试词法分析
+func TestLex(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []Item
+	}{
+		{
+			name:  "选择器和范围",
+			input: `foo{a=~"x"}[5m]`,
+			want: []Item{
+				{IDENTIFIER, 0, "foo"}, {LEFT_BRACE, 3, "{"}, {IDENTIFIER, 4, "a"}, {EQL_REGEX, 5, "=~"},
+				{STRING, 7, `"x"`}, {RIGHT_BRACE, 10, "}"}, {LEFT_BRACKET, 11, "["}, {DURATION, 12, "5m"},
+				{RIGHT_BRACKET, 14, "]"}, {EOF, 15, ""},
+			},
+		},
+		{
+			name:  "数字和时长",
+			input: "1 1.5 .5 1e3 0x1f Inf NaN 1h30m 500ms",
+			want: []Item{
+				{NUMBER, 0, "1"}, {NUMBER, 2, "1.5"}, {NUMBER, 6, ".5"}, {NUMBER, 9, "1e3"}, {NUMBER, 13, "0x1f"},
+				{NUMBER, 18, "Inf"}, {NUMBER, 22, "NaN"}, {DURATION, 26, "1h30m"}, {DURATION, 32, "500ms"}, {EOF, 37, ""},
+			},
+		},
+		{
+			name:  "运算符和关键字",
+			input: "a == bool on(b) != ignoring() <= >= unless AND",
+			want: []Item{
+				{IDENTIFIER, 0, "a"}, {EQLC, 2, "=="}, {BOOL, 5, "bool"}, {ON, 10, "on"}, {LEFT_PAREN, 12, "("},
+				{IDENTIFIER, 13, "b"}, {RIGHT_PAREN, 14, ")"}, {NEQ, 16, "!="}, {IGNORING, 19, "ignoring"},
+				{LEFT_PAREN, 27, "("}, {RIGHT_PAREN, 28, ")"}, {LTE, 30, "<="}, {GTE, 33, ">="},
+				{LUNLESS, 36, "unless"}, {LAND, 43, "AND"}, {EOF, 46, ""},
+			},
+		},
+		{
+			name:  "字符串、注释和带冒号的指标名",
+			input: "job:rate5m 'a\\'b' # comment\n`raw\\n`",
+			want: []Item{
+				{METRIC_IDENTIFIER, 0, "job:rate5m"}, {STRING, 11, `'a\'b'`}, {STRING, 28, "`raw\\n`"}, {EOF, 35, ""},
+			},
+		},
+		{
+			name:  "未结束的字符串",
+			input: `foo{a="b}`,
+			want: []Item{
+				{IDENTIFIER, 0, "foo"}, {LEFT_BRACE, 3, "{"}, {IDENTIFIER, 4, "a"}, {EQL, 5, "="},
+				{ERROR, 6, "unterminated quoted string"},
+			},
+		},
+		{
+			name:  "非法的时长",
+			input: "5mx",
+			want:  []Item{{ERROR, 0, `bad duration syntax: "5mx"`}},
+		},
+		{
+			name:  "非法字符",
+			input: "a ~ b",
+			want:  []Item{{IDENTIFIER, 0, "a"}, {ERROR, 2, `unexpected character: '~'`}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lex(tt.input); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("期望 %v，实际 %v", tt.want, got)
+			}
+		})
+	}
+}
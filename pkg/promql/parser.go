@@ -0,0 +1,697 @@
+package promql
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"mini-promethues/pkg/model"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// 带位置的语法错误, Error() 返回 "行:列: parse error: ..." 的形式, 行列从 1 开始
+type ParseError struct {
+	PositionRange PositionRange
+	Err           error
+	Query         string
+}
+
+func (e *ParseError) Error() string {
+	line, col := e.Position()
+	return fmt.Sprintf("%d:%d: parse error: %s", line, col, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// 错误起始位置的行号和列号, 列按字符计算
+func (e *ParseError) Position() (line, col int) {
+	start := min(e.PositionRange.Start, len(e.Query))
+	before := e.Query[:start]
+	line = strings.Count(before, "\n") + 1
+	if i := strings.LastIndexByte(before, '\n'); i >= 0 {
+		before = before[i+1:]
+	}
+	return line, utf8.RuneCountInString(before) + 1
+}
+
+// 聚合运算符, 值表示是否需要参数 (topk 的 k 等)
+var aggregators = map[string]bool{
+	"sum":          false,
+	"avg":          false,
+	"min":          false,
+	"max":          false,
+	"count":        false,
+	"group":        false,
+	"stddev":       false,
+	"stdvar":       false,
+	"topk":         true,
+	"bottomk":      true,
+	"quantile":     true,
+	"count_values": true,
+}
+
+/*
+把 PromQL 表达式解析成 AST 并做类型检查
+
+	sum by (job) (rate(http_requests_total{code=~"5.."}[5m] offset 1h)) / 2
+
+二元运算符的优先级从低到高: or; and unless; == != <= < >= >; + -; * / %; ^
+^ 是右结合的, 一元 + - 比 ^ 结合得松, 所以 -2 ^ 2 等于 -4
+*/
+func ParseExpr(input string) (expr Expr, err error) {
+	p := &parser{input: input, items: lex(input)}
+	defer func() {
+		if r := recover(); r != nil {
+			perr, ok := r.(*ParseError)
+			if !ok {
+				panic(r)
+			}
+			expr, err = nil, perr
+		}
+	}()
+	expr = p.parseExpr(1)
+	if it := p.next(); it.Typ != EOF {
+		p.unexpected(it, "")
+	}
+	return expr, nil
+}
+
+/*
+递归下降解析器, 出错时 panic 一个 *ParseError, 由 ParseExpr 恢复
+词法错误作为 ERROR Item 出现在 items 的末尾, 读到时才报告
+*/
+type parser struct {
+	input string
+	items []Item
+	pos   int
+}
+
+func (p *parser) peek() Item {
+	return p.items[p.pos]
+}
+
+func (p *parser) next() Item {
+	it := p.items[p.pos]
+	// EOF 和 ERROR 是最后一个 Item, 停在那里
+	if p.pos < len(p.items)-1 {
+		p.pos++
+	}
+	if it.Typ == ERROR {
+		p.errorf(PositionRange{Start: it.Pos, End: len(p.input)}, "%s", it.Val)
+	}
+	return it
+}
+
+func (p *parser) accept(t ItemType) bool {
+	if p.peek().Typ == t {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(t ItemType, context string) Item {
+	it := p.next()
+	if it.Typ != t {
+		p.unexpected(it, fmt.Sprintf("in %s, expected %s", context, t.desc()))
+	}
+	return it
+}
+
+func (p *parser) errorf(pos PositionRange, format string, args ...any) {
+	panic(&ParseError{PositionRange: pos, Err: fmt.Errorf(format, args...), Query: p.input})
+}
+
+func (p *parser) unexpected(it Item, context string) {
+	msg := "unexpected " + it.desc()
+	if context != "" {
+		msg += " " + context
+	}
+	panic(&ParseError{PositionRange: itemRange(it), Err: errors.New(msg), Query: p.input})
+}
+
+func itemRange(it Item) PositionRange {
+	return PositionRange{Start: it.Pos, End: it.Pos + len(it.Val)}
+}
+
+// 优先级爬升: 只消费优先级不低于 minPrec 的二元运算符
+func (p *parser) parseExpr(minPrec int) Expr {
+	lhs := p.parseUnary()
+	for {
+		op := p.peek()
+		prec := op.Typ.precedence()
+		if prec == 0 || prec < minPrec {
+			return lhs
+		}
+		p.next()
+		be := &BinaryExpr{Op: op.Typ, LHS: lhs}
+		p.parseBinaryModifiers(be, op)
+		if op.Typ.isRightAssociative() {
+			be.RHS = p.parseExpr(prec)
+		} else {
+			be.RHS = p.parseExpr(prec + 1)
+		}
+		p.checkBinary(be, op)
+		lhs = be
+	}
+}
+
+// bool、on/ignoring 和 group_left/group_right
+func (p *parser) parseBinaryModifiers(be *BinaryExpr, op Item) {
+	if p.peek().Typ == BOOL {
+		it := p.next()
+		if !op.Typ.IsComparisonOperator() {
+			p.errorf(itemRange(it), "bool modifier can only be used on comparison operators")
+		}
+		be.ReturnBool = true
+	}
+	vm := &VectorMatching{Card: CardOneToOne}
+	if op.Typ.IsSetOperator() {
+		vm.Card = CardManyToMany
+	}
+	be.VectorMatching = vm
+
+	switch p.peek().Typ {
+	case ON, IGNORING:
+		vm.On = p.next().Typ == ON
+		vm.MatchingLabels = p.parseGroupingLabels()
+	default:
+		return
+	}
+	switch p.peek().Typ {
+	case GROUP_LEFT, GROUP_RIGHT:
+		it := p.next()
+		if op.Typ.IsSetOperator() {
+			p.errorf(itemRange(it), "no grouping allowed for %q operation", op.Typ)
+		}
+		vm.Card = CardManyToOne
+		if it.Typ == GROUP_RIGHT {
+			vm.Card = CardOneToMany
+		}
+		if p.peek().Typ == LEFT_PAREN {
+			vm.Include = p.parseGroupingLabels()
+		}
+		if vm.On {
+			for _, l := range vm.Include {
+				if slices.Contains(vm.MatchingLabels, l) {
+					p.errorf(itemRange(it), "label %q must not occur in ON and GROUP clause at once", l)
+				}
+			}
+		}
+	}
+}
+
+func (p *parser) checkBinary(be *BinaryExpr, op Item) {
+	lt, rt := be.LHS.Type(), be.RHS.Type()
+	pos := be.PositionRange()
+	for _, t := range []ValueType{lt, rt} {
+		if t != ValueTypeScalar && t != ValueTypeVector {
+			p.errorf(pos, "binary expression must contain only scalar and instant vector types")
+		}
+	}
+	bothVectors := lt == ValueTypeVector && rt == ValueTypeVector
+	if op.Typ.IsSetOperator() && !bothVectors {
+		p.errorf(pos, "set operator %q not allowed in binary scalar expression", op.Typ)
+	}
+	if op.Typ.IsComparisonOperator() && !be.ReturnBool && lt == ValueTypeScalar && rt == ValueTypeScalar {
+		p.errorf(pos, "comparisons between scalars must use BOOL modifier")
+	}
+	vm := be.VectorMatching
+	if !bothVectors {
+		if vm.On || len(vm.MatchingLabels) > 0 || vm.Card != CardOneToOne {
+			p.errorf(pos, "vector matching only allowed between instant vectors")
+		}
+		be.VectorMatching = nil
+	}
+}
+
+// 一元运算符作用于 ^ 的结果, 所以 -a ^ b 解析为 -(a ^ b)
+func (p *parser) parseUnary() Expr {
+	switch p.peek().Typ {
+	case ADD, SUB:
+		op := p.next()
+		expr := p.parseExpr(POW.precedence())
+		if n, ok := expr.(*NumberLiteral); ok {
+			if op.Typ == SUB {
+				n.Val = -n.Val
+			}
+			n.PosRange.Start = op.Pos
+			return n
+		}
+		if t := expr.Type(); t != ValueTypeScalar && t != ValueTypeVector {
+			p.errorf(PositionRange{Start: op.Pos, End: expr.PositionRange().End},
+				"unary expression only allowed on expressions of type scalar or instant vector, got %q", documentedType(t))
+		}
+		return &UnaryExpr{Op: op.Typ, Expr: expr, StartPos: op.Pos}
+	}
+	return p.parsePostfix(p.parsePrimary())
+}
+
+func (p *parser) parsePrimary() Expr {
+	it := p.next()
+	switch it.Typ {
+	case NUMBER:
+		return &NumberLiteral{Val: p.parseNumber(it), PosRange: itemRange(it)}
+	case STRING:
+		return &StringLiteral{Val: p.unquote(it), PosRange: itemRange(it)}
+	case LEFT_PAREN:
+		expr := p.parseExpr(1)
+		end := p.expect(RIGHT_PAREN, "paren expression")
+		return &ParenExpr{Expr: expr, PosRange: PositionRange{Start: it.Pos, End: end.Pos + 1}}
+	case LEFT_BRACE:
+		return p.parseVectorSelector(Item{Typ: IDENTIFIER, Pos: it.Pos}, true)
+	case IDENTIFIER:
+		if _, ok := aggregators[it.Val]; ok {
+			switch p.peek().Typ {
+			case LEFT_PAREN, BY, WITHOUT:
+				return p.parseAggregate(it)
+			}
+		}
+		if p.peek().Typ == LEFT_PAREN {
+			return p.parseCall(it)
+		}
+		return p.parseVectorSelector(it, false)
+	case METRIC_IDENTIFIER:
+		return p.parseVectorSelector(it, false)
+	}
+	p.unexpected(it, "")
+	return nil
+}
+
+// 范围 [5m]、offset 和 @, 只能作用于选择器; 范围必须写在 offset 和 @ 之前
+func (p *parser) parsePostfix(expr Expr) Expr {
+	for {
+		switch p.peek().Typ {
+		case LEFT_BRACKET:
+			open := p.next()
+			vs, ok := expr.(*VectorSelector)
+			if !ok {
+				p.errorf(PositionRange{Start: expr.PositionRange().Start, End: open.Pos + 1},
+					"ranges only allowed for vector selectors")
+			}
+			if vs.Offset != 0 || vs.Timestamp != nil || vs.StartOrEnd != 0 {
+				p.errorf(itemRange(open), "no offset or @ modifiers allowed before range")
+			}
+			d := p.expect(DURATION, "range selector")
+			rng := p.parseDuration(d)
+			if rng <= 0 {
+				p.errorf(itemRange(d), "range must be positive, got %s", d.Val)
+			}
+			end := p.expect(RIGHT_BRACKET, "range selector")
+			expr = &MatrixSelector{VectorSelector: vs, Range: rng, EndPos: end.Pos + 1}
+		case OFFSET:
+			kw := p.next()
+			vs := p.modifierTarget(expr, kw, "offset")
+			if vs.Offset != 0 {
+				p.errorf(itemRange(kw), "offset may not be set multiple times")
+			}
+			neg := p.accept(SUB)
+			d := p.expect(DURATION, "offset modifier")
+			vs.Offset = p.parseDuration(d)
+			if neg {
+				vs.Offset = -vs.Offset
+			}
+			p.extendEnd(expr, d)
+		case AT:
+			at := p.next()
+			vs := p.modifierTarget(expr, at, "@")
+			if vs.Timestamp != nil || vs.StartOrEnd != 0 {
+				p.errorf(itemRange(at), "@ <timestamp> may not be set multiple times")
+			}
+			p.parseAtModifier(vs, expr)
+		default:
+			return expr
+		}
+	}
+}
+
+func (p *parser) modifierTarget(expr Expr, it Item, name string) *VectorSelector {
+	switch e := expr.(type) {
+	case *VectorSelector:
+		return e
+	case *MatrixSelector:
+		return e.VectorSelector.(*VectorSelector)
+	}
+	p.errorf(itemRange(it), "%s modifier must be preceded by an instant vector selector or range vector selector", name)
+	return nil
+}
+
+// 修饰符是选择器的一部分, 位置范围延伸到修饰符末尾
+func (p *parser) extendEnd(expr Expr, last Item) {
+	end := last.Pos + len(last.Val)
+	switch e := expr.(type) {
+	case *VectorSelector:
+		e.PosRange.End = end
+	case *MatrixSelector:
+		e.EndPos = end
+	}
+}
+
+// @ 后面是 Unix 时间戳 (秒, 可以带小数和符号) 或者 start() / end()
+func (p *parser) parseAtModifier(vs *VectorSelector, expr Expr) {
+	it := p.next()
+	switch it.Typ {
+	case IDENTIFIER:
+		switch it.Val {
+		case "start":
+			vs.StartOrEnd = START
+		case "end":
+			vs.StartOrEnd = END
+		default:
+			p.unexpected(it, "in @ modifier, expected timestamp, start() or end()")
+		}
+		p.expect(LEFT_PAREN, "@ modifier")
+		p.extendEnd(expr, p.expect(RIGHT_PAREN, "@ modifier"))
+		return
+	case ADD, SUB:
+		num := p.expect(NUMBER, "@ modifier")
+		v := p.parseNumber(num)
+		if it.Typ == SUB {
+			v = -v
+		}
+		p.setTimestamp(vs, v, PositionRange{Start: it.Pos, End: num.Pos + len(num.Val)})
+		p.extendEnd(expr, num)
+	case NUMBER:
+		p.setTimestamp(vs, p.parseNumber(it), itemRange(it))
+		p.extendEnd(expr, it)
+	default:
+		p.unexpected(it, "in @ modifier, expected timestamp, start() or end()")
+	}
+}
+
+func (p *parser) setTimestamp(vs *VectorSelector, seconds float64, pos PositionRange) {
+	if math.IsInf(seconds, 0) || math.IsNaN(seconds) || math.Abs(seconds) >= math.MaxInt64/1000 {
+		p.errorf(pos, "timestamp out of bounds for @ modifier: %v", seconds)
+	}
+	ts := int64(math.Round(seconds * 1000))
+	vs.Timestamp = &ts
+}
+
+/*
+name 是指标名称, fromBrace 为 true 时表达式以 { 开头, 没有指标名称
+至少要有一个不匹配空字符串的匹配器, 否则会选中所有序列
+*/
+func (p *parser) parseVectorSelector(name Item, fromBrace bool) *VectorSelector {
+	vs := &VectorSelector{PosRange: PositionRange{Start: name.Pos, End: name.Pos + len(name.Val)}}
+	if !fromBrace {
+		vs.Name = name.Val
+		m, _ := model.NewLabelMatcher(model.MatchEqual, model.MetricNameLabel, name.Val)
+		vs.LabelMatchers = append(vs.LabelMatchers, m)
+	}
+	if fromBrace || p.peek().Typ == LEFT_BRACE {
+		if !fromBrace {
+			p.next()
+		}
+		var end Item
+		vs.LabelMatchers, end = p.parseLabelMatchers(vs.LabelMatchers, vs.Name)
+		vs.PosRange.End = end.Pos + 1
+	}
+	for _, m := range vs.LabelMatchers {
+		if !m.Matches("") {
+			return vs
+		}
+	}
+	p.errorf(vs.PosRange, "vector selector must contain at least one non-empty matcher")
+	return nil
+}
+
+// 左花括号已经读过, 返回追加后的匹配器和右花括号
+func (p *parser) parseLabelMatchers(matchers []*model.LabelMatcher, metricName string) ([]*model.LabelMatcher, Item) {
+	for {
+		it := p.next()
+		if it.Typ == RIGHT_BRACE {
+			return matchers, it
+		}
+		if !isLabelName(it) {
+			p.unexpected(it, "in label matching, expected label name or \"}\"")
+		}
+		op := p.next()
+		var mt model.MatchType
+		switch op.Typ {
+		case EQL:
+			mt = model.MatchEqual
+		case NEQ:
+			mt = model.MatchNotEqual
+		case EQL_REGEX:
+			mt = model.MatchRegexp
+		case NEQ_REGEX:
+			mt = model.MatchNotRegexp
+		default:
+			p.unexpected(op, "in label matching, expected label matching operator")
+		}
+		val := p.expect(STRING, "label matching")
+		if it.Val == model.MetricNameLabel && metricName != "" {
+			p.errorf(PositionRange{Start: it.Pos, End: val.Pos + len(val.Val)},
+				"metric name must not be set twice: %q or %q", metricName, p.unquote(val))
+		}
+		m, err := model.NewLabelMatcher(mt, it.Val, p.unquote(val))
+		if err != nil {
+			p.errorf(itemRange(val), "%s", err)
+		}
+		matchers = append(matchers, m)
+
+		switch sep := p.next(); sep.Typ {
+		case COMMA:
+		case RIGHT_BRACE:
+			return matchers, sep
+		default:
+			p.unexpected(sep, "in label matching, expected \",\" or \"}\"")
+		}
+	}
+}
+
+// (label1, label2), 允许末尾逗号和空列表
+func (p *parser) parseGroupingLabels() []string {
+	p.expect(LEFT_PAREN, "grouping opts")
+	labels := []string{}
+	for {
+		it := p.next()
+		if it.Typ == RIGHT_PAREN {
+			return labels
+		}
+		if !isLabelName(it) {
+			p.unexpected(it, "in grouping opts, expected label")
+		}
+		labels = append(labels, it.Val)
+		switch sep := p.next(); sep.Typ {
+		case COMMA:
+		case RIGHT_PAREN:
+			return labels
+		default:
+			p.unexpected(sep, "in grouping opts, expected \",\" or \")\"")
+		}
+	}
+}
+
+// by/without 可以写在括号前面或后面: sum by (job) (x) 和 sum(x) by (job) 等价
+func (p *parser) parseAggregate(op Item) *AggregateExpr {
+	agg := &AggregateExpr{Op: op.Val}
+	hasGrouping := p.parseAggregateModifier(agg)
+	args, end := p.parseArgs("aggregation")
+	agg.PosRange = PositionRange{Start: op.Pos, End: end.Pos + 1}
+	if !hasGrouping {
+		switch p.peek().Typ {
+		case BY, WITHOUT:
+			p.parseAggregateModifier(agg)
+			agg.PosRange.End = p.items[p.pos-1].Pos + 1
+		}
+	}
+
+	want := 1
+	if aggregators[op.Val] {
+		want = 2
+	}
+	if len(args) != want {
+		p.errorf(agg.PosRange, "wrong number of arguments for aggregate expression provided, expected %d, got %d", want, len(args))
+	}
+	agg.Expr = args[len(args)-1]
+	if want == 2 {
+		agg.Param = args[0]
+		paramType := ValueTypeScalar
+		if op.Val == "count_values" {
+			paramType = ValueTypeString
+		}
+		p.checkType(agg.Param, paramType, "aggregation parameter")
+	}
+	p.checkType(agg.Expr, ValueTypeVector, "aggregation expression")
+	return agg
+}
+
+func (p *parser) parseAggregateModifier(agg *AggregateExpr) bool {
+	switch p.peek().Typ {
+	case BY:
+		p.next()
+	case WITHOUT:
+		p.next()
+		agg.Without = true
+	default:
+		return false
+	}
+	agg.Grouping = p.parseGroupingLabels()
+	return true
+}
+
+func (p *parser) parseCall(name Item) *Call {
+	f, ok := Functions[name.Val]
+	if !ok {
+		p.errorf(itemRange(name), "unknown function with name %q", name.Val)
+	}
+	args, end := p.parseArgs("function call")
+	call := &Call{Func: f, Args: args, PosRange: PositionRange{Start: name.Pos, End: end.Pos + 1}}
+
+	if n := len(f.ArgTypes); len(args) > n || len(args) < n-f.Variadic {
+		want := strconv.Itoa(n)
+		if f.Variadic > 0 {
+			want = fmt.Sprintf("%d to %d", n-f.Variadic, n)
+		}
+		p.errorf(call.PosRange, "expected %s argument(s) in call to %q, got %d", want, f.Name, len(args))
+	}
+	for i, arg := range args {
+		p.checkType(arg, f.ArgTypes[i], fmt.Sprintf("call to function %q", f.Name))
+	}
+	return call
+}
+
+// (arg1, arg2, ...), 返回参数和右括号
+func (p *parser) parseArgs(context string) ([]Expr, Item) {
+	p.expect(LEFT_PAREN, context)
+	var args []Expr
+	if it := p.peek(); it.Typ == RIGHT_PAREN {
+		return args, p.next()
+	}
+	for {
+		args = append(args, p.parseExpr(1))
+		switch sep := p.next(); sep.Typ {
+		case COMMA:
+		case RIGHT_PAREN:
+			return args, sep
+		default:
+			p.unexpected(sep, fmt.Sprintf("in %s, expected \",\" or \")\"", context))
+		}
+	}
+}
+
+func (p *parser) checkType(expr Expr, want ValueType, context string) {
+	if got := expr.Type(); got != want {
+		p.errorf(expr.PositionRange(), "expected type %s in %s, got %s", documentedType(want), context, documentedType(got))
+	}
+}
+
+func (p *parser) parseNumber(it Item) float64 {
+	if strings.HasPrefix(it.Val, "0x") || strings.HasPrefix(it.Val, "0X") {
+		v, err := strconv.ParseUint(it.Val[2:], 16, 64)
+		if err != nil {
+			p.errorf(itemRange(it), "invalid number %q", it.Val)
+		}
+		return float64(v)
+	}
+	v, err := strconv.ParseFloat(it.Val, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		p.errorf(itemRange(it), "invalid number %q", it.Val)
+	}
+	return v
+}
+
+func (p *parser) parseDuration(it Item) time.Duration {
+	d, err := parseDuration(it.Val)
+	if err != nil {
+		p.errorf(itemRange(it), "%s", err)
+	}
+	return d
+}
+
+// 支持 "..."、'...' 和 `...`, 前两种按 Go 的规则处理转义
+func (p *parser) unquote(it Item) string {
+	s := it.Val
+	if s[0] == '\'' {
+		// 转换成双引号字符串: \' 不需要转义, " 需要转义
+		var b strings.Builder
+		b.WriteByte('"')
+		for i := 1; i < len(s)-1; i++ {
+			switch {
+			case s[i] == '\\' && s[i+1] == '\'':
+				b.WriteByte('\'')
+				i++
+			case s[i] == '\\':
+				b.WriteString(s[i : i+2])
+				i++
+			case s[i] == '"':
+				b.WriteString(`\"`)
+			default:
+				b.WriteByte(s[i])
+			}
+		}
+		b.WriteByte('"')
+		s = b.String()
+	}
+	v, err := strconv.Unquote(s)
+	if err != nil {
+		p.errorf(itemRange(it), "invalid string %s: %s", it.Val, err)
+	}
+	return v
+}
+
+var durationUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+	"w":  7 * 24 * time.Hour,
+	"y":  365 * 24 * time.Hour,
+}
+
+// PromQL 的时长, 例如 1h30m; 单位必须从大到小且不能重复
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, fmt.Errorf("empty duration string")
+	}
+	var d time.Duration
+	last := time.Duration(math.MaxInt64)
+	rest := s
+	for rest != "" {
+		i := 0
+		for i < len(rest) && isDigit(rest[i]) {
+			i++
+		}
+		j := i
+		for j < len(rest) && !isDigit(rest[j]) {
+			j++
+		}
+		unit, ok := durationUnits[rest[i:j]]
+		if i == 0 || !ok || unit >= last {
+			return 0, fmt.Errorf("not a valid duration string: %q", s)
+		}
+		n, err := strconv.ParseInt(rest[:i], 10, 64)
+		if err != nil || n > int64(math.MaxInt64/unit) || d > time.Duration(math.MaxInt64)-time.Duration(n)*unit {
+			return 0, fmt.Errorf("duration out of range: %q", s)
+		}
+		d += time.Duration(n) * unit
+		last = unit
+		rest = rest[j:]
+	}
+	return d, nil
+}
+
+// parseDuration 的逆操作, 使用尽量大的单位
+func formatDuration(d time.Duration) string {
+	if d == 0 {
+		return "0s"
+	}
+	var b strings.Builder
+	for _, u := range []struct {
+		name string
+		d    time.Duration
+	}{{"y", durationUnits["y"]}, {"w", durationUnits["w"]}, {"d", durationUnits["d"]}, {"h", time.Hour}, {"m", time.Minute}, {"s", time.Second}, {"ms", time.Millisecond}} {
+		if n := d / u.d; n > 0 {
+			fmt.Fprintf(&b, "%d%s", n, u.name)
+			d -= n * u.d
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,302 @@
+package promql
+
+import (
+	"errors"
+	"mini-promethues/pkg/model"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustMatcher(t *testing.T, mt model.MatchType, name, value string) *model.LabelMatcher {
+	t.Helper()
+	m, err := model.NewLabelMatcher(mt, name, value)
+	if err != nil {
+		t.Fatalf("创建匹配器失败: %v", err)
+	}
+	return m
+}
+
+// TestParseExpr_Selectors 测试选择器和修饰符
+func TestParseExpr_Selectors(t *testing.T) {
+	ts := int64(1700000000500)
+	tests := []struct {
+		name  string
+		input string
+		want  Expr
+	}{
+		{
+			name:  "指标名称和匹配器",
+			input: `http_requests_total{method="GET", code=~"5..", path!="/", env!~'dev|test',}`,
+			want: &VectorSelector{
+				Name: "http_requests_total",
+				LabelMatchers: []*model.LabelMatcher{
+					mustMatcher(t, model.MatchEqual, model.MetricNameLabel, "http_requests_total"),
+					mustMatcher(t, model.MatchEqual, "method", "GET"),
+					mustMatcher(t, model.MatchRegexp, "code", "5.."),
+					mustMatcher(t, model.MatchNotEqual, "path", "/"),
+					mustMatcher(t, model.MatchNotRegexp, "env", "dev|test"),
+				},
+				PosRange: PositionRange{Start: 0, End: 75},
+			},
+		},
+		{
+			name:  "只有匹配器, 关键字作为标签名",
+			input: `{on="x", by!=""}`,
+			want: &VectorSelector{
+				LabelMatchers: []*model.LabelMatcher{
+					mustMatcher(t, model.MatchEqual, "on", "x"),
+					mustMatcher(t, model.MatchNotEqual, "by", ""),
+				},
+				PosRange: PositionRange{Start: 0, End: 16},
+			},
+		},
+		{
+			name:  "范围、@ 和负的 offset",
+			input: `job:up[1h30m] @ 1700000000.5 offset -5m`,
+			want: &MatrixSelector{
+				VectorSelector: &VectorSelector{
+					Name:          "job:up",
+					LabelMatchers: []*model.LabelMatcher{mustMatcher(t, model.MatchEqual, model.MetricNameLabel, "job:up")},
+					Offset:        -5 * time.Minute,
+					Timestamp:     &ts,
+					PosRange:      PositionRange{Start: 0, End: 6},
+				},
+				Range:  90 * time.Minute,
+				EndPos: 39,
+			},
+		},
+		{
+			name:  "offset 在 @ start() 之前",
+			input: `up offset 1d @ start()`,
+			want: &VectorSelector{
+				Name:          "up",
+				LabelMatchers: []*model.LabelMatcher{mustMatcher(t, model.MatchEqual, model.MetricNameLabel, "up")},
+				Offset:        24 * time.Hour,
+				StartOrEnd:    START,
+				PosRange:      PositionRange{Start: 0, End: 22},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseExpr(tt.input)
+			if err != nil {
+				t.Fatalf("解析失败: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("期望 %#v，实际 %#v", tt.want, got)
+			}
+		})
+	}
+}
+
+// TestParseExpr_String 测试解析结果的规范形式, 括号体现结合顺序
+func TestParseExpr_String(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+		typ   ValueType
+	}{
+		{"1 + 2 * 3", "1 + 2 * 3", ValueTypeScalar},
+		{"-5", "-5", ValueTypeScalar},
+		{"+0x10", "16", ValueTypeScalar},
+		{"-inf", "-Inf", ValueTypeScalar},
+		{`"a\"b"`, `"a\"b"`, ValueTypeString},
+		{"`c:\\dir`", `"c:\\dir"`, ValueTypeString},
+		{"foo offset 5m", "foo offset 5m", ValueTypeVector},
+		{"foo @ 10", "foo @ 10.000", ValueTypeVector},
+		{"foo[5m] @ end() offset 1h", "foo[5m] @ end() offset 1h", ValueTypeMatrix},
+		{"-foo", "-foo", ValueTypeVector},
+		{"a or b and c unless d", "a or b and c unless d", ValueTypeVector},
+		{"a > bool 1", "a > bool 1", ValueTypeVector},
+		{"a + on(x, y) group_left(z) b", "a + on (x, y) group_left (z) b", ValueTypeVector},
+		{"a / ignoring(x) group_right b", "a / ignoring (x) group_right () b", ValueTypeVector},
+		{"a and on() b", "a and on () b", ValueTypeVector},
+		{"sum(foo) by (job, instance)", "sum by (job, instance) (foo)", ValueTypeVector},
+		{"sum without (job) (foo)", "sum without (job) (foo)", ValueTypeVector},
+		{"topk by (job) (5, foo)", "topk by (job) (5, foo)", ValueTypeVector},
+		{`count_values("value", foo)`, `count_values("value", foo)`, ValueTypeVector},
+		{"quantile(0.9, foo)", "quantile(0.9, foo)", ValueTypeVector},
+		{"avg_over_time(foo[5m])", "avg_over_time(foo[5m])", ValueTypeVector},
+		{"round(foo)", "round(foo)", ValueTypeVector},
+		{"round(foo, 0.5)", "round(foo, 0.5)", ValueTypeVector},
+		{"time()", "time()", ValueTypeScalar},
+		{"scalar(foo) * 2", "scalar(foo) * 2", ValueTypeScalar},
+		{"sum", "sum", ValueTypeVector},
+		{"(1 + 2) * 3 # comment", "(1 + 2) * 3", ValueTypeScalar},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseExpr(tt.input)
+			if err != nil {
+				t.Fatalf("解析失败: %v", err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("期望 %s，实际 %s", tt.want, got)
+			}
+			if got.Type() != tt.typ {
+				t.Errorf("期望类型 %s，实际 %s", tt.typ, got.Type())
+			}
+		})
+	}
+}
+
+// TestParseExpr_Precedence 测试运算符优先级和结合性
+func TestParseExpr_Precedence(t *testing.T) {
+	// 按 AST 加上括号, 用于检查结合顺序
+	var group func(e Expr) string
+	group = func(e Expr) string {
+		switch e := e.(type) {
+		case *BinaryExpr:
+			return "(" + group(e.LHS) + " " + e.Op.String() + " " + group(e.RHS) + ")"
+		case *UnaryExpr:
+			return "(" + e.Op.String() + group(e.Expr) + ")"
+		}
+		return e.String()
+	}
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"a + b * c", "(a + (b * c))"},
+		{"a * b + c", "((a * b) + c)"},
+		{"a - b - c", "((a - b) - c)"},
+		{"a ^ b ^ c", "(a ^ (b ^ c))"},
+		{"-a ^ b", "(-(a ^ b))"},
+		{"-a * b", "((-a) * b)"},
+		{"a + b > c * d", "((a + b) > (c * d))"},
+		{"a > b and c or d unless e", "(((a > b) and c) or (d unless e))"},
+		{"a % b / c", "((a % b) / c)"},
+		{"-2 ^ 2", "(-(2 ^ 2))"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseExpr(tt.input)
+			if err != nil {
+				t.Fatalf("解析失败: %v", err)
+			}
+			if s := group(got); s != tt.want {
+				t.Errorf("期望 %s，实际 %s", tt.want, s)
+			}
+		})
+	}
+}
+
+// TestParseExpr_VectorMatching 测试向量匹配的修饰符
+func TestParseExpr_VectorMatching(t *testing.T) {
+	tests := []struct {
+		input string
+		want  *VectorMatching
+	}{
+		{"a + b", &VectorMatching{Card: CardOneToOne}},
+		{"a and b", &VectorMatching{Card: CardManyToMany}},
+		{"a * on(job) group_left(env) b", &VectorMatching{Card: CardManyToOne, On: true, MatchingLabels: []string{"job"}, Include: []string{"env"}}},
+		{"a * ignoring(le) group_right b", &VectorMatching{Card: CardOneToMany, MatchingLabels: []string{"le"}}},
+		{"a + 1", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseExpr(tt.input)
+			if err != nil {
+				t.Fatalf("解析失败: %v", err)
+			}
+			if vm := got.(*BinaryExpr).VectorMatching; !reflect.DeepEqual(vm, tt.want) {
+				t.Errorf("期望 %+v，实际 %+v", tt.want, vm)
+			}
+		})
+	}
+}
+
+// TestParseExpr_Errors 测试语法错误和类型错误, 错误信息带行号和列号
+func TestParseExpr_Errors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"", "1:1: parse error: unexpected end of input"},
+		{"foo{a=\"b\"", `1:10: parse error: unexpected end of input in label matching, expected "," or "}"`},
+		{"foo{a}", `1:6: parse error: unexpected "}" in label matching, expected label matching operator`},
+		{"{}", "1:1: parse error: vector selector must contain at least one non-empty matcher"},
+		{`{a=~".*"}`, "1:1: parse error: vector selector must contain at least one non-empty matcher"},
+		{`foo{__name__="bar"}`, `1:5: parse error: metric name must not be set twice: "foo" or "bar"`},
+		{"foo +\n  bar{a=~\"(\"}", "2:10: parse error: invalid regular expression"},
+		{"foo[5]", `1:5: parse error: unexpected number "5" in range selector, expected duration`},
+		{"foo[5x]", `1:5: parse error: bad number or duration syntax: "5x"`},
+		{"foo[0s]", "1:5: parse error: range must be positive, got 0s"},
+		{"foo offset 1m offset 2m", "1:15: parse error: offset may not be set multiple times"},
+		{"foo @ 1 @ 2", "1:9: parse error: @ <timestamp> may not be set multiple times"},
+		{"foo offset 1m [5m]", "1:15: parse error: no offset or @ modifiers allowed before range"},
+		{"(foo)[5m]", "1:1: parse error: ranges only allowed for vector selectors"},
+		{"1 offset 5m", "1:3: parse error: offset modifier must be preceded by an instant vector selector or range vector selector"},
+		{"foo @ now()", `1:7: parse error: unexpected identifier "now" in @ modifier, expected timestamp, start() or end()`},
+		{"1 == 1", "1:1: parse error: comparisons between scalars must use BOOL modifier"},
+		{"foo + bool bar", "1:7: parse error: bool modifier can only be used on comparison operators"},
+		{"foo and 1", `1:1: parse error: set operator "and" not allowed in binary scalar expression`},
+		{"foo + on(a) 1", "1:1: parse error: vector matching only allowed between instant vectors"},
+		{"foo or on(a) group_left b", `1:14: parse error: no grouping allowed for "or" operation`},
+		{"a + on(x) group_left(x) b", `1:11: parse error: label "x" must not occur in ON and GROUP clause at once`},
+		{"foo[5m] + 1", "1:1: parse error: binary expression must contain only scalar and instant vector types"},
+		{`-"a"`, `1:1: parse error: unary expression only allowed on expressions of type scalar or instant vector, got "string"`},
+		{"sum(foo[5m])", "1:5: parse error: expected type instant vector in aggregation expression, got range vector"},
+		{"topk(foo)", "1:1: parse error: wrong number of arguments for aggregate expression provided, expected 2, got 1"},
+		{"topk(\"3\", foo)", "1:6: parse error: expected type scalar in aggregation parameter, got string"},
+		{"sum by (job:x) (foo)", `1:9: parse error: unexpected identifier "job:x" in grouping opts, expected label`},
+		{"unknown(foo)", `1:1: parse error: unknown function with name "unknown"`},
+		{"abs()", `1:1: parse error: expected 1 argument(s) in call to "abs", got 0`},
+		{"round(foo, 1, 2)", `1:1: parse error: expected 1 to 2 argument(s) in call to "round", got 3`},
+		{"avg_over_time(foo)", `1:15: parse error: expected type range vector in call to function "avg_over_time", got instant vector`},
+		{"foo bar", `1:5: parse error: unexpected identifier "bar"`},
+		{"(foo", `1:5: parse error: unexpected end of input in paren expression, expected ")"`},
+		{"foo ! bar", `1:5: parse error: unexpected character after '!': ' '`},
+		{"\n  \"abc", "2:3: parse error: unterminated quoted string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := ParseExpr(tt.input)
+			if err == nil {
+				t.Fatalf("期望解析失败")
+			}
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("期望 *ParseError，实际 %T", err)
+			}
+			if !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("期望 %s，实际 %s", tt.want, err)
+			}
+		})
+	}
+}
+
+// TestParseDuration 测试时长的解析和格式化
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		input string
+		want  time.Duration
+	}{
+		{"500ms", 500 * time.Millisecond},
+		{"5m", 5 * time.Minute},
+		{"1h30m", 90 * time.Minute},
+		{"2w1d", 15 * 24 * time.Hour},
+		{"1y", 365 * 24 * time.Hour},
+	}
+	for _, tt := range tests {
+		got, err := parseDuration(tt.input)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: 期望 %v，实际 %v (%v)", tt.input, tt.want, got, err)
+		}
+		if s := formatDuration(got); s != tt.input {
+			t.Errorf("期望格式化为 %s，实际 %s", tt.input, s)
+		}
+	}
+
+	for _, input := range []string{"", "5", "m", "1m1h", "1m1m", "99999999999999y"} {
+		if _, err := parseDuration(input); err == nil {
+			t.Errorf("%q: 期望解析失败", input)
+		}
+	}
+	if d, _ := parseDuration("0s"); d != 0 || formatDuration(d) != "0s" {
+		t.Errorf("期望 0s，实际 %v", d)
+	}
+}
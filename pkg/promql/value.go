@@ -0,0 +1,126 @@
+package promql
+
+import (
+	"fmt"
+	"mini-promethues/pkg/model"
+	"strconv"
+	"strings"
+)
+
+// 查询结果: Scalar、String、Vector 或 Matrix
+type Value interface {
+	Type() ValueType
+	String() string
+}
+
+type Scalar struct {
+	T int64
+	V float64
+}
+
+type String struct {
+	T int64
+	V string
+}
+
+// 即时向量中的一个元素, Metric 是包含 __name__ 的规范标签集合, 函数和运算可能去掉 __name__
+type Sample struct {
+	Metric model.Labels
+	T      int64
+	V      float64
+}
+
+type Vector []Sample
+
+// 范围向量和范围查询结果中的一条序列, 样本按时间排序
+type Series struct {
+	Metric  model.Labels
+	Samples model.Samples
+}
+
+type Matrix []Series
+
+func (Scalar) Type() ValueType { return ValueTypeScalar }
+func (String) Type() ValueType { return ValueTypeString }
+func (Vector) Type() ValueType { return ValueTypeVector }
+func (Matrix) Type() ValueType { return ValueTypeMatrix }
+
+func (s Scalar) String() string {
+	return fmt.Sprintf("scalar: %s @[%d]", formatValue(s.V), s.T)
+}
+
+func (s String) String() string {
+	return fmt.Sprintf("string: %s @[%d]", strconv.Quote(s.V), s.T)
+}
+
+func (s Sample) String() string {
+	return fmt.Sprintf("%s => %s @[%d]", labelsString(s.Metric), formatValue(s.V), s.T)
+}
+
+func (v Vector) String() string {
+	lines := make([]string, len(v))
+	for i, s := range v {
+		lines[i] = s.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (s Series) String() string {
+	points := make([]string, len(s.Samples))
+	for i, p := range s.Samples {
+		points[i] = fmt.Sprintf("%s @[%d]", formatValue(p.Value), p.Timestamp)
+	}
+	return labelsString(s.Metric) + " =>\n" + strings.Join(points, "\n")
+}
+
+func (m Matrix) String() string {
+	series := make([]string, len(m))
+	for i, s := range m {
+		series[i] = s.String()
+	}
+	return strings.Join(series, "\n")
+}
+
+// 返回类似 http_requests_total{code="200", job="api"} 的字符串
+func labelsString(ls model.Labels) string {
+	var name string
+	var pairs []string
+	for _, l := range ls {
+		if l.Name == model.MetricNameLabel {
+			name = l.Value
+			continue
+		}
+		pairs = append(pairs, l.Name+"="+strconv.Quote(l.Value))
+	}
+	return name + "{" + strings.Join(pairs, ", ") + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+/*
+标签集合的唯一标识, 用于分组和去重
+每个名称和值后面都写入 0xff; 合法的标签名和 UTF-8 标签值中不会出现 0xff 字节, 所以不同的集合得到不同的 key
+*/
+func labelsKey(ls model.Labels) string {
+	var b strings.Builder
+	for _, l := range ls {
+		b.WriteString(l.Name)
+		b.WriteByte(0xff)
+		b.WriteString(l.Value)
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
+
+// 去掉 __name__, 返回新的标签集合
+func dropMetricName(ls model.Labels) model.Labels {
+	result := make(model.Labels, 0, len(ls))
+	for _, l := range ls {
+		if l.Name != model.MetricNameLabel {
+			result = append(result, l)
+		}
+	}
+	return result
+}
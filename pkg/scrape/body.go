@@ -5,13 +5,27 @@ type Body struct {
 	TargetUrl string
 	Data      []byte
 	Labels    map[string]string
+	// 抓取时间 (毫秒), 文本中没有携带时间戳的样本使用该时间
+	Timestamp int64
+	// 目标抓取失败或已被移除, 为它上次抓取到的所有序列写入 staleness marker
+	Stale bool
 }
 
-func NewBody(jobName string, targetUrl string, data []byte, labels map[string]string) *Body {
+func NewBody(jobName string, targetUrl string, data []byte, labels map[string]string, timestamp int64) *Body {
 	return &Body{
 		JobName:   jobName,
 		TargetUrl: targetUrl,
 		Data:      data,
 		Labels:    labels,
+		Timestamp: timestamp,
+	}
+}
+
+func newStaleBody(jobName string, targetUrl string, timestamp int64) *Body {
+	return &Body{
+		JobName:   jobName,
+		TargetUrl: targetUrl,
+		Timestamp: timestamp,
+		Stale:     true,
 	}
 }
@@ -0,0 +1,5 @@
+package scrape
+
+import "errors"
+
+var ErrScraperStopped = errors.New("scraper is stopped")
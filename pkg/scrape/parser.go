@@ -2,22 +2,38 @@ package scrape
 
 import (
 	"context"
+	"log"
+	"mini-promethues/pkg/model"
+	"mini-promethues/pkg/storage"
+	"net/url"
 	"sync"
 )
 
+const (
+	JobLabel      = "job"
+	InstanceLabel = "instance"
+	// 抓取到的标签和目标标签冲突时, 抓取到的标签加上该前缀保留
+	exportedLabelPrefix = "exported_"
+)
+
 type Parser struct {
-	ch     chan *Body
-	ctx    context.Context
-	cancel context.CancelFunc
-	wg     sync.WaitGroup
+	ch      chan *Body
+	storage storage.Storage
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	// 每个目标上次抓取到的序列, 只在 consume 协程中访问
+	previous map[targetKey]map[uint64]*model.Metric
 }
 
-func NewParser(ctx context.Context) *Parser {
+func NewParser(ctx context.Context, storage storage.Storage) *Parser {
 	ctx, cancel := context.WithCancel(ctx)
 	return &Parser{
-		ch:     make(chan *Body, 10000),
-		ctx:    ctx,
-		cancel: cancel,
+		ch:       make(chan *Body, 10000),
+		storage:  storage,
+		ctx:      ctx,
+		cancel:   cancel,
+		previous: make(map[targetKey]map[uint64]*model.Metric),
 	}
 }
 
@@ -26,13 +42,16 @@ func (p *Parser) start() {
 	go p.consume()
 }
 
-func (p *Parser) produce(body *Body) error {
+// ctx 是生产者自己的 context, 生产者停止时不再等待队列空间
+func (p *Parser) produce(ctx context.Context, body *Body) error {
 	if body == nil {
 		return nil
 	}
 	select {
 	case p.ch <- body:
 		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	case <-p.ctx.Done():
 		return p.ctx.Err()
 	}
@@ -42,7 +61,10 @@ func (p *Parser) consume() {
 	defer p.wg.Done()
 	for {
 		select {
-		case body := <-p.ch:
+		case body, ok := <-p.ch:
+			if !ok {
+				return
+			}
 			p.parser(body)
 		case <-p.ctx.Done():
 			return
@@ -50,13 +72,142 @@ func (p *Parser) consume() {
 	}
 }
 
-func (p *Parser) stop() {
-	p.cancel()
+/*
+停止解析, 调用前所有生产者必须已经退出
+队列中剩下的抓取结果 (包括被移除目标的 staleness marker) 全部写入存储后才返回;
+ctx 结束时放弃剩下的结果, 返回 ctx 的错误
+*/
+func (p *Parser) stop(ctx context.Context) error {
+	defer p.cancel()
 	close(p.ch)
-	p.wg.Wait()
-	return
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (p *Parser) parser(body *Body) {
+	key := targetKey{job: body.JobName, url: body.TargetUrl}
+	// 一次抓取的样本和 marker 一起提交, 在 WAL 中只占一条记录
+	app := p.storage.Appender()
+	if body.Stale {
+		p.markStale(app, body, p.previous[key], nil)
+		delete(p.previous, key)
+		p.commit(app, body)
+		return
+	}
+	result := ParseText(body.Data)
+	for _, err := range result.Errors {
+		log.Printf("parse metrics from %s (job %s): %v", body.TargetUrl, body.JobName, err)
+	}
+	targetLabels := buildTargetLabels(body)
+	current := make(map[uint64]*model.Metric, len(result.Samples))
+	failed := 0
+	for i := range result.Samples {
+		ps := &result.Samples[i]
+		metric := mergeLabels(&ps.Metric, targetLabels)
+		sample := ps.Sample
+		if !ps.HasTimestamp {
+			sample.Timestamp = body.Timestamp
+			// 带时间戳的样本由目标决定时间, 不能在抓取时间写入 marker, 和 Prometheus 一样不跟踪
+			current[metric.Fingerprint()] = metric
+		}
+		if err := app.Append(metric, &sample); err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		log.Printf("append samples from %s (job %s): %d of %d samples failed",
+			body.TargetUrl, body.JobName, failed, len(result.Samples))
+	}
+	p.markStale(app, body, p.previous[key], current)
+	p.previous[key] = current
+	p.commit(app, body)
+}
 
+func (p *Parser) commit(app storage.Appender, body *Body) {
+	if err := app.Commit(); err != nil {
+		log.Printf("commit samples from %s (job %s): %v", body.TargetUrl, body.JobName, err)
+	}
+}
+
+// 为上次抓取到、这次没有出现的序列写入 staleness marker
+func (p *Parser) markStale(app storage.Appender, body *Body, previous, current map[uint64]*model.Metric) {
+	failed := 0
+	for fp, metric := range previous {
+		if _, ok := current[fp]; ok {
+			continue
+		}
+		sample := model.Sample{Timestamp: body.Timestamp, Value: model.StaleValue()}
+		if err := app.Append(metric, &sample); err != nil {
+			failed++
+		}
+	}
+	if failed > 0 {
+		log.Printf("append staleness markers for %s (job %s): %d markers failed",
+			body.TargetUrl, body.JobName, failed)
+	}
+}
+
+/*
+目标标签: 静态配置标签 (已合并 external_labels) + job + instance
+job 默认为任务名, instance 默认为目标地址; 配置中写了同名标签时使用配置的值, 与 Prometheus 一致
+*/
+func buildTargetLabels(body *Body) model.Labels {
+	labels := make(model.Labels, 0, len(body.Labels)+2)
+	for k, v := range body.Labels {
+		labels = append(labels, model.Label{Name: k, Value: v})
+	}
+	if _, ok := body.Labels[JobLabel]; !ok {
+		labels = append(labels, model.Label{Name: JobLabel, Value: body.JobName})
+	}
+	if _, ok := body.Labels[InstanceLabel]; !ok {
+		labels = append(labels, model.Label{Name: InstanceLabel, Value: targetInstance(body.TargetUrl)})
+	}
+	return labels.Sorted()
+}
+
+// instance 取目标地址的 host:port 部分
+func targetInstance(targetUrl string) string {
+	u, err := url.Parse(targetUrl)
+	if err != nil || u.Host == "" {
+		return targetUrl
+	}
+	return u.Host
+}
+
+/*
+合并抓取到的标签和目标标签, 目标标签优先
+冲突的抓取标签重命名为 exported_<name>, 与 Prometheus honor_labels: false 的行为一致
+*/
+func mergeLabels(m *model.Metric, targetLabels model.Labels) *model.Metric {
+	merged := make(model.Labels, 0, len(m.Labels)+len(targetLabels))
+	for _, l := range m.Labels {
+		name := l.Name
+		if hasLabel(targetLabels, name) {
+			name = exportedLabelPrefix + name
+			for hasLabel(targetLabels, name) || hasLabel(m.Labels, name) {
+				name = exportedLabelPrefix + name
+			}
+		}
+		merged = append(merged, model.Label{Name: name, Value: l.Value})
+	}
+	merged = append(merged, targetLabels...)
+	return model.NewMetric(m.Name, merged)
+}
+
+func hasLabel(labels model.Labels, name string) bool {
+	for _, l := range labels {
+		if l.Name == name {
+			return true
+		}
+	}
+	return false
 }
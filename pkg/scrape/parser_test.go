@@ -0,0 +1,251 @@
+package scrape
+
+import (
+	"context"
+	"errors"
+	"mini-promethues/pkg/model"
+	"mini-promethues/pkg/storage"
+	"slices"
+	"testing"
+)
+
+// TestParser_AppendToStorage 测试解析结果写入存储并附加目标标签
+func TestParser_AppendToStorage(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	p := NewParser(context.Background(), store)
+
+	data := []byte(`# TYPE http_requests_total counter
+http_requests_total{method="GET"} 10
+http_requests_total{method="POST"} 20 1000
+`)
+	body := NewBody("api", "http://localhost:8080/metrics", data,
+		map[string]string{"env": "prod"}, 5000)
+	p.parser(body)
+
+	t.Run("无时间戳的样本使用抓取时间", func(t *testing.T) {
+		m := &model.Metric{Name: "http_requests_total", Labels: model.Labels{
+			{Name: "method", Value: "GET"},
+			{Name: "env", Value: "prod"},
+			{Name: "job", Value: "api"},
+			{Name: "instance", Value: "localhost:8080"},
+		}}
+		series, err := store.QueryRange(m, 0, 10000)
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		if len(series.Samples) != 1 || series.Samples[0] != (model.Sample{Timestamp: 5000, Value: 10}) {
+			t.Errorf("期望 [{5000 10}], 实际 %v", series.Samples)
+		}
+	})
+
+	t.Run("带时间戳的样本保留原时间戳", func(t *testing.T) {
+		m := &model.Metric{Name: "http_requests_total", Labels: model.Labels{
+			{Name: "method", Value: "POST"},
+			{Name: "env", Value: "prod"},
+			{Name: "job", Value: "api"},
+			{Name: "instance", Value: "localhost:8080"},
+		}}
+		series, err := store.QueryRange(m, 0, 10000)
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		if len(series.Samples) != 1 || series.Samples[0] != (model.Sample{Timestamp: 1000, Value: 20}) {
+			t.Errorf("期望 [{1000 20}], 实际 %v", series.Samples)
+		}
+	})
+}
+
+// TestBuildTargetLabels 测试配置的 job / instance 标签覆盖默认值
+func TestBuildTargetLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{name: "默认值", labels: map[string]string{"env": "prod"}, want: "env=prod,instance=localhost:8080,job=api"},
+		{name: "配置 instance", labels: map[string]string{"instance": "web-1"}, want: "instance=web-1,job=api"},
+		{name: "配置 job", labels: map[string]string{"job": "frontend"}, want: "instance=localhost:8080,job=frontend"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := NewBody("api", "http://localhost:8080/metrics", nil, tt.labels, 0)
+			if got := buildTargetLabels(body).String(); got != tt.want {
+				t.Errorf("期望 %s, 实际 %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMergeLabels(t *testing.T) {
+	target := model.Labels{
+		{Name: "instance", Value: "localhost:8080"},
+		{Name: "job", Value: "api"},
+	}
+	m := &model.Metric{Name: "up", Labels: model.Labels{
+		{Name: "job", Value: "scraped"},
+		{Name: "exported_job", Value: "other"},
+		{Name: "path", Value: "/"},
+	}}
+	got := mergeLabels(m, target)
+	want := "up{exported_exported_job=scraped,exported_job=other,instance=localhost:8080,job=api,path=/}"
+	if got.String() != want {
+		t.Errorf("期望 %s, 实际 %s", want, got.String())
+	}
+}
+
+// TestParser_StaleMarkers 测试序列消失和目标下线时写入 staleness marker
+func TestParser_StaleMarkers(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	p := NewParser(context.Background(), store)
+	target := "http://localhost:8080/metrics"
+	metric := func(method string) *model.Metric {
+		return &model.Metric{Name: "http_requests_total", Labels: model.Labels{
+			{Name: "method", Value: method},
+			{Name: "job", Value: "api"},
+			{Name: "instance", Value: "localhost:8080"},
+		}}
+	}
+	latest := func(t *testing.T, m *model.Metric, ts int64) model.Samples {
+		t.Helper()
+		series, err := store.QueryRange(m, ts, ts)
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		return series.Samples
+	}
+
+	p.parser(NewBody("api", target, []byte("http_requests_total{method=\"GET\"} 1\nhttp_requests_total{method=\"POST\"} 2\n"), nil, 1000))
+	p.parser(NewBody("api", target, []byte("http_requests_total{method=\"GET\"} 3\n"), nil, 2000))
+
+	t.Run("消失的序列写入 marker", func(t *testing.T) {
+		samples := latest(t, metric("POST"), 2000)
+		if len(samples) != 1 || !model.IsStaleNaN(samples[0].Value) {
+			t.Errorf("期望 POST 序列在 2000 写入 marker，实际 %v", samples)
+		}
+		if samples := latest(t, metric("GET"), 2000); len(samples) != 1 || samples[0].Value != 3 {
+			t.Errorf("期望 GET 序列的值为 3，实际 %v", samples)
+		}
+		series, _ := store.Query(metric("POST"), 3000)
+		if len(series.Samples) != 0 {
+			t.Errorf("期望即时查询 POST 序列没有值，实际 %v", series.Samples)
+		}
+	})
+
+	t.Run("目标下线时所有序列写入 marker", func(t *testing.T) {
+		p.parser(newStaleBody("api", target, 3000))
+		samples := latest(t, metric("GET"), 3000)
+		if len(samples) != 1 || !model.IsStaleNaN(samples[0].Value) {
+			t.Errorf("期望 GET 序列在 3000 写入 marker，实际 %v", samples)
+		}
+		// 已经写过 marker 的序列不会重复写入
+		p.parser(newStaleBody("api", target, 4000))
+		if samples := latest(t, metric("GET"), 4000); len(samples) != 0 {
+			t.Errorf("期望不再写入 marker，实际 %v", samples)
+		}
+	})
+
+	t.Run("带时间戳的样本不写入 marker", func(t *testing.T) {
+		other := "http://localhost:9090/metrics"
+		p.parser(NewBody("api", other, []byte("push_time_seconds 1 1500\n"), nil, 5000))
+		p.parser(newStaleBody("api", other, 6000))
+		m := &model.Metric{Name: "push_time_seconds", Labels: model.Labels{
+			{Name: "job", Value: "api"},
+			{Name: "instance", Value: "localhost:9090"},
+		}}
+		if samples := latest(t, m, 6000); len(samples) != 0 {
+			t.Errorf("期望不写入 marker，实际 %v", samples)
+		}
+	})
+}
+
+// TestParser_StopFlushesQueue 测试停止时队列中的抓取结果和 staleness marker 全部写入存储
+func TestParser_StopFlushesQueue(t *testing.T) {
+	store := storage.NewMemoryStorage()
+	p := NewParser(context.Background(), store)
+	target := "http://localhost:8080/metrics"
+	const n = 100
+	for i := 0; i < n; i++ {
+		body := NewBody("api", target, []byte("up 1\n"), nil, int64(i+1)*1000)
+		if err := p.produce(context.Background(), body); err != nil {
+			t.Fatalf("写入队列失败: %v", err)
+		}
+	}
+	if err := p.produce(context.Background(), newStaleBody("api", target, (n+1)*1000)); err != nil {
+		t.Fatalf("写入队列失败: %v", err)
+	}
+	p.start()
+	if err := p.stop(context.Background()); err != nil {
+		t.Fatalf("停止失败: %v", err)
+	}
+
+	m := &model.Metric{Name: "up", Labels: model.Labels{
+		{Name: "job", Value: "api"},
+		{Name: "instance", Value: "localhost:8080"},
+	}}
+	series, err := store.QueryRange(m, 0, (n+1)*1000)
+	if err != nil {
+		t.Fatalf("查询失败: %v", err)
+	}
+	if len(series.Samples) != n+1 {
+		t.Fatalf("期望 %d 个样本，实际 %d 个", n+1, len(series.Samples))
+	}
+	if last := series.Samples[n]; !model.IsStaleNaN(last.Value) {
+		t.Errorf("期望最后一个样本是 staleness marker，实际 %v", last)
+	}
+}
+
+// TestParser_StopTimeout 测试 ctx 结束时不再等待队列写完
+func TestParser_StopTimeout(t *testing.T) {
+	p := NewParser(context.Background(), storage.NewMemoryStorage())
+	p.produce(context.Background(), NewBody("api", "http://localhost:8080/metrics", []byte("up 1\n"), nil, 1000))
+	// 没有启动 consume, 队列永远不会写完
+	p.wg.Add(1)
+	defer p.wg.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.stop(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("期望 context.Canceled，实际 %v", err)
+	}
+}
+
+// 记录 Commit 次数和每次提交的样本数
+type commitCountingStorage struct {
+	storage.Storage
+	commits []int
+}
+
+func (s *commitCountingStorage) Appender() storage.Appender {
+	return &commitCountingAppender{Appender: s.Storage.Appender(), storage: s}
+}
+
+type commitCountingAppender struct {
+	storage.Appender
+	storage *commitCountingStorage
+	pending int
+}
+
+func (a *commitCountingAppender) Append(m *model.Metric, s *model.Sample) error {
+	a.pending++
+	return a.Appender.Append(m, s)
+}
+
+func (a *commitCountingAppender) Commit() error {
+	a.storage.commits = append(a.storage.commits, a.pending)
+	a.pending = 0
+	return a.Appender.Commit()
+}
+
+// TestParser_CommitPerBody 测试每次抓取的样本和 staleness marker 一起提交一次
+func TestParser_CommitPerBody(t *testing.T) {
+	store := &commitCountingStorage{Storage: storage.NewMemoryStorage()}
+	p := NewParser(context.Background(), store)
+	p.parser(NewBody("api", "http://localhost:8080/metrics", []byte("a 1\nb 2\nc 3\n"), nil, 1000))
+	// b、c 消失, 样本 a 和两个 marker 在同一次提交中
+	p.parser(NewBody("api", "http://localhost:8080/metrics", []byte("a 1\n"), nil, 2000))
+	p.parser(newStaleBody("api", "http://localhost:8080/metrics", 3000))
+
+	want := []int{3, 3, 1}
+	if !slices.Equal(store.commits, want) {
+		t.Errorf("期望每次提交的样本数 %v，实际 %v", want, store.commits)
+	}
+}
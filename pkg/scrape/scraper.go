@@ -2,98 +2,190 @@ package scrape
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"maps"
 	"mini-promethues/pkg/config"
+	"mini-promethues/pkg/storage"
 	"net/http"
 	"sync"
 	"time"
 )
 
+// 抓取目标由 job 和目标地址唯一确定
+type targetKey struct {
+	job string
+	url string
+}
+
+type scrapeTarget struct {
+	interval time.Duration
+	timeout  time.Duration
+	labels   map[string]string
+
+	cancel context.CancelFunc
+	// 目标从配置中移除, 停止时为它的序列写入 staleness marker; 在 cancel 之前设置
+	removed bool
+}
+
+func (t *scrapeTarget) equal(o *scrapeTarget) bool {
+	return t.interval == o.interval && t.timeout == o.timeout && maps.Equal(t.labels, o.labels)
+}
+
 type Scraper struct {
+	// 启动时使用的配置
 	configMap  map[string]config.ScrapeConfig
 	httpClient *http.Client
 	ctx        context.Context
 	cancel     context.CancelFunc
 	wg         sync.WaitGroup
 	parser     *Parser
+
+	// 保护 targets 和 stopped; Stop 持有锁设置 stopped 并取消 ctx, 之后不会再启动新的抓取循环
+	mutex   sync.Mutex
+	targets map[targetKey]*scrapeTarget
+	stopped bool
 }
 
-func NewScraper(config *config.Config) *Scraper {
+func NewScraper(config *config.Config, storage storage.Storage) *Scraper {
 	ctx, cancel := context.WithCancel(context.Background())
+	// 停止抓取后解析器还要写完队列中的结果, 不跟随 scraper 的 context 取消
 	return &Scraper{
 		configMap:  config.Process(),
 		httpClient: &http.Client{},
 		ctx:        ctx,
 		cancel:     cancel,
-		parser:     NewParser(ctx),
+		parser:     NewParser(context.Background(), storage),
+		targets:    make(map[targetKey]*scrapeTarget),
 	}
 }
 
 func (s *Scraper) Start() error {
-	for _, v := range s.configMap {
-		s.wg.Add(1)
-		go s.runJob(v)
+	if err := s.applyTargets(s.configMap); err != nil {
+		return err
 	}
 	s.parser.start()
 	return nil
 }
 
-func (s *Scraper) Stop() error {
+// 停止抓取, 等待已经抓取到的结果写入存储; ctx 结束时不再等待, 重复调用直接返回
+func (s *Scraper) Stop(ctx context.Context) error {
+	s.mutex.Lock()
+	if s.stopped {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.stopped = true
 	s.cancel()
+	s.mutex.Unlock()
+
 	s.wg.Wait()
-	s.parser.stop()
+	if err := s.parser.stop(ctx); err != nil {
+		return fmt.Errorf("flush scraped samples: %w", err)
+	}
 	return nil
 }
 
-func (s *Scraper) runJob(sc config.ScrapeConfig) {
-	defer s.wg.Done()
-	for _, stc := range sc.StaticConfigs {
-		for _, target := range stc.Targets {
-			s.wg.Add(1)
-			go s.runTarget(sc.JobName, target, sc.ScrapeInterval, sc.ScrapeTimeout, stc.Labels)
+/*
+使用新的配置更新抓取目标
+新增的目标开始抓取, 配置变化的目标重新启动, 被移除的目标停止并为它的序列写入 staleness marker
+*/
+func (s *Scraper) ApplyConfig(config *config.Config) error {
+	return s.applyTargets(config.Process())
+}
+
+func (s *Scraper) applyTargets(configMap map[string]config.ScrapeConfig) error {
+	want := make(map[targetKey]*scrapeTarget)
+	for _, sc := range configMap {
+		for _, stc := range sc.StaticConfigs {
+			for _, target := range stc.Targets {
+				want[targetKey{job: sc.JobName, url: target}] = &scrapeTarget{
+					interval: sc.ScrapeInterval,
+					timeout:  sc.ScrapeTimeout,
+					labels:   stc.Labels,
+				}
+			}
 		}
 	}
-}
 
-func (s *Scraper) runTarget(jobName, target string,
-	interval time.Duration, timeout time.Duration, labels map[string]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// 在锁内检查, Stop 开始等待抓取循环退出后不会再调用 wg.Add
+	if s.stopped {
+		return ErrScraperStopped
+	}
+	for key, t := range s.targets {
+		nt, ok := want[key]
+		if ok && t.equal(nt) {
+			want[key] = t
+			continue
+		}
+		// 配置变化的目标由新的抓取循环接着跟踪, 消失的序列在下一次抓取时写入 marker
+		t.removed = !ok
+		t.cancel()
+	}
+	for key, t := range want {
+		if t.cancel != nil {
+			continue
+		}
+		ctx, cancel := context.WithCancel(s.ctx)
+		t.cancel = cancel
+		s.wg.Add(1)
+		go s.runTarget(ctx, key, t)
+	}
+	s.targets = want
+	return nil
+}
 
+func (s *Scraper) runTarget(ctx context.Context, key targetKey, t *scrapeTarget) {
 	defer s.wg.Done()
-	ticker := time.NewTicker(interval)
+	ticker := time.NewTicker(t.interval)
 	defer ticker.Stop()
 
+	var lastScrape int64
 	for {
 		select {
 		case <-ticker.C:
-			s.scrape(target, jobName, labels, timeout)
-		case <-s.ctx.Done():
+			scrapeTime := time.Now().UnixMilli()
+			lastScrape = scrapeTime
+			data, err := s.scrape(ctx, key.url, t.timeout)
+			if ctx.Err() != nil {
+				continue
+			}
+			body := NewBody(key.job, key.url, data, t.labels, scrapeTime)
+			if err != nil {
+				// 目标下线, 它的序列从抓取时间开始没有值
+				body = newStaleBody(key.job, key.url, scrapeTime)
+			}
+			if err = s.parser.produce(ctx, body); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			// 停止整个 scraper 时不写入 marker, 重启后可以接着抓取
+			if t.removed && s.ctx.Err() == nil {
+				// 和上一次抓取在同一毫秒时, marker 会和样本冲突而写入失败
+				staleTime := max(time.Now().UnixMilli(), lastScrape+1)
+				s.parser.produce(s.ctx, newStaleBody(key.job, key.url, staleTime))
+			}
 			return
 		}
 	}
 }
 
-func (s *Scraper) scrape(targetUrl, jobName string,
-	labels map[string]string, timeout time.Duration) {
-	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+func (s *Scraper) scrape(ctx context.Context, targetUrl string, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 	req, err := http.NewRequestWithContext(ctx, "GET", targetUrl, nil)
 	if err != nil {
-		return
+		return nil, err
 	}
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
-		return
+		return nil, err
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return
-	}
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return
-	}
-	body := NewBody(jobName, targetUrl, data, labels)
-	if err = s.parser.produce(body); err != nil {
-		return
+		return nil, fmt.Errorf("server returned HTTP status %s", resp.Status)
 	}
+	return io.ReadAll(resp.Body)
 }
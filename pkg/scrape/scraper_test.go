@@ -0,0 +1,104 @@
+package scrape
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mini-promethues/pkg/config"
+	"mini-promethues/pkg/model"
+	"mini-promethues/pkg/storage"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestScraper_ApplyConfig 测试目标从配置中移除后写入 staleness marker
+func TestScraper_ApplyConfig(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "up 1")
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	cfg := &config.Config{ScrapeConfigs: []config.ScrapeConfig{{
+		JobName:        "node",
+		ScrapeInterval: 10 * time.Millisecond,
+		ScrapeTimeout:  time.Second,
+		StaticConfigs:  []config.StaticConfig{{Targets: []string{host}}},
+	}}}
+	store := storage.NewMemoryStorage()
+	s := NewScraper(cfg, store)
+	if err := s.Start(); err != nil {
+		t.Fatalf("启动失败: %v", err)
+	}
+	defer s.Stop(context.Background())
+
+	m := &model.Metric{Name: "up", Labels: model.Labels{
+		{Name: "job", Value: "node"},
+		{Name: "instance", Value: host},
+	}}
+	waitFor := func(desc string, cond func(series model.Series) bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			series, err := store.Query(m, time.Now().UnixMilli())
+			if err == nil && cond(series) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("等待超时: %s", desc)
+	}
+	waitFor("抓取到样本", func(series model.Series) bool { return len(series.Samples) == 1 })
+
+	if err := s.ApplyConfig(&config.Config{}); err != nil {
+		t.Fatalf("更新配置失败: %v", err)
+	}
+	waitFor("写入 marker", func(series model.Series) bool { return len(series.Samples) == 0 })
+}
+
+// TestScraper_ApplyConfigDuringStop 测试 ApplyConfig 和 Stop 并发时不会在停止后启动新的抓取循环
+func TestScraper_ApplyConfigDuringStop(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "up 1")
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	configWith := func(targets ...string) *config.Config {
+		return &config.Config{ScrapeConfigs: []config.ScrapeConfig{{
+			JobName:        "node",
+			ScrapeInterval: time.Millisecond,
+			ScrapeTimeout:  time.Second,
+			StaticConfigs:  []config.StaticConfig{{Targets: targets}},
+		}}}
+	}
+
+	for i := 0; i < 50; i++ {
+		s := NewScraper(configWith(host), storage.NewMemoryStorage())
+		if err := s.Start(); err != nil {
+			t.Fatalf("启动失败: %v", err)
+		}
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for j := 0; ; j++ {
+				// 交替移除和加入目标, 每次都会启动新的抓取循环并为移除的目标写入 marker
+				cfg := configWith(host, fmt.Sprintf("%s/%d", host, j))
+				if j%2 == 1 {
+					cfg = configWith()
+				}
+				if err := s.ApplyConfig(cfg); err != nil {
+					if !errors.Is(err, ErrScraperStopped) {
+						t.Errorf("期望 ErrScraperStopped，实际 %v", err)
+					}
+					return
+				}
+			}
+		}()
+		if err := s.Stop(context.Background()); err != nil {
+			t.Fatalf("停止失败: %v", err)
+		}
+		<-done
+	}
+}
@@ -0,0 +1,325 @@
+package scrape
+
+import (
+	"fmt"
+	"mini-promethues/pkg/model"
+	"strconv"
+	"strings"
+)
+
+type MetricType string
+
+const (
+	MetricTypeCounter   MetricType = "counter"
+	MetricTypeGauge     MetricType = "gauge"
+	MetricTypeHistogram MetricType = "histogram"
+	MetricTypeSummary   MetricType = "summary"
+	MetricTypeUntyped   MetricType = "untyped"
+)
+
+type Metadata struct {
+	Type MetricType
+	Help string
+}
+
+type ParsedSample struct {
+	Metric model.Metric
+	Sample model.Sample
+	// 文本中没有携带时间戳时为 false, 由调用方填充抓取时间
+	HasTimestamp bool
+}
+
+type ParseError struct {
+	Line int
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+type ParseResult struct {
+	Samples  []ParsedSample
+	Metadata map[string]Metadata
+	Errors   []error
+}
+
+/*
+解析 Prometheus 文本格式 (text/plain; version=0.0.4)
+
+	# HELP http_requests_total The total number of HTTP requests.
+	# TYPE http_requests_total counter
+	http_requests_total{method="post",code="200"} 1027 1395066363000
+
+格式错误的行会记录带行号的错误并跳过, 不影响其它行
+*/
+func ParseText(data []byte) *ParseResult {
+	result := &ParseResult{Metadata: make(map[string]Metadata)}
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		lineNo := i + 1
+		line = strings.TrimRight(line, "\r")
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			continue
+		}
+		var err error
+		if line[0] == '#' {
+			err = result.parseComment(line)
+		} else {
+			var ps ParsedSample
+			ps, err = parseSampleLine(line)
+			if err == nil {
+				result.Samples = append(result.Samples, ps)
+			}
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, &ParseError{Line: lineNo, Msg: err.Error()})
+		}
+	}
+	return result
+}
+
+// 只处理 HELP 和 TYPE, 其它注释直接忽略
+func (r *ParseResult) parseComment(line string) error {
+	fields := strings.Fields(line[1:])
+	if len(fields) < 2 || (fields[0] != "HELP" && fields[0] != "TYPE") {
+		return nil
+	}
+	name := fields[1]
+	if !model.ValidMetricName(name) {
+		return fmt.Errorf("invalid metric name %q in %s line", name, fields[0])
+	}
+	md := r.Metadata[name]
+	switch fields[0] {
+	case "HELP":
+		// 保留原始的空白字符, 只去掉 "HELP name" 前缀
+		rest := strings.TrimLeft(line[1:], " \t")
+		rest = strings.TrimLeft(rest[len("HELP"):], " \t")
+		rest = strings.TrimLeft(rest[len(name):], " \t")
+		help, err := unescapeHelp(rest)
+		if err != nil {
+			return err
+		}
+		md.Help = help
+	case "TYPE":
+		if len(fields) != 3 {
+			return fmt.Errorf("invalid TYPE line for metric %q", name)
+		}
+		if md.Type != "" {
+			return fmt.Errorf("second TYPE line for metric %q", name)
+		}
+		typ := MetricType(fields[2])
+		switch typ {
+		case MetricTypeCounter, MetricTypeGauge, MetricTypeHistogram, MetricTypeSummary, MetricTypeUntyped:
+		default:
+			return fmt.Errorf("unknown metric type %q for metric %q", fields[2], name)
+		}
+		md.Type = typ
+	}
+	r.Metadata[name] = md
+	return nil
+}
+
+func parseSampleLine(line string) (ParsedSample, error) {
+	var ps ParsedSample
+	lp := &lineParser{line: line}
+
+	name := lp.readName(isMetricNameChar)
+	if name == "" {
+		return ps, fmt.Errorf("invalid metric name at position %d", lp.pos)
+	}
+	ps.Metric.Name = name
+
+	lp.skipSpaces()
+	if lp.peek() == '{' {
+		lp.pos++
+		labels, err := lp.readLabels()
+		if err != nil {
+			return ps, err
+		}
+		ps.Metric.Labels = labels
+	}
+
+	lp.skipSpaces()
+	valueStr := lp.readToken()
+	if valueStr == "" {
+		return ps, fmt.Errorf("missing value for metric %q", name)
+	}
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil {
+		return ps, fmt.Errorf("invalid value %q for metric %q", valueStr, name)
+	}
+	ps.Sample.Value = value
+
+	lp.skipSpaces()
+	if tsStr := lp.readToken(); tsStr != "" {
+		ts, err := strconv.ParseInt(tsStr, 10, 64)
+		if err != nil {
+			return ps, fmt.Errorf("invalid timestamp %q for metric %q", tsStr, name)
+		}
+		ps.Sample.Timestamp = ts
+		ps.HasTimestamp = true
+	}
+
+	lp.skipSpaces()
+	if !lp.eof() {
+		return ps, fmt.Errorf("unexpected content %q after sample", line[lp.pos:])
+	}
+	return ps, nil
+}
+
+type lineParser struct {
+	line string
+	pos  int
+}
+
+func (lp *lineParser) eof() bool {
+	return lp.pos >= len(lp.line)
+}
+
+func (lp *lineParser) peek() byte {
+	if lp.eof() {
+		return 0
+	}
+	return lp.line[lp.pos]
+}
+
+func (lp *lineParser) skipSpaces() {
+	for !lp.eof() && (lp.line[lp.pos] == ' ' || lp.line[lp.pos] == '\t') {
+		lp.pos++
+	}
+}
+
+func (lp *lineParser) readName(valid func(c byte, first bool) bool) string {
+	start := lp.pos
+	for !lp.eof() && valid(lp.line[lp.pos], lp.pos == start) {
+		lp.pos++
+	}
+	return lp.line[start:lp.pos]
+}
+
+func (lp *lineParser) readToken() string {
+	start := lp.pos
+	for !lp.eof() && lp.line[lp.pos] != ' ' && lp.line[lp.pos] != '\t' {
+		lp.pos++
+	}
+	return lp.line[start:lp.pos]
+}
+
+// 读取 '{' 之后的标签列表, 直到匹配的 '}'
+func (lp *lineParser) readLabels() (model.Labels, error) {
+	var labels model.Labels
+	seen := make(map[string]struct{})
+	for {
+		lp.skipSpaces()
+		if lp.peek() == '}' {
+			lp.pos++
+			return labels, nil
+		}
+		name := lp.readName(isLabelNameChar)
+		if name == "" {
+			return nil, fmt.Errorf("invalid label name at position %d", lp.pos)
+		}
+		if _, ok := seen[name]; ok {
+			return nil, fmt.Errorf("duplicate label name %q", name)
+		}
+		seen[name] = struct{}{}
+
+		lp.skipSpaces()
+		if lp.peek() != '=' {
+			return nil, fmt.Errorf("expected '=' after label name %q", name)
+		}
+		lp.pos++
+		lp.skipSpaces()
+		if lp.peek() != '"' {
+			return nil, fmt.Errorf("expected '\"' to start value of label %q", name)
+		}
+		lp.pos++
+		value, err := lp.readLabelValue()
+		if err != nil {
+			return nil, fmt.Errorf("label %q: %w", name, err)
+		}
+		labels = append(labels, model.Label{Name: name, Value: value})
+
+		lp.skipSpaces()
+		switch lp.peek() {
+		case ',':
+			lp.pos++
+		case '}':
+			lp.pos++
+			return labels, nil
+		default:
+			return nil, fmt.Errorf("expected ',' or '}' after label %q", name)
+		}
+	}
+}
+
+// 读取引号内的标签值, 支持 \\ \" \n 三种转义
+func (lp *lineParser) readLabelValue() (string, error) {
+	var b strings.Builder
+	for !lp.eof() {
+		c := lp.line[lp.pos]
+		lp.pos++
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if lp.eof() {
+				return "", fmt.Errorf("unterminated escape sequence")
+			}
+			next := lp.line[lp.pos]
+			lp.pos++
+			switch next {
+			case '\\':
+				b.WriteByte('\\')
+			case '"':
+				b.WriteByte('"')
+			case 'n':
+				b.WriteByte('\n')
+			default:
+				return "", fmt.Errorf("invalid escape sequence '\\%c'", next)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated label value")
+}
+
+// HELP 文本只支持 \\ 和 \n 两种转义
+func unescapeHelp(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 >= len(s) {
+			return "", fmt.Errorf("unterminated escape sequence in HELP")
+		}
+		i++
+		switch s[i] {
+		case '\\':
+			b.WriteByte('\\')
+		case 'n':
+			b.WriteByte('\n')
+		default:
+			return "", fmt.Errorf("invalid escape sequence '\\%c' in HELP", s[i])
+		}
+	}
+	return b.String(), nil
+}
+
+func isMetricNameChar(c byte, first bool) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' || c == ':' ||
+		(!first && c >= '0' && c <= '9')
+}
+
+func isLabelNameChar(c byte, first bool) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' ||
+		(!first && c >= '0' && c <= '9')
+}
@@ -0,0 +1,157 @@
+package scrape
+
+import (
+	"errors"
+	"math"
+	"mini-promethues/pkg/model"
+	"reflect"
+	"testing"
+)
+
+// TestParseText_Samples 测试样本行解析
+func TestParseText_Samples(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []ParsedSample
+	}{
+		{
+			name:  "无标签无时间戳",
+			input: "up 1\n",
+			want: []ParsedSample{
+				{Metric: model.Metric{Name: "up"}, Sample: model.Sample{Value: 1}},
+			},
+		},
+		{
+			name:  "带标签和时间戳",
+			input: `http_requests_total{method="post",code="200"} 1027 1395066363000`,
+			want: []ParsedSample{
+				{
+					Metric: model.Metric{Name: "http_requests_total", Labels: model.Labels{
+						{Name: "method", Value: "post"},
+						{Name: "code", Value: "200"},
+					}},
+					Sample:       model.Sample{Timestamp: 1395066363000, Value: 1027},
+					HasTimestamp: true,
+				},
+			},
+		},
+		{
+			name:  "标签值转义",
+			input: `msdos_file_access_time_seconds{path="C:\\DIR\\FILE.TXT",error="Cannot find file:\n\"FILE.TXT\""} 1.458255915e9`,
+			want: []ParsedSample{
+				{
+					Metric: model.Metric{Name: "msdos_file_access_time_seconds", Labels: model.Labels{
+						{Name: "path", Value: `C:\DIR\FILE.TXT`},
+						{Name: "error", Value: "Cannot find file:\n\"FILE.TXT\""},
+					}},
+					Sample: model.Sample{Value: 1.458255915e9},
+				},
+			},
+		},
+		{
+			name:  "空标签集合和末尾逗号",
+			input: "a{} 1\nb{x=\"1\",} 2\n",
+			want: []ParsedSample{
+				{Metric: model.Metric{Name: "a"}, Sample: model.Sample{Value: 1}},
+				{Metric: model.Metric{Name: "b", Labels: model.Labels{{Name: "x", Value: "1"}}}, Sample: model.Sample{Value: 2}},
+			},
+		},
+		{
+			name:  "特殊浮点值",
+			input: "a +Inf\nb -Inf\n",
+			want: []ParsedSample{
+				{Metric: model.Metric{Name: "a"}, Sample: model.Sample{Value: math.Inf(1)}},
+				{Metric: model.Metric{Name: "b"}, Sample: model.Sample{Value: math.Inf(-1)}},
+			},
+		},
+		{
+			name:  "注释和空行被忽略",
+			input: "# just a comment\n\n   \nfoo:bar 3\r\n",
+			want: []ParsedSample{
+				{Metric: model.Metric{Name: "foo:bar"}, Sample: model.Sample{Value: 3}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := ParseText([]byte(tt.input))
+			if len(result.Errors) != 0 {
+				t.Fatalf("期望没有错误, 实际=%v", result.Errors)
+			}
+			if !reflect.DeepEqual(result.Samples, tt.want) {
+				t.Errorf("期望 %+v, 实际 %+v", tt.want, result.Samples)
+			}
+		})
+	}
+}
+
+func TestParseText_NaN(t *testing.T) {
+	result := ParseText([]byte("a NaN\n"))
+	if len(result.Errors) != 0 || len(result.Samples) != 1 {
+		t.Fatalf("解析失败: %v", result.Errors)
+	}
+	if !math.IsNaN(result.Samples[0].Sample.Value) {
+		t.Errorf("期望 NaN, 实际 %v", result.Samples[0].Sample.Value)
+	}
+}
+
+// TestParseText_Metadata 测试 HELP 和 TYPE 解析
+func TestParseText_Metadata(t *testing.T) {
+	input := `# HELP http_requests_total The total number of\nHTTP requests \\ all.
+# TYPE http_requests_total counter
+http_requests_total 1
+# TYPE rpc_duration_seconds summary
+`
+	result := ParseText([]byte(input))
+	if len(result.Errors) != 0 {
+		t.Fatalf("期望没有错误, 实际=%v", result.Errors)
+	}
+	want := map[string]Metadata{
+		"http_requests_total":  {Type: MetricTypeCounter, Help: "The total number of\nHTTP requests \\ all."},
+		"rpc_duration_seconds": {Type: MetricTypeSummary},
+	}
+	if !reflect.DeepEqual(result.Metadata, want) {
+		t.Errorf("期望 %+v, 实际 %+v", want, result.Metadata)
+	}
+}
+
+// TestParseText_Errors 测试格式错误的行返回带行号的错误, 且不影响其它行
+func TestParseText_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		errLine  int
+		nSamples int
+	}{
+		{"非法指标名", "ok 1\n1abc 2\n", 2, 1},
+		{"缺少值", "foo\nok 1\n", 1, 1},
+		{"非法值", "foo abc\n", 1, 0},
+		{"非法时间戳", "foo 1 12.5\n", 1, 0},
+		{"多余内容", "foo 1 100 extra\n", 1, 0},
+		{"标签值未闭合", "foo{a=\"b} 1\n", 1, 0},
+		{"标签缺少引号", "foo{a=b} 1\n", 1, 0},
+		{"非法转义", "foo{a=\"\\t\"} 1\n", 1, 0},
+		{"重复标签名", "foo{a=\"1\",a=\"2\"} 1\n", 1, 0},
+		{"未知类型", "ok 1\n\n# TYPE foo bar\n", 3, 1},
+		{"重复 TYPE", "# TYPE foo gauge\n# TYPE foo counter\n", 2, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := ParseText([]byte(tt.input))
+			if len(result.Errors) != 1 {
+				t.Fatalf("期望 1 个错误, 实际=%v", result.Errors)
+			}
+			var pe *ParseError
+			if !errors.As(result.Errors[0], &pe) {
+				t.Fatalf("期望 *ParseError, 实际=%T", result.Errors[0])
+			}
+			if pe.Line != tt.errLine {
+				t.Errorf("期望错误行号=%d, 实际=%d (%v)", tt.errLine, pe.Line, pe)
+			}
+			if len(result.Samples) != tt.nSamples {
+				t.Errorf("期望 %d 个样本, 实际=%d", tt.nSamples, len(result.Samples))
+			}
+		})
+	}
+}
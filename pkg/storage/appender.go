@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"fmt"
+	"mini-promethues/pkg/model"
+)
+
+/*
+批量写入样本, 例如一次抓取得到的全部样本; 带 WAL 时 Commit 把这些样本作为一条记录写入
+不能被多个 goroutine 同时使用, Commit 或 Rollback 之后可以继续写入下一批
+*/
+type Appender interface {
+	// 检查样本并缓存, 返回的错误与 Storage.Append 相同; Commit 之前样本对查询不可见
+	Append(m *model.Metric, s *model.Sample) error
+
+	// 把缓存的样本写入 WAL 再写入内存; 期间被并发写入抢先的样本被丢弃, 返回的错误包含第一个原因
+	Commit() error
+
+	// 丢弃缓存的样本
+	Rollback()
+}
+
+type headAppender struct {
+	ms      *MemoryStorage
+	series  []*memSeries
+	samples []refSample
+}
+
+func (ms *MemoryStorage) Appender() Appender {
+	return &headAppender{ms: ms}
+}
+
+func (a *headAppender) Append(m *model.Metric, s *model.Sample) error {
+	if m == nil {
+		return ErrNilMetric
+	}
+	if s == nil {
+		return ErrNilSample
+	}
+	ms := a.ms
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	if s.Timestamp < ms.minValidTime.Load() {
+		return ErrOutOfBounds
+	}
+	series, err := ms.lockSeries(m)
+	if err != nil {
+		return err
+	}
+	defer series.mutex.Unlock()
+	duplicate, err := series.appendable(s.Timestamp, s.Value, ms.oooMinTime())
+	if err != nil {
+		return err
+	}
+	// 完全相同的样本重复写入时保持幂等
+	if duplicate {
+		return nil
+	}
+	a.series = append(a.series, series)
+	a.samples = append(a.samples, refSample{Ref: series.ref, T: s.Timestamp, V: s.Value})
+	return nil
+}
+
+func (a *headAppender) Commit() error {
+	defer a.Rollback()
+	if len(a.samples) == 0 {
+		return nil
+	}
+	ms := a.ms
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	// Append 之后序列可能被删除或者截断时移除, 重新查找或创建, WAL 记录引用新的 ref
+	for i, series := range a.series {
+		if !series.deleted.Load() {
+			continue
+		}
+		fresh, err := ms.lockSeries(&series.metric)
+		if err != nil {
+			return err
+		}
+		fresh.mutex.Unlock()
+		a.series[i] = fresh
+		a.samples[i].Ref = fresh.ref
+	}
+	if ms.wal != nil {
+		if err := ms.wal.Log(encodeSamples(a.samples)); err != nil {
+			return fmt.Errorf("write wal: %w", err)
+		}
+	}
+
+	rejected := 0
+	var firstErr error
+	for i, s := range a.samples {
+		if err := ms.commitSample(a.series[i], s.T, s.V); err != nil {
+			if rejected == 0 {
+				firstErr = err
+			}
+			rejected++
+		}
+	}
+	if rejected > 0 {
+		return fmt.Errorf("%d of %d samples rejected on commit: %w", rejected, len(a.samples), firstErr)
+	}
+	return nil
+}
+
+/*
+持有序列锁再检查一次并写入内存
+切分 block 前的 snapshot 要么看到这个样本, 要么这次写入被拒绝;
+回放 WAL 时同样会按顺序检查, 这里被拒绝的样本回放后也不会出现
+*/
+func (ms *MemoryStorage) commitSample(series *memSeries, t int64, v float64) error {
+	series.mutex.Lock()
+	defer series.mutex.Unlock()
+	// 检查之后被并发删除, 相当于在删除之前写入
+	if series.deleted.Load() {
+		return nil
+	}
+	if t < ms.minValidTime.Load() {
+		return ErrOutOfBounds
+	}
+	duplicate, err := series.appendable(t, v, ms.oooMinTime())
+	if err != nil || duplicate {
+		return err
+	}
+	ms.appendSample(series, t, v)
+	return nil
+}
+
+func (a *headAppender) Rollback() {
+	clear(a.series)
+	a.series = a.series[:0]
+	a.samples = a.samples[:0]
+}
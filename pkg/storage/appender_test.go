@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"errors"
+	"mini-promethues/pkg/model"
+	"testing"
+)
+
+// 统计 WAL 中每种记录的条数, 读取前先把缓冲区写入文件
+func countWALRecords(t *testing.T, ms *MemoryStorage) map[recordType]int {
+	t.Helper()
+	if err := ms.wal.Sync(); err != nil {
+		t.Fatalf("落盘失败: %v", err)
+	}
+	counts := make(map[recordType]int)
+	err := forEachWALRecord(ms.wal.Dir(), -1, func(rec []byte) error {
+		counts[recordTypeOf(rec)]++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("读取 WAL 失败: %v", err)
+	}
+	return counts
+}
+
+// TestAppender 测试批量写入在 Commit 后可见, 整批样本在 WAL 中只占一条记录
+func TestAppender(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := OpenMemoryStorage(dir)
+	if err != nil {
+		t.Fatalf("打开存储失败: %v", err)
+	}
+	cpu := createTestMetric("cpu_usage", "host", "server1")
+	mem := createTestMetric("memory_usage", "host", "server1")
+
+	t.Run("Commit 之前不可见", func(t *testing.T) {
+		app := storage.Appender()
+		for i := int64(1); i <= 100; i++ {
+			if err := app.Append(cpu, &model.Sample{Timestamp: i * 1000, Value: float64(i)}); err != nil {
+				t.Fatalf("写入失败: %v", err)
+			}
+			if err := app.Append(mem, &model.Sample{Timestamp: i * 1000, Value: float64(i)}); err != nil {
+				t.Fatalf("写入失败: %v", err)
+			}
+		}
+		if series, _ := storage.QueryRange(cpu, 0, 200000); len(series.Samples) != 0 {
+			t.Errorf("期望 Commit 之前没有样本，实际 %d 个", len(series.Samples))
+		}
+		if err := app.Commit(); err != nil {
+			t.Fatalf("提交失败: %v", err)
+		}
+		if series, _ := storage.QueryRange(cpu, 0, 200000); len(series.Samples) != 100 {
+			t.Errorf("期望 100 个样本，实际 %d 个", len(series.Samples))
+		}
+		if n := countWALRecords(t, storage)[recordSamples]; n != 1 {
+			t.Errorf("期望 1 条样本记录，实际 %d 条", n)
+		}
+	})
+
+	t.Run("Rollback 丢弃样本", func(t *testing.T) {
+		app := storage.Appender()
+		if err := app.Append(cpu, &model.Sample{Timestamp: 200000, Value: 1}); err != nil {
+			t.Fatalf("写入失败: %v", err)
+		}
+		app.Rollback()
+		if err := app.Commit(); err != nil {
+			t.Fatalf("提交失败: %v", err)
+		}
+		if series, _ := storage.QueryRange(cpu, 200000, 200000); len(series.Samples) != 0 {
+			t.Errorf("期望样本被丢弃，实际 %v", series.Samples)
+		}
+		if n := countWALRecords(t, storage)[recordSamples]; n != 1 {
+			t.Errorf("期望没有新的样本记录，实际共 %d 条", n)
+		}
+	})
+
+	t.Run("同一批中时间戳相同的样本", func(t *testing.T) {
+		app := storage.Appender()
+		for _, v := range []float64{1, 1, 2} {
+			if err := app.Append(cpu, &model.Sample{Timestamp: 300000, Value: v}); err != nil {
+				t.Fatalf("写入失败: %v", err)
+			}
+		}
+		if err := app.Commit(); !errors.Is(err, ErrDuplicateSampleForTimestamp) {
+			t.Errorf("期望 ErrDuplicateSampleForTimestamp，实际 %v", err)
+		}
+		series, _ := storage.QueryRange(cpu, 300000, 300000)
+		if len(series.Samples) != 1 || series.Samples[0].Value != 1 {
+			t.Errorf("期望只保留第一个样本，实际 %v", series.Samples)
+		}
+	})
+
+	t.Run("重新打开后恢复", func(t *testing.T) {
+		if err := storage.Close(); err != nil {
+			t.Fatalf("关闭存储失败: %v", err)
+		}
+		reopened, err := OpenMemoryStorage(dir)
+		if err != nil {
+			t.Fatalf("重新打开存储失败: %v", err)
+		}
+		defer reopened.Close()
+		series, _ := reopened.QueryRange(cpu, 0, 400000)
+		if len(series.Samples) != 101 || series.Samples[100] != (model.Sample{Timestamp: 300000, Value: 1}) {
+			t.Errorf("期望恢复 101 个样本，实际 %d 个", len(series.Samples))
+		}
+	})
+}
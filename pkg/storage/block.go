@@ -0,0 +1,412 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"mini-promethues/pkg/model"
+	"mini-promethues/pkg/storage/chunkenc"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+持久化的 block, 保存 [MinTime, MaxTime) 范围内的数据, 目录结构:
+
+	<id>/
+	  meta.json   时间范围和统计信息
+	  chunks      压缩后的 chunk, 每个 chunk: len uvarint | data | crc32
+	  index       符号表, 序列和 postings, 见 block_index.go
+	  tombstones  已删除的序列下标 (可选)
+
+block 写入临时目录后再整体重命名, 不会出现只写了一半的 block
+*/
+
+const (
+	metaFilename       = "meta.json"
+	chunksFilename     = "chunks"
+	indexFilename      = "index"
+	tombstonesFilename = "tombstones"
+	tmpBlockSuffix     = ".tmp"
+
+	chunksMagic     = 0x4d50434b
+	tombstonesMagic = 0x4d505453
+)
+
+var errInvalidChunk = errors.New("invalid chunk")
+
+type BlockStats struct {
+	NumSamples uint64 `json:"numSamples"`
+	NumSeries  uint64 `json:"numSeries"`
+	NumChunks  uint64 `json:"numChunks"`
+}
+
+type BlockCompaction struct {
+	// 从 head 切出的 block 为 1, 每合并一次加 1
+	Level int `json:"level"`
+	// 参与合并的原始 block (从 head 切出的 block 为自身)
+	Sources []string `json:"sources,omitempty"`
+}
+
+type BlockMeta struct {
+	ID string `json:"id"`
+	// MinTime 包含, MaxTime 不包含
+	MinTime    int64           `json:"minTime"`
+	MaxTime    int64           `json:"maxTime"`
+	Stats      BlockStats      `json:"stats"`
+	Compaction BlockCompaction `json:"compaction"`
+}
+
+func (m *BlockMeta) overlaps(mint, maxt int64) bool {
+	return m.MinTime <= maxt && mint < m.MaxTime
+}
+
+type blockSeries struct {
+	metric model.Metric
+	chunks []chunkMeta
+}
+
+type Block struct {
+	dir      string
+	meta     BlockMeta
+	series   []blockSeries
+	postings *postingsIndex
+	// fingerprint -> series 下标
+	byFingerprint map[uint64][]uint64
+	chunks        *os.File
+	chunksSize    int64
+	// 打开时目录下所有文件的大小
+	numBytes int64
+
+	// 被删除的 series 下标, 查询时过滤, 合并 block 时真正删除
+	mutex      sync.RWMutex
+	tombstones map[uint64]struct{}
+}
+
+func OpenBlock(dir string) (*Block, error) {
+	metaData, err := os.ReadFile(filepath.Join(dir, metaFilename))
+	if err != nil {
+		return nil, fmt.Errorf("read block meta: %w", err)
+	}
+	b := &Block{dir: dir, byFingerprint: make(map[uint64][]uint64)}
+	if err := json.Unmarshal(metaData, &b.meta); err != nil {
+		return nil, fmt.Errorf("parse block meta %q: %w", dir, err)
+	}
+
+	indexData, err := os.ReadFile(filepath.Join(dir, indexFilename))
+	if err != nil {
+		return nil, fmt.Errorf("read block index: %w", err)
+	}
+	series, postings, err := decodeIndex(indexData)
+	if err != nil {
+		return nil, fmt.Errorf("block %s: %w", b.meta.ID, err)
+	}
+	b.postings = postings
+	b.series = make([]blockSeries, len(series))
+	for i, s := range series {
+		b.series[i] = blockSeries{metric: *model.MetricFromLabels(s.labels), chunks: s.chunks}
+		fp := b.series[i].metric.Fingerprint()
+		b.byFingerprint[fp] = append(b.byFingerprint[fp], uint64(i))
+	}
+
+	if b.tombstones, err = readTombstones(filepath.Join(dir, tombstonesFilename)); err != nil {
+		return nil, fmt.Errorf("block %s: %w", b.meta.ID, err)
+	}
+	if b.numBytes, err = dirSize(dir); err != nil {
+		return nil, fmt.Errorf("block %s: %w", b.meta.ID, err)
+	}
+	if b.chunks, err = os.Open(filepath.Join(dir, chunksFilename)); err != nil {
+		return nil, fmt.Errorf("open block chunks: %w", err)
+	}
+	fi, err := b.chunks.Stat()
+	if err != nil {
+		b.chunks.Close()
+		return nil, fmt.Errorf("stat block chunks: %w", err)
+	}
+	b.chunksSize = fi.Size()
+	return b, nil
+}
+
+func dirSize(dir string) (int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			return 0, err
+		}
+		size += fi.Size()
+	}
+	return size, nil
+}
+
+func (b *Block) Meta() BlockMeta {
+	return b.meta
+}
+
+func (b *Block) Dir() string {
+	return b.dir
+}
+
+// block 占用的磁盘空间
+func (b *Block) Size() int64 {
+	return b.numBytes
+}
+
+func (b *Block) Close() error {
+	return b.chunks.Close()
+}
+
+func (b *Block) deleted(id uint64) bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	_, ok := b.tombstones[id]
+	return ok
+}
+
+// 返回 series 下标, 已删除的序列视为不存在
+func (b *Block) lookup(m *model.Metric) (uint64, bool) {
+	for _, id := range b.byFingerprint[m.Fingerprint()] {
+		if b.series[id].metric.Equal(m) {
+			return id, !b.deleted(id)
+		}
+	}
+	return 0, false
+}
+
+// 序列 id 上的迭代器, chunk 在迭代到时才从文件读取
+func (b *Block) iterator(id uint64) SeriesIterator {
+	metas := b.series[id].chunks
+	return newChunkSeriesIterator(metas, func(i int) (*chunkenc.XORChunk, error) {
+		return b.readChunk(metas[i].Ref)
+	})
+}
+
+// 返回 [mint, maxt] 范围内的样本, 按时间戳排序
+func (b *Block) samples(id uint64, mint, maxt int64) (model.Samples, error) {
+	return samplesInRange(b.iterator(id), mint, maxt)
+}
+
+func (b *Block) selectSeries(matchers []*model.LabelMatcher, mint, maxt int64) ([]model.Series, error) {
+	var result []model.Series
+	for _, id := range b.postings.postingsForMatchers(matchers) {
+		if b.deleted(id) {
+			continue
+		}
+		samples, err := b.samples(id, mint, maxt)
+		if err != nil {
+			return nil, err
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		result = append(result, model.Series{Metric: b.series[id].metric, Samples: samples})
+	}
+	return result, nil
+}
+
+// 标记删除序列并持久化 tombstones, 序列不存在时返回 false
+func (b *Block) delete(m *model.Metric) (bool, error) {
+	id, ok := b.lookup(m)
+	if !ok {
+		return false, nil
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	tombstones := make(map[uint64]struct{}, len(b.tombstones)+1)
+	for k := range b.tombstones {
+		tombstones[k] = struct{}{}
+	}
+	tombstones[id] = struct{}{}
+	if err := writeTombstones(filepath.Join(b.dir, tombstonesFilename), tombstones); err != nil {
+		return false, err
+	}
+	b.tombstones = tombstones
+	return true, nil
+}
+
+func (b *Block) readChunk(ref uint64) (*chunkenc.XORChunk, error) {
+	var header [binary.MaxVarintLen64]byte
+	n, err := b.chunks.ReadAt(header[:], int64(ref))
+	if err != nil && !(errors.Is(err, io.EOF) && n > 0) {
+		return nil, fmt.Errorf("read chunk %d: %w", ref, err)
+	}
+	length, size := binary.Uvarint(header[:n])
+	if size <= 0 {
+		return nil, fmt.Errorf("%w: bad length at %d", errInvalidChunk, ref)
+	}
+	// 长度来自文件内容, 先和文件剩余的大小比较, 避免损坏的长度导致巨大的分配
+	if remaining := b.chunksSize - int64(ref) - int64(size) - 4; remaining < 0 || length > uint64(remaining) {
+		return nil, fmt.Errorf("%w: length %d exceeds file size at %d", errInvalidChunk, length, ref)
+	}
+	data := make([]byte, length+4)
+	if _, err := b.chunks.ReadAt(data, int64(ref)+int64(size)); err != nil {
+		return nil, fmt.Errorf("read chunk %d: %w", ref, err)
+	}
+	data, sum := data[:length], binary.BigEndian.Uint32(data[length:])
+	if crc32.Checksum(data, castagnoliTable) != sum {
+		return nil, fmt.Errorf("%w: checksum mismatch at %d", errInvalidChunk, ref)
+	}
+	return chunkenc.FromData(data)
+}
+
+type blockSeriesData struct {
+	metric  model.Metric
+	samples model.Samples
+}
+
+/*
+把 series 写成 parentDir 下的一个新 block, 覆盖 [mint, maxt)
+每条序列的样本会先按时间戳排序, 再按 samplesPerChunk 切分成 chunk
+*/
+func writeBlock(parentDir string, mint, maxt int64, series []blockSeriesData, compaction BlockCompaction) (BlockMeta, error) {
+	meta := BlockMeta{ID: newBlockID(), MinTime: mint, MaxTime: maxt, Compaction: compaction}
+	if len(meta.Compaction.Sources) == 0 {
+		meta.Compaction.Sources = []string{meta.ID}
+	}
+	tmp := filepath.Join(parentDir, meta.ID+tmpBlockSuffix)
+	if err := os.MkdirAll(tmp, 0o755); err != nil {
+		return meta, err
+	}
+	if err := writeBlockFiles(tmp, &meta, series); err != nil {
+		os.RemoveAll(tmp)
+		return meta, err
+	}
+	if err := os.Rename(tmp, filepath.Join(parentDir, meta.ID)); err != nil {
+		os.RemoveAll(tmp)
+		return meta, err
+	}
+	return meta, nil
+}
+
+func writeBlockFiles(dir string, meta *BlockMeta, series []blockSeriesData) error {
+	type entry struct {
+		labels  model.Labels
+		samples model.Samples
+	}
+	entries := make([]entry, 0, len(series))
+	for _, s := range series {
+		if len(s.samples) == 0 {
+			continue
+		}
+		samples := make(model.Samples, len(s.samples))
+		copy(samples, s.samples)
+		sort.SliceStable(samples, func(i, j int) bool { return samples[i].Timestamp < samples[j].Timestamp })
+		entries = append(entries, entry{labels: s.metric.LabelSet(), samples: samples})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].labels.Compare(entries[j].labels) < 0 })
+
+	chunks := binary.BigEndian.AppendUint32(nil, chunksMagic)
+	index := make([]indexSeries, 0, len(entries))
+	for _, e := range entries {
+		is := indexSeries{labels: e.labels}
+		for start := 0; start < len(e.samples); start += samplesPerChunk {
+			part := e.samples[start:min(start+samplesPerChunk, len(e.samples))]
+			c := chunkenc.NewXORChunk()
+			app, _ := c.Appender()
+			for _, s := range part {
+				app.Append(s.Timestamp, s.Value)
+			}
+			is.chunks = append(is.chunks, chunkMeta{
+				Ref:     uint64(len(chunks)),
+				MinTime: part[0].Timestamp,
+				MaxTime: part[len(part)-1].Timestamp,
+			})
+			chunks = binary.AppendUvarint(chunks, uint64(len(c.Bytes())))
+			chunks = append(chunks, c.Bytes()...)
+			chunks = binary.BigEndian.AppendUint32(chunks, crc32.Checksum(c.Bytes(), castagnoliTable))
+			meta.Stats.NumChunks++
+		}
+		meta.Stats.NumSamples += uint64(len(e.samples))
+		index = append(index, is)
+	}
+	meta.Stats.NumSeries = uint64(len(index))
+
+	if err := writeFileSync(filepath.Join(dir, chunksFilename), chunks); err != nil {
+		return err
+	}
+	if err := writeFileSync(filepath.Join(dir, indexFilename), encodeIndex(index)); err != nil {
+		return err
+	}
+	metaData, err := json.MarshalIndent(meta, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileSync(filepath.Join(dir, metaFilename), metaData)
+}
+
+func readTombstones(path string) (map[uint64]struct{}, error) {
+	tombstones := make(map[uint64]struct{})
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return tombstones, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 8 || binary.BigEndian.Uint32(data) != tombstonesMagic {
+		return nil, errors.New("invalid tombstones file")
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, castagnoliTable) != sum {
+		return nil, errors.New("invalid tombstones file: checksum mismatch")
+	}
+	d := &decbuf{b: body[4:]}
+	for d.len() > 0 && d.err == nil {
+		tombstones[d.uvarint()] = struct{}{}
+	}
+	return tombstones, d.err
+}
+
+// 先写临时文件再重命名, 保证 tombstones 文件总是完整的
+func writeTombstones(path string, tombstones map[uint64]struct{}) error {
+	ids := make([]uint64, 0, len(tombstones))
+	for id := range tombstones {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	buf := binary.BigEndian.AppendUint32(nil, tombstonesMagic)
+	for _, id := range ids {
+		buf = binary.AppendUvarint(buf, id)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, crc32.Checksum(buf, castagnoliTable))
+	tmp := path + tmpBlockSuffix
+	if err := writeFileSync(tmp, buf); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func writeFileSync(path string, data []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// 毫秒时间戳加随机后缀, 按字典序即创建顺序
+func newBlockID() string {
+	var suffix [5]byte
+	rand.Read(suffix[:])
+	return fmt.Sprintf("%013x%s", time.Now().UnixMilli(), hex.EncodeToString(suffix[:]))
+}
@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"mini-promethues/pkg/model"
+	"sort"
+)
+
+/*
+block 的 index 文件, 顺序写入以下几部分, 最后 4 字节是前面所有内容的 crc32:
+
+	magic    uint32
+	symbols  count, string...            所有标签名和标签值去重排序后的字符串表
+	series   count, series...            每条序列: 标签 (symbol 下标对), chunk 元数据 (mint, maxt, ref)
+	postings count, (name, value, ids)... 标签 -> 有序的 series 下标, ids 按差值编码
+
+指标名称以 __name__ 标签的形式写入
+*/
+
+const indexMagic = 0x4d504958
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errInvalidIndex = errors.New("invalid block index")
+
+type chunkMeta struct {
+	Ref     uint64
+	MinTime int64
+	MaxTime int64
+}
+
+type indexSeries struct {
+	labels model.Labels
+	chunks []chunkMeta
+}
+
+// series 必须已经按标签排序
+func encodeIndex(series []indexSeries) []byte {
+	symbolSet := make(map[string]struct{})
+	for _, s := range series {
+		for _, l := range s.labels {
+			symbolSet[l.Name] = struct{}{}
+			symbolSet[l.Value] = struct{}{}
+		}
+	}
+	symbols := make([]string, 0, len(symbolSet))
+	for s := range symbolSet {
+		symbols = append(symbols, s)
+	}
+	sort.Strings(symbols)
+	symbolRefs := make(map[string]uint64, len(symbols))
+	for i, s := range symbols {
+		symbolRefs[s] = uint64(i)
+	}
+
+	buf := binary.BigEndian.AppendUint32(nil, indexMagic)
+	buf = binary.AppendUvarint(buf, uint64(len(symbols)))
+	for _, s := range symbols {
+		buf = appendString(buf, s)
+	}
+
+	type labelPair struct{ name, value string }
+	postings := make(map[labelPair][]uint64)
+	buf = binary.AppendUvarint(buf, uint64(len(series)))
+	for id, s := range series {
+		buf = binary.AppendUvarint(buf, uint64(len(s.labels)))
+		for _, l := range s.labels {
+			buf = binary.AppendUvarint(buf, symbolRefs[l.Name])
+			buf = binary.AppendUvarint(buf, symbolRefs[l.Value])
+			key := labelPair{l.Name, l.Value}
+			postings[key] = append(postings[key], uint64(id))
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(s.chunks)))
+		for _, c := range s.chunks {
+			buf = binary.AppendVarint(buf, c.MinTime)
+			buf = binary.AppendVarint(buf, c.MaxTime)
+			buf = binary.AppendUvarint(buf, c.Ref)
+		}
+	}
+
+	keys := make([]labelPair, 0, len(postings))
+	for k := range postings {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].value < keys[j].value
+	})
+	buf = binary.AppendUvarint(buf, uint64(len(keys)))
+	for _, k := range keys {
+		ids := postings[k]
+		buf = binary.AppendUvarint(buf, symbolRefs[k.name])
+		buf = binary.AppendUvarint(buf, symbolRefs[k.value])
+		buf = binary.AppendUvarint(buf, uint64(len(ids)))
+		prev := uint64(0)
+		for _, id := range ids {
+			buf = binary.AppendUvarint(buf, id-prev)
+			prev = id
+		}
+	}
+	return binary.BigEndian.AppendUint32(buf, crc32.Checksum(buf, castagnoliTable))
+}
+
+func decodeIndex(b []byte) ([]indexSeries, *postingsIndex, error) {
+	if len(b) < 8 {
+		return nil, nil, errInvalidIndex
+	}
+	body, sum := b[:len(b)-4], binary.BigEndian.Uint32(b[len(b)-4:])
+	if crc32.Checksum(body, castagnoliTable) != sum {
+		return nil, nil, fmt.Errorf("%w: checksum mismatch", errInvalidIndex)
+	}
+	if binary.BigEndian.Uint32(body) != indexMagic {
+		return nil, nil, fmt.Errorf("%w: bad magic", errInvalidIndex)
+	}
+	d := &decbuf{b: body[4:]}
+	// 每个元素至少占一个字节, 超过剩余长度的数量一定是损坏的, 不能用来分配内存
+	count := func() uint64 {
+		n := d.uvarint()
+		if n > uint64(d.len()) && d.err == nil {
+			d.err = fmt.Errorf("count %d exceeds %d remaining bytes", n, d.len())
+		}
+		return n
+	}
+
+	numSymbols := count()
+	if d.err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errInvalidIndex, d.err)
+	}
+	symbols := make([]string, numSymbols)
+	for i := range symbols {
+		symbols[i] = d.string()
+	}
+	symbol := func() string {
+		ref := d.uvarint()
+		if ref >= uint64(len(symbols)) {
+			if d.err == nil {
+				d.err = errInvalidIndex
+			}
+			return ""
+		}
+		return symbols[ref]
+	}
+
+	numSeries := count()
+	if d.err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errInvalidIndex, d.err)
+	}
+	series := make([]indexSeries, numSeries)
+	for i := range series {
+		n := count()
+		for j := uint64(0); j < n && d.err == nil; j++ {
+			series[i].labels = append(series[i].labels, model.Label{Name: symbol(), Value: symbol()})
+		}
+		n = count()
+		for j := uint64(0); j < n && d.err == nil; j++ {
+			series[i].chunks = append(series[i].chunks, chunkMeta{
+				MinTime: d.varint(),
+				MaxTime: d.varint(),
+				Ref:     d.uvarint(),
+			})
+		}
+	}
+
+	pi := newPostingsIndex()
+	pi.all = make([]uint64, len(series))
+	for i := range pi.all {
+		pi.all[i] = uint64(i)
+	}
+	numPostings := count()
+	for i := uint64(0); i < numPostings && d.err == nil; i++ {
+		name, value := symbol(), symbol()
+		n := count()
+		if d.err != nil {
+			break
+		}
+		ids := make([]uint64, 0, n)
+		prev := uint64(0)
+		for j := uint64(0); j < n && d.err == nil; j++ {
+			delta := d.uvarint()
+			// 查询时直接用 id 访问 series, 越界或溢出的 id 必须在这里拒绝
+			if delta > numSeries || prev+delta >= numSeries {
+				if d.err == nil {
+					d.err = errors.New("series id out of range")
+				}
+				break
+			}
+			prev += delta
+			ids = append(ids, prev)
+		}
+		values, ok := pi.postings[name]
+		if !ok {
+			values = make(map[string][]uint64)
+			pi.postings[name] = values
+		}
+		values[value] = ids
+	}
+	if d.err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errInvalidIndex, d.err)
+	}
+	return series, pi, nil
+}
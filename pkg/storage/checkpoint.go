@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"mini-promethues/pkg/storage/wal"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+WAL checkpoint
+
+截断 head 之后, 把编号不超过 last 的段 (连同上一个 checkpoint) 中仍然需要的记录写入 WAL 目录下的 checkpoint.<last>:
+只保留还在内存中的序列和时间戳不早于 mint 的样本, 删除记录不再需要; 之后删除这些段和旧的 checkpoint
+回放时先读取最新的 checkpoint, 再读取编号大于 last 的段
+
+checkpoint 只读取已经切换走的段, 不持有 MemoryStorage.mutex, 期间新的写入记录到编号大于 last 的段
+*/
+
+const (
+	checkpointPrefix = "checkpoint."
+	checkpointTmp    = ".tmp"
+)
+
+// checkpoint 中每条样本记录最多包含的样本数
+const checkpointSamplesPerRecord = 10000
+
+func checkpointDir(walDir string, last int) string {
+	return filepath.Join(walDir, fmt.Sprintf("%s%08d", checkpointPrefix, last))
+}
+
+// 最新的 checkpoint 目录和它覆盖到的段编号, 没有 checkpoint 时返回 -1
+func lastCheckpoint(walDir string) (string, int, error) {
+	entries, err := os.ReadDir(walDir)
+	if err != nil {
+		return "", -1, fmt.Errorf("read wal dir %q: %w", walDir, err)
+	}
+	dir, last := "", -1
+	for _, e := range entries {
+		index, ok := checkpointIndex(e)
+		if ok && index > last {
+			dir, last = filepath.Join(walDir, e.Name()), index
+		}
+	}
+	return dir, last, nil
+}
+
+// 完整的 checkpoint 目录的编号, 写到一半的临时目录不算
+func checkpointIndex(e fs.DirEntry) (int, bool) {
+	name := e.Name()
+	if !e.IsDir() || !strings.HasPrefix(name, checkpointPrefix) || strings.HasSuffix(name, checkpointTmp) {
+		return 0, false
+	}
+	index, err := strconv.Atoi(strings.TrimPrefix(name, checkpointPrefix))
+	return index, err == nil
+}
+
+// 按写入顺序遍历最新的 checkpoint 和之后编号不超过 last 的段中的记录, last 为负数时读到最后一个段
+func forEachWALRecord(walDir string, last int, fn func(rec []byte) error) error {
+	cpDir, cpIndex, err := lastCheckpoint(walDir)
+	if err != nil {
+		return err
+	}
+	if cpDir != "" {
+		r, err := wal.NewReader(cpDir)
+		if err != nil {
+			return err
+		}
+		if err := readRecords(r, fn); err != nil {
+			return fmt.Errorf("checkpoint %q: %w", cpDir, err)
+		}
+	}
+	r, err := wal.NewSegmentRangeReader(walDir, cpIndex+1, last)
+	if err != nil {
+		return err
+	}
+	return readRecords(r, fn)
+}
+
+func readRecords(r *wal.Reader, fn func(rec []byte) error) error {
+	for r.Next() {
+		if err := fn(r.Record()); err != nil {
+			return err
+		}
+	}
+	return r.Err()
+}
+
+// 删除崩溃时留下的、没有写完的 checkpoint
+func removeTmpCheckpoints(walDir string) error {
+	entries, err := os.ReadDir(walDir)
+	if err != nil {
+		return fmt.Errorf("read wal dir %q: %w", walDir, err)
+	}
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), checkpointPrefix) && strings.HasSuffix(e.Name(), checkpointTmp) {
+			if err := os.RemoveAll(filepath.Join(walDir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+把截断后仍然需要的 WAL 记录写入新的 checkpoint, 然后删除被它覆盖的段和旧的 checkpoint
+同一时间只有一个 checkpoint, 不阻塞写入和查询
+*/
+func (ms *MemoryStorage) checkpointWAL(mint int64) error {
+	ms.checkpointMutex.Lock()
+	defer ms.checkpointMutex.Unlock()
+	// 切换到新的段, 之前的段不会再写入, 并且已经落盘
+	next, err := ms.wal.NextSegment()
+	if err != nil {
+		return fmt.Errorf("checkpoint wal: %w", err)
+	}
+	last := next - 1
+	walDir := ms.wal.Dir()
+	final := checkpointDir(walDir, last)
+	tmp := final + checkpointTmp
+	if err := os.RemoveAll(tmp); err != nil {
+		return fmt.Errorf("checkpoint wal: %w", err)
+	}
+	if err := ms.writeCheckpoint(tmp, walDir, last, mint); err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("checkpoint wal: %w", err)
+	}
+	if err := os.Rename(tmp, final); err != nil {
+		os.RemoveAll(tmp)
+		return fmt.Errorf("checkpoint wal: %w", err)
+	}
+	// checkpoint 落盘之前不能删除旧的段, 否则崩溃时两者可能都丢失
+	if err := syncDir(walDir); err != nil {
+		return fmt.Errorf("checkpoint wal: %w", err)
+	}
+	if err := ms.wal.Truncate(last + 1); err != nil {
+		return fmt.Errorf("checkpoint wal: %w", err)
+	}
+	return removeCheckpointsBefore(walDir, last)
+}
+
+func (ms *MemoryStorage) writeCheckpoint(dir, walDir string, last int, mint int64) error {
+	cp, err := wal.New(dir, 0)
+	if err != nil {
+		return err
+	}
+	// 多条记录中的样本合并成一条记录; 序列记录直接写入, 样本只会被推迟到它们的序列之后
+	samples := make([]refSample, 0, checkpointSamplesPerRecord)
+	flush := func() error {
+		if len(samples) == 0 {
+			return nil
+		}
+		err := cp.Log(encodeSamples(samples))
+		samples = samples[:0]
+		return err
+	}
+	err = forEachWALRecord(walDir, last, func(rec []byte) error {
+		switch recordTypeOf(rec) {
+		case recordSeries:
+			series, err := decodeSeries(rec)
+			if err != nil {
+				return err
+			}
+			kept := series[:0]
+			for _, s := range series {
+				if ms.seriesByRef(s.Ref) != nil {
+					kept = append(kept, s)
+				}
+			}
+			if len(kept) > 0 {
+				return cp.Log(encodeSeries(kept))
+			}
+		case recordSamples:
+			decoded, err := decodeSamples(rec)
+			if err != nil {
+				return err
+			}
+			for _, s := range decoded {
+				if s.T < mint || ms.seriesByRef(s.Ref) == nil {
+					continue
+				}
+				samples = append(samples, s)
+				if len(samples) == checkpointSamplesPerRecord {
+					if err := flush(); err != nil {
+						return err
+					}
+				}
+			}
+		case recordDeletes:
+			// 被删除的序列已经不在内存中, 它的序列记录不会写入 checkpoint
+		default:
+			return fmt.Errorf("unknown wal record type %d", recordTypeOf(rec))
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	// Close 会把记录落盘
+	return errors.Join(err, cp.Close())
+}
+
+func removeCheckpointsBefore(walDir string, last int) error {
+	entries, err := os.ReadDir(walDir)
+	if err != nil {
+		return fmt.Errorf("read wal dir %q: %w", walDir, err)
+	}
+	for _, e := range entries {
+		if index, ok := checkpointIndex(e); ok && index < last {
+			if err := os.RemoveAll(filepath.Join(walDir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 让目录中的创建和重命名落盘
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	return errors.Join(err, f.Close())
+}
@@ -0,0 +1,110 @@
+package chunkenc
+
+import "io"
+
+// 按位写入的字节流, count 表示最后一个字节中还剩多少位可写
+type bstream struct {
+	stream []byte
+	count  uint8
+}
+
+func (b *bstream) bytes() []byte {
+	return b.stream
+}
+
+func (b *bstream) writeBit(bit bool) {
+	if b.count == 0 {
+		b.stream = append(b.stream, 0)
+		b.count = 8
+	}
+	i := len(b.stream) - 1
+	if bit {
+		b.stream[i] |= 1 << (b.count - 1)
+	}
+	b.count--
+}
+
+func (b *bstream) writeByte(byt byte) {
+	if b.count == 0 {
+		b.stream = append(b.stream, byt)
+		return
+	}
+	i := len(b.stream) - 1
+	// 高位写入当前字节剩余的位, 低位写入新字节
+	b.stream[i] |= byt >> (8 - b.count)
+	b.stream = append(b.stream, byt<<b.count)
+}
+
+// 写入 u 的低 nbits 位, 高位在前
+func (b *bstream) writeBits(u uint64, nbits int) {
+	u <<= 64 - uint(nbits)
+	for nbits >= 8 {
+		b.writeByte(byte(u >> 56))
+		u <<= 8
+		nbits -= 8
+	}
+	for nbits > 0 {
+		b.writeBit((u >> 63) == 1)
+		u <<= 1
+		nbits--
+	}
+}
+
+type bstreamReader struct {
+	stream []byte
+	// 下一个要读取的位的位置
+	pos int
+}
+
+func newBReader(b []byte) bstreamReader {
+	return bstreamReader{stream: b}
+}
+
+func (r *bstreamReader) readBit() (bool, error) {
+	if r.pos >= len(r.stream)*8 {
+		return false, io.EOF
+	}
+	bit := r.stream[r.pos>>3]&(0x80>>uint(r.pos&7)) != 0
+	r.pos++
+	return bit, nil
+}
+
+func (r *bstreamReader) readBits(nbits int) (uint64, error) {
+	if r.pos+nbits > len(r.stream)*8 {
+		return 0, io.EOF
+	}
+	var u uint64
+	// 先按位读到字节边界, 再整字节读取
+	for nbits > 0 && r.pos&7 != 0 {
+		bit, _ := r.readBit()
+		u <<= 1
+		if bit {
+			u |= 1
+		}
+		nbits--
+	}
+	for nbits >= 8 {
+		u = u<<8 | uint64(r.stream[r.pos>>3])
+		r.pos += 8
+		nbits -= 8
+	}
+	for nbits > 0 {
+		bit, _ := r.readBit()
+		u <<= 1
+		if bit {
+			u |= 1
+		}
+		nbits--
+	}
+	return u, nil
+}
+
+func (r *bstreamReader) readByte() (byte, error) {
+	v, err := r.readBits(8)
+	return byte(v), err
+}
+
+// 兼容 encoding/binary 的 io.ByteReader, 用于读取 varint
+func (r *bstreamReader) ReadByte() (byte, error) {
+	return r.readByte()
+}
@@ -0,0 +1,313 @@
+package chunkenc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+/*
+Gorilla 论文中的压缩格式:
+  - 时间戳: 第一个样本存完整值 (varint), 第二个存 delta (uvarint), 之后存 delta-of-delta,
+    按大小使用 1/16/20/23/68 位编码, 固定间隔抓取时每个时间戳只占 1 位
+  - 值: 与前一个值做 XOR, 相同时只占 1 位, 否则只存去掉前导零和尾随零之后的有效位
+
+chunk 的前 2 个字节是样本数量 (大端序), 之后是按位写入的样本数据
+*/
+
+const chunkHeaderSize = 2
+
+type XORChunk struct {
+	b bstream
+}
+
+func NewXORChunk() *XORChunk {
+	b := make([]byte, chunkHeaderSize, 128)
+	return &XORChunk{b: bstream{stream: b, count: 0}}
+}
+
+func (c *XORChunk) Bytes() []byte {
+	return c.b.bytes()
+}
+
+func (c *XORChunk) NumSamples() int {
+	return int(binary.BigEndian.Uint16(c.Bytes()))
+}
+
+// 返回可以继续追加样本的 Appender, 已有样本时会先遍历一遍恢复编码状态
+func (c *XORChunk) Appender() (*XORAppender, error) {
+	it := c.iterator()
+	for it.Next() {
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	a := &XORAppender{
+		b:        &c.b,
+		t:        it.t,
+		v:        it.v,
+		tDelta:   it.tDelta,
+		leading:  it.leading,
+		trailing: it.trailing,
+	}
+	if it.numTotal == 0 {
+		a.leading = 0xff
+	}
+	return a, nil
+}
+
+// 迭代器只会读取创建时已经写入的样本
+func (c *XORChunk) Iterator() *XORIterator {
+	return c.iterator()
+}
+
+func (c *XORChunk) iterator() *XORIterator {
+	return &XORIterator{
+		br:       newBReader(c.b.bytes()[chunkHeaderSize:]),
+		numTotal: binary.BigEndian.Uint16(c.b.bytes()),
+	}
+}
+
+type XORAppender struct {
+	b *bstream
+
+	t      int64
+	v      float64
+	tDelta uint64
+
+	leading  uint8
+	trailing uint8
+}
+
+// 时间戳必须不小于上一个样本的时间戳, 由调用方保证
+func (a *XORAppender) Append(t int64, v float64) {
+	var tDelta uint64
+	num := binary.BigEndian.Uint16(a.b.bytes())
+
+	switch num {
+	case 0:
+		buf := make([]byte, binary.MaxVarintLen64)
+		for _, b := range buf[:binary.PutVarint(buf, t)] {
+			a.b.writeByte(b)
+		}
+		a.b.writeBits(math.Float64bits(v), 64)
+	case 1:
+		tDelta = uint64(t - a.t)
+		buf := make([]byte, binary.MaxVarintLen64)
+		for _, b := range buf[:binary.PutUvarint(buf, tDelta)] {
+			a.b.writeByte(b)
+		}
+		a.writeVDelta(v)
+	default:
+		tDelta = uint64(t - a.t)
+		dod := int64(tDelta - a.tDelta)
+		switch {
+		case dod == 0:
+			a.b.writeBit(false)
+		case bitRange(dod, 14):
+			a.b.writeBits(0b10, 2)
+			a.b.writeBits(uint64(dod), 14)
+		case bitRange(dod, 17):
+			a.b.writeBits(0b110, 3)
+			a.b.writeBits(uint64(dod), 17)
+		case bitRange(dod, 20):
+			a.b.writeBits(0b1110, 4)
+			a.b.writeBits(uint64(dod), 20)
+		default:
+			a.b.writeBits(0b1111, 4)
+			a.b.writeBits(uint64(dod), 64)
+		}
+		a.writeVDelta(v)
+	}
+
+	a.t = t
+	a.v = v
+	binary.BigEndian.PutUint16(a.b.bytes(), num+1)
+	a.tDelta = tDelta
+}
+
+// x 是否能用 nbits 位表示, 取值范围 [-(2^(nbits-1)-1), 2^(nbits-1)]
+func bitRange(x int64, nbits uint8) bool {
+	return -((1<<(nbits-1))-1) <= x && x <= 1<<(nbits-1)
+}
+
+func (a *XORAppender) writeVDelta(v float64) {
+	vDelta := math.Float64bits(v) ^ math.Float64bits(a.v)
+	if vDelta == 0 {
+		a.b.writeBit(false)
+		return
+	}
+	a.b.writeBit(true)
+
+	leading := uint8(bits.LeadingZeros64(vDelta))
+	trailing := uint8(bits.TrailingZeros64(vDelta))
+	// 前导零个数用 5 位存储, 最多 31
+	if leading >= 32 {
+		leading = 31
+	}
+
+	// 有效位落在上一次的窗口内时直接复用窗口
+	if a.leading != 0xff && leading >= a.leading && trailing >= a.trailing {
+		a.b.writeBit(false)
+		a.b.writeBits(vDelta>>a.trailing, 64-int(a.leading)-int(a.trailing))
+		return
+	}
+	a.leading, a.trailing = leading, trailing
+	a.b.writeBit(true)
+	a.b.writeBits(uint64(leading), 5)
+	// 有效位为 64 时写入 0, 读取时再还原
+	sigbits := 64 - leading - trailing
+	a.b.writeBits(uint64(sigbits), 6)
+	a.b.writeBits(vDelta>>trailing, int(sigbits))
+}
+
+type XORIterator struct {
+	br       bstreamReader
+	numTotal uint16
+	numRead  uint16
+
+	t      int64
+	v      float64
+	tDelta uint64
+
+	leading  uint8
+	trailing uint8
+
+	err error
+}
+
+func (it *XORIterator) At() (int64, float64) {
+	return it.t, it.v
+}
+
+func (it *XORIterator) Err() error {
+	return it.err
+}
+
+func (it *XORIterator) Next() bool {
+	if it.err != nil || it.numRead == it.numTotal {
+		return false
+	}
+
+	if it.numRead == 0 {
+		t, err := binary.ReadVarint(&it.br)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		v, err := it.br.readBits(64)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.t = t
+		it.v = math.Float64frombits(v)
+		it.numRead++
+		return true
+	}
+
+	if it.numRead == 1 {
+		tDelta, err := binary.ReadUvarint(&it.br)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		it.tDelta = tDelta
+		it.t += int64(tDelta)
+		return it.readValue()
+	}
+
+	// 读取 delta-of-delta 的前缀, 最多 4 位
+	var d byte
+	for i := 0; i < 4; i++ {
+		d <<= 1
+		bit, err := it.br.readBit()
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if !bit {
+			break
+		}
+		d |= 1
+	}
+	var sz uint8
+	switch d {
+	case 0b0:
+	case 0b10:
+		sz = 14
+	case 0b110:
+		sz = 17
+	case 0b1110:
+		sz = 20
+	case 0b1111:
+		sz = 64
+	}
+	var dod int64
+	if sz != 0 {
+		b, err := it.br.readBits(int(sz))
+		if err != nil {
+			it.err = err
+			return false
+		}
+		// 还原负数
+		if sz != 64 && b > (1<<(sz-1)) {
+			b -= 1 << sz
+		}
+		dod = int64(b)
+	}
+	it.tDelta = uint64(int64(it.tDelta) + dod)
+	it.t += int64(it.tDelta)
+	return it.readValue()
+}
+
+func (it *XORIterator) readValue() bool {
+	bit, err := it.br.readBit()
+	if err != nil {
+		it.err = err
+		return false
+	}
+	if bit {
+		bit, err = it.br.readBit()
+		if err != nil {
+			it.err = err
+			return false
+		}
+		if bit {
+			leading, err := it.br.readBits(5)
+			if err != nil {
+				it.err = err
+				return false
+			}
+			sigbits, err := it.br.readBits(6)
+			if err != nil {
+				it.err = err
+				return false
+			}
+			if sigbits == 0 {
+				sigbits = 64
+			}
+			it.leading = uint8(leading)
+			it.trailing = 64 - it.leading - uint8(sigbits)
+		}
+		sigbits := 64 - int(it.leading) - int(it.trailing)
+		b, err := it.br.readBits(sigbits)
+		if err != nil {
+			it.err = err
+			return false
+		}
+		vbits := math.Float64bits(it.v) ^ (b << it.trailing)
+		it.v = math.Float64frombits(vbits)
+	}
+	it.numRead++
+	return true
+}
+
+// 从持久化的字节恢复 chunk, 只用于读取, 返回的 chunk 直接引用 b
+func FromData(b []byte) (*XORChunk, error) {
+	if len(b) < chunkHeaderSize {
+		return nil, fmt.Errorf("chunk too short: %d bytes", len(b))
+	}
+	return &XORChunk{b: bstream{stream: b, count: 0}}, nil
+}
@@ -0,0 +1,182 @@
+package chunkenc
+
+import (
+	"math"
+	"math/rand"
+	"mini-promethues/pkg/model"
+	"testing"
+	"unsafe"
+)
+
+// 辅助函数：生成 15s 抓取间隔、带少量抖动的 counter 样本
+func createTestSamples(n int) model.Samples {
+	r := rand.New(rand.NewSource(42))
+	samples := make(model.Samples, 0, n)
+	t := int64(1702450800000)
+	v := 1000.0
+	for i := 0; i < n; i++ {
+		t += 15000 + r.Int63n(20) - 10
+		v += float64(r.Intn(100))
+		samples = append(samples, model.Sample{Timestamp: t, Value: v})
+	}
+	return samples
+}
+
+func readAll(t *testing.T, c *XORChunk) model.Samples {
+	t.Helper()
+	var result model.Samples
+	it := c.Iterator()
+	for it.Next() {
+		ts, v := it.At()
+		result = append(result, model.Sample{Timestamp: ts, Value: v})
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("遍历 chunk 失败: %v", err)
+	}
+	return result
+}
+
+func assertSamplesEqual(t *testing.T, want, got model.Samples) {
+	t.Helper()
+	if len(want) != len(got) {
+		t.Fatalf("期望 %d 个样本，实际得到 %d 个", len(want), len(got))
+	}
+	for i := range want {
+		// 按位比较, NaN 也必须原样还原
+		if want[i].Timestamp != got[i].Timestamp ||
+			math.Float64bits(want[i].Value) != math.Float64bits(got[i].Value) {
+			t.Fatalf("样本 %d: 期望 %v，实际 %v", i, want[i], got[i])
+		}
+	}
+}
+
+// TestXORChunk_RoundTrip 测试编码后能完整还原
+func TestXORChunk_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples model.Samples
+	}{
+		{"空 chunk", nil},
+		{"单个样本", model.Samples{{Timestamp: -1000, Value: 1.5}}},
+		{"固定间隔的 counter", createTestSamples(120)},
+		{
+			"特殊值和时间戳跳变",
+			model.Samples{
+				{Timestamp: 0, Value: 0},
+				{Timestamp: 1, Value: math.NaN()},
+				{Timestamp: 1, Value: math.Inf(1)},
+				{Timestamp: 100000, Value: math.Inf(-1)},
+				{Timestamp: 100001, Value: -0.0},
+				{Timestamp: 1 << 40, Value: math.MaxFloat64},
+				{Timestamp: 1<<40 + 15, Value: math.SmallestNonzeroFloat64},
+				{Timestamp: 1<<40 + 16, Value: 42},
+				{Timestamp: 1<<40 + 5000, Value: 42},
+				{Timestamp: 1<<40 + 200000, Value: 42.5},
+				{Timestamp: 1<<40 + 201000, Value: 1e-300},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewXORChunk()
+			app, err := c.Appender()
+			if err != nil {
+				t.Fatalf("创建 Appender 失败: %v", err)
+			}
+			for _, s := range tt.samples {
+				app.Append(s.Timestamp, s.Value)
+			}
+			if c.NumSamples() != len(tt.samples) {
+				t.Errorf("期望 NumSamples=%d，实际 %d", len(tt.samples), c.NumSamples())
+			}
+			assertSamplesEqual(t, tt.samples, readAll(t, c))
+		})
+	}
+}
+
+// TestXORChunk_ResumeAppender 测试在已有数据的 chunk 上重新创建 Appender 继续写入
+func TestXORChunk_ResumeAppender(t *testing.T) {
+	samples := createTestSamples(100)
+	c := NewXORChunk()
+	// 每写 7 个样本重新创建一次 Appender
+	for start := 0; start < len(samples); start += 7 {
+		app, err := c.Appender()
+		if err != nil {
+			t.Fatalf("样本 %d: 创建 Appender 失败: %v", start, err)
+		}
+		for _, s := range samples[start:min(start+7, len(samples))] {
+			app.Append(s.Timestamp, s.Value)
+		}
+	}
+	assertSamplesEqual(t, samples, readAll(t, c))
+}
+
+// TestXORChunk_IteratorSnapshot 测试迭代器只看到创建时已写入的样本
+func TestXORChunk_IteratorSnapshot(t *testing.T) {
+	samples := createTestSamples(10)
+	c := NewXORChunk()
+	app, _ := c.Appender()
+	for _, s := range samples[:5] {
+		app.Append(s.Timestamp, s.Value)
+	}
+	it := c.Iterator()
+	for _, s := range samples[5:] {
+		app.Append(s.Timestamp, s.Value)
+	}
+	n := 0
+	for it.Next() {
+		n++
+	}
+	if n != 5 {
+		t.Errorf("期望迭代 5 个样本，实际 %d 个", n)
+	}
+}
+
+// BenchmarkXORChunk_Append 对比压缩后每个样本占用的字节数
+func BenchmarkXORChunk_Append(b *testing.B) {
+	samples := createTestSamples(120)
+	b.ReportAllocs()
+	b.ResetTimer()
+	var size int
+	for i := 0; i < b.N; i++ {
+		c := NewXORChunk()
+		app, _ := c.Appender()
+		for _, s := range samples {
+			app.Append(s.Timestamp, s.Value)
+		}
+		size = len(c.Bytes())
+	}
+	b.ReportMetric(float64(size)/float64(len(samples)), "bytes/sample")
+}
+
+// BenchmarkSampleSlice_Append 作为对照, 直接追加到 model.Samples
+func BenchmarkSampleSlice_Append(b *testing.B) {
+	samples := createTestSamples(120)
+	b.ReportAllocs()
+	b.ResetTimer()
+	var size int
+	for i := 0; i < b.N; i++ {
+		var s model.Samples
+		for _, sample := range samples {
+			s = append(s, sample)
+		}
+		size = len(s) * int(unsafe.Sizeof(model.Sample{}))
+	}
+	b.ReportMetric(float64(size)/float64(len(samples)), "bytes/sample")
+}
+
+func BenchmarkXORChunk_Iterate(b *testing.B) {
+	samples := createTestSamples(120)
+	c := NewXORChunk()
+	app, _ := c.Appender()
+	for _, s := range samples {
+		app.Append(s.Timestamp, s.Value)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		it := c.Iterator()
+		for it.Next() {
+		}
+	}
+}
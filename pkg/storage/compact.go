@@ -0,0 +1,199 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"mini-promethues/pkg/model"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+/*
+选出下一组需要合并的 block, 没有时返回 nil, 按以下优先级:
+
+ 1. 时间范围重叠的 block (例如合并后、删除旧 block 前崩溃), 合并时对重复样本去重
+ 2. 完全落在同一个对齐的 CompactionRanges 窗口内的多个 block, 窗口必须已经结束
+    (最新的 block 已经越过窗口), 否则之后还会有数据写入这个窗口
+ 3. 带 tombstones 的 block, 重写一遍把删除的序列真正删掉
+
+调用方持有 compactMutex
+*/
+func (db *DB) plan() []*Block {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if len(db.blocks) == 0 {
+		return nil
+	}
+	if overlapping := overlappingBlocks(db.blocks); len(overlapping) > 0 {
+		return overlapping
+	}
+
+	lastMaxTime := db.blocks[len(db.blocks)-1].meta.MaxTime
+	for _, r := range db.opts.CompactionRanges {
+		step := r.Milliseconds()
+		var group []*Block
+		var groupEnd int64
+		for _, b := range db.blocks {
+			start := alignDown(b.meta.MinTime, step)
+			// 跨越窗口边界的 block 不属于任何窗口
+			fits := b.meta.MaxTime <= start+step
+			if len(group) > 0 && (!fits || start+step != groupEnd) {
+				if len(group) > 1 && groupEnd <= lastMaxTime {
+					return group
+				}
+				group = nil
+			}
+			if !fits {
+				continue
+			}
+			group = append(group, b)
+			groupEnd = start + step
+		}
+		if len(group) > 1 && groupEnd <= lastMaxTime {
+			return group
+		}
+	}
+
+	for _, b := range db.blocks {
+		b.mutex.RLock()
+		n := len(b.tombstones)
+		b.mutex.RUnlock()
+		if n > 0 {
+			return []*Block{b}
+		}
+	}
+	return nil
+}
+
+// blocks 按 MinTime 排序, 返回第一组互相重叠的 block
+func overlappingBlocks(blocks []*Block) []*Block {
+	group := []*Block{blocks[0]}
+	maxt := blocks[0].meta.MaxTime
+	for _, b := range blocks[1:] {
+		if b.meta.MinTime < maxt {
+			group = append(group, b)
+			maxt = max(maxt, b.meta.MaxTime)
+			continue
+		}
+		if len(group) > 1 {
+			return group
+		}
+		group = []*Block{b}
+		maxt = b.meta.MaxTime
+	}
+	if len(group) > 1 {
+		return group
+	}
+	return nil
+}
+
+/*
+把 blocks 合并成一个新 block: 跳过 tombstones 中的序列, 同一序列的样本按时间戳去重
+新 block 完整写入后, 在写锁内替换旧 block, 查询要么看到全部旧 block, 要么只看到新 block
+调用方持有 compactMutex
+*/
+func (db *DB) compactBlocks(blocks []*Block) error {
+	mint, maxt := blocks[0].meta.MinTime, blocks[0].meta.MaxTime
+	compaction := BlockCompaction{}
+	sources := make(map[string]struct{})
+	merged := make(map[uint64][]*blockSeriesData)
+	for _, b := range blocks {
+		mint, maxt = min(mint, b.meta.MinTime), max(maxt, b.meta.MaxTime)
+		compaction.Level = max(compaction.Level, b.meta.Compaction.Level+1)
+		for _, s := range b.meta.Compaction.Sources {
+			sources[s] = struct{}{}
+		}
+		for id := range b.series {
+			if b.deleted(uint64(id)) {
+				continue
+			}
+			samples, err := b.samples(uint64(id), b.meta.MinTime, b.meta.MaxTime-1)
+			if err != nil {
+				return fmt.Errorf("read block %s: %w", b.meta.ID, err)
+			}
+			metric := b.series[id].metric
+			fp := metric.Fingerprint()
+			if existing := findBlockSeries(merged[fp], &metric); existing != nil {
+				existing.samples = mergeSamples(existing.samples, samples)
+				continue
+			}
+			merged[fp] = append(merged[fp], &blockSeriesData{metric: metric, samples: samples})
+		}
+	}
+	// 只重写单个 block 时保持原来的层级
+	if len(blocks) == 1 {
+		compaction.Level = blocks[0].meta.Compaction.Level
+	}
+	for s := range sources {
+		compaction.Sources = append(compaction.Sources, s)
+	}
+	sort.Strings(compaction.Sources)
+
+	series := make([]blockSeriesData, 0, len(merged))
+	for _, list := range merged {
+		for _, s := range list {
+			if len(s.samples) > 0 {
+				series = append(series, *s)
+			}
+		}
+	}
+	var block *Block
+	if len(series) > 0 {
+		meta, err := writeBlock(db.dir, mint, maxt, series, compaction)
+		if err != nil {
+			return fmt.Errorf("write block: %w", err)
+		}
+		if block, err = OpenBlock(filepath.Join(db.dir, meta.ID)); err != nil {
+			return err
+		}
+	}
+
+	db.mutex.Lock()
+	remaining := make([]*Block, 0, len(db.blocks))
+	for _, b := range db.blocks {
+		if !containsBlock(blocks, b) {
+			remaining = append(remaining, b)
+		}
+	}
+	if block != nil {
+		remaining = append(remaining, block)
+	}
+	sortBlocks(remaining)
+	db.blocks = remaining
+	db.mutex.Unlock()
+
+	// 旧 block 已经不可见, 持有读锁的查询也都已经结束
+	for _, b := range blocks {
+		if err := b.Close(); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(b.dir); err != nil {
+			return err
+		}
+	}
+	if block != nil {
+		log.Printf("compacted %d blocks into %s [%d, %d), level %d",
+			len(blocks), block.meta.ID, mint, maxt, compaction.Level)
+	}
+	return nil
+}
+
+func containsBlock(blocks []*Block, b *Block) bool {
+	for _, x := range blocks {
+		if x == b {
+			return true
+		}
+	}
+	return false
+}
+
+// fingerprint 相同的序列中找到标签完全相同的一个
+func findBlockSeries(list []*blockSeriesData, m *model.Metric) *blockSeriesData {
+	for _, s := range list {
+		if s.metric.Equal(m) {
+			return s
+		}
+	}
+	return nil
+}
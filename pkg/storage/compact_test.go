@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"mini-promethues/pkg/model"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 辅助函数：写入一个 block, 在 [mint, maxt) 内每分钟一个样本, 值等于分钟数
+func writeTestBlock(t *testing.T, dir string, mint, maxt int64, metrics ...*model.Metric) {
+	t.Helper()
+	var samples model.Samples
+	for ts := mint; ts < maxt; ts += 60000 {
+		samples = append(samples, model.Sample{Timestamp: ts, Value: float64(ts / 60000)})
+	}
+	var series []blockSeriesData
+	for _, m := range metrics {
+		series = append(series, blockSeriesData{metric: *m, samples: samples})
+	}
+	if _, err := writeBlock(dir, mint, maxt, series, BlockCompaction{Level: 1}); err != nil {
+		t.Fatalf("写入 block 失败: %v", err)
+	}
+}
+
+// TestDB_CompactBlocks 测试相邻 block 逐级合并成更大的时间范围
+func TestDB_CompactBlocks(t *testing.T) {
+	dir := t.TempDir()
+	m := createTestMetric("cpu_usage", "host", "server1")
+	// 13 个 2h block, 覆盖 [0, 26h)
+	for i := int64(0); i < 13; i++ {
+		writeTestBlock(t, dir, i*testBlockRange, (i+1)*testBlockRange, m)
+	}
+	db := openTestDB(t, dir)
+	defer db.Close()
+	if err := db.Compact(); err != nil {
+		t.Fatalf("compaction 失败: %v", err)
+	}
+
+	// [0, 24h) 先合并成 4 个 6h block, 再合并成一个 24h block; [24h, 26h) 所在的窗口还没结束
+	blocks := db.Blocks()
+	if len(blocks) != 2 {
+		t.Fatalf("期望 2 个 block，实际 %d 个: %+v", len(blocks), blocks)
+	}
+	if blocks[0].MinTime != 0 || blocks[0].MaxTime != 12*testBlockRange {
+		t.Errorf("期望第一个 block 覆盖 [0, 24h)，实际 [%d, %d)", blocks[0].MinTime, blocks[0].MaxTime)
+	}
+	if blocks[0].Compaction.Level != 3 || len(blocks[0].Compaction.Sources) != 12 {
+		t.Errorf("期望层级 3、12 个源 block，实际 %+v", blocks[0].Compaction)
+	}
+	if blocks[0].Stats.NumSamples != uint64(12*testBlockRange/60000) {
+		t.Errorf("期望 %d 个样本，实际 %d 个", 12*testBlockRange/60000, blocks[0].Stats.NumSamples)
+	}
+	if blocks[1].Compaction.Level != 1 {
+		t.Errorf("期望最新的 block 没有被合并，实际 %+v", blocks[1])
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2 个 block 和 wal
+	if len(entries) != 3 {
+		t.Errorf("期望旧 block 目录被删除，实际还有 %d 个目录", len(entries))
+	}
+
+	series, err := db.QueryRange(m, 0, 13*testBlockRange)
+	if err != nil {
+		t.Fatalf("查询失败: %v", err)
+	}
+	if len(series.Samples) != int(13*testBlockRange/60000) {
+		t.Errorf("期望 %d 个样本，实际 %d 个", 13*testBlockRange/60000, len(series.Samples))
+	}
+}
+
+// TestDB_CompactOverlapping 测试合并时间范围重叠的 block 时对样本去重
+func TestDB_CompactOverlapping(t *testing.T) {
+	dir := t.TempDir()
+	m := createTestMetric("cpu_usage", "host", "server1")
+	writeTestBlock(t, dir, 0, testBlockRange, m)
+	writeTestBlock(t, dir, testBlockRange/2, testBlockRange*3/2, m)
+	db := openTestDB(t, dir)
+	defer db.Close()
+	if err := db.Compact(); err != nil {
+		t.Fatalf("compaction 失败: %v", err)
+	}
+	blocks := db.Blocks()
+	if len(blocks) != 1 || blocks[0].MinTime != 0 || blocks[0].MaxTime != testBlockRange*3/2 {
+		t.Fatalf("期望合并成一个 [0, 3h) 的 block，实际 %+v", blocks)
+	}
+	series, err := db.QueryRange(m, 0, testBlockRange*3/2)
+	if err != nil {
+		t.Fatalf("查询失败: %v", err)
+	}
+	if len(series.Samples) != 180 {
+		t.Fatalf("期望去重后 180 个样本，实际 %d 个", len(series.Samples))
+	}
+	for i, s := range series.Samples {
+		if s.Timestamp != int64(i)*60000 {
+			t.Fatalf("样本 %d: 期望时间戳 %d，实际 %d", i, int64(i)*60000, s.Timestamp)
+		}
+	}
+}
+
+// TestDB_CompactTombstones 测试 compaction 真正删除 tombstones 中的序列
+func TestDB_CompactTombstones(t *testing.T) {
+	dir := t.TempDir()
+	deleted := createTestMetric("cpu_usage", "host", "server1")
+	kept := createTestMetric("cpu_usage", "host", "server2")
+	writeTestBlock(t, dir, 0, testBlockRange, deleted, kept)
+	db := openTestDB(t, dir)
+	defer db.Close()
+	if err := db.Delete(deleted); err != nil {
+		t.Fatalf("删除失败: %v", err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatalf("compaction 失败: %v", err)
+	}
+
+	blocks := db.Blocks()
+	if len(blocks) != 1 || blocks[0].Stats.NumSeries != 1 || blocks[0].Compaction.Level != 1 {
+		t.Fatalf("期望重写后的 block 只有 1 条序列且层级不变，实际 %+v", blocks)
+	}
+	path := filepath.Join(dir, blocks[0].ID, tombstonesFilename)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("期望重写后的 block 没有 tombstones 文件，实际 %v", err)
+	}
+	if _, err := db.QueryRange(deleted, 0, testBlockRange); err != ErrSeriesNotFound {
+		t.Errorf("期望 ErrSeriesNotFound，实际 %v", err)
+	}
+	series, err := db.QueryRange(kept, 0, testBlockRange)
+	if err != nil || len(series.Samples) != 120 {
+		t.Errorf("期望保留的序列有 120 个样本，实际 %d 个, err=%v", len(series.Samples), err)
+	}
+}
+
+// TestOptions_Validate 测试 compaction 范围必须逐级整除
+func TestOptions_Validate(t *testing.T) {
+	opts := DefaultOptions()
+	if err := opts.validate(); err != nil {
+		t.Errorf("默认配置应该合法: %v", err)
+	}
+	opts.CompactionRanges = append(opts.CompactionRanges, DefaultCompactionRanges[1]*3/2)
+	if err := opts.validate(); err == nil {
+		t.Error("期望不能整除的范围返回错误")
+	}
+}
@@ -8,4 +8,9 @@ var (
 	ErrSeriesNotFound = errors.New("series not found")
 	ErrTimeRange      = errors.New("invalid time range: start > end")
 	ErrOutOfOrder     = errors.New("sample timestamp out of order")
+	ErrOutOfBounds    = errors.New("sample timestamp out of bounds: older than persisted data")
+	ErrNoMatchers     = errors.New("at least one label matcher is required")
+	ErrInvalidMetric  = errors.New("invalid metric")
+
+	ErrDuplicateSampleForTimestamp = errors.New("duplicate sample for timestamp with different value")
 )
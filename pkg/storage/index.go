@@ -0,0 +1,201 @@
+package storage
+
+import (
+	"mini-promethues/pkg/model"
+	"sort"
+)
+
+/*
+倒排索引: 标签名 -> 标签值 -> 有序的 series ref 列表 (postings)
+按 Metric 的规范形式建索引, 指标名称是 __name__ 标签, 所有 series 的 ref 单独保存在 all 中
+调用方负责加锁
+*/
+type postingsIndex struct {
+	postings map[string]map[string][]uint64
+	all      []uint64
+}
+
+func newPostingsIndex() *postingsIndex {
+	return &postingsIndex{
+		postings: make(map[string]map[string][]uint64),
+	}
+}
+
+func (pi *postingsIndex) add(ref uint64, m *model.Metric) {
+	pi.all = insertPosting(pi.all, ref)
+	for _, l := range m.LabelSet() {
+		pi.addLabel(ref, l.Name, l.Value)
+	}
+}
+
+func (pi *postingsIndex) addLabel(ref uint64, name, value string) {
+	values, ok := pi.postings[name]
+	if !ok {
+		values = make(map[string][]uint64)
+		pi.postings[name] = values
+	}
+	values[value] = insertPosting(values[value], ref)
+}
+
+func (pi *postingsIndex) delete(ref uint64, m *model.Metric) {
+	pi.all = removePosting(pi.all, ref)
+	for _, l := range m.LabelSet() {
+		pi.deleteLabel(ref, l.Name, l.Value)
+	}
+}
+
+func (pi *postingsIndex) deleteLabel(ref uint64, name, value string) {
+	values, ok := pi.postings[name]
+	if !ok {
+		return
+	}
+	list := removePosting(values[value], ref)
+	if len(list) == 0 {
+		delete(values, value)
+		if len(values) == 0 {
+			delete(pi.postings, name)
+		}
+		return
+	}
+	values[value] = list
+}
+
+func (pi *postingsIndex) get(name, value string) []uint64 {
+	return pi.postings[name][value]
+}
+
+/*
+根据匹配器计算满足条件的 series ref 列表
+
+  - 不匹配空字符串的匹配器 (如 method="GET", method=~"GET|POST"): 取所有匹配值的 postings 并集, 再求交集
+  - 匹配空字符串的匹配器 (如 method!="GET", method=~".*"): 标签不存在的 series 也满足条件,
+    因此从结果中减去所有不匹配值的 postings
+*/
+func (pi *postingsIndex) postingsForMatchers(matchers []*model.LabelMatcher) []uint64 {
+	var its, notIts [][]uint64
+	for _, m := range matchers {
+		if m.Matches("") {
+			notIts = append(notIts, pi.postingsForValues(m.Name, func(v string) bool { return !m.Matches(v) }))
+			continue
+		}
+		if m.Type == model.MatchEqual {
+			its = append(its, pi.get(m.Name, m.Value))
+			continue
+		}
+		its = append(its, pi.postingsForValues(m.Name, m.Matches))
+	}
+	var result []uint64
+	if len(its) == 0 {
+		result = pi.all
+	} else {
+		// 从最短的列表开始求交集, 尽早缩小结果
+		sort.Slice(its, func(i, j int) bool { return len(its[i]) < len(its[j]) })
+		result = its[0]
+		for _, it := range its[1:] {
+			result = intersectPostings(result, it)
+		}
+	}
+	for _, it := range notIts {
+		result = subtractPostings(result, it)
+	}
+	return result
+}
+
+func (pi *postingsIndex) postingsForValues(name string, accept func(string) bool) []uint64 {
+	var lists [][]uint64
+	for value, list := range pi.postings[name] {
+		if accept(value) {
+			lists = append(lists, list)
+		}
+	}
+	return mergePostings(lists...)
+}
+
+func insertPosting(list []uint64, ref uint64) []uint64 {
+	// ref 单调递增, 绝大多数情况下直接追加到末尾
+	n := len(list)
+	if n == 0 || list[n-1] < ref {
+		return append(list, ref)
+	}
+	i := sort.Search(n, func(i int) bool { return list[i] >= ref })
+	if list[i] == ref {
+		return list
+	}
+	list = append(list, 0)
+	copy(list[i+1:], list[i:])
+	list[i] = ref
+	return list
+}
+
+// 返回新的切片, 不修改可能正在被查询引用的旧切片
+func removePosting(list []uint64, ref uint64) []uint64 {
+	i := sort.Search(len(list), func(i int) bool { return list[i] >= ref })
+	if i == len(list) || list[i] != ref {
+		return list
+	}
+	result := make([]uint64, 0, len(list)-1)
+	result = append(result, list[:i]...)
+	return append(result, list[i+1:]...)
+}
+
+func intersectPostings(a, b []uint64) []uint64 {
+	var result []uint64
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	return result
+}
+
+func mergePostings(lists ...[]uint64) []uint64 {
+	switch len(lists) {
+	case 0:
+		return nil
+	case 1:
+		return lists[0]
+	}
+	mid := len(lists) / 2
+	a, b := mergePostings(lists[:mid]...), mergePostings(lists[mid:]...)
+	result := make([]uint64, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			result = append(result, a[i])
+			i++
+		case a[i] > b[j]:
+			result = append(result, b[j])
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	result = append(result, a[i:]...)
+	return append(result, b[j:]...)
+}
+
+// 返回在 a 中但不在 b 中的 ref
+func subtractPostings(a, b []uint64) []uint64 {
+	var result []uint64
+	j := 0
+	for _, ref := range a {
+		for j < len(b) && b[j] < ref {
+			j++
+		}
+		if j < len(b) && b[j] == ref {
+			continue
+		}
+		result = append(result, ref)
+	}
+	return result
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"fmt"
+	"mini-promethues/pkg/model"
+	"reflect"
+	"testing"
+)
+
+func TestPostingsOperations(t *testing.T) {
+	a := []uint64{1, 3, 5, 7, 9}
+	b := []uint64{2, 3, 4, 7, 10}
+
+	t.Run("交集", func(t *testing.T) {
+		want := []uint64{3, 7}
+		if got := intersectPostings(a, b); !reflect.DeepEqual(got, want) {
+			t.Errorf("期望 %v，实际 %v", want, got)
+		}
+	})
+	t.Run("并集", func(t *testing.T) {
+		want := []uint64{1, 2, 3, 4, 5, 7, 9, 10}
+		if got := mergePostings(a, b); !reflect.DeepEqual(got, want) {
+			t.Errorf("期望 %v，实际 %v", want, got)
+		}
+		want = []uint64{1, 2, 3, 4, 5, 6, 7, 9, 10}
+		if got := mergePostings(a, b, []uint64{6}); !reflect.DeepEqual(got, want) {
+			t.Errorf("期望 %v，实际 %v", want, got)
+		}
+	})
+	t.Run("差集", func(t *testing.T) {
+		want := []uint64{1, 5, 9}
+		if got := subtractPostings(a, b); !reflect.DeepEqual(got, want) {
+			t.Errorf("期望 %v，实际 %v", want, got)
+		}
+	})
+	t.Run("有序插入和删除", func(t *testing.T) {
+		var list []uint64
+		for _, ref := range []uint64{5, 1, 3, 3, 9} {
+			list = insertPosting(list, ref)
+		}
+		if want := []uint64{1, 3, 5, 9}; !reflect.DeepEqual(list, want) {
+			t.Errorf("期望 %v，实际 %v", want, list)
+		}
+		list = removePosting(list, 3)
+		list = removePosting(list, 4)
+		if want := []uint64{1, 5, 9}; !reflect.DeepEqual(list, want) {
+			t.Errorf("期望 %v，实际 %v", want, list)
+		}
+	})
+}
+
+func TestPostingsIndex_PostingsForMatchers(t *testing.T) {
+	pi := newPostingsIndex()
+	pi.add(1, createTestMetric("http_requests_total", "method", "GET", "status", "200"))
+	pi.add(2, createTestMetric("http_requests_total", "method", "POST", "status", "500"))
+	pi.add(3, createTestMetric("http_requests_total", "method", "PUT"))
+	pi.add(4, createTestMetric("cpu_usage", "host", "server1"))
+
+	tests := []struct {
+		name     string
+		matchers []*model.LabelMatcher
+		want     []uint64
+	}{
+		{
+			name:     "指标名称",
+			matchers: []*model.LabelMatcher{createTestMatcher(t, model.MatchEqual, model.MetricNameLabel, "http_requests_total")},
+			want:     []uint64{1, 2, 3},
+		},
+		{
+			name: "正则并集",
+			matchers: []*model.LabelMatcher{
+				createTestMatcher(t, model.MatchEqual, model.MetricNameLabel, "http_requests_total"),
+				createTestMatcher(t, model.MatchRegexp, "method", "GET|PUT"),
+			},
+			want: []uint64{1, 3},
+		},
+		{
+			name: "不等于包含缺失标签的序列",
+			matchers: []*model.LabelMatcher{
+				createTestMatcher(t, model.MatchRegexp, model.MetricNameLabel, ".+"),
+				createTestMatcher(t, model.MatchNotEqual, "status", "200"),
+			},
+			want: []uint64{2, 3, 4},
+		},
+		{
+			name: "空值匹配缺失标签",
+			matchers: []*model.LabelMatcher{
+				createTestMatcher(t, model.MatchEqual, model.MetricNameLabel, "http_requests_total"),
+				createTestMatcher(t, model.MatchEqual, "status", ""),
+			},
+			want: []uint64{3},
+		},
+		{
+			name:     "只有否定匹配器",
+			matchers: []*model.LabelMatcher{createTestMatcher(t, model.MatchNotRegexp, "method", "GET|POST")},
+			want:     []uint64{3, 4},
+		},
+		{
+			name:     "不存在的值",
+			matchers: []*model.LabelMatcher{createTestMatcher(t, model.MatchEqual, "method", "PATCH")},
+			want:     nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pi.postingsForMatchers(tt.matchers); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("期望 %v，实际 %v", tt.want, got)
+			}
+		})
+	}
+
+	t.Run("删除后不再命中", func(t *testing.T) {
+		pi.delete(1, createTestMetric("http_requests_total", "method", "GET", "status", "200"))
+		matchers := []*model.LabelMatcher{createTestMatcher(t, model.MatchEqual, "method", "GET")}
+		if got := pi.postingsForMatchers(matchers); len(got) != 0 {
+			t.Errorf("期望没有结果，实际 %v", got)
+		}
+		if _, ok := pi.postings["status"]["200"]; ok {
+			t.Error("期望空的 postings 被清理")
+		}
+	})
+}
+
+// BenchmarkMemoryStorage_Select 在 10 万条时间序列中按匹配器查询
+func BenchmarkMemoryStorage_Select(b *testing.B) {
+	storage := NewMemoryStorage()
+	for i := 0; i < 100000; i++ {
+		metric := createTestMetric("http_requests_total",
+			"instance", fmt.Sprintf("host-%d", i%1000),
+			"method", []string{"GET", "POST", "PUT", "DELETE"}[(i/1000)%4],
+			"id", fmt.Sprintf("%d", i))
+		storage.Append(metric, &model.Sample{Timestamp: 1000, Value: float64(i)})
+	}
+	matchers := []*model.LabelMatcher{
+		createTestMatcher(b, model.MatchEqual, model.MetricNameLabel, "http_requests_total"),
+		createTestMatcher(b, model.MatchEqual, "instance", "host-42"),
+		createTestMatcher(b, model.MatchRegexp, "method", "GET|POST"),
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ss, err := storage.Select(matchers, 0, 2000)
+		if err != nil {
+			b.Fatal(err)
+		}
+		n := 0
+		for ss.Next() {
+			n++
+		}
+		if n != 50 {
+			b.Fatalf("期望 50 条时间序列，实际 %d 条", n)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"errors"
+	"mini-promethues/pkg/model"
+	"mini-promethues/pkg/storage/chunkenc"
+	"sort"
+)
+
+// 按时间戳递增的顺序遍历一条序列的样本
+type SeriesIterator interface {
+	// 移动到下一个样本
+	Next() bool
+	// 移动到第一个时间戳不小于 t 的样本; 当前样本已经满足时不移动, 不会向后回退
+	// 不叫 Seek, 避免和 io.Seeker 的签名冲突 (go vet 会检查)
+	SeekTo(t int64) bool
+	// 当前样本, 只有 Next 或 SeekTo 返回 true 之后才有效
+	At() (int64, float64)
+	Err() error
+}
+
+type listSeriesIterator struct {
+	samples model.Samples
+	cur     int
+}
+
+// 有序样本列表上的迭代器, SeekTo 二分查找
+func NewListSeriesIterator(samples model.Samples) SeriesIterator {
+	return &listSeriesIterator{samples: samples, cur: -1}
+}
+
+func (it *listSeriesIterator) Next() bool {
+	if it.cur < len(it.samples) {
+		it.cur++
+	}
+	return it.cur < len(it.samples)
+}
+
+func (it *listSeriesIterator) SeekTo(t int64) bool {
+	start := max(it.cur, 0)
+	if start >= len(it.samples) {
+		return false
+	}
+	if it.samples[start].Timestamp < t {
+		rest := it.samples[start:]
+		start += sort.Search(len(rest), func(i int) bool { return rest[i].Timestamp >= t })
+	}
+	it.cur = start
+	return it.cur < len(it.samples)
+}
+
+func (it *listSeriesIterator) At() (int64, float64) {
+	s := it.samples[it.cur]
+	return s.Timestamp, s.Value
+}
+
+func (it *listSeriesIterator) Err() error {
+	return nil
+}
+
+/*
+按时间排序且互不重叠的 chunk 上的迭代器
+SeekTo 先二分查找可能包含 t 的 chunk, 只解码这一个 chunk 中 t 之前的样本; chunk 按需加载
+*/
+type chunkSeriesIterator struct {
+	metas []chunkMeta
+	load  func(i int) (*chunkenc.XORChunk, error)
+
+	i     int
+	cur   *chunkenc.XORIterator
+	valid bool
+	err   error
+}
+
+func newChunkSeriesIterator(metas []chunkMeta, load func(i int) (*chunkenc.XORChunk, error)) *chunkSeriesIterator {
+	return &chunkSeriesIterator{metas: metas, load: load, i: -1}
+}
+
+func (it *chunkSeriesIterator) openChunk(i int) bool {
+	it.cur = nil
+	it.i = min(i, len(it.metas))
+	if it.i == len(it.metas) {
+		return false
+	}
+	c, err := it.load(i)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.cur = c.Iterator()
+	return true
+}
+
+func (it *chunkSeriesIterator) Next() bool {
+	it.valid = false
+	for it.err == nil {
+		if it.cur != nil {
+			if it.cur.Next() {
+				it.valid = true
+				return true
+			}
+			if err := it.cur.Err(); err != nil {
+				it.err = err
+				return false
+			}
+		}
+		if !it.openChunk(it.i + 1) {
+			return false
+		}
+	}
+	return false
+}
+
+func (it *chunkSeriesIterator) SeekTo(t int64) bool {
+	if it.valid {
+		if ts, _ := it.cur.At(); ts >= t {
+			return true
+		}
+	}
+	if j := sort.Search(len(it.metas), func(j int) bool { return it.metas[j].MaxTime >= t }); j > it.i {
+		if !it.openChunk(j) {
+			it.valid = false
+			return false
+		}
+	}
+	for it.Next() {
+		if ts, _ := it.cur.At(); ts >= t {
+			return true
+		}
+	}
+	return false
+}
+
+func (it *chunkSeriesIterator) At() (int64, float64) {
+	return it.cur.At()
+}
+
+func (it *chunkSeriesIterator) Err() error {
+	return it.err
+}
+
+// 当前样本来自哪个迭代器
+type mergeSource int
+
+const (
+	sourceNone mergeSource = iota
+	sourceA
+	sourceB
+	// 两边时间戳相同, 使用 a 的样本
+	sourceBoth
+)
+
+// 合并两个有序迭代器, 时间戳相同时保留 a 中的样本
+type mergeSeriesIterator struct {
+	a, b     SeriesIterator
+	aok, bok bool
+	started  bool
+	cur      mergeSource
+}
+
+func newMergeSeriesIterator(a, b SeriesIterator) *mergeSeriesIterator {
+	return &mergeSeriesIterator{a: a, b: b}
+}
+
+func (it *mergeSeriesIterator) Next() bool {
+	if !it.started {
+		it.started = true
+		it.aok, it.bok = it.a.Next(), it.b.Next()
+		return it.pick()
+	}
+	if it.cur == sourceA || it.cur == sourceBoth {
+		it.aok = it.a.Next()
+	}
+	if it.cur == sourceB || it.cur == sourceBoth {
+		it.bok = it.b.Next()
+	}
+	return it.pick()
+}
+
+func (it *mergeSeriesIterator) SeekTo(t int64) bool {
+	if !it.started {
+		it.started = true
+		it.aok, it.bok = it.a.SeekTo(t), it.b.SeekTo(t)
+		return it.pick()
+	}
+	if it.cur == sourceNone {
+		return false
+	}
+	if it.aok {
+		it.aok = it.a.SeekTo(t)
+	}
+	if it.bok {
+		it.bok = it.b.SeekTo(t)
+	}
+	return it.pick()
+}
+
+func (it *mergeSeriesIterator) pick() bool {
+	switch {
+	case it.aok && it.bok:
+		ta, _ := it.a.At()
+		tb, _ := it.b.At()
+		switch {
+		case ta < tb:
+			it.cur = sourceA
+		case ta > tb:
+			it.cur = sourceB
+		default:
+			it.cur = sourceBoth
+		}
+	case it.aok:
+		it.cur = sourceA
+	case it.bok:
+		it.cur = sourceB
+	default:
+		it.cur = sourceNone
+		return false
+	}
+	return true
+}
+
+func (it *mergeSeriesIterator) At() (int64, float64) {
+	if it.cur == sourceB {
+		return it.b.At()
+	}
+	return it.a.At()
+}
+
+func (it *mergeSeriesIterator) Err() error {
+	return errors.Join(it.a.Err(), it.b.Err())
+}
+
+// 返回 [mint, maxt] 范围内的样本
+func samplesInRange(it SeriesIterator, mint, maxt int64) (model.Samples, error) {
+	var result model.Samples
+	for ok := it.SeekTo(mint); ok; ok = it.Next() {
+		t, v := it.At()
+		if t > maxt {
+			break
+		}
+		result = append(result, model.Sample{Timestamp: t, Value: v})
+	}
+	return result, it.Err()
+}
+
+// 返回 [mint, maxt] 范围内时间戳最大的样本
+func latestInRange(it SeriesIterator, mint, maxt int64) (model.Sample, bool, error) {
+	var result model.Sample
+	found := false
+	for ok := it.SeekTo(mint); ok; ok = it.Next() {
+		t, v := it.At()
+		if t > maxt {
+			break
+		}
+		result, found = model.Sample{Timestamp: t, Value: v}, true
+	}
+	return result, found, it.Err()
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"mini-promethues/pkg/model"
+	"testing"
+)
+
+// 辅助函数：按 ops 依次调用迭代器, 记录每次得到的时间戳, 没有样本时记为 -1
+func runIterator(it SeriesIterator, ops []int64) []int64 {
+	var result []int64
+	for _, op := range ops {
+		var ok bool
+		// 负数表示 Next, 其余表示 SeekTo(op)
+		if op < 0 {
+			ok = it.Next()
+		} else {
+			ok = it.SeekTo(op)
+		}
+		if !ok {
+			result = append(result, -1)
+			continue
+		}
+		t, _ := it.At()
+		result = append(result, t)
+	}
+	return result
+}
+
+func assertTimestamps(t *testing.T, want, got []int64) {
+	t.Helper()
+	if len(want) != len(got) {
+		t.Fatalf("期望 %v，实际 %v", want, got)
+	}
+	for i := range want {
+		if want[i] != got[i] {
+			t.Fatalf("期望 %v，实际 %v", want, got)
+		}
+	}
+}
+
+// TestSeriesIterator 测试各种迭代器的 Next 和 SeekTo 语义一致
+func TestSeriesIterator(t *testing.T) {
+	// 时间戳 0, 10, 20, ..., 2990, 写入 memSeries 时分布在 3 个 chunk 中
+	var samples model.Samples
+	for i := int64(0); i < 300; i++ {
+		samples = append(samples, model.Sample{Timestamp: i * 10, Value: float64(i)})
+	}
+	ops := []int64{-1, -1, 15, 15, 0, 1555, -1, 2990, -1, 5000}
+	want := []int64{0, 10, 20, 20, 20, 1560, 1570, 2990, -1, -1}
+
+	t.Run("样本列表", func(t *testing.T) {
+		assertTimestamps(t, want, runIterator(NewListSeriesIterator(samples), ops))
+	})
+
+	t.Run("chunk", func(t *testing.T) {
+		s := newMemSeries(1, createTestMetric("up"))
+		for _, sample := range samples {
+			s.append(sample.Timestamp, sample.Value)
+		}
+		assertTimestamps(t, want, runIterator(s.iterator(), ops))
+	})
+
+	t.Run("合并两个迭代器", func(t *testing.T) {
+		var even, odd model.Samples
+		for i, s := range samples {
+			if i%2 == 0 {
+				even = append(even, s)
+			} else {
+				odd = append(odd, s)
+			}
+		}
+		// 重复的样本只出现一次
+		odd = append(odd[:10:10], append(model.Samples{samples[20]}, odd[10:]...)...)
+		it := newMergeSeriesIterator(NewListSeriesIterator(even), NewListSeriesIterator(odd))
+		assertTimestamps(t, want, runIterator(it, ops))
+	})
+
+	t.Run("空迭代器", func(t *testing.T) {
+		assertTimestamps(t, []int64{-1, -1}, runIterator(NewListSeriesIterator(nil), []int64{0, -1}))
+	})
+}
+
+// BenchmarkMemoryStorage_QueryRange 在一周的序列 (15s 间隔) 上查询最近 1 小时
+func BenchmarkMemoryStorage_QueryRange(b *testing.B) {
+	storage := NewMemoryStorage()
+	metric := createTestMetric("cpu_usage", "host", "server1")
+	const n = 7 * 24 * 3600 / 15
+	for i := int64(0); i < n; i++ {
+		storage.Append(metric, &model.Sample{Timestamp: i * 15000, Value: float64(i)})
+	}
+	end := int64(n-1) * 15000
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		series, err := storage.QueryRange(metric, end-3600000, end)
+		if err != nil || len(series.Samples) != 241 {
+			b.Fatalf("期望 241 个样本，实际 %d 个, err=%v", len(series.Samples), err)
+		}
+	}
+}
+
+// BenchmarkMemoryStorage_Query 在一周的序列上做即时查询
+func BenchmarkMemoryStorage_Query(b *testing.B) {
+	storage := NewMemoryStorage()
+	metric := createTestMetric("cpu_usage", "host", "server1")
+	const n = 7 * 24 * 3600 / 15
+	for i := int64(0); i < n; i++ {
+		storage.Append(metric, &model.Sample{Timestamp: i * 15000, Value: float64(i)})
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := storage.Query(metric, int64(i%n)*15000); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
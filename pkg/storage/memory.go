@@ -1,76 +1,326 @@
 package storage
 
 import (
+	"fmt"
+	"math"
 	"mini-promethues/pkg/model"
+	"mini-promethues/pkg/storage/wal"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+/*
+锁的粒度:
+  - 按 fingerprint 分片的序列表 (hashes), 每个分片一把锁, 查找和创建序列只锁一个分片
+  - 每条序列自己的锁, 写入和读取样本只锁这条序列
+  - indexMutex 保护 ref 表和倒排索引, 只在创建、删除序列和 Select 时使用
+  - mutex 在截断内存中的数据时独占, 写入和删除时共享, 保证截断时没有进行到一半的写入
+  - checkpointMutex 保证同一时间只有一个 checkpoint, checkpoint 不持有 mutex, 期间写入和查询照常进行
+
+加锁顺序: checkpointMutex -> mutex -> 分片锁 -> indexMutex -> 序列锁
+*/
 type MemoryStorage struct {
-	series map[uint64]*model.Series
-	mutex  sync.RWMutex
+	hashes *stripeSeries
+	// ref -> series, ref 是倒排索引中使用的 series ID
+	refs       map[uint64]*memSeries
+	index      *postingsIndex
+	indexMutex sync.RWMutex
+	symbols    *symbolTable
+	lastRef    atomic.Uint64
+	// 所有样本的时间范围
+	minTime, maxTime atomic.Int64
+	// 早于该时间的数据已经持久化到 block, 不再接受写入
+	minValidTime atomic.Int64
+	// 乱序窗口 (毫秒), 为 0 时拒绝所有乱序样本
+	oooTimeWindow int64
+	// 即时查询的回溯窗口 (毫秒)
+	lookbackDelta int64
+	// 为 nil 时不记录 WAL, 重启后数据丢失
+	wal             *wal.WAL
+	mutex           sync.RWMutex
+	checkpointMutex sync.Mutex
+}
+
+type Option func(*MemoryStorage)
+
+/*
+允许写入比已写入的最大时间戳早不超过 window 的乱序样本
+乱序样本单独缓存在序列中, 查询时和有序样本合并; 更早的样本仍然返回 ErrOutOfOrder
+*/
+func WithOutOfOrderTimeWindow(window time.Duration) Option {
+	return func(ms *MemoryStorage) {
+		ms.oooTimeWindow = window.Milliseconds()
+	}
+}
+
+// 即时查询默认的回溯窗口, 抓取间隔较长的任务需要调大, 否则查询结果会出现空洞
+func WithLookbackDelta(lookback time.Duration) Option {
+	return func(ms *MemoryStorage) {
+		if lookback > 0 {
+			ms.lookbackDelta = lookback.Milliseconds()
+		}
+	}
+}
+
+func NewMemoryStorage(opts ...Option) *MemoryStorage {
+	ms := &MemoryStorage{
+		hashes:        newStripeSeries(defaultStripeSize),
+		refs:          make(map[uint64]*memSeries),
+		index:         newPostingsIndex(),
+		symbols:       newSymbolTable(),
+		lookbackDelta: DefaultLookbackDelta.Milliseconds(),
+	}
+	ms.minTime.Store(math.MaxInt64)
+	ms.maxTime.Store(math.MinInt64)
+	ms.minValidTime.Store(math.MinInt64)
+	for _, opt := range opts {
+		opt(ms)
+	}
+	return ms
 }
 
-func NewMemoryStorage() *MemoryStorage {
-	return &MemoryStorage{
-		series: make(map[uint64]*model.Series),
+// 打开 walDir 下的 WAL 并回放, 重建内存中的时间序列; 之后的写入会先记录到 WAL 再对查询可见
+func OpenMemoryStorage(walDir string, opts ...Option) (*MemoryStorage, error) {
+	w, err := wal.New(walDir, wal.DefaultSegmentSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := removeTmpCheckpoints(walDir); err != nil {
+		w.Close()
+		return nil, err
 	}
+	ms := NewMemoryStorage(opts...)
+	if err := ms.replayWAL(walDir); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("replay wal: %w", err)
+	}
+	ms.wal = w
+	return ms, nil
 }
 
-const defaultLookbackDelta = 5 * 60 * 1000
+// 先回放最新的 checkpoint, 再回放之后的段
+func (ms *MemoryStorage) replayWAL(dir string) error {
+	return forEachWALRecord(dir, -1, func(rec []byte) error {
+		switch recordTypeOf(rec) {
+		case recordSeries:
+			series, err := decodeSeries(rec)
+			if err != nil {
+				return err
+			}
+			for i := range series {
+				if ms.seriesByRef(series[i].Ref) != nil {
+					continue
+				}
+				stripe := ms.hashes.stripe(series[i].Metric.Fingerprint())
+				stripe.Lock()
+				ms.createSeries(stripe, series[i].Ref, &series[i].Metric)
+				stripe.Unlock()
+				ms.lastRef.Store(max(ms.lastRef.Load(), series[i].Ref))
+			}
+		case recordSamples:
+			samples, err := decodeSamples(rec)
+			if err != nil {
+				return err
+			}
+			for _, s := range samples {
+				series := ms.seriesByRef(s.Ref)
+				if series == nil {
+					continue
+				}
+				// 写入 WAL 后 Commit 还会再检查一次, 当时被拒绝的样本回放时同样跳过
+				if duplicate, err := series.appendable(s.T, s.V, ms.oooMinTime()); err != nil || duplicate {
+					continue
+				}
+				ms.appendSample(series, s.T, s.V)
+			}
+		case recordDeletes:
+			refs, err := decodeDeletes(rec)
+			if err != nil {
+				return err
+			}
+			for _, ref := range refs {
+				if series := ms.seriesByRef(ref); series != nil {
+					ms.removeSeries(series)
+				}
+			}
+		default:
+			return fmt.Errorf("unknown wal record type %d", recordTypeOf(rec))
+		}
+		return nil
+	})
+}
 
+// 单个样本的写入, 等价于只包含一个样本的 Appender
 func (ms *MemoryStorage) Append(m *model.Metric, s *model.Sample) error {
-	if m == nil {
-		return ErrNilMetric
+	app := ms.Appender()
+	if err := app.Append(m, s); err != nil {
+		return err
 	}
-	if s == nil {
-		return ErrNilSample
+	return app.Commit()
+}
+
+/*
+查找或创建序列并持有它的锁返回
+查找到加锁之间序列可能被并发的 Delete 删除, 这时重新查找, 样本不会写进已经删除的序列而丢失
+*/
+func (ms *MemoryStorage) lockSeries(m *model.Metric) (*memSeries, error) {
+	for {
+		series, err := ms.getOrCreateSeries(m)
+		if err != nil {
+			return nil, err
+		}
+		series.mutex.Lock()
+		if !series.deleted.Load() {
+			return series, nil
+		}
+		series.mutex.Unlock()
+	}
+}
+
+// 查找序列, 不存在时创建并记录到 WAL
+func (ms *MemoryStorage) getOrCreateSeries(m *model.Metric) (*memSeries, error) {
+	if series := ms.hashes.get(m); series != nil {
+		return series, nil
+	}
+	// 已有序列的标签和 m 完全相同, 只需要在创建序列时检查
+	if err := m.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidMetric, err)
 	}
-	ms.mutex.Lock()
-	defer ms.mutex.Unlock()
 	fp := m.Fingerprint()
-	if series, ok := ms.series[fp]; ok {
-		series.Samples = append(series.Samples, *s)
-	} else {
-		newSeries := &model.Series{Metric: *m, Samples: model.Samples{*s}}
-		ms.series[fp] = newSeries
+	stripe := ms.hashes.stripe(fp)
+	stripe.Lock()
+	defer stripe.Unlock()
+	// 并发的写入可能已经创建了同一条序列
+	if series := stripe.get(fp, m); series != nil {
+		return series, nil
 	}
-	return nil
+	// 先加入内存再记录 WAL: checkpoint 根据内存中是否存在决定保留哪些序列记录, 已记录的序列一定能被它看到
+	series := ms.createSeries(stripe, ms.lastRef.Add(1), m)
+	if ms.wal != nil {
+		if err := ms.wal.Log(encodeSeries([]refSeries{{Ref: series.ref, Metric: series.metric}})); err != nil {
+			ms.deleteSeries(stripe, series)
+			return nil, fmt.Errorf("write wal: %w", err)
+		}
+	}
+	return series, nil
+}
+
+// 允许写入乱序样本的最早时间
+func (ms *MemoryStorage) oooMinTime() int64 {
+	maxTime := ms.maxTime.Load()
+	if ms.oooTimeWindow <= 0 || maxTime == math.MinInt64 {
+		return math.MaxInt64
+	}
+	return maxTime - ms.oooTimeWindow
+}
+
+// 调用方持有序列锁
+func (ms *MemoryStorage) appendSample(series *memSeries, t int64, v float64) {
+	series.append(t, v)
+	storeMin(&ms.minTime, t)
+	storeMax(&ms.maxTime, t)
+}
+
+func storeMin(a *atomic.Int64, v int64) {
+	for old := a.Load(); v < old && !a.CompareAndSwap(old, v); old = a.Load() {
+	}
+}
+
+func storeMax(a *atomic.Int64, v int64) {
+	for old := a.Load(); v > old && !a.CompareAndSwap(old, v); old = a.Load() {
+	}
+}
+
+func (ms *MemoryStorage) seriesByRef(ref uint64) *memSeries {
+	ms.indexMutex.RLock()
+	defer ms.indexMutex.RUnlock()
+	return ms.refs[ref]
+}
+
+// 当前所有序列, 调用方自己给每条序列加锁
+func (ms *MemoryStorage) allSeries() []*memSeries {
+	ms.indexMutex.RLock()
+	defer ms.indexMutex.RUnlock()
+	result := make([]*memSeries, 0, len(ms.refs))
+	for _, series := range ms.refs {
+		result = append(result, series)
+	}
+	return result
+}
+
+func (ms *MemoryStorage) numSeries() int {
+	ms.indexMutex.RLock()
+	defer ms.indexMutex.RUnlock()
+	return len(ms.refs)
+}
+
+// 调用方持有 stripe 的写锁
+func (ms *MemoryStorage) createSeries(stripe *seriesStripe, ref uint64, m *model.Metric) *memSeries {
+	series := newMemSeries(ref, ms.symbols.internMetric(m))
+	stripe.add(series.metric.Fingerprint(), series)
+	ms.indexMutex.Lock()
+	ms.refs[ref] = series
+	ms.index.add(ref, &series.metric)
+	ms.indexMutex.Unlock()
+	return series
+}
+
+// 调用方持有序列所在分片的写锁
+func (ms *MemoryStorage) deleteSeries(stripe *seriesStripe, series *memSeries) {
+	series.deleted.Store(true)
+	stripe.delete(series.metric.Fingerprint(), series)
+	ms.indexMutex.Lock()
+	delete(ms.refs, series.ref)
+	ms.index.delete(series.ref, &series.metric)
+	ms.indexMutex.Unlock()
+	ms.symbols.releaseMetric(&series.metric)
+}
+
+func (ms *MemoryStorage) removeSeries(series *memSeries) {
+	stripe := ms.hashes.stripe(series.metric.Fingerprint())
+	stripe.Lock()
+	defer stripe.Unlock()
+	ms.deleteSeries(stripe, series)
+}
+
+func (ms *MemoryStorage) LookbackDelta() time.Duration {
+	return time.Duration(ms.lookbackDelta) * time.Millisecond
 }
 
 func (ms *MemoryStorage) Query(m *model.Metric, timestamp int64) (model.Series, error) {
 	if m == nil {
 		return model.Series{}, ErrNilMetric
 	}
-	return ms.queryWithLookback(m, timestamp, defaultLookbackDelta)
+	return dropStale(ms.queryWithLookback(m, timestamp, ms.lookbackDelta))
+}
+
+func (ms *MemoryStorage) QueryWithLookback(m *model.Metric, timestamp int64, lookback time.Duration) (model.Series, error) {
+	if m == nil {
+		return model.Series{}, ErrNilMetric
+	}
+	if lookback <= 0 {
+		return dropStale(ms.queryWithLookback(m, timestamp, ms.lookbackDelta))
+	}
+	return dropStale(ms.queryWithLookback(m, timestamp, lookback.Milliseconds()))
 }
 
 /*
 使用Lookback Delta 回溯窗口
-在 [timestamp - lookback, timestamp] 范围内查找最新的样本
+在 [timestamp - lookback, timestamp] 范围内查找最新的样本, 结果可能是 staleness marker
 */
 func (ms *MemoryStorage) queryWithLookback(m *model.Metric, timestamp, lookback int64) (model.Series, error) {
-	ms.mutex.RLock()
-	defer ms.mutex.RUnlock()
-	fp := m.Fingerprint()
-	series, ok := ms.series[fp]
-	if !ok {
+	series := ms.hashes.get(m)
+	if series == nil {
 		return model.Series{}, ErrSeriesNotFound
 	}
-	minTimestamp := timestamp - lookback
-	maxTimestamp := timestamp
-	var result *model.Sample
-	for i := range series.Samples {
-		s := &series.Samples[i]
-		if s.Timestamp >= minTimestamp && s.Timestamp <= maxTimestamp {
-			if result == nil || result.Timestamp < s.Timestamp {
-				result = s
-			}
-		}
+	series.mutex.Lock()
+	result, found := series.latestInRange(timestamp-lookback, timestamp)
+	series.mutex.Unlock()
+	if !found {
+		return model.Series{Metric: series.metric}, nil
 	}
-	if result == nil {
-		return model.Series{Metric: series.Metric}, nil
-	}
-	return model.Series{Metric: series.Metric, Samples: model.Samples{*result}}, nil
+	return model.Series{Metric: series.metric, Samples: model.Samples{result}}, nil
 }
 
 func (ms *MemoryStorage) QueryRange(m *model.Metric, start, end int64) (model.Series, error) {
@@ -80,29 +330,145 @@ func (ms *MemoryStorage) QueryRange(m *model.Metric, start, end int64) (model.Se
 	if start > end {
 		return model.Series{}, ErrTimeRange
 	}
-	ms.mutex.RLock()
-	defer ms.mutex.RUnlock()
-	fp := m.Fingerprint()
-	series, ok := ms.series[fp]
-	if !ok {
+	series := ms.hashes.get(m)
+	if series == nil {
 		return model.Series{}, ErrSeriesNotFound
 	}
-	filtered := make(model.Samples, 0, len(series.Samples))
-	for _, s := range series.Samples {
-		if s.Timestamp >= start && s.Timestamp <= end {
-			filtered = append(filtered, s)
+	series.mutex.Lock()
+	filtered := series.samplesInRange(start, end)
+	series.mutex.Unlock()
+	if filtered == nil {
+		filtered = model.Samples{}
+	}
+	return model.Series{Metric: series.metric, Samples: filtered}, nil
+}
+
+func (ms *MemoryStorage) Select(matchers []*model.LabelMatcher, mint, maxt int64) (SeriesSet, error) {
+	if len(matchers) == 0 {
+		return nil, ErrNoMatchers
+	}
+	if mint > maxt {
+		return nil, ErrTimeRange
+	}
+	ms.indexMutex.RLock()
+	refs := ms.index.postingsForMatchers(matchers)
+	matched := make([]*memSeries, len(refs))
+	for i, ref := range refs {
+		matched[i] = ms.refs[ref]
+	}
+	ms.indexMutex.RUnlock()
+
+	var result []model.Series
+	for _, series := range matched {
+		series.mutex.Lock()
+		filtered := series.samplesInRange(mint, maxt)
+		series.mutex.Unlock()
+		if len(filtered) == 0 {
+			continue
 		}
+		result = append(result, model.Series{Metric: series.metric, Samples: filtered})
 	}
-	return model.Series{Metric: series.Metric, Samples: filtered}, nil
+	return newListSeriesSet(result), nil
 }
 
 func (ms *MemoryStorage) Delete(m *model.Metric) error {
 	if m == nil {
 		return ErrNilMetric
 	}
-	ms.mutex.Lock()
-	defer ms.mutex.Unlock()
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
 	fp := m.Fingerprint()
-	delete(ms.series, fp)
+	stripe := ms.hashes.stripe(fp)
+	stripe.Lock()
+	defer stripe.Unlock()
+	series := stripe.get(fp, m)
+	if series == nil {
+		return nil
+	}
+	if ms.wal != nil {
+		if err := ms.wal.Log(encodeDeletes([]uint64{series.ref})); err != nil {
+			return fmt.Errorf("write wal: %w", err)
+		}
+	}
+	ms.deleteSeries(stripe, series)
 	return nil
 }
+
+// 没有数据时返回 math.MaxInt64
+func (ms *MemoryStorage) MinTime() int64 {
+	return ms.minTime.Load()
+}
+
+// 没有数据时返回 math.MinInt64
+func (ms *MemoryStorage) MaxTime() int64 {
+	return ms.maxTime.Load()
+}
+
+// 拒绝之后早于 t 的写入, 用于把 [.., t) 切成 block 之前冻结这段数据
+func (ms *MemoryStorage) setMinValidTime(t int64) {
+	storeMax(&ms.minValidTime, t)
+}
+
+// 返回 [mint, maxt) 范围内所有序列的样本, 用于写入 block
+func (ms *MemoryStorage) snapshot(mint, maxt int64) []blockSeriesData {
+	all := ms.allSeries()
+	result := make([]blockSeriesData, 0, len(all))
+	for _, series := range all {
+		series.mutex.Lock()
+		samples := series.samplesInRange(mint, maxt-1)
+		series.mutex.Unlock()
+		if len(samples) == 0 {
+			continue
+		}
+		result = append(result, blockSeriesData{metric: series.metric, samples: samples})
+	}
+	return result
+}
+
+/*
+删除早于 mint 的样本和因此变空的序列, 返回删除的样本数
+内存中的截断独占 mutex, 完成后立即释放; WAL 中的旧数据随后通过 checkpoint 清理, 不阻塞写入和查询
+*/
+func (ms *MemoryStorage) truncate(mint int64) (int, error) {
+	removed := ms.truncateMemory(mint)
+	if ms.wal == nil {
+		return removed, nil
+	}
+	return removed, ms.checkpointWAL(mint)
+}
+
+func (ms *MemoryStorage) truncateMemory(mint int64) int {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.setMinValidTime(mint)
+	minTime := int64(math.MaxInt64)
+	removed := 0
+	for _, series := range ms.allSeries() {
+		series.mutex.Lock()
+		removed += series.truncateBefore(mint)
+		empty, seriesMin := series.empty(), series.minTime()
+		series.mutex.Unlock()
+		if empty {
+			ms.removeSeries(series)
+			continue
+		}
+		minTime = min(minTime, seriesMin)
+	}
+	ms.minTime.Store(minTime)
+	if minTime == math.MaxInt64 {
+		ms.maxTime.Store(math.MinInt64)
+	}
+	return removed
+}
+
+// 关闭 WAL, 等待进行中的 checkpoint 完成; 之后不再接受写入由调用方保证
+func (ms *MemoryStorage) Close() error {
+	ms.checkpointMutex.Lock()
+	defer ms.checkpointMutex.Unlock()
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if ms.wal == nil {
+		return nil
+	}
+	return ms.wal.Close()
+}
@@ -1,10 +1,18 @@
 package storage
 
 import (
+	"errors"
+	"fmt"
 	"mini-promethues/pkg/model"
+	"mini-promethues/pkg/storage/wal"
+	"os"
+	"runtime"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unsafe"
 )
 
 // 辅助函数：创建测试用的 Metric
@@ -110,6 +118,84 @@ func TestMemoryStorage_Append(t *testing.T) {
 		}
 	})
 
+	t.Run("乱序和重复样本", func(t *testing.T) {
+		storage := NewMemoryStorage()
+		metric := createTestMetric("cpu_usage", "host", "server1")
+		storage.Append(metric, &model.Sample{Timestamp: 1000, Value: 1})
+		storage.Append(metric, &model.Sample{Timestamp: 2000, Value: 2})
+
+		if err := storage.Append(metric, &model.Sample{Timestamp: 500, Value: 1}); err != ErrOutOfOrder {
+			t.Errorf("期望错误 ErrOutOfOrder，实际得到 %v", err)
+		}
+		if err := storage.Append(metric, &model.Sample{Timestamp: 1000, Value: 1}); err != nil {
+			t.Errorf("重新写入较早的相同样本不应该报错，实际得到 %v", err)
+		}
+		if err := storage.Append(metric, &model.Sample{Timestamp: 2000, Value: 3}); err != ErrDuplicateSampleForTimestamp {
+			t.Errorf("期望错误 ErrDuplicateSampleForTimestamp，实际得到 %v", err)
+		}
+		if err := storage.Append(metric, &model.Sample{Timestamp: 2000, Value: 2}); err != nil {
+			t.Errorf("重复写入相同样本不应该报错，实际得到 %v", err)
+		}
+		series, _ := storage.QueryRange(metric, 0, 5000)
+		want := model.Samples{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 2}}
+		if !slices.Equal(series.Samples, want) {
+			t.Errorf("期望样本 %v，实际 %v", want, series.Samples)
+		}
+	})
+
+	t.Run("乱序窗口", func(t *testing.T) {
+		dir := t.TempDir()
+		storage, err := OpenMemoryStorage(dir, WithOutOfOrderTimeWindow(time.Minute))
+		if err != nil {
+			t.Fatalf("打开存储失败: %v", err)
+		}
+		metric := createTestMetric("cpu_usage", "host", "server1")
+		for _, ts := range []int64{0, 60000, 120000, 90000, 70000} {
+			if err := storage.Append(metric, &model.Sample{Timestamp: ts, Value: float64(ts)}); err != nil {
+				t.Fatalf("样本 %d: 写入失败: %v", ts, err)
+			}
+		}
+		if err := storage.Append(metric, &model.Sample{Timestamp: 30000, Value: 1}); err != ErrOutOfOrder {
+			t.Errorf("期望窗口外的样本返回 ErrOutOfOrder，实际得到 %v", err)
+		}
+		storage.Close()
+
+		// 乱序样本同样写入 WAL, 重启后仍然可以查询到
+		storage, err = OpenMemoryStorage(dir, WithOutOfOrderTimeWindow(time.Minute))
+		if err != nil {
+			t.Fatalf("打开存储失败: %v", err)
+		}
+		defer storage.Close()
+		series, _ := storage.QueryRange(metric, 0, 200000)
+		want := []int64{0, 60000, 70000, 90000, 120000}
+		if len(series.Samples) != len(want) {
+			t.Fatalf("期望 %d 个样本，实际 %v", len(want), series.Samples)
+		}
+		for i, ts := range want {
+			if series.Samples[i].Timestamp != ts {
+				t.Errorf("样本 %d: 期望时间戳 %d，实际 %d", i, ts, series.Samples[i].Timestamp)
+			}
+		}
+	})
+
+	t.Run("非法的标签", func(t *testing.T) {
+		storage := NewMemoryStorage()
+		invalid := []*model.Metric{
+			createTestMetric("http-requests"),
+			createTestMetric("up", "host", "a", "host", "b"),
+			createTestMetric("up", "__tenant", "a"),
+			createTestMetric("up", "1host", "a"),
+		}
+		for _, m := range invalid {
+			if err := storage.Append(m, createTestSample(0, 1)); !errors.Is(err, ErrInvalidMetric) {
+				t.Errorf("%s: 期望 ErrInvalidMetric，实际 %v", m, err)
+			}
+		}
+		if n := storage.numSeries(); n != 0 {
+			t.Errorf("期望不创建序列，实际 %d 条", n)
+		}
+	})
+
 	t.Run("nil Metric 参数", func(t *testing.T) {
 		storage := NewMemoryStorage()
 		sample := createTestSample(0, 100)
@@ -231,6 +317,62 @@ func TestMemoryStorage_Query(t *testing.T) {
 		}
 	})
 
+	t.Run("配置 lookback", func(t *testing.T) {
+		// 10 分钟抓取一次的任务
+		storage := NewMemoryStorage(WithLookbackDelta(15 * time.Minute))
+		metric := createTestMetric("slow_job_metric", "type", "test")
+		now := time.Now()
+		storage.Append(metric, &model.Sample{Timestamp: now.Add(-10 * time.Minute).UnixMilli(), Value: 1})
+
+		series, err := storage.Query(metric, now.UnixMilli())
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		if len(series.Samples) != 1 {
+			t.Errorf("期望存储配置的 lookback 内找到 1 个样本，实际得到 %d 个", len(series.Samples))
+		}
+
+		// 单次查询指定的 lookback 优先
+		series, err = storage.QueryWithLookback(metric, now.UnixMilli(), 5*time.Minute)
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		if len(series.Samples) != 0 {
+			t.Errorf("期望 5 分钟 lookback 内没有样本，实际得到 %d 个", len(series.Samples))
+		}
+		series, _ = storage.QueryWithLookback(metric, now.UnixMilli(), 0)
+		if len(series.Samples) != 1 {
+			t.Errorf("期望 lookback 为 0 时使用存储配置，实际得到 %d 个样本", len(series.Samples))
+		}
+	})
+
+	t.Run("staleness marker", func(t *testing.T) {
+		storage := NewMemoryStorage()
+		metric := createTestMetric("stale_metric", "type", "test")
+		now := time.Now()
+		storage.Append(metric, &model.Sample{Timestamp: now.Add(-2 * time.Minute).UnixMilli(), Value: 1})
+		storage.Append(metric, &model.Sample{Timestamp: now.Add(-time.Minute).UnixMilli(), Value: model.StaleValue()})
+
+		series, err := storage.Query(metric, now.UnixMilli())
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		if len(series.Samples) != 0 {
+			t.Errorf("期望 marker 之后没有值，实际 %v", series.Samples)
+		}
+		// marker 之前的时刻仍然能查到原来的值
+		series, _ = storage.Query(metric, now.Add(-90*time.Second).UnixMilli())
+		if len(series.Samples) != 1 || series.Samples[0].Value != 1 {
+			t.Errorf("期望 marker 之前的值为 1，实际 %v", series.Samples)
+		}
+		// 序列恢复后重新有值
+		storage.Append(metric, &model.Sample{Timestamp: now.UnixMilli(), Value: 2})
+		series, _ = storage.Query(metric, now.UnixMilli())
+		if len(series.Samples) != 1 || series.Samples[0].Value != 2 {
+			t.Errorf("期望恢复后的值为 2，实际 %v", series.Samples)
+		}
+	})
+
 	t.Run("查询不存在的时间序列", func(t *testing.T) {
 		storage := NewMemoryStorage()
 		metric := createTestMetric("nonexistent", "label", "value")
@@ -423,21 +565,70 @@ func TestMemoryStorage_Delete(t *testing.T) {
 	})
 }
 
+// TestMemoryStorage_FingerprintCollision 测试 fingerprint 冲突的两个序列不会被合并
+func TestMemoryStorage_FingerprintCollision(t *testing.T) {
+	storage := NewMemoryStorage()
+	m1 := createTestMetric("cpu_usage", "host", "server1")
+	m2 := createTestMetric("cpu_usage", "host", "server2")
+	storage.Append(m1, &model.Sample{Timestamp: 1000, Value: 1})
+
+	// 构造冲突: 把 m1 的序列也放进 m2 的 fingerprint 下
+	s1 := storage.hashes.get(m1)
+	fp := m2.Fingerprint()
+	storage.hashes.stripe(fp).series[fp] = []*memSeries{s1}
+
+	if err := storage.Append(m2, &model.Sample{Timestamp: 1000, Value: 2}); err != nil {
+		t.Fatalf("写入失败: %v", err)
+	}
+	if n := storage.numSeries(); n != 2 {
+		t.Fatalf("期望 2 条序列，实际 %d 条", n)
+	}
+	for _, tt := range []struct {
+		m     *model.Metric
+		value float64
+	}{{m1, 1}, {m2, 2}} {
+		series, err := storage.QueryRange(tt.m, 0, 2000)
+		if err != nil {
+			t.Fatalf("查询 %s 失败: %v", tt.m, err)
+		}
+		if len(series.Samples) != 1 || series.Samples[0].Value != tt.value {
+			t.Errorf("%s: 期望值 %v，实际 %v", tt.m, tt.value, series.Samples)
+		}
+	}
+
+	if err := storage.Delete(m2); err != nil {
+		t.Fatalf("删除失败: %v", err)
+	}
+	if got := storage.hashes.stripe(fp).series[fp]; len(got) != 1 || got[0] != s1 {
+		t.Errorf("期望只删除 m2 的序列，实际 %v", got)
+	}
+}
+
+// TestSeriesStripe_Padding 测试相邻分片的字段至少隔开一个缓存行
+func TestSeriesStripe_Padding(t *testing.T) {
+	if size := unsafe.Sizeof(stripeFields{}); size > cacheLineSize {
+		t.Errorf("期望分片字段不超过 %d 字节，实际 %d 字节", cacheLineSize, size)
+	}
+	if size := unsafe.Sizeof(seriesStripe{}); size%(2*cacheLineSize) != 0 {
+		t.Errorf("期望分片大小是 %d 的整数倍，实际 %d 字节", 2*cacheLineSize, size)
+	}
+}
+
 // TestMemoryStorage_Concurrent 测试并发安全性
 func TestMemoryStorage_Concurrent(t *testing.T) {
 	t.Run("并发写入", func(t *testing.T) {
 		storage := NewMemoryStorage()
-		metric := createTestMetric("concurrent_write", "test", "parallel")
 
 		var wg sync.WaitGroup
 		goroutines := 100
 		samplesPerGoroutine := 10
 
-		// 启动多个 goroutine 并发写入
+		// 启动多个 goroutine 并发写入, 同一序列的样本必须有序, 每个 goroutine 写入各自的序列
 		for i := 0; i < goroutines; i++ {
 			wg.Add(1)
 			go func(id int) {
 				defer wg.Done()
+				metric := createTestMetric("concurrent_write", "test", "parallel", "goroutine", fmt.Sprint(id))
 				for j := 0; j < samplesPerGoroutine; j++ {
 					sample := &model.Sample{
 						Timestamp: time.Now().Add(time.Duration(id*samplesPerGoroutine+j) * time.Millisecond).UnixMilli(),
@@ -454,14 +645,20 @@ func TestMemoryStorage_Concurrent(t *testing.T) {
 		wg.Wait()
 
 		// 验证所有数据都已写入
-		series, err := storage.QueryRange(metric, 0, time.Now().Add(time.Hour).UnixMilli())
+		ss, err := storage.Select([]*model.LabelMatcher{
+			createTestMatcher(t, model.MatchEqual, model.MetricNameLabel, "concurrent_write"),
+		}, 0, time.Now().Add(time.Hour).UnixMilli())
 		if err != nil {
 			t.Fatalf("查询失败: %v", err)
 		}
+		count := 0
+		for _, series := range collectSeriesSet(t, ss) {
+			count += len(series.Samples)
+		}
 
 		expectedCount := goroutines * samplesPerGoroutine
-		if len(series.Samples) != expectedCount {
-			t.Errorf("期望 %d 个样本，实际得到 %d 个", expectedCount, len(series.Samples))
+		if count != expectedCount {
+			t.Errorf("期望 %d 个样本，实际得到 %d 个", expectedCount, count)
 		}
 	})
 
@@ -478,15 +675,17 @@ func TestMemoryStorage_Concurrent(t *testing.T) {
 		var wg sync.WaitGroup
 		operations := 50
 
-		// 并发写入
-		for i := 0; i < operations; i++ {
-			wg.Add(1)
-			go func(id int) {
-				defer wg.Done()
-				sample := createTestSample(time.Duration(50+id)*time.Millisecond, float64(50+id))
-				storage.Append(metric, sample)
-			}(i)
-		}
+		// 写入和读取并发进行, 写入按时间顺序
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < operations; i++ {
+				sample := createTestSample(time.Duration(50+i)*time.Millisecond, float64(50+i))
+				if err := storage.Append(metric, sample); err != nil {
+					t.Errorf("写入失败: %v", err)
+				}
+			}
+		}()
 
 		// 并发读取
 		for i := 0; i < operations; i++ {
@@ -513,6 +712,143 @@ func TestMemoryStorage_Concurrent(t *testing.T) {
 			t.Errorf("期望 %d 个样本，实际得到 %d 个", expectedCount, len(series.Samples))
 		}
 	})
+
+	t.Run("并发删除和写入", func(t *testing.T) {
+		storage := NewMemoryStorage()
+		metric := createTestMetric("concurrent_delete", "test", "delete")
+		storage.Append(metric, createTestSample(0, 0))
+
+		// 写入方已经找到序列但还没拿到序列锁时, 序列被删除
+		old := storage.hashes.get(metric)
+		old.mutex.Lock()
+		done := make(chan error)
+		go func() {
+			done <- storage.Append(metric, createTestSample(time.Millisecond, 1))
+		}()
+		time.Sleep(10 * time.Millisecond)
+		if err := storage.Delete(metric); err != nil {
+			t.Fatalf("删除失败: %v", err)
+		}
+		old.mutex.Unlock()
+		if err := <-done; err != nil {
+			t.Fatalf("写入失败: %v", err)
+		}
+		series, err := storage.QueryRange(metric, 0, time.Now().Add(time.Hour).UnixMilli())
+		if err != nil {
+			t.Fatalf("删除后写入的样本丢失: %v", err)
+		}
+		if len(series.Samples) != 1 || series.Samples[0].Value != 1 {
+			t.Errorf("期望只有删除后写入的样本，实际 %v", series.Samples)
+		}
+
+		// 反复删除的同时持续写入, 写入不报错, 停止删除后索引中只有一条序列
+		var wg sync.WaitGroup
+		var stopped atomic.Bool
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !stopped.Load() {
+				if err := storage.Delete(metric); err != nil && err != ErrSeriesNotFound {
+					t.Errorf("删除失败: %v", err)
+				}
+			}
+		}()
+		for i := 2; i < 2000; i++ {
+			if err := storage.Append(metric, createTestSample(time.Duration(i)*time.Millisecond, float64(i))); err != nil {
+				t.Errorf("写入失败: %v", err)
+			}
+		}
+		stopped.Store(true)
+		wg.Wait()
+
+		last := createTestSample(2000*time.Millisecond, 2000)
+		if err := storage.Append(metric, last); err != nil {
+			t.Fatalf("写入失败: %v", err)
+		}
+		ss, err := storage.Select([]*model.LabelMatcher{
+			createTestMatcher(t, model.MatchEqual, model.MetricNameLabel, "concurrent_delete"),
+		}, 0, time.Now().Add(time.Hour).UnixMilli())
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		got := collectSeriesSet(t, ss)
+		if len(got) != 1 {
+			t.Fatalf("期望 1 条序列，实际 %d 条", len(got))
+		}
+		if samples := got[0].Samples; samples[len(samples)-1].Timestamp != last.Timestamp {
+			t.Errorf("期望最后一个样本时间戳 %d，实际 %d", last.Timestamp, samples[len(samples)-1].Timestamp)
+		}
+	})
+}
+
+/*
+并发写入的吞吐量, 对比只有一个分片 (相当于全局锁) 和默认分片数在不同 GOMAXPROCS 下的表现
+每个 goroutine 写入自己的 100 条序列, 时间戳递增
+wal=true 时和生产环境一样打开带 WAL 的存储, 每个 goroutine 像一次抓取那样通过 Appender 每 100 个样本提交一次
+*/
+func BenchmarkMemoryStorage_ConcurrentAppend(b *testing.B) {
+	const seriesPerWorker = 100
+	for _, withWAL := range []bool{false, true} {
+		for _, stripes := range []int{1, defaultStripeSize} {
+			for _, procs := range []int{1, 2, 4, 8} {
+				b.Run(fmt.Sprintf("wal=%v/stripes=%d/procs=%d", withWAL, stripes, procs), func(b *testing.B) {
+					defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(procs))
+					storage := NewMemoryStorage()
+					if withWAL {
+						var err error
+						if storage, err = OpenMemoryStorage(b.TempDir()); err != nil {
+							b.Fatal(err)
+						}
+						defer storage.Close()
+					}
+					storage.hashes = newStripeSeries(stripes)
+					var worker atomic.Int64
+					b.ReportAllocs()
+					b.ResetTimer()
+					b.RunParallel(func(pb *testing.PB) {
+						id := worker.Add(1)
+						metrics := make([]*model.Metric, seriesPerWorker)
+						for i := range metrics {
+							metrics[i] = createTestMetric("bench_append", "worker", fmt.Sprint(id), "series", fmt.Sprint(i))
+						}
+						var app Appender
+						if withWAL {
+							app = storage.Appender()
+						}
+						sample := &model.Sample{}
+						i := 0
+						for ; pb.Next(); i++ {
+							sample.Timestamp = int64(i / seriesPerWorker)
+							sample.Value = float64(i)
+							m := metrics[i%seriesPerWorker]
+							if app == nil {
+								if err := storage.Append(m, sample); err != nil {
+									b.Error(err)
+									return
+								}
+								continue
+							}
+							if err := app.Append(m, sample); err != nil {
+								b.Error(err)
+								return
+							}
+							if i%seriesPerWorker == seriesPerWorker-1 {
+								if err := app.Commit(); err != nil {
+									b.Error(err)
+									return
+								}
+							}
+						}
+						if app != nil {
+							if err := app.Commit(); err != nil {
+								b.Error(err)
+							}
+						}
+					})
+				})
+			}
+		}
+	}
 }
 
 // TestMemoryStorage_RealWorldScenario 测试真实场景
@@ -605,3 +941,316 @@ func TestMemoryStorage_RealWorldScenario(t *testing.T) {
 		})
 	})
 }
+
+// 辅助函数：创建测试用的 LabelMatcher
+func createTestMatcher(t testing.TB, mt model.MatchType, name, value string) *model.LabelMatcher {
+	t.Helper()
+	m, err := model.NewLabelMatcher(mt, name, value)
+	if err != nil {
+		t.Fatalf("创建匹配器失败: %v", err)
+	}
+	return m
+}
+
+// 辅助函数：遍历 SeriesSet 收集所有时间序列
+func collectSeriesSet(t *testing.T, ss SeriesSet) []model.Series {
+	t.Helper()
+	var result []model.Series
+	for ss.Next() {
+		result = append(result, ss.At())
+	}
+	if err := ss.Err(); err != nil {
+		t.Fatalf("遍历 SeriesSet 失败: %v", err)
+	}
+	return result
+}
+
+// TestMemoryStorage_Select 测试基于标签匹配器的查询
+func TestMemoryStorage_Select(t *testing.T) {
+	storage := NewMemoryStorage()
+	for i, method := range []string{"GET", "POST", "PUT", "DELETE"} {
+		metric := createTestMetric("http_requests_total", "method", method, "status", "200")
+		storage.Append(metric, &model.Sample{Timestamp: 1000, Value: float64(i)})
+		storage.Append(metric, &model.Sample{Timestamp: 2000, Value: float64(i + 10)})
+	}
+	storage.Append(createTestMetric("http_errors_total", "method", "GET"), &model.Sample{Timestamp: 1000, Value: 1})
+	storage.Append(createTestMetric("cpu_usage", "host", "server1"), &model.Sample{Timestamp: 1000, Value: 1})
+
+	t.Run("指标名称加正则匹配", func(t *testing.T) {
+		ss, err := storage.Select([]*model.LabelMatcher{
+			createTestMatcher(t, model.MatchEqual, model.MetricNameLabel, "http_requests_total"),
+			createTestMatcher(t, model.MatchRegexp, "method", "GET|POST"),
+		}, 0, 3000)
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		series := collectSeriesSet(t, ss)
+		if len(series) != 2 {
+			t.Fatalf("期望 2 条时间序列，实际得到 %d 条", len(series))
+		}
+		// 结果按标签集合排序
+		if series[0].Metric.Get("method") != "GET" || series[1].Metric.Get("method") != "POST" {
+			t.Errorf("期望 GET, POST，实际 %s, %s", series[0].Metric.String(), series[1].Metric.String())
+		}
+		if len(series[0].Samples) != 2 {
+			t.Errorf("期望 2 个样本，实际得到 %d 个", len(series[0].Samples))
+		}
+	})
+
+	t.Run("不等于和正则不匹配", func(t *testing.T) {
+		ss, _ := storage.Select([]*model.LabelMatcher{
+			createTestMatcher(t, model.MatchRegexp, model.MetricNameLabel, "http_.*"),
+			createTestMatcher(t, model.MatchNotEqual, "method", "GET"),
+			createTestMatcher(t, model.MatchNotRegexp, "method", "P.*"),
+		}, 0, 3000)
+		series := collectSeriesSet(t, ss)
+		if len(series) != 1 || series[0].Metric.Get("method") != "DELETE" {
+			t.Errorf("期望只返回 DELETE，实际 %v", series)
+		}
+	})
+
+	t.Run("时间范围过滤样本", func(t *testing.T) {
+		ss, _ := storage.Select([]*model.LabelMatcher{
+			createTestMatcher(t, model.MatchEqual, model.MetricNameLabel, "http_requests_total"),
+		}, 1500, 3000)
+		series := collectSeriesSet(t, ss)
+		if len(series) != 4 {
+			t.Fatalf("期望 4 条时间序列，实际得到 %d 条", len(series))
+		}
+		for _, s := range series {
+			if len(s.Samples) != 1 || s.Samples[0].Timestamp != 2000 {
+				t.Errorf("%s: 期望只保留 2000 的样本，实际 %v", s.Metric.String(), s.Samples)
+			}
+		}
+	})
+
+	t.Run("按标签集合排序", func(t *testing.T) {
+		// 字符串形式 cpu{host=a,b} 排在 cpu{host=a,zone=x} 之前, 按标签比较时 host="a" 在前
+		storage := NewMemoryStorage()
+		storage.Append(createTestMetric("cpu", "host", "a,b"), &model.Sample{Timestamp: 1000, Value: 1})
+		storage.Append(createTestMetric("cpu", "host", "a", "zone", "x"), &model.Sample{Timestamp: 1000, Value: 2})
+		ss, _ := storage.Select([]*model.LabelMatcher{
+			createTestMatcher(t, model.MatchEqual, model.MetricNameLabel, "cpu"),
+		}, 0, 3000)
+		series := collectSeriesSet(t, ss)
+		if len(series) != 2 || series[0].Metric.Get("host") != "a" || series[1].Metric.Get("host") != "a,b" {
+			t.Errorf("期望 host=a 在 host=a,b 之前，实际 %v", series)
+		}
+	})
+
+	t.Run("范围内没有样本的序列不返回", func(t *testing.T) {
+		ss, _ := storage.Select([]*model.LabelMatcher{
+			createTestMatcher(t, model.MatchEqual, model.MetricNameLabel, "cpu_usage"),
+		}, 1500, 3000)
+		if series := collectSeriesSet(t, ss); len(series) != 0 {
+			t.Errorf("期望 0 条时间序列，实际得到 %d 条", len(series))
+		}
+	})
+
+	t.Run("名称写在 __name__ 标签中", func(t *testing.T) {
+		m := &model.Metric{Labels: model.Labels{
+			{Name: "status", Value: "200"},
+			{Name: model.MetricNameLabel, Value: "http_requests_total"},
+			{Name: "method", Value: "GET"},
+		}}
+		before := storage.numSeries()
+		if err := storage.Append(m, &model.Sample{Timestamp: 3000, Value: 20}); err != nil {
+			t.Fatalf("写入失败: %v", err)
+		}
+		if n := storage.numSeries(); n != before {
+			t.Errorf("期望写入已有的序列，实际序列数 %d -> %d", before, n)
+		}
+		series, err := storage.QueryRange(createTestMetric("http_requests_total", "method", "GET", "status", "200"), 0, 3000)
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		if len(series.Samples) != 3 || series.Metric.Name != "http_requests_total" {
+			t.Errorf("期望 3 个样本且名称为 http_requests_total，实际 %v", series)
+		}
+	})
+
+	t.Run("参数校验", func(t *testing.T) {
+		if _, err := storage.Select(nil, 0, 1000); err != ErrNoMatchers {
+			t.Errorf("期望错误 ErrNoMatchers，实际得到 %v", err)
+		}
+		matchers := []*model.LabelMatcher{createTestMatcher(t, model.MatchEqual, "host", "server1")}
+		if _, err := storage.Select(matchers, 1000, 0); err != ErrTimeRange {
+			t.Errorf("期望错误 ErrTimeRange，实际得到 %v", err)
+		}
+	})
+}
+
+// TestMemoryStorage_WALReplay 测试重启后从 WAL 恢复数据
+func TestMemoryStorage_WALReplay(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := OpenMemoryStorage(dir)
+	if err != nil {
+		t.Fatalf("打开存储失败: %v", err)
+	}
+	cpu := createTestMetric("cpu_usage", "host", "server1")
+	mem := createTestMetric("memory_usage", "host", "server1")
+	deleted := createTestMetric("to_delete", "host", "server1")
+	for i := 0; i < 200; i++ {
+		storage.Append(cpu, &model.Sample{Timestamp: int64(i * 1000), Value: float64(i)})
+	}
+	storage.Append(mem, &model.Sample{Timestamp: 1000, Value: 512})
+	storage.Append(deleted, &model.Sample{Timestamp: 1000, Value: 1})
+	storage.Delete(deleted)
+	if err := storage.Close(); err != nil {
+		t.Fatalf("关闭存储失败: %v", err)
+	}
+
+	storage, err = OpenMemoryStorage(dir)
+	if err != nil {
+		t.Fatalf("重新打开存储失败: %v", err)
+	}
+	defer storage.Close()
+
+	series, err := storage.QueryRange(cpu, 0, 200000)
+	if err != nil {
+		t.Fatalf("查询失败: %v", err)
+	}
+	if len(series.Samples) != 200 || series.Samples[199].Value != 199 {
+		t.Errorf("期望恢复 200 个样本，实际 %d 个", len(series.Samples))
+	}
+	if _, err := storage.QueryRange(deleted, 0, 200000); err != ErrSeriesNotFound {
+		t.Errorf("已删除的序列不应该恢复，实际 err=%v", err)
+	}
+
+	// 恢复后新建的序列不能复用已有的 ref
+	disk := createTestMetric("disk_usage", "host", "server1")
+	storage.Append(disk, &model.Sample{Timestamp: 2000, Value: 1})
+	ss, _ := storage.Select([]*model.LabelMatcher{createTestMatcher(t, model.MatchEqual, "host", "server1")}, 0, 200000)
+	if got := collectSeriesSet(t, ss); len(got) != 3 {
+		t.Errorf("期望 3 条时间序列，实际 %d 条", len(got))
+	}
+}
+
+// TestMemoryStorage_WALCheckpoint 测试截断后 checkpoint 只保留仍然需要的记录, 重新打开后数据完整
+func TestMemoryStorage_WALCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := OpenMemoryStorage(dir)
+	if err != nil {
+		t.Fatalf("打开存储失败: %v", err)
+	}
+	cpu := createTestMetric("cpu_usage", "host", "server1")
+	old := createTestMetric("old_metric", "host", "server1")
+	storage.Append(old, &model.Sample{Timestamp: 0, Value: 1})
+	total := checkpointSamplesPerRecord + 500
+	for i := 1; i <= total; i++ {
+		storage.Append(cpu, &model.Sample{Timestamp: int64(i), Value: float64(i)})
+	}
+	for i := 0; i < 100; i++ {
+		storage.Append(createTestMetric("empty_after_truncate", "id", fmt.Sprint(i)), &model.Sample{Timestamp: 0, Value: 1})
+	}
+	if _, err := storage.truncate(1); err != nil {
+		t.Fatalf("截断失败: %v", err)
+	}
+
+	cpDir, last, err := lastCheckpoint(dir)
+	if err != nil || cpDir == "" {
+		t.Fatalf("期望生成 checkpoint，实际 %q, err=%v", cpDir, err)
+	}
+	if remaining, _ := wal.NewSegmentRangeReader(dir, 0, last); remaining.Next() {
+		t.Errorf("期望 checkpoint 覆盖的段都已删除")
+	}
+	// 变空的序列和早于 mint 的样本不写入 checkpoint, 样本合并成少量记录
+	r, err := wal.NewReader(cpDir)
+	if err != nil {
+		t.Fatalf("读取 checkpoint 失败: %v", err)
+	}
+	seriesCount, sampleRecords := 0, 0
+	for r.Next() {
+		rec := r.Record()
+		switch recordTypeOf(rec) {
+		case recordSeries:
+			series, _ := decodeSeries(rec)
+			seriesCount += len(series)
+		case recordSamples:
+			samples, _ := decodeSamples(rec)
+			for _, s := range samples {
+				if s.T < 1 {
+					t.Errorf("checkpoint 中不应该有早于 mint 的样本 %v", s)
+				}
+			}
+			sampleRecords++
+		default:
+			t.Errorf("checkpoint 中不应该有类型为 %d 的记录", recordTypeOf(rec))
+		}
+	}
+	if err := r.Err(); err != nil {
+		t.Fatalf("读取 checkpoint 失败: %v", err)
+	}
+	if seriesCount != 1 || sampleRecords != 2 {
+		t.Errorf("期望 1 条序列和 2 条样本记录，实际 %d 条序列, %d 条样本记录", seriesCount, sampleRecords)
+	}
+
+	// 第二次 checkpoint 基于上一个 checkpoint 和之后的段, 并删除上一个 checkpoint
+	storage.Append(cpu, &model.Sample{Timestamp: int64(total + 1), Value: 1})
+	if _, err := storage.truncate(1); err != nil {
+		t.Fatalf("截断失败: %v", err)
+	}
+	if _, err := os.Stat(cpDir); !os.IsNotExist(err) {
+		t.Errorf("期望旧的 checkpoint 被删除，实际 err=%v", err)
+	}
+	storage.Append(cpu, &model.Sample{Timestamp: int64(total + 2), Value: 2})
+	if err := storage.Close(); err != nil {
+		t.Fatalf("关闭存储失败: %v", err)
+	}
+
+	// 崩溃时留下的临时目录在打开时删除
+	tmp := checkpointDir(dir, 1000) + checkpointTmp
+	if err := os.MkdirAll(tmp, 0o755); err != nil {
+		t.Fatalf("创建临时目录失败: %v", err)
+	}
+	storage, err = OpenMemoryStorage(dir)
+	if err != nil {
+		t.Fatalf("重新打开存储失败: %v", err)
+	}
+	defer storage.Close()
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("期望临时目录被删除，实际 err=%v", err)
+	}
+	series, err := storage.QueryRange(cpu, 0, int64(total+2))
+	if err != nil {
+		t.Fatalf("查询失败: %v", err)
+	}
+	if len(series.Samples) != total+2 {
+		t.Errorf("期望恢复 %d 个样本，实际 %d 个", total+2, len(series.Samples))
+	}
+	if _, err := storage.QueryRange(old, 0, int64(total)); err != ErrSeriesNotFound {
+		t.Errorf("截断后变空的序列不应该恢复，实际 err=%v", err)
+	}
+}
+
+// TestMemoryStorage_CheckpointDoesNotBlockAppend 测试 checkpoint 期间写入和查询不被阻塞
+func TestMemoryStorage_CheckpointDoesNotBlockAppend(t *testing.T) {
+	storage, err := OpenMemoryStorage(t.TempDir())
+	if err != nil {
+		t.Fatalf("打开存储失败: %v", err)
+	}
+	defer storage.Close()
+	cpu := createTestMetric("cpu_usage", "host", "server1")
+	storage.Append(cpu, &model.Sample{Timestamp: 1000, Value: 1})
+
+	// 持有 checkpointMutex, 截断在内存中完成后停在 checkpoint 之前
+	storage.checkpointMutex.Lock()
+	done := make(chan error)
+	go func() {
+		_, err := storage.truncate(500)
+		done <- err
+	}()
+	for storage.minValidTime.Load() != 500 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := storage.Append(cpu, &model.Sample{Timestamp: 2000, Value: 2}); err != nil {
+		t.Errorf("checkpoint 期间写入失败: %v", err)
+	}
+	if series, err := storage.QueryRange(cpu, 0, 3000); err != nil || len(series.Samples) != 2 {
+		t.Errorf("checkpoint 期间查询失败: %v, %v", series.Samples, err)
+	}
+	storage.checkpointMutex.Unlock()
+	if err := <-done; err != nil {
+		t.Fatalf("截断失败: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"mini-promethues/pkg/model"
+)
+
+/*
+WAL 记录的编码, 第一个字节是记录类型:
+  - series:  新建的时间序列, ref 和完整的指标
+  - samples: 一批样本, 通过 ref 引用时间序列
+  - deletes: 被删除的时间序列 ref
+*/
+
+type recordType byte
+
+const (
+	recordSeries  recordType = 1
+	recordSamples recordType = 2
+	recordDeletes recordType = 3
+)
+
+var errInvalidRecord = errors.New("invalid wal record")
+
+type refSeries struct {
+	Ref    uint64
+	Metric model.Metric
+}
+
+type refSample struct {
+	Ref uint64
+	T   int64
+	V   float64
+}
+
+func recordTypeOf(rec []byte) recordType {
+	if len(rec) == 0 {
+		return 0
+	}
+	return recordType(rec[0])
+}
+
+func encodeSeries(series []refSeries) []byte {
+	buf := []byte{byte(recordSeries)}
+	for _, s := range series {
+		buf = binary.AppendUvarint(buf, s.Ref)
+		buf = appendString(buf, s.Metric.Name)
+		buf = binary.AppendUvarint(buf, uint64(len(s.Metric.Labels)))
+		for _, l := range s.Metric.Labels {
+			buf = appendString(buf, l.Name)
+			buf = appendString(buf, l.Value)
+		}
+	}
+	return buf
+}
+
+func encodeSamples(samples []refSample) []byte {
+	buf := []byte{byte(recordSamples)}
+	for _, s := range samples {
+		buf = binary.AppendUvarint(buf, s.Ref)
+		buf = binary.AppendVarint(buf, s.T)
+		buf = binary.BigEndian.AppendUint64(buf, math.Float64bits(s.V))
+	}
+	return buf
+}
+
+func encodeDeletes(refs []uint64) []byte {
+	buf := []byte{byte(recordDeletes)}
+	for _, ref := range refs {
+		buf = binary.AppendUvarint(buf, ref)
+	}
+	return buf
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func decodeSeries(rec []byte) ([]refSeries, error) {
+	d := &decbuf{b: rec[1:]}
+	var result []refSeries
+	for d.len() > 0 && d.err == nil {
+		s := refSeries{Ref: d.uvarint()}
+		s.Metric.Name = d.string()
+		n := d.uvarint()
+		for i := uint64(0); i < n && d.err == nil; i++ {
+			s.Metric.Labels = append(s.Metric.Labels, model.Label{Name: d.string(), Value: d.string()})
+		}
+		result = append(result, s)
+	}
+	return result, d.err
+}
+
+func decodeSamples(rec []byte) ([]refSample, error) {
+	d := &decbuf{b: rec[1:]}
+	var result []refSample
+	for d.len() > 0 && d.err == nil {
+		s := refSample{Ref: d.uvarint(), T: d.varint()}
+		s.V = math.Float64frombits(d.be64())
+		result = append(result, s)
+	}
+	return result, d.err
+}
+
+func decodeDeletes(rec []byte) ([]uint64, error) {
+	d := &decbuf{b: rec[1:]}
+	var result []uint64
+	for d.len() > 0 && d.err == nil {
+		result = append(result, d.uvarint())
+	}
+	return result, d.err
+}
+
+// 解码辅助, 出错后所有读取都返回零值, 由调用方最后检查 err
+type decbuf struct {
+	b   []byte
+	err error
+}
+
+func (d *decbuf) len() int {
+	return len(d.b)
+}
+
+func (d *decbuf) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errInvalidRecord
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decbuf) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errInvalidRecord
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decbuf) be64() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) < 8 {
+		d.err = errInvalidRecord
+		return 0
+	}
+	v := binary.BigEndian.Uint64(d.b)
+	d.b = d.b[8:]
+	return v
+}
+
+func (d *decbuf) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if uint64(len(d.b)) < n {
+		d.err = errInvalidRecord
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sync/atomic"
+)
+
+// retention 累计清理的数据量
+type RetentionStats struct {
+	// 超过 RetentionDuration 被删除的 block 数
+	TimeRetentionBlocks uint64
+	// 超过 MaxBytes 被删除的 block 数
+	SizeRetentionBlocks uint64
+	// 删除的 block 占用的磁盘空间
+	BytesReclaimed uint64
+	// 从 head 中删除的样本数
+	HeadSamplesReclaimed uint64
+}
+
+type retentionMetrics struct {
+	timeRetentionBlocks  atomic.Uint64
+	sizeRetentionBlocks  atomic.Uint64
+	bytesReclaimed       atomic.Uint64
+	headSamplesReclaimed atomic.Uint64
+}
+
+func (db *DB) RetentionStats() RetentionStats {
+	return RetentionStats{
+		TimeRetentionBlocks:  db.retention.timeRetentionBlocks.Load(),
+		SizeRetentionBlocks:  db.retention.sizeRetentionBlocks.Load(),
+		BytesReclaimed:       db.retention.bytesReclaimed.Load(),
+		HeadSamplesReclaimed: db.retention.headSamplesReclaimed.Load(),
+	}
+}
+
+// block 和 WAL 占用的磁盘空间
+func (db *DB) Size() (int64, error) {
+	walSize, err := db.head.wal.Size()
+	if err != nil {
+		return 0, err
+	}
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	size := walSize
+	for _, b := range db.blocks {
+		size += b.Size()
+	}
+	return size, nil
+}
+
+/*
+删除超出保留策略的数据:
+
+  - RetentionDuration: 以已写入的最大时间戳为准, 删除完全早于 maxt - RetentionDuration 的 block,
+    head 中早于该时间的样本也一并删除
+  - MaxBytes: block 的总大小超过限制时, 从最旧的 block 开始删除, 直到不超过限制
+    WAL 不计入: 删除 block 不能让 WAL 变小, WAL 本身超过限制时会删掉所有 block 仍然达不到要求;
+    WAL 在 head 切分成 block 时 checkpoint 缩小
+
+block 总是整体删除, 剩余 block 中早于截止时间的样本仍然可以查询到
+*/
+func (db *DB) applyRetention() error {
+	if db.opts.RetentionDuration <= 0 && db.opts.MaxBytes <= 0 {
+		return nil
+	}
+	db.compactMutex.Lock()
+	defer db.compactMutex.Unlock()
+
+	db.mutex.RLock()
+	blocks := append([]*Block(nil), db.blocks...)
+	db.mutex.RUnlock()
+
+	deletable := make(map[*Block]struct{})
+	var timeBlocks, sizeBlocks uint64
+	if db.opts.RetentionDuration > 0 {
+		maxt := db.head.MaxTime()
+		if len(blocks) > 0 {
+			maxt = max(maxt, blocks[len(blocks)-1].meta.MaxTime-1)
+		}
+		if maxt != math.MinInt64 {
+			cutoff := maxt - db.opts.RetentionDuration.Milliseconds()
+			for _, b := range blocks {
+				if b.meta.MaxTime <= cutoff {
+					deletable[b] = struct{}{}
+					timeBlocks++
+				}
+			}
+			if db.head.MinTime() < cutoff {
+				removed, err := db.head.truncate(cutoff)
+				if err != nil {
+					return fmt.Errorf("truncate head: %w", err)
+				}
+				db.retention.headSamplesReclaimed.Add(uint64(removed))
+			}
+		}
+	}
+	if db.opts.MaxBytes > 0 {
+		var size int64
+		for _, b := range blocks {
+			if _, ok := deletable[b]; !ok {
+				size += b.Size()
+			}
+		}
+		for _, b := range blocks {
+			if size <= db.opts.MaxBytes {
+				break
+			}
+			if _, ok := deletable[b]; ok {
+				continue
+			}
+			deletable[b] = struct{}{}
+			sizeBlocks++
+			size -= b.Size()
+		}
+	}
+	if len(deletable) == 0 {
+		return nil
+	}
+
+	db.mutex.Lock()
+	remaining := make([]*Block, 0, len(db.blocks))
+	for _, b := range db.blocks {
+		if _, ok := deletable[b]; !ok {
+			remaining = append(remaining, b)
+		}
+	}
+	db.blocks = remaining
+	db.mutex.Unlock()
+
+	var reclaimed int64
+	var errs []error
+	for b := range deletable {
+		reclaimed += b.Size()
+		errs = append(errs, b.Close(), os.RemoveAll(b.dir))
+	}
+	db.retention.timeRetentionBlocks.Add(timeBlocks)
+	db.retention.sizeRetentionBlocks.Add(sizeBlocks)
+	db.retention.bytesReclaimed.Add(uint64(reclaimed))
+	log.Printf("retention removed %d blocks (%d by time, %d by size), reclaimed %d bytes",
+		len(deletable), timeBlocks, sizeBlocks, reclaimed)
+	return errors.Join(errs...)
+}
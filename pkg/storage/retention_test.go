@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// TestDB_Retention 测试按时间和大小删除旧数据
+func TestDB_Retention(t *testing.T) {
+	m := createTestMetric("cpu_usage", "host", "server1")
+
+	t.Run("按时间删除 block", func(t *testing.T) {
+		dir := t.TempDir()
+		for i := int64(0); i < 3; i++ {
+			writeTestBlock(t, dir, i*testBlockRange, (i+1)*testBlockRange, m)
+		}
+		db, err := Open(dir, &Options{RetentionDuration: 3 * time.Hour})
+		if err != nil {
+			t.Fatalf("打开存储失败: %v", err)
+		}
+		defer db.Close()
+		oldest := db.blocks[0]
+		// head 中的数据到 7h, 截止时间为 4h 前一分钟, 只有 [0, 2h) 完全过期
+		appendMinutes(t, db, m, 360, 420)
+		if err := db.applyRetention(); err != nil {
+			t.Fatalf("retention 失败: %v", err)
+		}
+		blocks := db.Blocks()
+		if len(blocks) != 2 || blocks[0].MinTime != testBlockRange {
+			t.Fatalf("期望只删除最旧的 block，实际 %+v", blocks)
+		}
+		if _, err := os.Stat(oldest.Dir()); !os.IsNotExist(err) {
+			t.Errorf("期望 block 目录被删除，实际 %v", err)
+		}
+		stats := db.RetentionStats()
+		if stats.TimeRetentionBlocks != 1 || stats.BytesReclaimed != uint64(oldest.Size()) {
+			t.Errorf("期望删除 1 个 block、回收 %d 字节，实际 %+v", oldest.Size(), stats)
+		}
+	})
+
+	t.Run("按时间截断 head", func(t *testing.T) {
+		db, err := Open(t.TempDir(), &Options{RetentionDuration: time.Hour})
+		if err != nil {
+			t.Fatalf("打开存储失败: %v", err)
+		}
+		defer db.Close()
+		appendMinutes(t, db, m, 0, 300)
+		if err := db.applyRetention(); err != nil {
+			t.Fatalf("retention 失败: %v", err)
+		}
+		series, err := db.QueryRange(m, 0, 300*60000)
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		if len(series.Samples) != 61 || series.Samples[0].Value != 239 {
+			t.Errorf("期望保留 [239, 299] 分钟的 61 个样本，实际 %d 个", len(series.Samples))
+		}
+		if stats := db.RetentionStats(); stats.HeadSamplesReclaimed != 239 {
+			t.Errorf("期望从 head 删除 239 个样本，实际 %d 个", stats.HeadSamplesReclaimed)
+		}
+	})
+
+	t.Run("按大小删除 block", func(t *testing.T) {
+		dir := t.TempDir()
+		for i := int64(0); i < 3; i++ {
+			writeTestBlock(t, dir, i*testBlockRange, (i+1)*testBlockRange, m)
+		}
+		db, err := Open(dir, nil)
+		if err != nil {
+			t.Fatalf("打开存储失败: %v", err)
+		}
+		defer db.Close()
+		size, err := db.Size()
+		if err != nil {
+			t.Fatalf("计算大小失败: %v", err)
+		}
+		db.opts.MaxBytes = size - 1
+		if err := db.applyRetention(); err != nil {
+			t.Fatalf("retention 失败: %v", err)
+		}
+		blocks := db.Blocks()
+		if len(blocks) != 2 || blocks[0].MinTime != testBlockRange {
+			t.Fatalf("期望只删除最旧的 block，实际 %+v", blocks)
+		}
+		if stats := db.RetentionStats(); stats.SizeRetentionBlocks != 1 || stats.TimeRetentionBlocks != 0 {
+			t.Errorf("期望按大小删除 1 个 block，实际 %+v", stats)
+		}
+	})
+
+	t.Run("WAL 超过限制时不删除 block", func(t *testing.T) {
+		dir := t.TempDir()
+		for i := int64(0); i < 3; i++ {
+			writeTestBlock(t, dir, i*testBlockRange, (i+1)*testBlockRange, m)
+		}
+		db, err := Open(dir, nil)
+		if err != nil {
+			t.Fatalf("打开存储失败: %v", err)
+		}
+		defer db.Close()
+		var blocksSize int64
+		for _, b := range db.blocks {
+			blocksSize += b.Size()
+		}
+		db.opts.MaxBytes = blocksSize
+		// head 中写入足够多的样本, 让 WAL 单独超过限制
+		for from := 360; ; from += 600 {
+			appendMinutes(t, db, m, from, from+600)
+			walSize, err := db.head.wal.Size()
+			if err != nil {
+				t.Fatalf("计算 WAL 大小失败: %v", err)
+			}
+			if walSize > db.opts.MaxBytes {
+				break
+			}
+		}
+		if err := db.applyRetention(); err != nil {
+			t.Fatalf("retention 失败: %v", err)
+		}
+		if blocks := db.Blocks(); len(blocks) != 3 {
+			t.Errorf("期望保留 3 个 block，实际 %d 个", len(blocks))
+		}
+		if stats := db.RetentionStats(); stats.SizeRetentionBlocks != 0 {
+			t.Errorf("期望没有按大小删除 block，实际 %+v", stats)
+		}
+	})
+}
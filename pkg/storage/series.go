@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"math"
+	"mini-promethues/pkg/model"
+	"mini-promethues/pkg/storage/chunkenc"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// 每个 chunk 最多保存的样本数, 15s 抓取间隔下约 30 分钟
+const samplesPerChunk = 120
+
+// 每条序列最多缓存的未压缩乱序样本数, 写满后压缩成一个乱序 chunk
+const oooSamplesCapacity = 32
+
+type memChunk struct {
+	chunk   *chunkenc.XORChunk
+	minTime int64
+	maxTime int64
+}
+
+/*
+一条时间序列在内存中的数据, 样本压缩在 chunk 中, 最后一个 chunk 是正在写入的 head chunk
+样本严格按时间戳递增, chunk 之间按时间排序且互不重叠, 查询时可以二分查找 chunk
+乱序窗口内迟到的样本先按顺序插入 oooSamples, 写满后和时间范围重叠的乱序 chunk 合并, 重新压缩到 oooChunks;
+oooChunks 之间同样按时间排序且互不重叠, 但可能和 chunks 重叠, 查询时 chunks、oooChunks、oooSamples 三路合并
+ref 和 metric 创建后不再修改, 其余字段由 mutex 保护, 方法由调用方加锁
+*/
+type memSeries struct {
+	ref    uint64
+	metric model.Metric
+	// 已经从 storage 中删除, 在持有分片写锁时设置; 写入方拿到序列锁后发现已删除时重新查找或创建序列
+	deleted atomic.Bool
+
+	mutex  sync.Mutex
+	chunks []*memChunk
+	app    *chunkenc.XORAppender
+	// 最后一个样本的值, 用于识别重复写入
+	lastValue float64
+	// 早于 head chunk 最大时间的样本, 按时间戳排序, 最多 oooSamplesCapacity 个
+	oooSamples model.Samples
+	// 已压缩的乱序样本, 按时间排序且互不重叠
+	oooChunks []*memChunk
+}
+
+func newMemSeries(ref uint64, m *model.Metric) *memSeries {
+	return &memSeries{ref: ref, metric: *m}
+}
+
+func (s *memSeries) head() *memChunk {
+	if len(s.chunks) == 0 {
+		return nil
+	}
+	return s.chunks[len(s.chunks)-1]
+}
+
+/*
+检查样本能否写入序列:
+和已有样本完全相同时返回 duplicate, 调用方应当忽略这次写入, 不受乱序窗口限制;
+时间戳已经存在但值不同返回 ErrDuplicateSampleForTimestamp,
+时间戳早于最后一个样本且早于 oooMint 返回 ErrOutOfOrder, oooMint 为 math.MaxInt64 时不接受任何乱序样本
+*/
+func (s *memSeries) appendable(t int64, v float64, oooMint int64) (duplicate bool, err error) {
+	c := s.head()
+	if c == nil || t > c.maxTime {
+		return false, nil
+	}
+	existing, found := s.lastValue, t == c.maxTime
+	if !found {
+		existing, found = s.valueAt(t)
+	}
+	if !found {
+		if t < oooMint {
+			return false, ErrOutOfOrder
+		}
+		return false, nil
+	}
+	// 按位比较, NaN 也能识别为重复
+	if math.Float64bits(v) != math.Float64bits(existing) {
+		return false, ErrDuplicateSampleForTimestamp
+	}
+	return true, nil
+}
+
+// 查找时间戳为 t 的样本, 只解码时间范围包含 t 的 chunk
+func (s *memSeries) valueAt(t int64) (float64, bool) {
+	if i, found := s.oooIndex(t); found {
+		return s.oooSamples[i].Value, true
+	}
+	for _, chunks := range [][]*memChunk{s.chunks, s.oooChunks} {
+		i := sort.Search(len(chunks), func(i int) bool { return chunks[i].maxTime >= t })
+		if i == len(chunks) || chunks[i].minTime > t {
+			continue
+		}
+		it := chunks[i].chunk.Iterator()
+		for it.Next() {
+			if ts, v := it.At(); ts >= t {
+				if ts == t {
+					return v, true
+				}
+				break
+			}
+		}
+	}
+	return 0, false
+}
+
+// 返回 oooSamples 中第一个时间戳不小于 t 的下标, 以及该样本的时间戳是否正好为 t
+func (s *memSeries) oooIndex(t int64) (int, bool) {
+	i := sort.Search(len(s.oooSamples), func(i int) bool { return s.oooSamples[i].Timestamp >= t })
+	return i, i < len(s.oooSamples) && s.oooSamples[i].Timestamp == t
+}
+
+/*
+调用方需要先通过 appendable 检查
+早于 head chunk 最大时间的样本按顺序插入 oooSamples, 其余样本写入 head chunk, 写满时切换到新的 chunk
+*/
+func (s *memSeries) append(t int64, v float64) {
+	c := s.head()
+	if c != nil && t < c.maxTime {
+		i, _ := s.oooIndex(t)
+		s.oooSamples = append(s.oooSamples, model.Sample{})
+		copy(s.oooSamples[i+1:], s.oooSamples[i:])
+		s.oooSamples[i] = model.Sample{Timestamp: t, Value: v}
+		if len(s.oooSamples) >= oooSamplesCapacity {
+			s.flushOOOSamples()
+		}
+		return
+	}
+	if c == nil || c.chunk.NumSamples() >= samplesPerChunk {
+		c = s.cutNewChunk(t)
+	}
+	s.app.Append(t, v)
+	c.maxTime = t
+	s.lastValue = v
+}
+
+/*
+把缓存的乱序样本压缩到 oooChunks
+和缓存时间范围重叠的乱序 chunk 是连续的一段, 解码后与缓存合并再按 samplesPerChunk 切分, 替换原来的这一段,
+这样 oooChunks 始终互不重叠, 查询时只需要一个迭代器, 不会随着乱序 chunk 增多而嵌套合并
+*/
+func (s *memSeries) flushOOOSamples() {
+	mint, maxt := s.oooSamples[0].Timestamp, s.oooSamples[len(s.oooSamples)-1].Timestamp
+	i := sort.Search(len(s.oooChunks), func(i int) bool { return s.oooChunks[i].maxTime >= mint })
+	j := sort.Search(len(s.oooChunks), func(j int) bool { return s.oooChunks[j].minTime > maxt })
+	samples := s.oooSamples
+	if i < j {
+		var overlapping model.Samples
+		for _, c := range s.oooChunks[i:j] {
+			it := c.chunk.Iterator()
+			for it.Next() {
+				t, v := it.At()
+				overlapping = append(overlapping, model.Sample{Timestamp: t, Value: v})
+			}
+		}
+		// appendable 已经排除了重复的时间戳, 合并只是归并排序
+		samples = mergeSamples(overlapping, samples)
+	}
+	var merged []*memChunk
+	for len(samples) > 0 {
+		n := min(len(samples), samplesPerChunk)
+		merged = append(merged, encodeMemChunk(samples[:n]))
+		samples = samples[n:]
+	}
+	s.oooChunks = slices.Concat(s.oooChunks[:i], merged, s.oooChunks[j:])
+	s.oooSamples = s.oooSamples[:0]
+}
+
+// 把按时间戳排序的非空样本压缩成一个 chunk
+func encodeMemChunk(samples model.Samples) *memChunk {
+	c := &memChunk{
+		chunk:   chunkenc.NewXORChunk(),
+		minTime: samples[0].Timestamp,
+		maxTime: samples[len(samples)-1].Timestamp,
+	}
+	app, _ := c.chunk.Appender()
+	for _, sample := range samples {
+		app.Append(sample.Timestamp, sample.Value)
+	}
+	return c
+}
+
+func (s *memSeries) cutNewChunk(mint int64) *memChunk {
+	c := &memChunk{
+		chunk:   chunkenc.NewXORChunk(),
+		minTime: mint,
+		maxTime: mint,
+	}
+	// 新建的空 chunk 创建 Appender 不会失败
+	s.app, _ = c.chunk.Appender()
+	s.chunks = append(s.chunks, c)
+	return c
+}
+
+/*
+返回序列上的迭代器, 有乱序样本时和 chunk 合并, 最多合并三路
+调用方持有锁, 迭代结束前序列不能被修改
+*/
+func (s *memSeries) iterator() SeriesIterator {
+	it := memChunksIterator(s.chunks)
+	if len(s.oooChunks) > 0 {
+		it = newMergeSeriesIterator(it, memChunksIterator(s.oooChunks))
+	}
+	if len(s.oooSamples) > 0 {
+		it = newMergeSeriesIterator(it, NewListSeriesIterator(s.oooSamples))
+	}
+	return it
+}
+
+// 按时间排序且互不重叠的 chunk 上的迭代器
+func memChunksIterator(chunks []*memChunk) SeriesIterator {
+	metas := make([]chunkMeta, len(chunks))
+	for i, c := range chunks {
+		metas[i] = chunkMeta{MinTime: c.minTime, MaxTime: c.maxTime}
+	}
+	return newChunkSeriesIterator(metas, func(i int) (*chunkenc.XORChunk, error) {
+		return chunks[i].chunk, nil
+	})
+}
+
+// 返回 [mint, maxt] 范围内的样本, 内存中的 chunk 读取不会出错
+func (s *memSeries) samplesInRange(mint, maxt int64) model.Samples {
+	samples, _ := samplesInRange(s.iterator(), mint, maxt)
+	return samples
+}
+
+// 返回 [mint, maxt] 范围内时间戳最大的样本
+func (s *memSeries) latestInRange(mint, maxt int64) (model.Sample, bool) {
+	sample, found, _ := latestInRange(s.iterator(), mint, maxt)
+	return sample, found
+}
+
+// 删除时间戳小于 mint 的样本, 跨越 mint 的 chunk 重新编码, 返回删除的样本数
+func (s *memSeries) truncateBefore(mint int64) int {
+	kept := s.chunks[:0]
+	headChanged := false
+	removed := 0
+	for i, c := range s.chunks {
+		isHead := i == len(s.chunks)-1
+		if c.maxTime < mint {
+			headChanged = headChanged || isHead
+			removed += c.chunk.NumSamples()
+			continue
+		}
+		if c.minTime < mint {
+			n := c.chunk.NumSamples()
+			c = reencodeChunk(c, mint)
+			removed += n - c.chunk.NumSamples()
+			headChanged = headChanged || isHead
+		}
+		kept = append(kept, c)
+	}
+	for i := len(kept); i < len(s.chunks); i++ {
+		s.chunks[i] = nil
+	}
+	s.chunks = kept
+	keptOOO := s.oooChunks[:0]
+	for _, c := range s.oooChunks {
+		if c.maxTime < mint {
+			removed += c.chunk.NumSamples()
+			continue
+		}
+		if c.minTime < mint {
+			n := c.chunk.NumSamples()
+			c = reencodeChunk(c, mint)
+			removed += n - c.chunk.NumSamples()
+		}
+		keptOOO = append(keptOOO, c)
+	}
+	for i := len(keptOOO); i < len(s.oooChunks); i++ {
+		s.oooChunks[i] = nil
+	}
+	s.oooChunks = keptOOO
+	if n, _ := s.oooIndex(mint); n > 0 {
+		s.oooSamples = append(model.Samples(nil), s.oooSamples[n:]...)
+		removed += n
+	}
+	if headChanged {
+		s.app = nil
+		if c := s.head(); c != nil {
+			s.app, _ = c.chunk.Appender()
+		}
+	}
+	return removed
+}
+
+func (s *memSeries) empty() bool {
+	return len(s.chunks) == 0 && len(s.oooSamples) == 0 && len(s.oooChunks) == 0
+}
+
+// 最早的样本时间, 序列为空时返回 math.MaxInt64
+func (s *memSeries) minTime() int64 {
+	t := int64(math.MaxInt64)
+	if len(s.chunks) > 0 {
+		t = s.chunks[0].minTime
+	}
+	if len(s.oooSamples) > 0 {
+		t = min(t, s.oooSamples[0].Timestamp)
+	}
+	for _, c := range s.oooChunks {
+		t = min(t, c.minTime)
+	}
+	return t
+}
+
+func reencodeChunk(c *memChunk, mint int64) *memChunk {
+	nc := &memChunk{chunk: chunkenc.NewXORChunk(), minTime: c.maxTime, maxTime: c.maxTime}
+	app, _ := nc.chunk.Appender()
+	it := c.chunk.Iterator()
+	for it.Next() {
+		t, v := it.At()
+		if t < mint {
+			continue
+		}
+		nc.minTime = min(nc.minTime, t)
+		app.Append(t, v)
+	}
+	return nc
+}
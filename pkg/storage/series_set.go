@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"mini-promethues/pkg/model"
+	"sort"
+)
+
+// Select 返回的时间序列集合, 按 Next/At 的方式遍历
+type SeriesSet interface {
+	Next() bool
+	At() model.Series
+	Err() error
+}
+
+type listSeriesSet struct {
+	series []model.Series
+	cur    int
+}
+
+// 按规范标签集合排序, 保证结果顺序稳定; 标签集合只计算一次, 比较时不再分配内存
+func newListSeriesSet(series []model.Series) *listSeriesSet {
+	sort.Sort(bySeriesLabels{series: series, labels: seriesLabelSets(series)})
+	return &listSeriesSet{series: series, cur: -1}
+}
+
+func seriesLabelSets(series []model.Series) []model.Labels {
+	labels := make([]model.Labels, len(series))
+	for i := range series {
+		labels[i] = series[i].Metric.LabelSet()
+	}
+	return labels
+}
+
+// 序列和它们的标签集合一起交换
+type bySeriesLabels struct {
+	series []model.Series
+	labels []model.Labels
+}
+
+func (s bySeriesLabels) Len() int           { return len(s.series) }
+func (s bySeriesLabels) Less(i, j int) bool { return s.labels[i].Compare(s.labels[j]) < 0 }
+func (s bySeriesLabels) Swap(i, j int) {
+	s.series[i], s.series[j] = s.series[j], s.series[i]
+	s.labels[i], s.labels[j] = s.labels[j], s.labels[i]
+}
+
+func (s *listSeriesSet) Next() bool {
+	s.cur++
+	return s.cur < len(s.series)
+}
+
+func (s *listSeriesSet) At() model.Series {
+	return s.series[s.cur]
+}
+
+func (s *listSeriesSet) Err() error {
+	return nil
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"math"
+	"mini-promethues/pkg/model"
+	"testing"
+)
+
+// TestMemSeries_Chunks 测试样本按 chunk 切分存储
+func TestMemSeries_Chunks(t *testing.T) {
+	t.Run("写满后切换新 chunk", func(t *testing.T) {
+		s := newMemSeries(1, createTestMetric("up"))
+		for i := 0; i < 2*samplesPerChunk+10; i++ {
+			s.append(int64(i*1000), float64(i))
+		}
+		if len(s.chunks) != 3 {
+			t.Fatalf("期望 3 个 chunk，实际 %d 个", len(s.chunks))
+		}
+		if s.chunks[1].minTime != samplesPerChunk*1000 || s.chunks[1].maxTime != (2*samplesPerChunk-1)*1000 {
+			t.Errorf("第二个 chunk 时间范围错误: [%d, %d]", s.chunks[1].minTime, s.chunks[1].maxTime)
+		}
+		samples := s.samplesInRange(100000, 130000)
+		if len(samples) != 31 || samples[0].Value != 100 || samples[30].Value != 130 {
+			t.Errorf("跨 chunk 范围查询结果错误: %v", samples)
+		}
+	})
+
+	t.Run("二分查找最新样本", func(t *testing.T) {
+		s := newMemSeries(1, createTestMetric("up"))
+		for i := 0; i < 3*samplesPerChunk; i++ {
+			s.append(int64(i*1000), float64(i))
+		}
+		latest, ok := s.latestInRange(0, 200500)
+		if !ok || latest != (model.Sample{Timestamp: 200000, Value: 200}) {
+			t.Errorf("期望最新样本 {200000 200}，实际 %v", latest)
+		}
+		if _, ok := s.latestInRange(200100, 200900); ok {
+			t.Error("期望范围内没有样本")
+		}
+		if samples := s.samplesInRange(-5000, 1000); len(samples) != 2 {
+			t.Errorf("期望 2 个样本，实际 %d 个", len(samples))
+		}
+	})
+}
+
+// TestMemSeries_Appendable 测试乱序和重复样本的检查
+func TestMemSeries_Appendable(t *testing.T) {
+	s := newMemSeries(1, createTestMetric("up"))
+	s.append(1000, 1)
+	s.append(2000, 2)
+	tests := []struct {
+		name      string
+		sample    model.Sample
+		duplicate bool
+		err       error
+	}{
+		{"更新的样本", model.Sample{Timestamp: 3000, Value: 3}, false, nil},
+		{"乱序样本", model.Sample{Timestamp: 500, Value: 1}, false, ErrOutOfOrder},
+		{"早于最后一个样本的完全相同样本", model.Sample{Timestamp: 1000, Value: 1}, true, nil},
+		{"相同时间戳不同值", model.Sample{Timestamp: 2000, Value: 3}, false, ErrDuplicateSampleForTimestamp},
+		{"完全相同的样本", model.Sample{Timestamp: 2000, Value: 2}, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			duplicate, err := s.appendable(tt.sample.Timestamp, tt.sample.Value, math.MaxInt64)
+			if duplicate != tt.duplicate || err != tt.err {
+				t.Errorf("期望 (%v, %v)，实际 (%v, %v)", tt.duplicate, tt.err, duplicate, err)
+			}
+		})
+	}
+}
+
+// TestMemSeries_OutOfOrder 测试乱序窗口内的样本单独缓存, 查询时合并
+func TestMemSeries_OutOfOrder(t *testing.T) {
+	s := newMemSeries(1, createTestMetric("up"))
+	for _, ts := range []int64{1000, 5000, 10000} {
+		s.append(ts, float64(ts/1000))
+	}
+	// 窗口从 4000 开始
+	oooMint := int64(4000)
+	for _, ts := range []int64{7000, 4000, 9000} {
+		if duplicate, err := s.appendable(ts, float64(ts/1000), oooMint); err != nil || duplicate {
+			t.Fatalf("样本 %d: 期望可以写入，实际 (%v, %v)", ts, duplicate, err)
+		}
+		s.append(ts, float64(ts/1000))
+	}
+	if _, err := s.appendable(3000, 3, oooMint); err != ErrOutOfOrder {
+		t.Errorf("期望窗口外的样本返回 ErrOutOfOrder，实际 %v", err)
+	}
+	if _, err := s.appendable(7000, 8, oooMint); err != ErrDuplicateSampleForTimestamp {
+		t.Errorf("期望 ErrDuplicateSampleForTimestamp，实际 %v", err)
+	}
+	if duplicate, err := s.appendable(5000, 5, oooMint); !duplicate || err != nil {
+		t.Errorf("期望和 chunk 中的样本重复，实际 (%v, %v)", duplicate, err)
+	}
+
+	samples := s.samplesInRange(0, 20000)
+	want := []int64{1000, 4000, 5000, 7000, 9000, 10000}
+	if len(samples) != len(want) {
+		t.Fatalf("期望 %d 个样本，实际 %d 个", len(want), len(samples))
+	}
+	for i, ts := range want {
+		if samples[i].Timestamp != ts {
+			t.Errorf("样本 %d: 期望时间戳 %d，实际 %d", i, ts, samples[i].Timestamp)
+		}
+	}
+	latest, ok := s.latestInRange(0, 9500)
+	if !ok || latest.Timestamp != 9000 {
+		t.Errorf("期望最新样本时间戳 9000，实际 %v", latest)
+	}
+
+	if removed := s.truncateBefore(6000); removed != 3 || s.minTime() != 7000 {
+		t.Errorf("期望删除 3 个样本、最早时间 7000，实际删除 %d 个、最早时间 %d", removed, s.minTime())
+	}
+}
+
+// TestMemSeries_OutOfOrderFlush 测试乱序样本写满缓存后压缩成 chunk
+func TestMemSeries_OutOfOrderFlush(t *testing.T) {
+	s := newMemSeries(1, createTestMetric("up"))
+	const n = 100
+	// 偶数秒按顺序写入, 奇数秒全部迟到
+	for i := 0; i <= 2*n; i += 2 {
+		s.append(int64(i)*1000, float64(i))
+	}
+	for i := 1; i < 2*n; i += 2 {
+		if duplicate, err := s.appendable(int64(i)*1000, float64(i), 0); err != nil || duplicate {
+			t.Fatalf("样本 %d: 期望可以写入，实际 (%v, %v)", i, duplicate, err)
+		}
+		s.append(int64(i)*1000, float64(i))
+	}
+	if len(s.oooSamples) >= oooSamplesCapacity {
+		t.Errorf("期望缓存少于 %d 个样本，实际 %d 个", oooSamplesCapacity, len(s.oooSamples))
+	}
+	if want := n / oooSamplesCapacity; len(s.oooChunks) != want {
+		t.Errorf("期望 %d 个乱序 chunk，实际 %d 个", want, len(s.oooChunks))
+	}
+
+	samples := s.samplesInRange(0, 2*n*1000)
+	if len(samples) != 2*n+1 {
+		t.Fatalf("期望 %d 个样本，实际 %d 个", 2*n+1, len(samples))
+	}
+	for i, sample := range samples {
+		if sample.Timestamp != int64(i)*1000 || sample.Value != float64(i) {
+			t.Fatalf("样本 %d: 期望 {%d %d}，实际 %v", i, i*1000, i, sample)
+		}
+	}
+	// 已经压缩的样本同样能识别重复写入
+	if _, err := s.appendable(1000, 2, 0); err != ErrDuplicateSampleForTimestamp {
+		t.Errorf("期望 ErrDuplicateSampleForTimestamp，实际 %v", err)
+	}
+	if duplicate, err := s.appendable(1000, 1, 0); !duplicate || err != nil {
+		t.Errorf("期望和乱序 chunk 中的样本重复，实际 (%v, %v)", duplicate, err)
+	}
+
+	// 截断点落在第二个乱序 chunk 中间
+	if removed := s.truncateBefore(100000); removed != 100 || s.minTime() != 100000 {
+		t.Errorf("期望删除 100 个样本、最早时间 100000，实际删除 %d 个、最早时间 %d", removed, s.minTime())
+	}
+	if got := len(s.samplesInRange(0, 2*n*1000)); got != n+1 {
+		t.Errorf("期望剩余 %d 个样本，实际 %d 个", n+1, got)
+	}
+}
+
+// TestMemSeries_OutOfOrderOverlap 测试时间范围重叠的乱序样本压缩时和已有乱序 chunk 合并
+func TestMemSeries_OutOfOrderOverlap(t *testing.T) {
+	s := newMemSeries(1, createTestMetric("up"))
+	const n = 400
+	s.append(n*1000, n)
+	// 分两轮迟到: 先写 4k+1, 再写 4k+3, 第二轮每次压缩都和第一轮的 chunk 重叠
+	for _, offset := range []int{1, 3} {
+		for i := offset; i < n; i += 4 {
+			if duplicate, err := s.appendable(int64(i)*1000, float64(i), 0); err != nil || duplicate {
+				t.Fatalf("样本 %d: 期望可以写入，实际 (%v, %v)", i, duplicate, err)
+			}
+			s.append(int64(i)*1000, float64(i))
+		}
+	}
+	for i, c := range s.oooChunks {
+		if c.chunk.NumSamples() > samplesPerChunk {
+			t.Errorf("乱序 chunk %d: 期望最多 %d 个样本，实际 %d 个", i, samplesPerChunk, c.chunk.NumSamples())
+		}
+		if i > 0 && s.oooChunks[i-1].maxTime >= c.minTime {
+			t.Errorf("乱序 chunk %d: 期望和前一个 chunk 不重叠，实际 [%d, %d] 和 [%d, %d]",
+				i, s.oooChunks[i-1].minTime, s.oooChunks[i-1].maxTime, c.minTime, c.maxTime)
+		}
+	}
+
+	samples := s.samplesInRange(0, n*1000)
+	if len(samples) != n/2+1 {
+		t.Fatalf("期望 %d 个样本，实际 %d 个", n/2+1, len(samples))
+	}
+	for i, sample := range samples[:n/2] {
+		if want := int64(2*i+1) * 1000; sample.Timestamp != want {
+			t.Fatalf("样本 %d: 期望时间戳 %d，实际 %d", i, want, sample.Timestamp)
+		}
+	}
+	for _, ts := range []int64{1000, 3000, 201000, 399000} {
+		if v, found := s.valueAt(ts); !found || v != float64(ts/1000) {
+			t.Errorf("%d: 期望找到值 %d，实际 (%v, %v)", ts, ts/1000, v, found)
+		}
+	}
+	if _, found := s.valueAt(2000); found {
+		t.Error("期望 2000 没有样本")
+	}
+}
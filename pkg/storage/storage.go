@@ -1,13 +1,42 @@
 package storage
 
-import "mini-promethues/pkg/model"
+import (
+	"mini-promethues/pkg/model"
+	"time"
+)
+
+// 即时查询默认的回溯窗口, 见 docs/knowledge/03-instant-query-lookback.md
+const DefaultLookbackDelta = 5 * time.Minute
 
 type Storage interface {
 	Append(m *model.Metric, s *model.Sample) error
 
+	// 批量写入, 同一批样本在 WAL 中只占一条记录
+	Appender() Appender
+
+	// 使用存储配置的回溯窗口查找 timestamp 时刻的最新样本, 最新样本是 staleness marker 时没有值
 	Query(m *model.Metric, timestamp int64) (model.Series, error)
 
+	// 在 [timestamp - lookback, timestamp] 内查找最新样本, lookback 为 0 时使用存储配置的回溯窗口
+	QueryWithLookback(m *model.Metric, timestamp int64, lookback time.Duration) (model.Series, error)
+
+	// 存储配置的回溯窗口, 查询引擎用它求值即时向量选择器, 与 Query 的结果保持一致
+	LookbackDelta() time.Duration
+
 	QueryRange(m *model.Metric, start, end int64) (model.Series, error)
 
+	// 返回满足所有匹配器且在 [mint, maxt] 内有样本的时间序列
+	Select(matchers []*model.LabelMatcher, mint, maxt int64) (SeriesSet, error)
+
 	Delete(m *model.Metric) error
+
+	Close() error
+}
+
+// 回溯窗口内的最新样本是 staleness marker 时, 序列在该时刻没有值
+func dropStale(s model.Series, err error) (model.Series, error) {
+	if err == nil && len(s.Samples) == 1 && model.IsStaleNaN(s.Samples[0].Value) {
+		s.Samples = nil
+	}
+	return s, err
 }
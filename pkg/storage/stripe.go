@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"mini-promethues/pkg/model"
+	"slices"
+	"sync"
+	"unsafe"
+)
+
+// 默认的分片数, 必须是 2 的幂
+const defaultStripeSize = 256
+
+const cacheLineSize = 64
+
+/*
+按 fingerprint 分片的序列表, 每个分片有自己的锁
+并发写入不同的序列时大多落在不同的分片上, 查找已有序列只需要分片的读锁
+fingerprint 相同但标签不同的序列保存在同一个列表中
+*/
+type stripeSeries struct {
+	mask    uint64
+	stripes []seriesStripe
+}
+
+type stripeFields struct {
+	sync.RWMutex
+	series map[uint64][]*memSeries
+}
+
+/*
+分片的大小补齐到两个缓存行的整数倍, 避免相邻分片的锁落在同一个缓存行上, 互相影响
+分片数组的起始地址不保证按缓存行对齐, 只补齐到一个缓存行时相邻分片仍会共享缓存行;
+stripeFields 不超过一个缓存行, 间隔两个缓存行时相邻分片的字段之间至少隔开一个缓存行
+*/
+type seriesStripe struct {
+	stripeFields
+	_ [(2*cacheLineSize - unsafe.Sizeof(stripeFields{})%(2*cacheLineSize)) % (2 * cacheLineSize)]byte
+}
+
+func newStripeSeries(size int) *stripeSeries {
+	ss := &stripeSeries{mask: uint64(size - 1), stripes: make([]seriesStripe, size)}
+	for i := range ss.stripes {
+		ss.stripes[i].series = make(map[uint64][]*memSeries)
+	}
+	return ss
+}
+
+func (ss *stripeSeries) stripe(fp uint64) *seriesStripe {
+	return &ss.stripes[fp&ss.mask]
+}
+
+func (ss *stripeSeries) get(m *model.Metric) *memSeries {
+	fp := m.Fingerprint()
+	s := ss.stripe(fp)
+	s.RLock()
+	defer s.RUnlock()
+	return s.get(fp, m)
+}
+
+// 调用方持有分片的锁
+func (s *seriesStripe) get(fp uint64, m *model.Metric) *memSeries {
+	for _, series := range s.series[fp] {
+		if series.metric.Equal(m) {
+			return series
+		}
+	}
+	return nil
+}
+
+// 调用方持有分片的写锁
+func (s *seriesStripe) add(fp uint64, series *memSeries) {
+	s.series[fp] = append(s.series[fp], series)
+}
+
+// 调用方持有分片的写锁
+func (s *seriesStripe) delete(fp uint64, series *memSeries) {
+	list := slices.DeleteFunc(s.series[fp], func(e *memSeries) bool { return e == series })
+	if len(list) == 0 {
+		delete(s.series, fp)
+		return
+	}
+	s.series[fp] = list
+}
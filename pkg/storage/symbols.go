@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"mini-promethues/pkg/model"
+	"strings"
+	"sync"
+)
+
+/*
+标签名和标签值的驻留表, 相同的字符串在 head 中只保存一份
+序列和倒排索引都引用驻留后的字符串; 每条序列创建时对它的每个字符串加一次引用, 删除时释放, 引用数归零后从表中删除
+驻留时复制一份字符串, 抓取解析出的标签是响应内容的子串, 直接保存会让整个响应无法回收
+nil 表示不驻留, 直接使用原字符串
+*/
+type symbolTable struct {
+	mutex   sync.Mutex
+	symbols map[string]*symbol
+}
+
+type symbol struct {
+	s    string
+	refs int
+}
+
+func newSymbolTable() *symbolTable {
+	return &symbolTable{symbols: make(map[string]*symbol)}
+}
+
+// 返回驻留后的字符串并增加引用
+func (st *symbolTable) intern(s string) string {
+	if st == nil {
+		return s
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if sym, ok := st.symbols[s]; ok {
+		sym.refs++
+		return sym.s
+	}
+	s = strings.Clone(s)
+	st.symbols[s] = &symbol{s: s, refs: 1}
+	return s
+}
+
+func (st *symbolTable) release(s string) {
+	if st == nil {
+		return
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	sym, ok := st.symbols[s]
+	if !ok {
+		return
+	}
+	sym.refs--
+	if sym.refs == 0 {
+		delete(st.symbols, s)
+	}
+}
+
+// 返回规范化并且名称和标签都已驻留的 Metric
+func (st *symbolTable) internMetric(m *model.Metric) *model.Metric {
+	c := model.NewMetric(m.Name, m.Labels)
+	// c.Labels 是 NewMetric 复制出来的, 替换成内容相同的字符串不影响缓存的 fingerprint
+	c.Name = st.intern(c.Name)
+	for i, l := range c.Labels {
+		c.Labels[i] = model.Label{Name: st.intern(l.Name), Value: st.intern(l.Value)}
+	}
+	return c
+}
+
+func (st *symbolTable) releaseMetric(m *model.Metric) {
+	st.release(m.Name)
+	for _, l := range m.Labels {
+		st.release(l.Name)
+		st.release(l.Value)
+	}
+}
+
+// 表中不同字符串的个数
+func (st *symbolTable) len() int {
+	if st == nil {
+		return 0
+	}
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return len(st.symbols)
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"mini-promethues/pkg/model"
+	"runtime"
+	"strconv"
+	"testing"
+	"unsafe"
+)
+
+// TestSymbolTable 测试字符串驻留和引用计数
+func TestSymbolTable(t *testing.T) {
+	st := newSymbolTable()
+	a := st.intern(string([]byte("job")))
+	b := st.intern(string([]byte("job")))
+	if unsafe.StringData(a) != unsafe.StringData(b) {
+		t.Error("期望相同的字符串共享同一份内存")
+	}
+	st.release(a)
+	if st.len() != 1 {
+		t.Errorf("期望还有 1 个引用时保留，实际 %d 个字符串", st.len())
+	}
+	st.release(b)
+	if st.len() != 0 {
+		t.Errorf("期望引用归零后删除，实际 %d 个字符串", st.len())
+	}
+
+	var nilTable *symbolTable
+	if s := nilTable.intern("job"); s != "job" {
+		t.Errorf("期望 nil 表直接返回原字符串，实际 %q", s)
+	}
+}
+
+// TestMemoryStorage_Symbols 测试序列共享标签字符串, 删除后释放
+func TestMemoryStorage_Symbols(t *testing.T) {
+	storage := NewMemoryStorage()
+	m1 := createTestMetric("up", "job", "api", "instance", "a:9100")
+	m2 := createTestMetric("up", "job", "api", "instance", "b:9100")
+	storage.Append(m1, &model.Sample{Timestamp: 1000, Value: 1})
+	storage.Append(m2, &model.Sample{Timestamp: 1000, Value: 1})
+	// up, job, api, instance, a:9100, b:9100
+	if n := storage.symbols.len(); n != 6 {
+		t.Errorf("期望 6 个字符串，实际 %d 个", n)
+	}
+	s1, s2 := storage.hashes.get(m1), storage.hashes.get(m2)
+	if unsafe.StringData(s1.metric.Get("job")) != unsafe.StringData(s2.metric.Get("job")) {
+		t.Error("期望两条序列共享标签值 api")
+	}
+
+	storage.Delete(m1)
+	if n := storage.symbols.len(); n != 5 {
+		t.Errorf("期望删除序列后剩余 5 个字符串，实际 %d 个", n)
+	}
+	storage.Delete(m2)
+	if n := storage.symbols.len(); n != 0 {
+		t.Errorf("期望全部删除后没有字符串，实际 %d 个", n)
+	}
+}
+
+/*
+高基数场景下 head 中序列标签占用的内存
+每条序列的标签字符串都是新分配的, 和抓取解析出的标签一样; 对比驻留和不驻留时每条序列的堆内存
+*/
+func BenchmarkMemoryStorage_LabelMemory(b *testing.B) {
+	const numSeries = 100000
+	// 每次调用都分配新的字符串
+	fresh := func(s string) string { return string([]byte(s)) }
+	for _, bc := range []struct {
+		name    string
+		symbols func() *symbolTable
+	}{
+		{"interned", newSymbolTable},
+		{"copied", func() *symbolTable { return nil }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			var heap int64
+			for i := 0; i < b.N; i++ {
+				before := heapInUse()
+				storage := NewMemoryStorage()
+				storage.symbols = bc.symbols()
+				for j := 0; j < numSeries; j++ {
+					m := &model.Metric{Name: fresh("node_cpu_seconds_total"), Labels: model.Labels{
+						{Name: fresh("job"), Value: fresh("node-exporter-production")},
+						{Name: fresh("instance"), Value: "host-" + strconv.Itoa(j/8) + ".cluster.example.com:9100"},
+						{Name: fresh("region"), Value: fresh("ap-southeast-1")},
+						{Name: fresh("mode"), Value: strconv.Itoa(j % 8)},
+					}}
+					storage.Append(m, &model.Sample{Timestamp: 1000, Value: 1})
+				}
+				// GC 可能让堆比 before 更小, 用有符号数避免回绕
+				heap += heapInUse() - before
+				runtime.KeepAlive(storage)
+			}
+			b.ReportMetric(float64(heap)/float64(b.N)/numSeries, "B/series")
+		})
+	}
+}
+
+func heapInUse() int64 {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return int64(ms.HeapInuse)
+}
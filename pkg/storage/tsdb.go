@@ -0,0 +1,499 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"mini-promethues/pkg/model"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultBlockDuration = 2 * time.Hour
+	walDirname           = "wal"
+	compactInterval      = time.Minute
+)
+
+var DefaultCompactionRanges = []time.Duration{6 * time.Hour, 24 * time.Hour}
+
+type Options struct {
+	// head 中的数据按该时长对齐切分成 block
+	BlockDuration time.Duration
+	// 相邻的 block 逐级合并成这些更大的对齐时间范围, 每一级必须是前一级的整数倍
+	CompactionRanges []time.Duration
+	// 数据保留时长, 为 0 时不按时间删除
+	RetentionDuration time.Duration
+	// block 最多占用的字节数, 不包括 WAL, 为 0 时不按大小删除
+	MaxBytes int64
+	// head 接受乱序样本的时间窗口, 为 0 时拒绝乱序样本; 已经切成 block 的时间范围不再接受写入
+	OutOfOrderTimeWindow time.Duration
+	// 即时查询的回溯窗口, 为 0 时使用 DefaultLookbackDelta
+	LookbackDelta time.Duration
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		BlockDuration:    DefaultBlockDuration,
+		CompactionRanges: DefaultCompactionRanges,
+		LookbackDelta:    DefaultLookbackDelta,
+	}
+}
+
+func (o *Options) validate() error {
+	prev := o.BlockDuration
+	for _, r := range o.CompactionRanges {
+		if r <= prev || r%prev != 0 {
+			return fmt.Errorf("compaction range %v must be a multiple of %v", r, prev)
+		}
+		prev = r
+	}
+	if o.RetentionDuration < 0 {
+		return fmt.Errorf("retention duration must not be negative, got %v", o.RetentionDuration)
+	}
+	if o.LookbackDelta < 0 {
+		return fmt.Errorf("lookback delta must not be negative, got %v", o.LookbackDelta)
+	}
+	if o.OutOfOrderTimeWindow < 0 {
+		return fmt.Errorf("out of order time window must not be negative, got %v", o.OutOfOrderTimeWindow)
+	}
+	if o.MaxBytes < 0 {
+		return fmt.Errorf("max bytes must not be negative, got %d", o.MaxBytes)
+	}
+	return nil
+}
+
+/*
+DB 由一个内存中的 head (MemoryStorage + WAL) 和若干持久化的 block 组成:
+
+	dir/
+	  wal/        head 的预写日志
+	  <block id>/ 每个 block 覆盖一段对齐的时间范围
+
+head 的时间跨度超过 1.5 倍 BlockDuration 时, 最早的一段完整时间范围会被切成 block 并从 head 删除,
+查询透明地合并 head 和所有时间范围重叠的 block, 后台再把小 block 逐级合并成大 block (见 compact.go), 并删除超出保留策略的数据 (见 retention.go)
+*/
+type DB struct {
+	dir  string
+	opts *Options
+	head *MemoryStorage
+
+	// 只保护 blocks; 切分 block 时先加入 block, 释放锁之后才截断 head,
+	// 查询可能看到同一段样本同时在 block 和 head 中, 依靠 mergeSamples 按时间戳去重保证结果不变
+	mutex  sync.RWMutex
+	blocks []*Block
+	// 串行化 compaction 和 Delete, 避免正在合并的数据中丢失刚删除的序列
+	compactMutex sync.Mutex
+	retention    retentionMetrics
+
+	stopc chan struct{}
+	donec chan struct{}
+}
+
+func Open(dir string, opts *Options) (*DB, error) {
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	if opts.BlockDuration <= 0 {
+		opts.BlockDuration = DefaultBlockDuration
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create storage dir %q: %w", dir, err)
+	}
+	blocks, err := openBlocks(dir)
+	if err != nil {
+		return nil, err
+	}
+	head, err := OpenMemoryStorage(filepath.Join(dir, walDirname),
+		WithOutOfOrderTimeWindow(opts.OutOfOrderTimeWindow), WithLookbackDelta(opts.LookbackDelta))
+	if err != nil {
+		closeBlocks(blocks)
+		return nil, err
+	}
+	// 上次切 block 之后、截断 WAL 之前崩溃时, head 中会残留已经持久化的数据
+	if len(blocks) > 0 {
+		if _, err := head.truncate(blocks[len(blocks)-1].meta.MaxTime); err != nil {
+			head.Close()
+			closeBlocks(blocks)
+			return nil, err
+		}
+	}
+	db := &DB{
+		dir:    dir,
+		opts:   opts,
+		head:   head,
+		blocks: blocks,
+		stopc:  make(chan struct{}),
+		donec:  make(chan struct{}),
+	}
+	go db.run()
+	return db, nil
+}
+
+func openBlocks(dir string) ([]*Block, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var blocks []*Block
+	for _, e := range entries {
+		if !e.IsDir() || e.Name() == walDirname {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		// 没有写完的 block
+		if strings.HasSuffix(e.Name(), tmpBlockSuffix) {
+			if err := os.RemoveAll(path); err != nil {
+				closeBlocks(blocks)
+				return nil, err
+			}
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(path, metaFilename)); err != nil {
+			continue
+		}
+		b, err := OpenBlock(path)
+		if err != nil {
+			closeBlocks(blocks)
+			return nil, err
+		}
+		blocks = append(blocks, b)
+	}
+	sortBlocks(blocks)
+	return blocks, nil
+}
+
+func sortBlocks(blocks []*Block) {
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].meta.MinTime < blocks[j].meta.MinTime })
+}
+
+func closeBlocks(blocks []*Block) error {
+	var errs []error
+	for _, b := range blocks {
+		if err := b.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (db *DB) run() {
+	defer close(db.donec)
+	ticker := time.NewTicker(compactInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := db.Compact(); err != nil {
+				log.Printf("storage compaction failed: %v", err)
+			}
+			if err := db.applyRetention(); err != nil {
+				log.Printf("storage retention failed: %v", err)
+			}
+		case <-db.stopc:
+			return
+		}
+	}
+}
+
+// 返回所有 block 的元数据, 按时间排序
+func (db *DB) Blocks() []BlockMeta {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	metas := make([]BlockMeta, 0, len(db.blocks))
+	for _, b := range db.blocks {
+		metas = append(metas, b.meta)
+	}
+	return metas
+}
+
+// 把 head 中已经完整的时间范围持久化成 block, 再合并可以合并的 block
+func (db *DB) Compact() error {
+	db.compactMutex.Lock()
+	defer db.compactMutex.Unlock()
+	if err := db.compactHead(); err != nil {
+		return err
+	}
+	for {
+		blocks := db.plan()
+		if len(blocks) == 0 {
+			return nil
+		}
+		if err := db.compactBlocks(blocks); err != nil {
+			return err
+		}
+	}
+}
+
+func (db *DB) compactHead() error {
+	blockRange := db.opts.BlockDuration.Milliseconds()
+	for {
+		mint, maxt := db.head.MinTime(), db.head.MaxTime()
+		if mint == math.MaxInt64 || maxt-mint < blockRange*3/2 {
+			return nil
+		}
+		start := alignDown(mint, blockRange)
+		if err := db.cutBlock(start, start+blockRange); err != nil {
+			return err
+		}
+	}
+}
+
+func alignDown(t, step int64) int64 {
+	r := t % step
+	if r < 0 {
+		r += step
+	}
+	return t - r
+}
+
+func (db *DB) cutBlock(mint, maxt int64) error {
+	// 先冻结这段时间, 避免写 block 期间写入的样本在截断 head 时丢失
+	db.head.setMinValidTime(maxt)
+	series := db.head.snapshot(mint, maxt)
+	var block *Block
+	if len(series) > 0 {
+		meta, err := writeBlock(db.dir, mint, maxt, series, BlockCompaction{Level: 1})
+		if err != nil {
+			return fmt.Errorf("write block: %w", err)
+		}
+		if block, err = OpenBlock(filepath.Join(db.dir, meta.ID)); err != nil {
+			return err
+		}
+	}
+	if block != nil {
+		db.mutex.Lock()
+		db.blocks = append(db.blocks, block)
+		sortBlocks(db.blocks)
+		db.mutex.Unlock()
+	}
+	// 截断 head 时要为 WAL 写 checkpoint, 不能持有 db.mutex, 否则期间所有查询都被阻塞
+	// block 加入之后、截断之前的样本同时在 block 和 head 中, 查询合并时按时间戳去重, 结果不变
+	_, err := db.head.truncate(maxt)
+	return err
+}
+
+func (db *DB) Append(m *model.Metric, s *model.Sample) error {
+	return db.head.Append(m, s)
+}
+
+func (db *DB) Appender() Appender {
+	return db.head.Appender()
+}
+
+func (db *DB) LookbackDelta() time.Duration {
+	return db.head.LookbackDelta()
+}
+
+func (db *DB) Query(m *model.Metric, timestamp int64) (model.Series, error) {
+	if m == nil {
+		return model.Series{}, ErrNilMetric
+	}
+	return dropStale(db.queryWithLookback(m, timestamp, db.head.lookbackDelta))
+}
+
+func (db *DB) QueryWithLookback(m *model.Metric, timestamp int64, lookback time.Duration) (model.Series, error) {
+	if m == nil {
+		return model.Series{}, ErrNilMetric
+	}
+	if lookback <= 0 {
+		return dropStale(db.queryWithLookback(m, timestamp, db.head.lookbackDelta))
+	}
+	return dropStale(db.queryWithLookback(m, timestamp, lookback.Milliseconds()))
+}
+
+// head 和 block 中的最新样本一起比较, head 中的 marker 也能覆盖 block 中更早的样本
+func (db *DB) queryWithLookback(m *model.Metric, timestamp, lookback int64) (model.Series, error) {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	result, err := db.head.queryWithLookback(m, timestamp, lookback)
+	if err != nil && err != ErrSeriesNotFound {
+		return model.Series{}, err
+	}
+	found := err == nil
+	for _, b := range db.blocks {
+		id, ok := b.lookup(m)
+		if !ok {
+			continue
+		}
+		if !found {
+			found = true
+			result.Metric = b.series[id].metric
+		}
+		if !b.meta.overlaps(timestamp-lookback, timestamp) {
+			continue
+		}
+		samples, err := b.samples(id, timestamp-lookback, timestamp)
+		if err != nil {
+			return model.Series{}, err
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		latest := samples[len(samples)-1]
+		if len(result.Samples) == 0 || result.Samples[0].Timestamp < latest.Timestamp {
+			result.Samples = model.Samples{latest}
+		}
+	}
+	if !found {
+		return model.Series{}, ErrSeriesNotFound
+	}
+	return result, nil
+}
+
+func (db *DB) QueryRange(m *model.Metric, start, end int64) (model.Series, error) {
+	if m == nil {
+		return model.Series{}, ErrNilMetric
+	}
+	if start > end {
+		return model.Series{}, ErrTimeRange
+	}
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	result := model.Series{Samples: model.Samples{}}
+	found := false
+	for _, b := range db.blocks {
+		id, ok := b.lookup(m)
+		if !ok {
+			continue
+		}
+		found = true
+		result.Metric = b.series[id].metric
+		if !b.meta.overlaps(start, end) {
+			continue
+		}
+		samples, err := b.samples(id, start, end)
+		if err != nil {
+			return model.Series{}, err
+		}
+		result.Samples = mergeSamples(result.Samples, samples)
+	}
+	series, err := db.head.QueryRange(m, start, end)
+	if err == nil {
+		found = true
+		result.Metric = series.Metric
+		result.Samples = mergeSamples(result.Samples, series.Samples)
+	} else if err != ErrSeriesNotFound {
+		return model.Series{}, err
+	}
+	if !found {
+		return model.Series{}, ErrSeriesNotFound
+	}
+	return result, nil
+}
+
+func (db *DB) Select(matchers []*model.LabelMatcher, mint, maxt int64) (SeriesSet, error) {
+	if len(matchers) == 0 {
+		return nil, ErrNoMatchers
+	}
+	if mint > maxt {
+		return nil, ErrTimeRange
+	}
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	// fingerprint 相同时再比较标签, 哈希冲突的序列不会被合并
+	merged := make(map[uint64][]*model.Series)
+	add := func(s model.Series) {
+		fp := s.Metric.Fingerprint()
+		for _, existing := range merged[fp] {
+			if existing.Metric.Equal(&s.Metric) {
+				existing.Samples = mergeSamples(existing.Samples, s.Samples)
+				return
+			}
+		}
+		merged[fp] = append(merged[fp], &s)
+	}
+	for _, b := range db.blocks {
+		if !b.meta.overlaps(mint, maxt) {
+			continue
+		}
+		series, err := b.selectSeries(matchers, mint, maxt)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range series {
+			add(s)
+		}
+	}
+	ss, err := db.head.Select(matchers, mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	for ss.Next() {
+		add(ss.At())
+	}
+	result := make([]model.Series, 0, len(merged))
+	for _, list := range merged {
+		for _, s := range list {
+			result = append(result, *s)
+		}
+	}
+	return newListSeriesSet(result), nil
+}
+
+// head 中直接删除, block 中记录 tombstones, 下次 compaction 时真正删除
+func (db *DB) Delete(m *model.Metric) error {
+	if m == nil {
+		return ErrNilMetric
+	}
+	db.compactMutex.Lock()
+	defer db.compactMutex.Unlock()
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if err := db.head.Delete(m); err != nil {
+		return err
+	}
+	for _, b := range db.blocks {
+		if _, err := b.delete(m); err != nil {
+			return fmt.Errorf("delete from block %s: %w", b.meta.ID, err)
+		}
+	}
+	return nil
+}
+
+func (db *DB) Close() error {
+	close(db.stopc)
+	<-db.donec
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+	return errors.Join(db.head.Close(), closeBlocks(db.blocks))
+}
+
+// 合并两个按时间戳排序的样本列表, 时间戳相同时保留 a 中的样本
+func mergeSamples(a, b model.Samples) model.Samples {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+	if a[len(a)-1].Timestamp < b[0].Timestamp {
+		return append(a, b...)
+	}
+	result := make(model.Samples, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i].Timestamp < b[j].Timestamp:
+			result = append(result, a[i])
+			i++
+		case a[i].Timestamp > b[j].Timestamp:
+			result = append(result, b[j])
+			j++
+		default:
+			result = append(result, a[i])
+			i++
+			j++
+		}
+	}
+	result = append(result, a[i:]...)
+	return append(result, b[j:]...)
+}
@@ -0,0 +1,344 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"mini-promethues/pkg/model"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testBlockRange = int64(2 * time.Hour / time.Millisecond)
+
+func openTestDB(t *testing.T, dir string) *DB {
+	t.Helper()
+	db, err := Open(dir, nil)
+	if err != nil {
+		t.Fatalf("打开存储失败: %v", err)
+	}
+	return db
+}
+
+// 每分钟一个样本, 值等于分钟数
+func appendMinutes(t *testing.T, s Storage, m *model.Metric, from, to int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		sample := &model.Sample{Timestamp: int64(i) * 60000, Value: float64(i)}
+		if err := s.Append(m, sample); err != nil {
+			t.Fatalf("追加样本 %d 失败: %v", i, err)
+		}
+	}
+}
+
+// TestBlock_WriteAndOpen 测试 block 写入后重新打开能还原所有序列和样本
+func TestBlock_WriteAndOpen(t *testing.T) {
+	dir := t.TempDir()
+	m1 := createTestMetric("http_requests_total", "method", "GET")
+	m2 := createTestMetric("http_requests_total", "method", "POST")
+	var samples model.Samples
+	for i := 0; i < 300; i++ {
+		samples = append(samples, model.Sample{Timestamp: int64(i) * 1000, Value: float64(i)})
+	}
+	meta, err := writeBlock(dir, 0, 300000, []blockSeriesData{
+		{metric: *m1, samples: samples},
+		{metric: *m2, samples: samples[:10]},
+	}, BlockCompaction{Level: 1})
+	if err != nil {
+		t.Fatalf("写入 block 失败: %v", err)
+	}
+	if meta.Stats.NumSeries != 2 || meta.Stats.NumSamples != 310 || meta.Stats.NumChunks != 4 {
+		t.Errorf("统计信息不正确: %+v", meta.Stats)
+	}
+
+	b, err := OpenBlock(filepath.Join(dir, meta.ID))
+	if err != nil {
+		t.Fatalf("打开 block 失败: %v", err)
+	}
+	defer b.Close()
+	if b.Meta().ID != meta.ID || b.Meta().MaxTime != 300000 {
+		t.Errorf("期望 meta %+v，实际 %+v", meta, b.Meta())
+	}
+
+	id, ok := b.lookup(m1)
+	if !ok {
+		t.Fatal("期望找到序列")
+	}
+	got, err := b.samples(id, 100000, 199999)
+	if err != nil {
+		t.Fatalf("读取样本失败: %v", err)
+	}
+	if len(got) != 100 || got[0].Value != 100 || got[99].Value != 199 {
+		t.Errorf("期望 100 个样本 [100, 199]，实际 %d 个", len(got))
+	}
+
+	series, err := b.selectSeries([]*model.LabelMatcher{
+		createTestMatcher(t, model.MatchEqual, model.MetricNameLabel, "http_requests_total"),
+		createTestMatcher(t, model.MatchNotEqual, "method", "GET"),
+	}, 0, 300000)
+	if err != nil {
+		t.Fatalf("Select 失败: %v", err)
+	}
+	if len(series) != 1 || series[0].Metric.String() != m2.String() || len(series[0].Samples) != 10 {
+		t.Errorf("期望只匹配 POST 序列的 10 个样本，实际 %v", series)
+	}
+
+	t.Run("tombstones 重新打开后仍然生效", func(t *testing.T) {
+		if ok, err := b.delete(m1); !ok || err != nil {
+			t.Fatalf("删除失败: %v, %v", ok, err)
+		}
+		reopened, err := OpenBlock(filepath.Join(dir, meta.ID))
+		if err != nil {
+			t.Fatalf("打开 block 失败: %v", err)
+		}
+		defer reopened.Close()
+		if _, ok := reopened.lookup(m1); ok {
+			t.Error("期望删除的序列不可见")
+		}
+		if _, ok := reopened.lookup(m2); !ok {
+			t.Error("期望未删除的序列仍然可见")
+		}
+	})
+}
+
+// TestBlock_Corrupted 测试损坏的长度和 series id 返回错误, 而不是分配巨大的内存或越界
+func TestBlock_Corrupted(t *testing.T) {
+	withChecksum := func(b []byte) []byte {
+		return binary.BigEndian.AppendUint32(b, crc32.Checksum(b, castagnoliTable))
+	}
+	header := binary.BigEndian.AppendUint32(nil, indexMagic)
+
+	t.Run("符号数量超过剩余长度", func(t *testing.T) {
+		index := withChecksum(binary.AppendUvarint(header, 1<<40))
+		if _, _, err := decodeIndex(index); !errors.Is(err, errInvalidIndex) {
+			t.Errorf("期望 errInvalidIndex，实际 %v", err)
+		}
+	})
+
+	t.Run("postings 中的 series id 越界", func(t *testing.T) {
+		index := binary.AppendUvarint(header, 2)
+		index = appendString(appendString(index, "job"), "api")
+		// 一条序列 {job="api"}, 没有 chunk
+		for _, v := range []uint64{1, 1, 0, 1, 0} {
+			index = binary.AppendUvarint(index, v)
+		}
+		// 一个 posting job="api" -> [5]
+		for _, v := range []uint64{1, 0, 1, 1, 5} {
+			index = binary.AppendUvarint(index, v)
+		}
+		if _, _, err := decodeIndex(withChecksum(index)); !errors.Is(err, errInvalidIndex) {
+			t.Errorf("期望 errInvalidIndex，实际 %v", err)
+		}
+	})
+
+	t.Run("chunk 长度超过文件大小", func(t *testing.T) {
+		dir := t.TempDir()
+		m := createTestMetric("up")
+		meta, err := writeBlock(dir, 0, 60000, []blockSeriesData{
+			{metric: *m, samples: model.Samples{{Timestamp: 0, Value: 1}}},
+		}, BlockCompaction{Level: 1})
+		if err != nil {
+			t.Fatalf("写入 block 失败: %v", err)
+		}
+		// 第一个 chunk 紧跟在 magic 之后, 把它的长度改成很大的值
+		path := filepath.Join(dir, meta.ID, chunksFilename)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("读取 chunks 失败: %v", err)
+		}
+		copy(data[4:], binary.AppendUvarint(nil, 1<<40))
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatalf("写入 chunks 失败: %v", err)
+		}
+		b, err := OpenBlock(filepath.Join(dir, meta.ID))
+		if err != nil {
+			t.Fatalf("打开 block 失败: %v", err)
+		}
+		defer b.Close()
+		id, _ := b.lookup(m)
+		if _, err := b.samples(id, 0, 60000); !errors.Is(err, errInvalidChunk) {
+			t.Errorf("期望 errInvalidChunk，实际 %v", err)
+		}
+	})
+}
+
+// TestDB_CutBlock 测试 head 切分成 block 后查询仍然合并所有数据
+func TestDB_CutBlock(t *testing.T) {
+	dir := t.TempDir()
+	db := openTestDB(t, dir)
+	m := createTestMetric("cpu_usage", "host", "server1")
+	// 5.5 小时的数据, [0, 2h) 和 [2h, 4h) 会被切成 block, 剩余的 1.5 小时不足以再切分, 留在 head 中
+	appendMinutes(t, db, m, 0, 330)
+	if err := db.Compact(); err != nil {
+		t.Fatalf("切分 block 失败: %v", err)
+	}
+	blocks := db.Blocks()
+	if len(blocks) != 2 {
+		t.Fatalf("期望 2 个 block，实际 %d 个", len(blocks))
+	}
+	if blocks[0].MinTime != 0 || blocks[0].MaxTime != testBlockRange || blocks[1].MaxTime != 2*testBlockRange {
+		t.Errorf("block 时间范围不正确: %+v", blocks)
+	}
+	if db.head.MinTime() != 2*testBlockRange {
+		t.Errorf("期望 head 最小时间为 %d，实际 %d", 2*testBlockRange, db.head.MinTime())
+	}
+
+	t.Run("早于 block 的写入被拒绝", func(t *testing.T) {
+		err := db.Append(m, &model.Sample{Timestamp: 60000, Value: 1})
+		if err != ErrOutOfBounds {
+			t.Errorf("期望 ErrOutOfBounds，实际 %v", err)
+		}
+	})
+
+	t.Run("QueryRange 跨 block 和 head", func(t *testing.T) {
+		series, err := db.QueryRange(m, 100*60000, 279*60000)
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		if len(series.Samples) != 180 {
+			t.Fatalf("期望 180 个样本，实际 %d 个", len(series.Samples))
+		}
+		for i, s := range series.Samples {
+			if s.Value != float64(100+i) {
+				t.Fatalf("样本 %d: 期望值 %d，实际 %v", i, 100+i, s.Value)
+			}
+		}
+	})
+
+	t.Run("Query 回溯到 block 中的样本", func(t *testing.T) {
+		series, err := db.Query(m, 60*60000+30000)
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		if len(series.Samples) != 1 || series.Samples[0].Value != 60 {
+			t.Errorf("期望最新样本值为 60，实际 %v", series.Samples)
+		}
+	})
+
+	t.Run("Select 合并同一序列", func(t *testing.T) {
+		ss, err := db.Select([]*model.LabelMatcher{
+			createTestMatcher(t, model.MatchEqual, "host", "server1"),
+		}, 0, 330*60000)
+		if err != nil {
+			t.Fatalf("Select 失败: %v", err)
+		}
+		series := collectSeriesSet(t, ss)
+		if len(series) != 1 || len(series[0].Samples) != 330 {
+			t.Errorf("期望 1 条序列 330 个样本，实际 %v", series)
+		}
+	})
+
+	t.Run("重新打开后数据完整", func(t *testing.T) {
+		if err := db.Close(); err != nil {
+			t.Fatalf("关闭失败: %v", err)
+		}
+		db = openTestDB(t, dir)
+		if len(db.Blocks()) != 2 {
+			t.Errorf("期望 2 个 block，实际 %d 个", len(db.Blocks()))
+		}
+		series, err := db.QueryRange(m, 0, 330*60000)
+		if err != nil {
+			t.Fatalf("查询失败: %v", err)
+		}
+		if len(series.Samples) != 330 {
+			t.Errorf("期望 330 个样本，实际 %d 个", len(series.Samples))
+		}
+	})
+
+	t.Run("删除序列", func(t *testing.T) {
+		if err := db.Delete(m); err != nil {
+			t.Fatalf("删除失败: %v", err)
+		}
+		if _, err := db.QueryRange(m, 0, 330*60000); err != ErrSeriesNotFound {
+			t.Errorf("期望 ErrSeriesNotFound，实际 %v", err)
+		}
+	})
+	db.Close()
+}
+
+// TestDB_CutBlock_ConcurrentQuery 测试切分 block 期间的查询既不丢样本也不重复
+func TestDB_CutBlock_ConcurrentQuery(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	defer db.Close()
+	m := createTestMetric("cpu_usage", "host", "server1")
+	appendMinutes(t, db, m, 0, 330)
+
+	done := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			series, err := db.QueryRange(m, 0, 330*60000)
+			if err != nil {
+				errc <- err
+				return
+			}
+			if len(series.Samples) != 330 {
+				errc <- fmt.Errorf("期望 330 个样本，实际 %d 个", len(series.Samples))
+				return
+			}
+		}
+	}()
+	if err := db.Compact(); err != nil {
+		t.Fatalf("切分 block 失败: %v", err)
+	}
+	close(done)
+	if err := <-errc; err != nil {
+		t.Error(err)
+	}
+	if len(db.Blocks()) != 2 {
+		t.Errorf("期望 2 个 block，实际 %d 个", len(db.Blocks()))
+	}
+}
+
+// TestDB_StaleMarker 测试 head 中的 staleness marker 覆盖 block 中更早的样本
+func TestDB_StaleMarker(t *testing.T) {
+	dir := t.TempDir()
+	m := createTestMetric("cpu_usage", "host", "server1")
+	writeTestBlock(t, dir, 0, testBlockRange, m)
+	db := openTestDB(t, dir)
+	defer db.Close()
+
+	series, err := db.Query(m, testBlockRange+60000)
+	if err != nil {
+		t.Fatalf("查询失败: %v", err)
+	}
+	if len(series.Samples) != 1 {
+		t.Fatalf("期望回溯到 block 中的样本，实际 %v", series.Samples)
+	}
+	if err := db.Append(m, &model.Sample{Timestamp: testBlockRange, Value: model.StaleValue()}); err != nil {
+		t.Fatalf("写入 marker 失败: %v", err)
+	}
+	series, err = db.Query(m, testBlockRange+60000)
+	if err != nil {
+		t.Fatalf("查询失败: %v", err)
+	}
+	if len(series.Samples) != 0 {
+		t.Errorf("期望 marker 之后没有值，实际 %v", series.Samples)
+	}
+}
+
+// TestDB_RemoveTmpBlocks 测试打开时清理没有写完的 block
+func TestDB_RemoveTmpBlocks(t *testing.T) {
+	dir := t.TempDir()
+	tmp := filepath.Join(dir, newBlockID()+tmpBlockSuffix)
+	if err := os.MkdirAll(tmp, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	db := openTestDB(t, dir)
+	defer db.Close()
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("期望临时目录被删除，实际 %v", err)
+	}
+	if len(db.Blocks()) != 0 {
+		t.Errorf("期望没有 block，实际 %d 个", len(db.Blocks()))
+	}
+}
@@ -0,0 +1,414 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+/*
+分段的预写日志 (write-ahead log)
+
+目录下按顺序编号的段文件 00000000, 00000001, ..., 每条记录的格式:
+
+	| length uint32 | crc32 uint32 | data [length]byte |
+
+当前段超过 segmentSize 时切换到新的段; 只有最后一个段可能因为崩溃留下不完整的记录,
+打开时会把它截断到最后一条完整记录
+*/
+
+const (
+	DefaultSegmentSize = 32 * 1024 * 1024
+	recordHeaderSize   = 8
+	// 写入段文件的缓冲区大小, 写满、Sync、切换段和 Close 时写入文件
+	bufferSize = 32 * 1024
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrCorrupted = errors.New("wal: corrupted record")
+
+type WAL struct {
+	dir         string
+	segmentSize int
+
+	mutex   sync.Mutex
+	segment *os.File
+	buf     *bufio.Writer
+	// 当前段的编号和已写入的字节数
+	segmentIndex int
+	segmentBytes int
+}
+
+// 打开 dir 下的 WAL, 修复最后一个段的残缺记录, 并创建新的段用于写入
+func New(dir string, segmentSize int) (*WAL, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create wal dir %q: %w", dir, err)
+	}
+	w := &WAL{dir: dir, segmentSize: segmentSize}
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	next := 0
+	if len(segments) > 0 {
+		last := segments[len(segments)-1]
+		if err := repairSegment(segmentPath(dir, last)); err != nil {
+			return nil, err
+		}
+		next = last + 1
+	}
+	if err := w.openSegment(next); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *WAL) Dir() string {
+	return w.dir
+}
+
+/*
+追加记录, 一次调用中的记录会写入同一个段
+记录先写入缓冲区, 只在切换段、Sync 和 Close 时写入文件并落盘: 进程崩溃可能丢失缓冲区中最近的记录,
+需要确保落盘的调用方 (例如 checkpoint) 显式调用 Sync
+*/
+func (w *WAL) Log(recs ...[]byte) error {
+	size := 0
+	for _, rec := range recs {
+		size += recordHeaderSize + len(rec)
+	}
+	buf := make([]byte, 0, size)
+	for _, rec := range recs {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(rec)))
+		buf = binary.BigEndian.AppendUint32(buf, crc32.Checksum(rec, castagnoliTable))
+		buf = append(buf, rec...)
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.segment == nil {
+		return errors.New("wal: closed")
+	}
+	if w.segmentBytes > 0 && w.segmentBytes+len(buf) > w.segmentSize {
+		if err := w.nextSegment(); err != nil {
+			return err
+		}
+	}
+	n, err := w.buf.Write(buf)
+	w.segmentBytes += n
+	if err != nil {
+		return fmt.Errorf("wal: write segment %d: %w", w.segmentIndex, err)
+	}
+	return nil
+}
+
+// 把当前段已写入的记录写入文件并落盘
+func (w *WAL) Sync() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.segment == nil {
+		return errors.New("wal: closed")
+	}
+	return w.syncSegment()
+}
+
+func (w *WAL) syncSegment() error {
+	if err := w.buf.Flush(); err != nil {
+		return fmt.Errorf("wal: write segment %d: %w", w.segmentIndex, err)
+	}
+	if err := w.segment.Sync(); err != nil {
+		return fmt.Errorf("wal: sync segment %d: %w", w.segmentIndex, err)
+	}
+	return nil
+}
+
+// 切换到新的段, 返回新段的编号; 之前的段不会再写入
+func (w *WAL) NextSegment() (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err := w.nextSegment(); err != nil {
+		return 0, err
+	}
+	return w.segmentIndex, nil
+}
+
+func (w *WAL) nextSegment() error {
+	if err := w.closeSegment(); err != nil {
+		return err
+	}
+	return w.openSegment(w.segmentIndex + 1)
+}
+
+func (w *WAL) openSegment(index int) error {
+	f, err := os.OpenFile(segmentPath(w.dir, index), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("wal: open segment %d: %w", index, err)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.segment = f
+	w.buf = bufio.NewWriterSize(f, bufferSize)
+	w.segmentIndex = index
+	w.segmentBytes = int(stat.Size())
+	return nil
+}
+
+func (w *WAL) closeSegment() error {
+	if w.segment == nil {
+		return nil
+	}
+	if err := w.syncSegment(); err != nil {
+		return err
+	}
+	err := w.segment.Close()
+	w.segment, w.buf = nil, nil
+	return err
+}
+
+// 删除编号小于 index 的段
+func (w *WAL) Truncate(index int) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	segments, err := listSegments(w.dir)
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if s >= index || s == w.segmentIndex {
+			continue
+		}
+		if err := os.Remove(segmentPath(w.dir, s)); err != nil {
+			return fmt.Errorf("wal: remove segment %d: %w", s, err)
+		}
+	}
+	return nil
+}
+
+// 目录下所有文件占用的字节数, 包括子目录 (例如 checkpoint) 和还在缓冲区中的记录
+func (w *WAL) Size() (int64, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	var size int64
+	if w.buf != nil {
+		size = int64(w.buf.Buffered())
+	}
+	// checkpoint 可能同时在删除旧的段和目录, 已经删除的文件不计入
+	err := filepath.WalkDir(w.dir, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		fi, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("wal: stat %q: %w", path, err)
+		}
+		size += fi.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func (w *WAL) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.closeSegment()
+}
+
+func segmentPath(dir string, index int) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d", index))
+}
+
+// 返回目录下所有段的编号, 升序
+func listSegments(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("wal: read dir %q: %w", dir, err)
+	}
+	var segments []int
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		index, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		segments = append(segments, index)
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+// 把段文件截断到最后一条完整且校验通过的记录
+func repairSegment(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("wal: open segment %q: %w", path, err)
+	}
+	r, err := newSegmentReader(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	for r.next() {
+	}
+	f.Close()
+	if r.err == nil {
+		return nil
+	}
+	if err := os.Truncate(path, r.offset); err != nil {
+		return fmt.Errorf("wal: truncate torn segment %q: %w", path, err)
+	}
+	return nil
+}
+
+type segmentReader struct {
+	r    io.Reader
+	size int64
+	rec  []byte
+	// 最后一条完整记录结束的位置
+	offset int64
+	err    error
+}
+
+func newSegmentReader(f *os.File) (*segmentReader, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &segmentReader{r: bufio.NewReader(f), size: stat.Size()}, nil
+}
+
+func (r *segmentReader) next() bool {
+	var header [recordHeaderSize]byte
+	n, err := io.ReadFull(r.r, header[:])
+	if err == io.EOF {
+		return false
+	}
+	if err != nil {
+		r.err = fmt.Errorf("%w: short header (%d bytes) at offset %d", ErrCorrupted, n, r.offset)
+		return false
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	crc := binary.BigEndian.Uint32(header[4:])
+	// 长度字段本身可能已经损坏, 先和文件剩余大小比较, 避免分配过大的内存
+	if r.offset+recordHeaderSize+int64(length) > r.size {
+		r.err = fmt.Errorf("%w: short record at offset %d", ErrCorrupted, r.offset)
+		return false
+	}
+	rec := make([]byte, length)
+	if _, err := io.ReadFull(r.r, rec); err != nil {
+		r.err = fmt.Errorf("%w: short record at offset %d", ErrCorrupted, r.offset)
+		return false
+	}
+	if crc32.Checksum(rec, castagnoliTable) != crc {
+		r.err = fmt.Errorf("%w: checksum mismatch at offset %d", ErrCorrupted, r.offset)
+		return false
+	}
+	r.rec = rec
+	r.offset += int64(recordHeaderSize) + int64(length)
+	return true
+}
+
+// 按顺序读取目录下所有段中的记录
+type Reader struct {
+	dir      string
+	segments []int
+	cur      int
+	file     *os.File
+	sr       *segmentReader
+	err      error
+}
+
+func NewReader(dir string) (*Reader, error) {
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{dir: dir, segments: segments, cur: -1}, nil
+}
+
+// 只读取编号在 [first, last] 内的段, last 为负数时读到最后一个段
+func NewSegmentRangeReader(dir string, first, last int) (*Reader, error) {
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	inRange := segments[:0]
+	for _, s := range segments {
+		if s >= first && (last < 0 || s <= last) {
+			inRange = append(inRange, s)
+		}
+	}
+	return &Reader{dir: dir, segments: inRange, cur: -1}, nil
+}
+
+func (r *Reader) Next() bool {
+	for r.err == nil {
+		if r.sr != nil {
+			if r.sr.next() {
+				return true
+			}
+			if r.sr.err != nil {
+				r.err = fmt.Errorf("segment %d: %w", r.segments[r.cur], r.sr.err)
+				break
+			}
+			r.file.Close()
+			r.file, r.sr = nil, nil
+		}
+		r.cur++
+		if r.cur >= len(r.segments) {
+			return false
+		}
+		f, err := os.Open(segmentPath(r.dir, r.segments[r.cur]))
+		if err != nil {
+			r.err = err
+			break
+		}
+		sr, err := newSegmentReader(f)
+		if err != nil {
+			f.Close()
+			r.err = err
+			break
+		}
+		r.file = f
+		r.sr = sr
+	}
+	if r.file != nil {
+		r.file.Close()
+		r.file = nil
+	}
+	return false
+}
+
+func (r *Reader) Record() []byte {
+	return r.sr.rec
+}
+
+func (r *Reader) Err() error {
+	return r.err
+}
@@ -0,0 +1,189 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func readAllRecords(t *testing.T, dir string) ([][]byte, error) {
+	t.Helper()
+	r, err := NewReader(dir)
+	if err != nil {
+		t.Fatalf("创建 Reader 失败: %v", err)
+	}
+	var recs [][]byte
+	for r.Next() {
+		recs = append(recs, r.Record())
+	}
+	return recs, r.Err()
+}
+
+// TestWAL_LogAndRead 测试写入后按顺序读出所有记录
+func TestWAL_LogAndRead(t *testing.T) {
+	dir := t.TempDir()
+	w, err := New(dir, 0)
+	if err != nil {
+		t.Fatalf("打开 WAL 失败: %v", err)
+	}
+	var want [][]byte
+	for i := 0; i < 10; i++ {
+		rec := []byte(fmt.Sprintf("record-%d", i))
+		want = append(want, rec)
+		if err := w.Log(rec); err != nil {
+			t.Fatalf("写入记录失败: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("关闭 WAL 失败: %v", err)
+	}
+	got, err := readAllRecords(t, dir)
+	if err != nil {
+		t.Fatalf("读取记录失败: %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("期望 %q，实际 %q", want, got)
+	}
+}
+
+// TestWAL_SegmentRotation 测试超过段大小后切换新段, 并且可以删除旧段
+func TestWAL_SegmentRotation(t *testing.T) {
+	dir := t.TempDir()
+	w, err := New(dir, 64)
+	if err != nil {
+		t.Fatalf("打开 WAL 失败: %v", err)
+	}
+	defer w.Close()
+	for i := 0; i < 10; i++ {
+		// 每条记录 8 字节头 + 24 字节数据, 每个段最多两条
+		if err := w.Log(make([]byte, 24)); err != nil {
+			t.Fatalf("写入记录失败: %v", err)
+		}
+	}
+	segments, _ := listSegments(dir)
+	if len(segments) != 5 {
+		t.Fatalf("期望 5 个段，实际 %v", segments)
+	}
+	if err := w.Truncate(3); err != nil {
+		t.Fatalf("删除旧段失败: %v", err)
+	}
+	segments, _ = listSegments(dir)
+	if !reflect.DeepEqual(segments, []int{3, 4}) {
+		t.Errorf("期望剩余段 [3 4]，实际 %v", segments)
+	}
+	// 当前段的记录还在缓冲区中, 读取前先写入文件
+	if err := w.Sync(); err != nil {
+		t.Fatalf("落盘失败: %v", err)
+	}
+	recs, err := readAllRecords(t, dir)
+	if err != nil || len(recs) != 4 {
+		t.Errorf("期望读取 4 条记录，实际 %d 条, err=%v", len(recs), err)
+	}
+}
+
+// TestWAL_RepairTornRecord 测试最后一个段的残缺记录在打开时被截断
+func TestWAL_RepairTornRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(data []byte) []byte
+	}{
+		{"记录头不完整", func(data []byte) []byte { return append(data, 0, 0, 1) }},
+		{"记录数据不完整", func(data []byte) []byte { return data[:len(data)-3] }},
+		{"校验和错误", func(data []byte) []byte {
+			data[len(data)-1] ^= 0xff
+			return data
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			w, _ := New(dir, 0)
+			w.Log([]byte("first"))
+			w.Log([]byte("second"))
+			w.Close()
+
+			path := segmentPath(dir, 0)
+			data, _ := os.ReadFile(path)
+			os.WriteFile(path, tt.corrupt(data), 0o644)
+
+			// 修复前读取会报告损坏
+			if _, err := readAllRecords(t, dir); !errors.Is(err, ErrCorrupted) {
+				t.Fatalf("期望 ErrCorrupted，实际 %v", err)
+			}
+
+			w, err := New(dir, 0)
+			if err != nil {
+				t.Fatalf("打开残缺的 WAL 失败: %v", err)
+			}
+			w.Log([]byte("third"))
+			w.Close()
+
+			recs, err := readAllRecords(t, dir)
+			if err != nil {
+				t.Fatalf("修复后读取失败: %v", err)
+			}
+			want := [][]byte{[]byte("first"), []byte("third")}
+			if tt.name == "记录头不完整" {
+				want = [][]byte{[]byte("first"), []byte("second"), []byte("third")}
+			}
+			if !reflect.DeepEqual(recs, want) {
+				t.Errorf("期望 %q，实际 %q", want, recs)
+			}
+		})
+	}
+}
+
+// TestWAL_CorruptedMiddleSegment 测试非最后一个段损坏时读取报错
+func TestWAL_CorruptedMiddleSegment(t *testing.T) {
+	dir := t.TempDir()
+	w, _ := New(dir, 0)
+	w.Log([]byte("first"))
+	w.Close()
+	data, _ := os.ReadFile(segmentPath(dir, 0))
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(segmentPath(dir, 0), data, 0o644)
+	os.WriteFile(segmentPath(dir, 1), nil, 0o644)
+	os.WriteFile(segmentPath(dir, 2), nil, 0o644)
+
+	// 只修复最后一个段, 中间段的损坏需要暴露出来
+	w, err := New(dir, 0)
+	if err != nil {
+		t.Fatalf("打开 WAL 失败: %v", err)
+	}
+	w.Close()
+	if _, err := readAllRecords(t, dir); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("期望 ErrCorrupted，实际 %v", err)
+	}
+}
+
+// TestWAL_Sync 测试记录先写入缓冲区, Sync 后才写入文件, 关闭后不能再调用
+func TestWAL_Sync(t *testing.T) {
+	dir := t.TempDir()
+	w, err := New(dir, 0)
+	if err != nil {
+		t.Fatalf("打开 WAL 失败: %v", err)
+	}
+	if err := w.Log([]byte("record")); err != nil {
+		t.Fatalf("写入记录失败: %v", err)
+	}
+	if recs, err := readAllRecords(t, dir); err != nil || len(recs) != 0 {
+		t.Errorf("期望 Sync 之前文件中没有记录，实际 %d 条, err=%v", len(recs), err)
+	}
+	if size, err := w.Size(); err != nil || size != recordHeaderSize+int64(len("record")) {
+		t.Errorf("期望大小包含缓冲区中的记录，实际 %d, err=%v", size, err)
+	}
+	if err := w.Sync(); err != nil {
+		t.Errorf("落盘失败: %v", err)
+	}
+	if recs, err := readAllRecords(t, dir); err != nil || len(recs) != 1 {
+		t.Errorf("期望 Sync 之后读取 1 条记录，实际 %d 条, err=%v", len(recs), err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("关闭 WAL 失败: %v", err)
+	}
+	if err := w.Sync(); err == nil {
+		t.Error("期望关闭后落盘返回错误")
+	}
+}